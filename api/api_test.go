@@ -1,21 +1,30 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/javitab/go-web/auth"
+	"github.com/javitab/go-web/cli/command"
+	dbase "github.com/javitab/go-web/database"
 	test_suite "github.com/javitab/go-web/tests"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestAPIRouter(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
 	// Start Web Server
 	router := test_suite.AppRouter()
 
 	// Setup route group for API
-	ApiRouterGroup(router)
+	ApiRouterGroup(router, dbase.DefaultRepository())
 
 	// Send HTTP Request for Hello World
 	expectedResponse :=
@@ -24,8 +33,228 @@ func TestAPIRouter(t *testing.T) {
 	req.Header.Set("content-type", "application/json;")
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.Header.Set("Authorization", test_suite.AuthHeader(t, "testuser"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
 
 	responseData, _ := io.ReadAll(w.Body)
 	assert.Equal(t, expectedResponse, string(responseData))
 	assert.Equal(t, http.StatusOK, w.Code)
 }
+
+func TestRunCommand(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	router := test_suite.AppRouter()
+	ApiRouterGroup(router, dbase.DefaultRepository())
+	runAs := func(username string, path string, body string) (int, command.Response) {
+		req, _ := http.NewRequest("POST", "/api/commands/"+path, strings.NewReader(body))
+		req.Header.Set("content-type", "application/json")
+		req.Header.Set("Authorization", test_suite.AuthHeader(t, username))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response command.Response
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+	run := func(path string, body string) (int, command.Response) {
+		return runAs("testuser", path, body)
+	}
+
+	status, response := run("group/get", `{"flags":{"group":"Admin Group"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, string(response.Result), `"name":"Admin Group"`)
+
+	// Passwords are requested before the command runs
+	body := `{"flags":{"username":"remote","email":"remote@test.com"}}`
+	status, response = run("user/create", body)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.True(t, response.SecretRequired)
+	status, _ = run("user/create", `{"flags":{"username":"remote","email":"remote@test.com"},"secret":"password"}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, response = run("user/create", `{"flags":{"username":"remote","email":"remote@test.com"},"secret":"password"}`)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, command.ExitError, response.ExitCode)
+
+	status, _ = run("user/get", `{"flags":{"username":"nobody"}}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = run("secpoint/load", `{}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = run("user/get", `{"flags":{"unknown":"x"}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Users without security points can't change other users, nor test
+	// credentials without the login rate limit
+	status, response = runAs("remote", "user/set-password", `{"flags":{"username":"testuser"},"secret":"taken-over"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, response.Error, "missing security point 16")
+	status, _ = runAs("remote", "user/delete", `{"flags":{"username":"testuser","reason":"test"}}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = runAs("remote", "user/undelete", `{"flags":{"username":"testuser","reason":"test"}}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = runAs("remote", "user/login-test", `{"flags":{"username":"testuser"},"secret":"password"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = runAs("remote", "ldap/login-test", `{"flags":{"username":"testuser"},"secret":"password"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// Nor view users, groups and security points, other than their own user
+	for path, body := range map[string]string{
+		"user/list":     `{}`,
+		"group/list":    `{}`,
+		"group/get":     `{"flags":{"group":"1"}}`,
+		"secpoint/list": `{}`,
+		"secpoint/get":  `{"flags":{"spid":"1"}}`,
+	} {
+		status, response = runAs("remote", path, body)
+		assert.Equal(t, http.StatusForbidden, status, path)
+		assert.Contains(t, response.Error, "missing security point 18", path)
+	}
+	status, _ = runAs("remote", "user/get", `{"flags":{"username":"testuser"}}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = runAs("remote", "user/get", `{"flags":{"username":"remote"}}`)
+	assert.Equal(t, http.StatusOK, status)
+
+	// Their own password they can change
+	status, _ = runAs("remote", "user/set-password", `{"flags":{"username":"remote"},"secret":"new-password"}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = run("user/set-password", `{"flags":{"username":"remote"},"secret":"reset-password"}`)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestImportExportUsers(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	router := test_suite.AppRouter()
+	ApiRouterGroup(router, dbase.DefaultRepository())
+	importUsers := func(query string, contentType string, body string) (int, ImportUsersResponse) {
+		req, _ := http.NewRequest("POST", "/api/users/import"+query, strings.NewReader(body))
+		req.Header.Set("content-type", contentType)
+		req.Header.Set("Authorization", test_suite.AuthHeader(t, "testuser"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response ImportUsersResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	yamlFile := "- username: api\n  email: api@test.com\n  groups: [User Group]\n"
+	status, response := importUsers("?dry_run=true", "application/yaml", yamlFile)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, response.Report.DryRun)
+	assert.Equal(t, 1, response.Report.Created)
+
+	status, response = importUsers("", "application/yaml; charset=utf-8", yamlFile)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "create", response.Report.Rows[0].Action)
+
+	status, response = importUsers("?format=csv", "text/plain", "username,email\napi,testuser@test.com\n")
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, 1, response.Report.Failed)
+	assert.Contains(t, response.Report.Rows[0].Error, "is used by user testuser")
+
+	status, _ = importUsers("", "application/json", "[]")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = importUsers("", "text/csv", "username,unknown\n")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	req, _ := http.NewRequest("GET", "/api/users/export?format=csv", nil)
+	req.Header.Set("Authorization", test_suite.AuthHeader(t, "testuser"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t, "username,first_name,last_name,email,ldap,groups,add_sec_points,del_sec_points,ovr_sec_points\n"+
+		"api,,,api@test.com,false,User Group,,,\n"+
+		"testuser,User,Test,testuser@test.com,false,Admin Group,,,\n", w.Body.String())
+
+	req, _ = http.NewRequest("GET", "/api/users/export?format=xml", nil)
+	req.Header.Set("Authorization", test_suite.AuthHeader(t, "testuser"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUpdateUserGroups(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	ctx := context.Background()
+
+	repo := dbase.DefaultRepository()
+	router := test_suite.AppRouter()
+	AuthRoutes(auth.AuthRouterGroup(router, repo), repo)
+	updateAs := func(username string, query string) int {
+		req, _ := http.NewRequest("POST", "/auth/update_user?reason=test&"+query, nil)
+		req.Header.Set("Authorization", test_suite.AuthHeader(t, username))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	_, err := dbase.DefaultRepository().CreateUser(ctx, dbase.NewUser{
+		Username: "plain", LastName: "User", FirstName: "Plain", Email: "plain@test.local", Password: "password",
+	})
+	assert.NoError(t, err)
+
+	// Users without the security points can't join the superuser group, nor
+	// remove others from a group
+	assert.Equal(t, http.StatusForbidden, updateAs("plain", "username=plain&action=add_group&value=1"))
+	assert.Equal(t, http.StatusForbidden, updateAs("plain", "username=testuser&action=remove_group&value=1"))
+	assert.Empty(t, auth.GetUserInfo("plain").DB.Groups)
+
+	// Nor look up users, groups and security points
+	for _, path := range []string{"/auth/user?username=testuser", "/auth/group?group_id=1", "/auth/sec_point?spid=1"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", test_suite.AuthHeader(t, "plain"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, path)
+	}
+
+	assert.Equal(t, http.StatusOK, updateAs("testuser", "username=plain&action=add_group&value=2"))
+	assert.Equal(t, http.StatusConflict, updateAs("testuser", "username=plain&action=add_group&value=2"))
+	assert.Equal(t, http.StatusOK, updateAs("testuser", "username=plain&action=remove_group&value=2"))
+
+	// The other actions apply the security points of their commands too
+	assert.Equal(t, http.StatusForbidden, updateAs("plain", "username=plain&action=add_user_sec_point&value=1&sec_point_field=UserAddSecPoints"))
+	assert.Equal(t, http.StatusForbidden, updateAs("plain", "username=testuser&action=delete_user"))
+	assert.Equal(t, http.StatusBadRequest, updateAs("testuser", "username=testuser&action=delete_user"))
+	assert.Equal(t, http.StatusNotFound, updateAs("testuser", "username=missing&action=delete_user"))
+	assert.Equal(t, http.StatusOK, updateAs("testuser", "username=plain&action=add_user_sec_point&value=3&sec_point_field=UserAddSecPoints"))
+	assert.Equal(t, http.StatusConflict, updateAs("testuser", "username=plain&action=add_user_sec_point&value=3&sec_point_field=UserAddSecPoints"))
+}
+
+func TestCreateUser(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	repo := dbase.DefaultRepository()
+	router := test_suite.AppRouter()
+	AuthRoutes(auth.AuthRouterGroup(router, repo), repo)
+	createAs := func(username string) int {
+		body := `{"username":"created","password":"password","first_name":"Created","last_name":"User","email":"created@test.local"}`
+		req, _ := http.NewRequest("POST", "/auth/create_user", strings.NewReader(body))
+		req.Header.Set("content-type", "application/json")
+		if username != "" {
+			req.Header.Set("Authorization", test_suite.AuthHeader(t, username))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Creating users needs a login and the CreateUser security point
+	assert.Equal(t, http.StatusUnauthorized, createAs(""))
+	_, err := dbase.DefaultRepository().CreateUser(context.Background(), dbase.NewUser{
+		Username: "plain", LastName: "User", FirstName: "Plain", Email: "plain@test.local", Password: "password",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, createAs("plain"))
+	assert.Zero(t, auth.GetUserInfo("created").DB.ID)
+
+	assert.Equal(t, http.StatusCreated, createAs("testuser"))
+	assert.Equal(t, http.StatusConflict, createAs("testuser"))
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/auth"
+	cli_auth "github.com/javitab/go-web/cli/auth"
+	"github.com/javitab/go-web/cli/command"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// RunCommand godoc
+//
+//		@Summary		Run a CLI command
+//		@Schemes		http
+//		@Tags			api
+//		@Security		ApiKeyAuth
+//		@Description	Runs a user, group, security point or LDAP command of the CLI as the authenticated user, with the same security point checks. Used by the CLI in remote mode. Commands reading a password answer with secret_required until the request holds a secret.
+//	 	@Param 			group path string true "command group" Enums(apikey,group,ldap,secpoint,user)
+//	 	@Param 			name path string true "command name, e.g. create or add-member"
+//	 	@Param 			request body command.Request true "command flags and secret"
+//		@Accept			json
+//		@Produce		json
+//		@Success		200	{object} command.Response
+//		@Failure		400	{object} command.Response
+//		@Failure		403	{object} command.Response
+//		@Failure		404	{object} command.Response
+//		@Failure		409	{object} command.Response
+//		@Router			/api/commands/{group}/{name} [post]
+func RunCommand(c *gin.Context) {
+	var request command.Request
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, command.Response{Error: "invalid input: " + err.Error(), ExitCode: command.ExitUsage})
+		return
+	}
+
+	ctx := c.Request.Context()
+	repo := dbase.DefaultRepository()
+	user := auth.LoadUserInfo(ctx, repo, c.GetString("currentUser"))
+	if user.DB.ID == 0 || !user.IsActiveUser {
+		c.JSON(http.StatusUnauthorized, command.Response{Error: "unauthorized", ExitCode: command.ExitDenied})
+		return
+	}
+
+	group, name := c.Param("group"), c.Param("name")
+	status, response := cli_auth.Commands.Serve(command.Env{Ctx: ctx, User: user, Repo: repo}, group, name, request)
+	if status >= http.StatusInternalServerError {
+		dbase.LogServerErrorContext(ctx, "RunCommand:HTTP:"+group+":"+name, errors.New(response.Error), "reqUser: "+user.DB.Username)
+	}
+	c.JSON(status, response)
+}
@@ -4,11 +4,13 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
 	"github.com/javitab/go-web/middlewares"
 )
 
-func ApiRouterGroup(router *gin.Engine) *gin.RouterGroup {
-	api := router.Group("/api", middlewares.CheckAuth)
+func ApiRouterGroup(router *gin.Engine, repo *dbase.Repository) *gin.RouterGroup {
+	api := router.Group("/api", middlewares.ContentSecurityPolicy(config.CSPGroupAPI), middlewares.CheckAuth(repo), middlewares.RateLimit(config.RateLimitGroupAPI))
 	{
 		apiHandler := func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{
@@ -18,6 +20,19 @@ func ApiRouterGroup(router *gin.Engine) *gin.RouterGroup {
 		api.GET("", apiHandler)
 		api.GET("/", apiHandler)
 		api.Any("/server_events", ServerEventHandler)
+		api.POST("/commands/:group/:name", RunCommand)
+		api.POST("/users/import", ImportUsers)
+		api.GET("/users/export", ExportUsers)
 	}
 	return api
 }
+
+// AuthRoutes adds the endpoints of the auth group that run through the
+// service, which the auth package cannot import
+func AuthRoutes(auth *gin.RouterGroup, repo *dbase.Repository) *gin.RouterGroup {
+	checkAuth := middlewares.CheckAuth(repo)
+	apiLimit := middlewares.RateLimit(config.RateLimitGroupAPI)
+	auth.POST("/create_user", checkAuth, apiLimit, CreateUser)
+	auth.POST("/update_user", checkAuth, apiLimit, UpdateUser)
+	return auth
+}
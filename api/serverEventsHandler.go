@@ -37,6 +37,8 @@ type GetServerEventsResponse struct {
 //	 	@Param 			limit query string false "search filter"
 //	 	@Param 			EventType query string false "EventType to filter for"
 //	 	@Param 			ServerRunID query string false "ServerRunID to filter for"
+//	 	@Param 			RequestID query string false "X-Request-ID of the HTTP request that logged the events"
+//	 	@Param 			TraceID query string false "OpenTelemetry trace ID of the request that logged the events"
 //		@Accept			json
 //		@Produce		json
 //		@Success		200	{object} GetServerEventsResponse
@@ -76,7 +78,12 @@ func GETServerEvents(c *gin.Context) {
 	db.Limit(limit).Where(&dbase.ServerEvent{
 		EventType:   eventType,
 		ServerRunID: ServerRunID,
+		RequestID:   c.Query("RequestID"),
+		TraceID:     c.Query("TraceID"),
 	}).Find(&serverEvents)
+	for i, event := range serverEvents {
+		serverEvents[i] = event.Redacted()
+	}
 
 	// Return the server events as JSON
 	c.JSON(http.StatusOK, gin.H{
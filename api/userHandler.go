@@ -0,0 +1,141 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/service"
+)
+
+// CreateUser godoc
+//
+//		@Summary		Create a new user via API
+//		@Security		ApiKeyAuth
+//		@Schemes		http
+//		@Tags			user/group security
+//		@Description	Create a new user given a CreateUserInput object. Requires the CreateUser security point.
+//	 	@Param request body auth.CreateUserInput true "query params"
+//		@Accept			json
+//		@Produce		json
+//		@Success		201	{object} auth.CreateUserResponse
+//		@Failure		403	{object} map[string]string
+//		@Failure		409	{object} map[string]string
+//		@Router			/auth/create_user [post]
+func CreateUser(c *gin.Context) {
+	ctx := c.Request.Context()
+	var input auth.CreateUserInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid input",
+			"err":   fmt.Sprintf("%v", err),
+		})
+		dbase.LogServerErrorContext(ctx, "CreateUser:HTTP:InvalidInput", err, "Invalid Input for CreateUser")
+		return
+	}
+
+	svc := userService(c)
+	_, err := svc.CreateUser(dbase.NewUser{
+		Username:  input.Username,
+		LastName:  input.LastName,
+		FirstName: input.FirstName,
+		Email:     input.Email,
+	}, service.Password(input.Password))
+	switch status := service.HTTPStatus(err); {
+	case err == nil:
+		c.JSON(http.StatusCreated, auth.CreateUserResponse{Message: "User created"})
+	case errors.Is(err, dbase.ErrUserExists):
+		c.JSON(status, gin.H{"error": "User already exists"})
+	case status >= http.StatusInternalServerError:
+		dbase.LogServerErrorContext(ctx, "CreateUser:HTTP", err, "Error creating user: "+input.Username)
+		c.JSON(status, gin.H{"error": "Error creating user"})
+	default:
+		c.JSON(status, gin.H{"error": err.Error()})
+	}
+}
+
+// UpdateUser godoc
+//
+//		@Summary		Update User Record
+//		@Security		ApiKeyAuth
+//		@Schemes		http
+//		@Tags			user/group security
+//		@Description	Given a username, will make given updates. Each action requires the security point of the matching command.
+//	 	@Param 			username query string true "username to update"
+//	 	@Param 			action query string true "action to perform" Enums(delete_user,undelete_user,add_group,remove_group,add_user_sec_point,remove_user_sec_point)
+//	 	@Param 			reason query string true "reason for update (incident #, etc.)"
+//	 	@Param 			value query string true "value to set"
+//	 	@Param 			sec_point_field query string false "field to append user-level security point to" Enums(UserAddSecPoints,UserDelSecPoints,UserOvrSecPoints)
+//		@Accept			json
+//		@Produce		plain
+//		@Success		200	{string}	operation outcome
+//		@Failure		403	{string}	missing security point
+//		@Router			/auth/update_user [post]
+func UpdateUser(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	// Validate inputs
+	username := c.Query("username")
+	action := c.Query("action")
+	value := c.Query("value")
+	reason := c.Query("reason")
+	var err error
+	switch {
+	case username == "":
+		err = fmt.Errorf("username not provided")
+	case action == "":
+		err = fmt.Errorf("action not provided")
+	case value == "" && action != "delete_user" && action != "undelete_user":
+		err = fmt.Errorf("value not provided")
+	case reason == "":
+		err = fmt.Errorf("reason not provided")
+	}
+	if err != nil {
+		dbase.LogServerErrorContext(ctx, "UpdateUser:HTTP:InvalidInput", err, "Invalid Input for UpdateUser")
+		c.Data(http.StatusBadRequest, "text/plaintext", []byte("Input error: "+err.Error()))
+		return
+	}
+
+	// Update user, the service checks the security point of each action
+	svc := userService(c)
+	switch action {
+	case "delete_user":
+		_, err = svc.DeleteUser(username, reason)
+	case "undelete_user":
+		_, err = svc.UndeleteUser(username, reason)
+	case "add_group":
+		_, err = svc.AddGroupMember(username, value)
+	case "remove_group":
+		_, err = svc.RemoveGroupMember(username, value)
+	case "add_user_sec_point", "remove_user_sec_point":
+		SPID, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			err = fmt.Errorf("%w: unable to convert value to integer: %q", service.ErrInvalidInput, value)
+			break
+		}
+		field := c.Query("sec_point_field")
+		if action == "add_user_sec_point" {
+			_, err = svc.AddUserSecPoint(username, SPID, field)
+		} else {
+			_, err = svc.RemoveUserSecPoint(username, SPID, field)
+		}
+	default:
+		err = fmt.Errorf("undefined action: %q", action)
+		dbase.LogServerErrorContext(ctx, "UpdateUser:HTTP:InvalidInput", err, "Invalid Input for UpdateUser")
+		c.Data(http.StatusBadRequest, "text/plaintext", []byte("Input error: "+err.Error()))
+		return
+	}
+
+	if err != nil {
+		dbase.LogServerErrorContext(ctx, "UpdateUser:HTTP:"+action, err, "reqUser: "+svc.User().DB.Username)
+		c.Data(service.HTTPStatus(err), "text/plaintext", []byte("error: "+err.Error()))
+		return
+	}
+
+	c.Data(http.StatusOK, "text/plaintext", []byte("User updated"))
+	dbase.LogServerEventContext(ctx, "UpdateUser:HTTP", "User updated: "+username+"\nAction: "+action, "INFO")
+}
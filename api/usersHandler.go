@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/service"
+)
+
+// maxImportBytes limits the size of user import files
+const maxImportBytes = 10 << 20
+
+// recordContentTypes are the content types of user record files by format
+var recordContentTypes = map[dbase.UserRecordFormat]string{
+	dbase.UserRecordsCSV:  "text/csv",
+	dbase.UserRecordsYAML: "application/yaml",
+}
+
+// userService returns the service running as the authenticated user
+func userService(c *gin.Context) *service.Service {
+	ctx := c.Request.Context()
+	return service.New(ctx, dbase.DefaultRepository(), auth.GetUserInfoContext(ctx, c.GetString("currentUser")))
+}
+
+type ImportUsersResponse struct {
+	Error  string                 `json:"error,omitempty"`
+	Report dbase.UserImportReport `json:"report"`
+}
+
+// ImportUsers godoc
+//
+//		@Summary		Bulk import users
+//		@Schemes		http
+//		@Tags			api
+//		@Security		ApiKeyAuth
+//		@Description	Creates missing users and updates existing users to match a CSV or YAML file of usernames, names, emails, LDAP flags, groups and user-level security points. All rows are validated first, nothing is written when any row fails. Importing the same file again changes nothing. Requires the ImportUsers security point.
+//	 	@Param 			format query string false "file format, by default from the Content-Type" Enums(csv,yaml)
+//	 	@Param 			dry_run query bool false "only validate the file and report the changes"
+//	 	@Param 			file body string true "CSV with a header row, or a YAML list of users"
+//		@Accept			text/csv,application/yaml
+//		@Produce		json
+//		@Success		200	{object} ImportUsersResponse
+//		@Failure		400	{object} ImportUsersResponse
+//		@Failure		403	{object} map[string]string
+//		@Failure		422	{object} ImportUsersResponse "rows failed validation, see report"
+//		@Router			/api/users/import [post]
+func ImportUsers(c *gin.Context) {
+	format, err := importFormat(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ImportUsersResponse{Error: err.Error()})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	records, err := dbase.ReadUserRecords(body, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ImportUsersResponse{Error: err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	report, err := userService(c).ImportUsers(records, c.Query("dry_run") == "true")
+	switch {
+	case errors.Is(err, service.ErrDenied):
+		c.JSON(http.StatusForbidden, ImportUsersResponse{Error: err.Error()})
+	case errors.Is(err, dbase.ErrInvalidUserRecords):
+		c.JSON(http.StatusUnprocessableEntity, ImportUsersResponse{Error: err.Error(), Report: report})
+	case err != nil:
+		dbase.LogServerErrorContext(ctx, "ImportUsers:HTTP", err, "reqUser: "+c.GetString("currentUser"))
+		c.JSON(http.StatusInternalServerError, ImportUsersResponse{Error: "error importing users", Report: report})
+	default:
+		c.JSON(http.StatusOK, ImportUsersResponse{Report: report})
+	}
+}
+
+// importFormat returns the format query parameter, or the format of the
+// Content-Type without one
+func importFormat(c *gin.Context) (dbase.UserRecordFormat, error) {
+	if format := c.Query("format"); format != "" {
+		return dbase.ParseUserRecordFormat(format)
+	}
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	switch mediaType {
+	case "text/csv":
+		return dbase.UserRecordsCSV, nil
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		return dbase.UserRecordsYAML, nil
+	default:
+		return dbase.ParseUserRecordFormat(mediaType)
+	}
+}
+
+// ExportUsers godoc
+//
+//		@Summary		Bulk export users
+//		@Schemes		http
+//		@Tags			api
+//		@Security		ApiKeyAuth
+//		@Description	Exports the active users with their groups and user-level security points in the format read by the import endpoint. Requires the ExportUsers security point.
+//	 	@Param 			format query string false "file format" Enums(csv,yaml) default(yaml)
+//		@Produce		text/csv,application/yaml
+//		@Success		200	{string} string "users file"
+//		@Failure		400	{object} map[string]string
+//		@Failure		403	{object} map[string]string
+//		@Router			/api/users/export [get]
+func ExportUsers(c *gin.Context) {
+	format, err := dbase.ParseUserRecordFormat(c.DefaultQuery("format", string(dbase.UserRecordsYAML)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	records, err := userService(c).ExportUsers()
+	if errors.Is(err, service.ErrDenied) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		dbase.LogServerErrorContext(ctx, "ExportUsers:HTTP", err, "reqUser: "+c.GetString("currentUser"))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error exporting users"})
+		return
+	}
+	var buf bytes.Buffer
+	if err := dbase.WriteUserRecords(&buf, format, records); err != nil {
+		dbase.LogServerErrorContext(ctx, "ExportUsers:Write", err, "reqUser: "+c.GetString("currentUser"))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error exporting users"})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="users.`+string(format)+`"`)
+	c.Data(http.StatusOK, recordContentTypes[format], buf.Bytes())
+}
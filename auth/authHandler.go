@@ -1,13 +1,15 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/metrics"
+	"github.com/javitab/go-web/middlewares"
 )
 
 type CreateUserInput struct {
@@ -22,72 +24,12 @@ type CreateUserResponse struct {
 	Message string `json:"message" enums:"User created,User already exists,Error creating user"`
 }
 
-// CreateUser godoc
-//
-//		@Summary		Create a new user via API
-//		@Security		ApiKeyAuth
-//		@Schemes		http
-//		@Tags			user/group security
-//		@Description	Create a new user given a CreateUserInput object
-//	 	@Param request body CreateUserInput true "query params"
-//		@Accept			json
-//		@Produce		json
-//		@Success		200	{object} CreateUserResponse
-//		@Router			/auth/create_user [post]
-func CreateUser(c *gin.Context) {
-	reqUser, _ := c.Get("user")
-	LoggedInUser := reqUser.(UserInfo)
-	if !LoggedInUser.SPCheck(2) {
-		err := fmt.Errorf("user %v missing security point 2", LoggedInUser.DB.Username)
-		dbase.LogServerError("CreateUser:HTTP:MissingSecurityPoint", err, "AUTH")
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "Unauthorized",
-			"err":   fmt.Sprintf("%v", err),
-		})
-		return
-	}
-	var input CreateUserInput
-	err := c.ShouldBindJSON(&input)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid input",
-			"err":   fmt.Sprintf("%v", err),
-			"input": input,
-		})
-		dbase.LogServerError("CreateUser:HTTP:InvalidInput", err, "Invalid Input for CreateUser")
-		return
-	}
-	db := dbase.GetDBConn()
-
-	//Check if user exists
-	var userFound dbase.User
-	db.Where("username = ?", input.Username).Find(&userFound)
-
-	if userFound.Username != "" {
-		c.JSON(http.StatusConflict, gin.H{
-			"error": "User already exists",
-		})
-		return
-	}
-
-	//Create user
-	new_user_err := dbase.CreateUser(input.Username, input.LastName, input.FirstName, input.Email, input.Password)
-	if new_user_err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error creating user",
-		})
-		dbase.LogServerError("CreateUser:HTTP", new_user_err, "Error creating user: "+input.Username)
-		return
-	} else {
-		c.JSON(http.StatusCreated, gin.H{
-			"message": "User created",
-		})
-	}
-}
-
 type LoginUserInput struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	// Mode selects the login security point checked by /auth/login, the CLI
+	// logs in with cli_login
+	Mode ValidLoginMode `json:"mode,omitempty" enums:"web_login,cli_login"`
 }
 
 type LoginUserResponse struct {
@@ -99,35 +41,50 @@ type LoginUserResponse struct {
 //		@Summary		Login user
 //		@Schemes		http
 //		@Tags			login
-//		@Description	Authenticate a user given a LoginUserInput object. Returns a JWT token upon successful authentication
+//		@Description	Authenticate a user given a LoginUserInput object. Returns a JWT token upon successful authentication, web logins also set it as the session cookie
 //	 	@Param request body LoginUserInput true "query params"
 //		@Accept			json
 //		@Produce		plain
 //		@Success		200	{string}	token
 //		@Router			/auth/login [post]
-func LoginUser(c *gin.Context) {
-	var input LoginUserInput
-	err := c.ShouldBindJSON(&input)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid input",
-			"err":   fmt.Sprintf("%v", err),
-		})
-		dbase.LogServerError("LoginUser:HTTP:InvalidInput", err, "Invalid Input for LoginUser")
-		return
+func LoginUser(repo *dbase.Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input LoginUserInput
+		err := c.ShouldBindJSON(&input)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid input",
+				"err":   fmt.Sprintf("%v", err),
+			})
+			dbase.LogServerErrorContext(c.Request.Context(), "LoginUser:HTTP:InvalidInput", err, "Invalid Input for LoginUser")
+			return
+		}
+		mode := WebLogin
+		if input.Mode == CLILogin {
+			mode = CLILogin
+		} else if input.Mode != "" && input.Mode != WebLogin {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid input",
+				"err":   fmt.Sprintf("unsupported login mode %q", input.Mode),
+			})
+			return
+		}
+		token, err := UserLogin(c.Request.Context(), repo, input, mode)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Unable to authenticate",
+				"err":   fmt.Sprintf("%v", err),
+			})
+			dbase.LogServerErrorContext(c.Request.Context(), "LoginUser:HTTP:InvalidLogin", err, "Unable to authenticate")
+			return
+		}
+		// Browser logins also start a cookie session, headers must be set before
+		// the body is written
+		if mode == WebLogin {
+			middlewares.SetSessionCookie(c, token)
+		}
+		c.Data(http.StatusOK, "text/plaintext", []byte("Bearer "+token))
 	}
-	token, err := UserLogin(input, WebLogin, c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "Unable to authenticate",
-			"err":   fmt.Sprintf("%v", err),
-		})
-		dbase.LogServerError("LoginUser:HTTP:InvalidLogin", err, "Unable to authenticate")
-		return
-	}
-	token = "Bearer " + token
-	c.Data(http.StatusOK, "text/plaintext", []byte(token))
-	c.SetCookie("token", token, int(time.Hour*1), "/", "localhost", false, true)
 }
 
 type GetJWTFromAPIKeyInput struct {
@@ -145,41 +102,47 @@ type GetJWTFromAPIKeyInput struct {
 //		@Produce		plain
 //		@Success		200	{string}	token
 //		@Router			/auth/generate_jwt [post]
-func GetJWTFromAPIKey(c *gin.Context) {
-	var api_key_input GetJWTFromAPIKeyInput
-	err := c.ShouldBindJSON(&api_key_input)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid input",
-			"err":   fmt.Sprintf("%v", err),
-			"input": api_key_input,
-		})
-		dbase.LogServerError("GetJWT:HTTP:InvalidInput", err, "Invalid input")
-		return
-	}
-	db := dbase.GetDBConn()
-	var APIKey dbase.APIKey
-	APIKey.KeyValue = api_key_input.Key
-	db.Model(dbase.APIKey{}).Find(&APIKey)
-	if APIKey.ID == 0 {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "API Key not found",
-		})
-		dbase.LogServerEvent("GetJWT:HTTP:APIKeyNotFound", "API Key not found: "+api_key_input.Key, "ERROR")
-		return
+func GetJWTFromAPIKey(repo *dbase.Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var api_key_input GetJWTFromAPIKeyInput
+		err := c.ShouldBindJSON(&api_key_input)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid input",
+				"err":   fmt.Sprintf("%v", err),
+				"input": api_key_input,
+			})
+			dbase.LogServerErrorContext(c.Request.Context(), "GetJWT:HTTP:InvalidInput", err, "Invalid input")
+			return
+		}
+		user, err := repo.GetUserByAPIKey(c.Request.Context(), api_key_input.Key)
+		if err != nil {
+			outcome := metrics.LoginUserNotFound
+			if errors.Is(err, dbase.ErrUserNotFound) {
+				outcome = metrics.LoginUserDeleted
+			} else if !errors.Is(err, dbase.ErrAPIKeyNotFound) {
+				outcome = metrics.LoginError
+			}
+			metrics.RecordLogin(string(APILogin), metrics.LoginMethodAPIKey, outcome)
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "API Key not found",
+			})
+			dbase.LogServerErrorContext(c.Request.Context(), "GetJWT:HTTP:APIKeyNotFound", err, "API key login refused")
+			return
+		}
+		token, err := dbase.GenerateJWT(user.Username)
+		if err != nil {
+			metrics.RecordLogin(string(APILogin), metrics.LoginMethodAPIKey, metrics.LoginError)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Error generating token",
+			})
+			dbase.LogServerErrorContext(c.Request.Context(), "GetJWT:HTTP", err, "Error generating token for user: "+user.Username)
+			return
+		}
+		metrics.RecordLogin(string(APILogin), metrics.LoginMethodAPIKey, metrics.LoginSuccess)
+		token = "Bearer " + token
+		c.Data(http.StatusOK, "text/plaintext", []byte(token))
 	}
-	var user dbase.User
-	db.Where("ID = ?", APIKey.UserID).Find(&user)
-	token, err := dbase.GenerateJWT(user.Username)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error generating token",
-		})
-		dbase.LogServerError("GetJWT:HTTP", err, "Error generating token for user: "+user.Username)
-		return
-	}
-	token = "Bearer " + token
-	c.Data(http.StatusOK, "text/plaintext", []byte(token))
 }
 
 type GetUserInput struct {
@@ -208,14 +171,14 @@ func GetUser(c *gin.Context) {
 		log.Print("Username not provided")
 		return
 	}
-	UserInfo := GetUserInfo(username)
+	UserInfo := GetUserInfoContext(c.Request.Context(), username)
 	c.JSON(http.StatusOK, UserInfo)
 }
 
 type GenerateAPIKeyResponse struct {
 	User    string `json:"user"`
 	Message string `json:"message" enums:"API Key generated"`
-	APIKey  string
+	APIKey  string `json:"api_key"`
 }
 
 // GenerateAPIKey godoc
@@ -230,29 +193,36 @@ type GenerateAPIKeyResponse struct {
 //		@Produce		json
 //		@Success		200	{object} GenerateAPIKeyResponse
 //		@Router			/auth/generate_api_key [post]
-func GenerateAPIKey(c *gin.Context) {
-	// Get user from context
-	db := dbase.GetDBConn()
-	user, exists := c.Get("currentUser")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "Unauthorized",
+func GenerateAPIKey(repo *dbase.Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user from context
+		user, exists := c.Get("currentUser")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Unauthorized",
+			})
+			return
+		}
+		userData, err := repo.GetUser(c.Request.Context(), fmt.Sprint(user))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Error generating API Key",
+			})
+			dbase.LogServerErrorContext(c.Request.Context(), "GenerateAPIKey:HTTP:GetUser", err, fmt.Sprintf("Error looking up user: %v", user))
+			return
+		}
+		apiKey, err := repo.CreateAPIKey(c.Request.Context(), *userData, c.Query("description"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Error generating API Key",
+			})
+			dbase.LogServerErrorContext(c.Request.Context(), "GenerateAPIKey:HTTP", err, "Error generating API Key for user: "+userData.Username)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"user":    userData.Username,
+			"message": "API Key generated",
+			"api_key": apiKey.Key,
 		})
-		return
-	}
-	var userData dbase.User
-	db.Where("Username = ?", user).Find(&userData)
-	apiKey, err := dbase.CreateAPIKey(userData, c.Query("description"))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error generating API Key",
-		})
-		dbase.LogServerError("GenerateAPIKey:HTTP", err, "Error generating API Key for user: "+userData.Username)
-		return
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"user":    userData.Username,
-		"message": "API Key generated",
-		"api_key": apiKey,
-	})
 }
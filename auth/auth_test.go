@@ -1,12 +1,18 @@
 package auth
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/health"
+	"github.com/javitab/go-web/metrics"
 	test_suite "github.com/javitab/go-web/tests"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,7 +23,7 @@ func TestAuthRouter(t *testing.T) {
 	// Start Web Server
 	router := test_suite.AppRouter()
 
-	AuthRouterGroup(router)
+	AuthRouterGroup(router, dbase.DefaultRepository())
 
 	// Send HTTP Request for Hello World
 	expectedResponse :=
@@ -30,4 +36,184 @@ func TestAuthRouter(t *testing.T) {
 	responseData, _ := io.ReadAll(w.Body)
 	assert.Equal(t, expectedResponse, string(responseData))
 	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Logins choose the CLI or web login security point
+	login := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/auth/login", strings.NewReader(body))
+		req.Header.Set("content-type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w = login(`{"username":"testuser","password":"password","mode":"cli_login"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "Bearer "))
+	assert.Empty(t, w.Result().Cookies())
+
+	// Web logins also start a cookie session with the token
+	w = login(`{"username":"testuser","password":"password"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if cookies := w.Result().Cookies(); assert.Len(t, cookies, 1) {
+		assert.Equal(t, "Bearer "+cookies[0].Value, w.Body.String())
+		assert.Equal(t, 3600, cookies[0].MaxAge)
+		assert.True(t, cookies[0].Secure)
+		assert.True(t, cookies[0].HttpOnly)
+	}
+	w = login(`{"username":"testuser","password":"password","mode":"other"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func createLDAPTestUser(t *testing.T, username string) UserInfo {
+	t.Helper()
+	err := dbase.CreateUser(username, "LDAP", "Test", username+"@test.local", "unused_local_password")
+	assert.NoError(t, err)
+
+	db := dbase.GetDBConn()
+	db.Model(&dbase.User{}).Where("username = ?", username).Update("is_ldap_user", true)
+
+	return GetUserInfo(username)
+}
+
+func TestLDAPAuth(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	ctx := context.Background()
+
+	// Readiness skips LDAP until it is configured
+	assert.ErrorIs(t, CheckLDAP(ctx), health.ErrSkipped)
+	test_suite.StartFakeLDAP(t, "ldap.yaml")
+	assert.NoError(t, CheckLDAP(ctx))
+
+	valid, err := LDAPAuth(ctx, LoginUserInput{Username: "ldapuser", Password: "ldapuser_password"})
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	valid, err = LDAPAuth(ctx, LoginUserInput{Username: "ldapuser", Password: "wrong_password"})
+	assert.Error(t, err)
+	assert.False(t, valid)
+
+	valid, err = LDAPAuth(ctx, LoginUserInput{Username: "missing", Password: "ldapuser_password"})
+	assert.Error(t, err)
+	assert.False(t, valid)
+}
+
+func TestLDAPGetUserInfo(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	test_suite.StartFakeLDAP(t, "ldap.yaml")
+	ctx := context.Background()
+
+	info, err := LDAPGetUserInfo(ctx, "ldapadmin")
+	assert.NoError(t, err)
+	assert.Equal(t, "ldapadmin@test.local", info.Email)
+	assert.Equal(t, "LDAP", info.FirstName)
+	assert.Equal(t, "Admin", info.LastName)
+	assert.ElementsMatch(t, []string{"AP.YH.AA.All.Dev", "ITS_All"}, info.Groups)
+
+	assert.True(t, LDAPUserExists(ctx, "ldapnogroups"))
+	assert.Empty(t, LDAPGroups(ctx, "ldapnogroups"))
+	assert.False(t, LDAPUserExists(ctx, "missing"))
+}
+
+func TestLDAPEvalGroups(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	test_suite.StartFakeLDAP(t, "ldap.yaml")
+	ctx := context.Background()
+
+	// Put the user in the admin group, which LDAP does not grant them
+	user := createLDAPTestUser(t, "ldapuser")
+	assert.NoError(t, user.AddUserToGroup(1))
+
+	LDAPEvalGroups(ctx, dbase.DefaultRepository(), GetUserInfo("ldapuser"))
+
+	synced := GetUserInfo("ldapuser")
+	var groupIDs []uint
+	for _, g := range synced.DB.Groups {
+		groupIDs = append(groupIDs, g.ID)
+	}
+	assert.Equal(t, []uint{2}, groupIDs)
+}
+
+func TestLDAPUserLogin(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	test_suite.StartFakeLDAP(t, "ldap.yaml")
+	ctx := context.Background()
+
+	createLDAPTestUser(t, "ldapadmin")
+	createLDAPTestUser(t, "ldapnogroups")
+
+	logins := func(mode ValidLoginMode, outcome string) float64 {
+		return testutil.ToFloat64(metrics.Logins.WithLabelValues(string(mode), metrics.LoginMethodLDAP, outcome))
+	}
+	spans := test_suite.RecordSpans(t)
+	successes := logins(CLILogin, metrics.LoginSuccess)
+	invalid := logins(CLILogin, metrics.LoginInvalidPassword)
+	unauthorized := logins(WebLogin, metrics.LoginUnauthorized)
+
+	// Login syncs LDAP groups before checking login security points
+	token, err := UserLogin(ctx, dbase.DefaultRepository(), LoginUserInput{Username: "ldapadmin", Password: "ldapadmin_password"}, CLILogin)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	assert.True(t, GetUserInfo("ldapadmin").SPCheck(7))
+
+	_, err = UserLogin(ctx, dbase.DefaultRepository(), LoginUserInput{Username: "ldapadmin", Password: "wrong_password"}, CLILogin)
+	assert.EqualError(t, err, "invalid ldap password")
+
+	// Users without mapped LDAP groups have no login security points
+	_, err = UserLogin(ctx, dbase.DefaultRepository(), LoginUserInput{Username: "ldapnogroups", Password: "ldapnogroups_password"}, WebLogin)
+	assert.EqualError(t, err, "unauthorized login: missing Security Point 5")
+
+	// LDAP users missing from the directory cannot log in with any password,
+	// even when their local groups grant the login security point
+	removed := createLDAPTestUser(t, "ldapremoved")
+	assert.NoError(t, removed.AddUserToGroup(1))
+	token, err = UserLogin(ctx, dbase.DefaultRepository(), LoginUserInput{Username: "ldapremoved", Password: "anything"}, WebLogin)
+	assert.EqualError(t, err, "user not found in ldap")
+	assert.Empty(t, token)
+
+	// Outcomes are counted by mode and method
+	assert.Equal(t, successes+1, logins(CLILogin, metrics.LoginSuccess))
+	assert.Equal(t, invalid+1, logins(CLILogin, metrics.LoginInvalidPassword))
+	assert.Equal(t, unauthorized+1, logins(WebLogin, metrics.LoginUnauthorized))
+
+	// Logins trace the user lookup and each LDAP operation
+	names := test_suite.SpanNames(spans)
+	for _, name := range []string{"auth.UserLogin", "auth.GetUserInfo", "ldap.connect", "ldap.search", "ldap.bind", "gorm.query"} {
+		assert.Contains(t, names, name)
+	}
+}
+
+func TestRateLimitExempt(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	ctx := context.Background()
+	repo := dbase.DefaultRepository()
+
+	// Group membership alone does not exempt
+	exempt, err := RateLimitExempt(dbase.DefaultRepository())(ctx, "testuser")
+	assert.NoError(t, err)
+	assert.False(t, exempt)
+
+	// The RateLimitExempt security point does
+	user, err := repo.CreateUser(ctx, dbase.NewUser{
+		Username: "svc-router", LastName: "Router", FirstName: "Service", Email: "router@test.local", Password: "password",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, repo.AddUserSecPoint(ctx, *user, SPRateLimitExempt, "UserAddSecPoints"))
+	exempt, err = RateLimitExempt(dbase.DefaultRepository())(ctx, "svc-router")
+	assert.NoError(t, err)
+	assert.True(t, exempt)
+
+	// As do superusers, who hold every security point
+	testuser, err := repo.GetUser(ctx, "testuser")
+	assert.NoError(t, err)
+	assert.NoError(t, repo.AddUserSecPoint(ctx, *testuser, 1, "UserAddSecPoints"))
+	exempt, err = RateLimitExempt(dbase.DefaultRepository())(ctx, "testuser")
+	assert.NoError(t, err)
+	assert.True(t, exempt)
+
+	_, err = RateLimitExempt(dbase.DefaultRepository())(ctx, "missing")
+	assert.ErrorIs(t, err, dbase.ErrUserNotFound)
 }
@@ -1,18 +1,24 @@
 package auth
 
-import dbase "github.com/javitab/go-web/database"
+import (
+	"context"
+
+	dbase "github.com/javitab/go-web/database"
+)
 
 type GroupInfo struct {
 	DB dbase.Group
 }
 
 func GetGroupInfo(GroupID int) GroupInfo {
-	// Get Database Connection
-	db := dbase.GetDBConn()
+	return LoadGroupInfo(context.Background(), dbase.DefaultRepository(), GroupID)
+}
 
+// LoadGroupInfo loads a group with its security points from repo
+func LoadGroupInfo(ctx context.Context, repo *dbase.Repository, GroupID int) GroupInfo {
 	// Get Group from Database
 	var GroupInfo GroupInfo
-	db.Model(&GroupInfo.DB).Preload("AddSecPoints").Preload("DelSecPoints").Preload("OvrSecPoints").Where("ID = ?", GroupID).Find(&GroupInfo.DB)
+	repo.DB().WithContext(ctx).Model(&GroupInfo.DB).Preload("AddSecPoints").Preload("DelSecPoints").Preload("OvrSecPoints").Where("ID = ?", GroupID).Find(&GroupInfo.DB)
 
 	// ### ###
 	// ### ###
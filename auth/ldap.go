@@ -1,13 +1,20 @@
 package auth
 
 import (
-	b64 "encoding/base64"
+	"context"
 	"fmt"
-	"os"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
+	"github.com/javitab/go-web/config"
 	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/health"
+	"github.com/javitab/go-web/metrics"
+	"github.com/javitab/go-web/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // UserLogin struct to represent user credentials
@@ -24,84 +31,169 @@ type LdapBindCredentials struct {
 
 // Decode LdapBindCredentials
 
-func GetLdapBindCredentials() LdapBindCredentials {
-	encodedCreds := os.Getenv("LDAP_BIND_CREDENTIALS")
-	decodedCreds, _ := b64.StdEncoding.DecodeString(encodedCreds)
-	decodedCredsString := string([]byte(decodedCreds))
-	ldapBindParts := strings.Split(decodedCredsString, ":")
+func GetLdapBindCredentials() (LdapBindCredentials, error) {
+	username, password, err := config.GetConfig().LDAP.DecodeBindCredentials()
+	if err != nil {
+		return LdapBindCredentials{}, err
+	}
 
 	// Create object
 	var LdapBindCredentials LdapBindCredentials
-	LdapBindCredentials.Username = ldapBindParts[0]
-	LdapBindCredentials.Password = ldapBindParts[1]
+	LdapBindCredentials.Username = username
+	LdapBindCredentials.Password = password
 
 	// Return object
-	return LdapBindCredentials
+	return LdapBindCredentials, nil
 }
 
-func GetLdapConnection() (*ldap.Conn, error) {
-	conn, err := ldap.DialURL(os.Getenv("LDAP_ADDRESS"))
+func GetLdapConnection(ctx context.Context) (*ldap.Conn, error) {
+	ldapConfig := config.GetConfig().LDAP
+	if !ldapConfig.Enabled() {
+		return nil, fmt.Errorf("ldap is not configured")
+	}
+	creds, err := GetLdapBindCredentials()
 	if err != nil {
-		dbase.LogServerError("GetLdapConnection:ldap.DialURL", err, "Error loading connection: "+os.Getenv("LDAP_ADDRESS"))
+		dbase.LogServerErrorContext(ctx, "GetLdapConnection:GetLdapBindCredentials", err, "Invalid LDAP bind credentials")
 		return nil, err
 	}
-	creds := GetLdapBindCredentials()
-	if err := conn.Bind(creds.Username, creds.Password); err != nil {
-		dbase.LogServerError("GetLdapConnection:ldap.Bind", err, "Error binding LDAP connection: "+creds.Username)
+	var conn *ldap.Conn
+	err = ldapOperation(ctx, "connect", func() error {
+		conn, err = ldap.DialURL(ldapConfig.Address)
+		if err != nil {
+			dbase.LogServerErrorContext(ctx, "GetLdapConnection:ldap.DialURL", err, "Error loading connection: "+ldapConfig.Address)
+			return err
+		}
+		if err := conn.Bind(creds.Username, creds.Password); err != nil {
+			conn.Close()
+			dbase.LogServerErrorContext(ctx, "GetLdapConnection:ldap.Bind", err, "Error binding LDAP connection: "+creds.Username)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 	return conn, nil
 }
 
-func LDAPAuth(creds LoginUserInput) (bool, error) {
-	conn, err := GetLdapConnection()
+// CheckLDAP connects and binds to the configured LDAP server for readiness
+// probes, returning health.ErrSkipped when LDAP is not configured. Failures
+// are reported by the probe rather than logged as server events.
+func CheckLDAP(ctx context.Context) error {
+	ldapConfig := config.GetConfig().LDAP
+	if !ldapConfig.Enabled() {
+		return health.ErrSkipped
+	}
+	creds, err := GetLdapBindCredentials()
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		dialer.Deadline = deadline
+	}
+	return ldapOperation(ctx, "connect", func() error {
+		conn, err := ldap.DialURL(ldapConfig.Address, ldap.DialWithDialer(dialer))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if hasDeadline {
+			conn.SetTimeout(time.Until(deadline))
+		}
+		return conn.Bind(creds.Username, creds.Password)
+	})
+}
+
+// ldapOperation runs an LDAP operation in a span of the trace of ctx and
+// records its latency. Rejected user passwords are not counted as errors.
+func ldapOperation(ctx context.Context, operation string, run func() error) error {
+	_, span := tracing.Tracer().Start(ctx, "ldap."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("ldap.operation", operation)),
+	)
+	defer span.End()
+
+	start := time.Now()
+	err := run()
+	failure := err
+	if operation == "bind" && ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		failure = nil
+	}
+	metrics.ObserveLDAP(operation, start, failure)
+	if failure != nil {
+		tracing.SetError(span, failure)
+	}
+	return err
+}
+
+// ldapSearch runs a search request as an LDAP operation
+func ldapSearch(ctx context.Context, conn *ldap.Conn, searchRequest *ldap.SearchRequest) (result *ldap.SearchResult, err error) {
+	err = ldapOperation(ctx, "search", func() error {
+		result, err = conn.Search(searchRequest)
+		return err
+	})
+	return result, err
+}
+
+func LDAPAuth(ctx context.Context, creds LoginUserInput) (bool, error) {
+	conn, err := GetLdapConnection(ctx)
 	if err != nil {
-		dbase.LogServerError("LDAPAuth:GetLdapConnection", err, "Failed to get connection to perform LDAPAuth request: "+creds.Username)
+		dbase.LogServerErrorContext(ctx, "LDAPAuth:GetLdapConnection", err, "Failed to get connection to perform LDAPAuth request: "+creds.Username)
 		return false, err
 	}
+	defer conn.Close()
 	searchRequest := ldap.NewSearchRequest(
-		os.Getenv("LDAP_BASE_DN"),
+		config.GetConfig().LDAP.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		fmt.Sprintf("(anr=%s)", creds.Username),
 		[]string{"dn"},
 		nil,
 	)
-	searchResp, err := conn.Search(searchRequest)
+	searchResp, err := ldapSearch(ctx, conn, searchRequest)
 	if err != nil {
-		dbase.LogServerError("LDAPAuth:searchRequest:RequestFailed", err, fmt.Sprintf("LDAP search failed for user %s, error details: %v", creds.Username, err))
+		dbase.LogServerErrorContext(ctx, "LDAPAuth:searchRequest:RequestFailed", err, fmt.Sprintf("LDAP search failed for user %s, error details: %v", creds.Username, err))
 		return false, err
 	}
 	if len(searchResp.Entries) == 0 {
 		err = fmt.Errorf("user: %s not found", creds.Username)
-		dbase.LogServerError("LDAPAuth:searchRequest:NotFound", err, "Login Error Logged")
+		dbase.LogServerErrorContext(ctx, "LDAPAuth:searchRequest:NotFound", err, "Login Error Logged")
 		return false, err
 	}
 
 	userDN := searchResp.Entries[0].DN
 
-	err = conn.Bind(userDN, creds.Password)
+	err = ldapOperation(ctx, "bind", func() error {
+		return conn.Bind(userDN, creds.Password)
+	})
 	if err != nil {
 		err = fmt.Errorf("authentication failed")
-		dbase.LogServerError("LDAPAuth:ldapAuthBind:authFailed", err, "")
+		dbase.LogServerErrorContext(ctx, "LDAPAuth:ldapAuthBind:authFailed", err, "")
 		return false, err
 	}
 	return true, nil
 }
 
-func LDAPGroups(username string) (groups []string) {
-	conn, _ := GetLdapConnection()
+func LDAPGroups(ctx context.Context, username string) (groups []string) {
+	conn, err := GetLdapConnection(ctx)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
 
 	searchRequest := ldap.NewSearchRequest(
-		os.Getenv("LDAP_BASE_DN"),
+		config.GetConfig().LDAP.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		fmt.Sprintf("(sAMAccountName=%s)", username),
 		[]string{"memberOf"},
 		nil,
 	)
 
-	searchResult, err := conn.Search(searchRequest)
+	searchResult, err := ldapSearch(ctx, conn, searchRequest)
 	if err != nil {
-		dbase.LogServerError("LDAPGroups:ldapSearchRequest:error", err, "")
+		dbase.LogServerErrorContext(ctx, "LDAPGroups:ldapSearchRequest:error", err, "")
 		return nil
 	}
 	if len(searchResult.Entries) > 0 {
@@ -122,46 +214,52 @@ type LDAPUserInfo struct {
 	FirstName string
 }
 
-func LDAPGetUserInfo(username string) (LDAPUserInfo, error) {
+func LDAPGetUserInfo(ctx context.Context, username string) (LDAPUserInfo, error) {
 	UserInfo := LDAPUserInfo{}
-	conn, _ := GetLdapConnection()
+	conn, err := GetLdapConnection(ctx)
+	if err != nil {
+		return UserInfo, err
+	}
+	defer conn.Close()
 	searchRequest := ldap.NewSearchRequest(
-		os.Getenv("LDAP_BASE_DN"),
+		config.GetConfig().LDAP.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		fmt.Sprintf("(sAMAccountName=%s)", username),
 		[]string{"mail", "givenName", "sn"},
 		nil,
 	)
 
-	searchResult, err := conn.Search(searchRequest)
+	searchResult, err := ldapSearch(ctx, conn, searchRequest)
 	if err != nil {
-		dbase.LogServerError("LDAPGetUserInfo:ldapSearchRequest:error", err, "")
+		dbase.LogServerErrorContext(ctx, "LDAPGetUserInfo:ldapSearchRequest:error", err, "")
 		return UserInfo, err
 	}
 	if len(searchResult.Entries) != 1 {
 		lookup_err := fmt.Errorf(("user not found in LDAP"))
-		dbase.LogServerError("LDAPGetUserInfo:UserNotFound", lookup_err, fmt.Sprintf("User: %v not found in LDAP", username))
+		dbase.LogServerErrorContext(ctx, "LDAPGetUserInfo:UserNotFound", lookup_err, fmt.Sprintf("User: %v not found in LDAP", username))
 		return UserInfo, lookup_err
 	}
 	user := searchResult.Entries[0]
-	UserInfo.Groups = LDAPGroups(username)
+	UserInfo.Groups = LDAPGroups(ctx, username)
 	UserInfo.Email = user.GetAttributeValue("mail")
 	UserInfo.LastName = user.GetAttributeValue("sn")
 	UserInfo.FirstName = user.GetAttributeValue("givenName")
 	return UserInfo, nil
 }
 
-func LDAPUserExists(username string) bool {
-	_, err := LDAPGetUserInfo(username)
+func LDAPUserExists(ctx context.Context, username string) bool {
+	_, err := LDAPGetUserInfo(ctx, username)
 	return err == nil
 }
 
-func LDAPEvalGroups(u UserInfo) {
+// LDAPEvalGroups updates the groups of u in repo to the groups mapped to its
+// LDAP groups
+func LDAPEvalGroups(ctx context.Context, repo *dbase.Repository, u UserInfo) {
 
 	// Function to get the difference between two slices
-	getDiff := func(arr1, arr2 []int) []int {
-		diff := []int{}
-		m := make(map[int]bool)
+	getDiff := func(arr1, arr2 []uint) []uint {
+		diff := []uint{}
+		m := make(map[uint]bool)
 
 		// Add all elements of arr2 to the map
 		for _, num := range arr2 {
@@ -178,26 +276,38 @@ func LDAPEvalGroups(u UserInfo) {
 		return diff
 	}
 
-	db := dbase.GetDBConn()
-	var LDAPGroupIDs []int
-	db.Raw("SELECT id from public.groups WHERE ldap_group in ?", u.LDAPGroups).Scan(&LDAPGroupIDs)
+	// Get all groups mapped to the user's LDAP groups
+	LDAPGroupIDs, err := repo.GroupIDsByLDAPGroups(ctx, u.LDAPGroups)
+	if err != nil {
+		dbase.LogServerErrorContext(ctx, "LDAPEvalGroups:GroupIDsByLDAPGroups", err, "User: "+u.DB.Username)
+		return
+	}
 
 	// Get all groups that user is in
-	var UserGroups []int
-	db.Raw("select group_id from user_groups where user_id = ?", u.DB.ID).Scan(&UserGroups)
+	UserGroups, err := repo.UserGroupIDs(ctx, u.DB.ID)
+	if err != nil {
+		dbase.LogServerErrorContext(ctx, "LDAPEvalGroups:UserGroupIDs", err, "User: "+u.DB.Username)
+		return
+	}
 
 	addGroups := getDiff(LDAPGroupIDs, UserGroups)
 	remGroups := getDiff(UserGroups, LDAPGroupIDs)
 
 	// Remove users in RemGroups
-	for _, groupID := range remGroups {
-		db.Exec("DELETE from user_groups where user_id = ? AND group_id = ?", u.DB.ID, groupID)
-		dbase.LogServerEvent("LDAPEvalGroups:LDAPRemoveGroup", fmt.Sprintf("LDAP mandated remove user %v from group id %v", u.DB.Username, groupID), "LDAP")
+	if err := repo.RemoveUserFromGroups(ctx, u.DB.ID, remGroups); err != nil {
+		dbase.LogServerErrorContext(ctx, "LDAPEvalGroups:LDAPRemoveGroup", err, "User: "+u.DB.Username)
+	} else {
+		for _, groupID := range remGroups {
+			dbase.LogServerEventContext(ctx, "LDAPEvalGroups:LDAPRemoveGroup", fmt.Sprintf("LDAP mandated remove user %v from group id %v", u.DB.Username, groupID), "LDAP")
+		}
 	}
 
 	// Add user to groups in AddGroups
-	for _, groupID := range addGroups {
-		db.Exec("INSERT INTO user_groups (user_id, group_id) VALUES (?, ?)", u.DB.ID, groupID)
-		dbase.LogServerEvent("LDAPEvalGroups:LDAPAddGroup", fmt.Sprintf("LDAP mandated add user %v to group id %v", u.DB.Username, groupID), "LDAP")
+	if err := repo.AddUserToGroups(ctx, u.DB.ID, addGroups); err != nil {
+		dbase.LogServerErrorContext(ctx, "LDAPEvalGroups:LDAPAddGroup", err, "User: "+u.DB.Username)
+	} else {
+		for _, groupID := range addGroups {
+			dbase.LogServerEventContext(ctx, "LDAPEvalGroups:LDAPAddGroup", fmt.Sprintf("LDAP mandated add user %v to group id %v", u.DB.Username, groupID), "LDAP")
+		}
 	}
 }
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	dbase "github.com/javitab/go-web/database"
+)
+
+const (
+	// SPCreateUser allows creating users
+	SPCreateUser = 2
+	// SPRemoveUserFromGroup allows removing users from groups
+	SPRemoveUserFromGroup = 6
+	// SPAddUserToGroup allows adding users to groups
+	SPAddUserToGroup = 7
+	// SPUpdateSecPoints allows changing user-level security points and
+	// loading security point and group definitions
+	SPUpdateSecPoints = 8
+	// SPSetLDAPUser allows setting whether users authenticate against LDAP
+	SPSetLDAPUser = 9
+	// SPViewMetrics allows scraping /metrics on the application listener
+	SPViewMetrics = 11
+	// SPImportUsers allows bulk creating and updating users
+	SPImportUsers = 12
+	// SPExportUsers allows bulk exporting users
+	SPExportUsers = 13
+	// SPViewServerEvents allows viewing server events in the web UI
+	SPViewServerEvents = 14
+	// SPDeleteUser allows deleting and restoring users
+	SPDeleteUser = 15
+	// SPSetUserPassword allows changing the password of other users
+	SPSetUserPassword = 16
+	// SPTestLogin allows testing user and LDAP credentials with the CLI
+	SPTestLogin = 17
+	// SPViewUsers allows viewing users, groups and security points
+	SPViewUsers = 18
+)
+
+// RequireSecPoint aborts requests of users without the security point with
+// 403 Forbidden, looking them up in repo. It must follow
+// middlewares.CheckAuth.
+func RequireSecPoint(repo *dbase.Repository, SPID int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := LoadUserInfo(c.Request.Context(), repo, c.GetString("currentUser"))
+		if user.DB.ID == 0 || !user.IsActiveUser || !user.SPCheck(SPID) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("missing security point %v", SPID),
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
 	"github.com/javitab/go-web/middlewares"
 )
 
-func AuthRouterGroup(router *gin.Engine) *gin.RouterGroup {
-	auth := router.Group("/auth")
+func AuthRouterGroup(router *gin.Engine, repo *dbase.Repository) *gin.RouterGroup {
+	auth := router.Group("/auth", middlewares.ContentSecurityPolicy(config.CSPGroupAPI))
 	{
 		authHandler := func(c *gin.Context) {
 
@@ -17,8 +19,6 @@ func AuthRouterGroup(router *gin.Engine) *gin.RouterGroup {
 					"message": "Auth router",
 					"path":    c.Request.URL.Path,
 				})
-			} else if c.Request.Method == "POST" {
-				CreateUser(c)
 			} else {
 				c.JSON(http.StatusMethodNotAllowed, gin.H{
 					"error": "Method not allowed",
@@ -28,14 +28,20 @@ func AuthRouterGroup(router *gin.Engine) *gin.RouterGroup {
 		}
 		auth.GET("", authHandler)
 		auth.GET("/", authHandler)
-		auth.POST("/create_user", CreateUser)
-		auth.POST("/login", LoginUser)
-		auth.POST("/generate_jwt", GetJWTFromAPIKey)
-		auth.POST("/update_user", middlewares.CheckAuth, UpdateUser)
-		auth.GET("/user", middlewares.CheckAuth, GetUser)
-		auth.GET("/group", middlewares.CheckAuth, GetGroup)
-		auth.GET("/sec_point", middlewares.CheckAuth, GetSecPoint)
-		auth.POST("/generate_api_key", middlewares.CheckAuth, GenerateAPIKey)
+
+		// Unauthenticated endpoints share the login rate limit
+		loginLimit := middlewares.RateLimit(config.RateLimitGroupLogin)
+		auth.POST("/login", loginLimit, LoginUser(repo))
+		auth.POST("/generate_jwt", loginLimit, GetJWTFromAPIKey(repo))
+
+		// Authenticated endpoints share the API rate limit
+		checkAuth := middlewares.CheckAuth(repo)
+		apiLimit := middlewares.RateLimit(config.RateLimitGroupAPI)
+		viewUsers := RequireSecPoint(repo, SPViewUsers)
+		auth.GET("/user", checkAuth, apiLimit, viewUsers, GetUser)
+		auth.GET("/group", checkAuth, apiLimit, viewUsers, GetGroup)
+		auth.GET("/sec_point", checkAuth, apiLimit, viewUsers, GetSecPoint)
+		auth.POST("/generate_api_key", checkAuth, apiLimit, GenerateAPIKey(repo))
 
 		return auth
 	}
@@ -36,6 +36,6 @@ func GetSecPoint(c *gin.Context) {
 		return
 	}
 
-	sec_point := GetSecPointInfo(SPID)
+	sec_point := GetSecPointInfoContext(c.Request.Context(), SPID)
 	c.JSON(http.StatusOK, sec_point)
 }
@@ -1,6 +1,11 @@
 package auth
 
-import dbase "github.com/javitab/go-web/database"
+import (
+	"context"
+	"fmt"
+
+	dbase "github.com/javitab/go-web/database"
+)
 
 type SecPointInfo struct {
 	DB                dbase.SecPoint
@@ -8,40 +13,34 @@ type SecPointInfo struct {
 }
 
 func GetSecPointInfo(SPID int) SecPointInfo {
-	// Get Database Connection
-	db := dbase.GetDBConn()
+	return GetSecPointInfoContext(context.Background(), SPID)
+}
 
+// GetSecPointInfoContext is GetSecPointInfo with server events stamped with
+// the request of ctx
+func GetSecPointInfoContext(ctx context.Context, SPID int) SecPointInfo {
+	return LoadSecPointInfo(ctx, dbase.DefaultRepository(), SPID)
+}
+
+// LoadSecPointInfo loads a security point and the groups referencing it from
+// repo
+func LoadSecPointInfo(ctx context.Context, repo *dbase.Repository, SPID int) SecPointInfo {
 	// Get SecPoint from Database
 	var SecPoint dbase.SecPoint
-	db.Model(&SecPoint).Where("id = ?", SPID).Find(&SecPoint)
+	repo.DB().WithContext(ctx).Model(&SecPoint).Where("id = ?", SPID).Find(&SecPoint)
 
 	// Initialize SecPointInfo w/ DB Object
 	SPInfo := SecPointInfo{}
 	SPInfo.DB = SecPoint
 
 	// Get groups with reference to SecPoint
-	var groupIDs []int
-	db.Raw(
-		"SELECT id from public.Groups"+
-			" INNER JOIN group_add_sec_points"+
-			" ON group_add_sec_points.group_id = groups.id"+
-			" WHERE group_add_sec_points.sec_point_id = ?",
-		SPInfo.DB.ID).Scan(&groupIDs)
-	db.Raw(
-		"SELECT id from public.Groups"+
-			" INNER JOIN group_del_sec_points"+
-			" ON group_del_sec_points.group_id = groups.id"+
-			" WHERE group_del_sec_points.sec_point_id = ?",
-		SPInfo.DB.ID).Scan(&groupIDs)
-	db.Raw(
-		"SELECT id from public.Groups"+
-			" INNER JOIN group_ovr_sec_points"+
-			" ON group_ovr_sec_points.group_id = groups.id"+
-			" WHERE group_ovr_sec_points.sec_point_id = ?",
-		SPInfo.DB.ID).Scan(&groupIDs)
+	groupIDs, err := repo.GroupIDsReferencingSecPoint(ctx, SPInfo.DB.ID)
+	if err != nil {
+		dbase.LogServerErrorContext(ctx, "GetSecPointInfo:GroupIDsReferencingSecPoint", err, fmt.Sprintf("SPID: %v", SPID))
+	}
 	var GroupInfos []GroupInfo
 	for _, id := range groupIDs {
-		GroupInfos = append(GroupInfos, GetGroupInfo(id))
+		GroupInfos = append(GroupInfos, LoadGroupInfo(ctx, repo, int(id)))
 	}
 	SPInfo.ReferencingGroups = GroupInfos
 
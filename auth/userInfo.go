@@ -1,10 +1,23 @@
 package auth
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"sort"
 
 	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/metrics"
+	"github.com/javitab/go-web/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUserHasSecPoint = errors.New("user already has security point")
+	ErrGroupNotFound   = errors.New("group not found")
 )
 
 type UserInfo struct {
@@ -25,24 +38,29 @@ type UserInfo struct {
 	GenerateAPIKey     func(desc string) error            `json:"-"`
 }
 
+// SPRateLimitExempt exempts a user, typically a service account, from rate
+// limits
+const SPRateLimitExempt = 10
+
 func GetUserInfo(Username string) UserInfo {
+	return GetUserInfoContext(context.Background(), Username)
+}
+
+// GetUserInfoContext loads a user and its security points. Events logged by
+// the returned functions are stamped with the request ID of ctx.
+func GetUserInfoContext(ctx context.Context, Username string) UserInfo {
+	return LoadUserInfo(ctx, dbase.DefaultRepository(), Username)
+}
+
+// LoadUserInfo is GetUserInfoContext on repo, which the returned functions
+// write to as well
+func LoadUserInfo(ctx context.Context, repo *dbase.Repository, Username string) UserInfo {
 
-	// Get Database Connection
-	db := dbase.GetDBConn()
+	// Loading is traced on its own, the functions below log under ctx
+	loadCtx, span := tracing.Tracer().Start(ctx, "auth.GetUserInfo", trace.WithAttributes(semconv.EnduserID(Username)))
 
 	// Get User from Database
-	var DBUser dbase.User
-	db.
-		Unscoped().
-		Preload("UserAddSecPoints").
-		Preload("UserDelSecPoints").
-		Preload("UserOvrSecPoints").
-		Preload("APIKeys").
-		Preload("Groups").
-		Preload("Groups.AddSecPoints").
-		Preload("Groups.DelSecPoints").
-		Preload("Groups.OvrSecPoints").
-		Where("Username = ?", Username).Find(&DBUser)
+	DBUser, _ := loadUser(repo.DB().WithContext(loadCtx), Username)
 
 	// Populate UserInfo Object with DB values
 	var UserInfo UserInfo
@@ -55,8 +73,9 @@ func GetUserInfo(Username string) UserInfo {
 	// LDAP Attributes
 	UserInfo.IsLDAPUser = UserInfo.DB.IsLDAPUser
 	if UserInfo.IsLDAPUser {
-		UserInfo.LDAPGroups = LDAPGroups(Username)
+		UserInfo.LDAPGroups = LDAPGroups(loadCtx, Username)
 	}
+	span.End()
 
 	// ### ###
 	// ### ###
@@ -72,40 +91,41 @@ func GetUserInfo(Username string) UserInfo {
 		_, exists := UserInfo.SecurityPoints[uint(SPID)]
 		if !exists {
 			if _, exists := UserInfo.SecurityPoints[uint(1)]; exists {
-				dbase.LogServerEvent("SPcheck", fmt.Sprintf("User: %v SPID: %v", UserInfo.DB.Username, SPID), "SUPERUSER")
+				dbase.LogServerEventContext(ctx, "SPcheck", fmt.Sprintf("User: %v SPID: %v", UserInfo.DB.Username, SPID), "SUPERUSER")
 				return true
 			}
-			fmt.Printf("SPCheck %v - DENIED\n", SPID)
-			dbase.LogServerEvent("SPcheck", fmt.Sprintf("User: %v SPID: %v", UserInfo.DB.Username, SPID), "DENY")
+			fmt.Fprintf(os.Stderr, "SPCheck %v - DENIED\n", SPID)
+			metrics.RecordSecPointDenial(SPID)
+			dbase.LogServerEventContext(ctx, "SPcheck", fmt.Sprintf("User: %v SPID: %v", UserInfo.DB.Username, SPID), "DENY")
 		}
 		return exists
 	}
 
+	// ###
+	// ### SetLDAPUser Function
+	// ###
+
+	UserInfo.SetLDAPUser = func(IsLDAPUser bool) error {
+		err := repo.SetLDAPUser(ctx, UserInfo.DB.Username, IsLDAPUser)
+		if err != nil {
+			return err
+		}
+		UserInfo.DB.IsLDAPUser = IsLDAPUser
+		UserInfo.IsLDAPUser = IsLDAPUser
+		return nil
+	}
+
 	// ###
 	// ### SetUserSecPoint Function
 	// ###
 
 	UserInfo.SetUserSecPoint = func(SPID int, field string) error {
 		// Check if user already has SecPoint
-		if UserInfo.SPCheck(SPID) {
-			return fmt.Errorf("user already has security point: %v\nsource: %v", SPID, UserInfo.SecurityPoints[uint(SPID)].Source)
-		}
-
-		SetSecPoint := GetSecPointInfo(SPID)
-		switch field {
-		case "UserAddSecPoints":
-			UserInfo.DB.UserAddSecPoints = append(UserInfo.DB.UserAddSecPoints, SetSecPoint.DB)
-		case "UserDelSecPoints":
-			UserInfo.DB.UserDelSecPoints = append(UserInfo.DB.UserDelSecPoints, SetSecPoint.DB)
-		case "UserOvrSecPoints":
-			UserInfo.DB.UserDelSecPoints = append(UserInfo.DB.UserDelSecPoints, SetSecPoint.DB)
-		default:
-			return fmt.Errorf("invalid field selection: %q", field)
+		if sp, exists := UserInfo.SecurityPoints[uint(SPID)]; exists {
+			return fmt.Errorf("%w: %v\nsource: %v", ErrUserHasSecPoint, SPID, sp.Source)
 		}
-		db := dbase.GetDBConn()
-		db.Save(UserInfo.DB)
 
-		return nil
+		return repo.AddUserSecPoint(ctx, UserInfo.DB, uint(SPID), field)
 	}
 
 	// ###
@@ -113,18 +133,11 @@ func GetUserInfo(Username string) UserInfo {
 	// ###
 
 	UserInfo.RemoveUserSecPoint = func(SPID int, field string) error {
-		SetSecPoint := GetSecPointInfo(SPID)
-		switch field {
-		case "UserAddSecPoints":
-			db.Exec("DELETE FROM user_add_sec_points where user_id=? and sec_point_id=?", UserInfo.DB.ID, SetSecPoint.DB.ID)
-		case "UserDelSecPoints":
-			db.Exec("DELETE FROM user_del_sec_points where user_id=? and sec_point_id=?", UserInfo.DB.ID, SetSecPoint.DB.ID)
-		case "UserOvrSecPoints":
-			db.Exec("DELETE FROM user_ovr_sec_points where user_id=? and sec_point_id=?", UserInfo.DB.ID, SetSecPoint.DB.ID)
-		default:
-			return fmt.Errorf("invalid field selection: %q", field)
+		err := repo.RemoveUserSecPoint(ctx, UserInfo.DB, uint(SPID), field)
+		if err != nil {
+			return err
 		}
-		UserInfo = GetUserInfo(UserInfo.DB.Username)
+		UserInfo = LoadUserInfo(ctx, repo, UserInfo.DB.Username)
 		return nil
 	}
 
@@ -133,27 +146,11 @@ func GetUserInfo(Username string) UserInfo {
 	// ###
 
 	UserInfo.AddUserToGroup = func(GID int) error {
-		group := GetGroupInfo(GID)
-		// Check if user in group
-		UserInGroup := false
-		for _, g := range UserInfo.DB.Groups {
-			if g.ID == group.DB.ID {
-				// GroupIndex = indx
-				UserInGroup = true
-				break
-			}
-		}
-		if UserInGroup {
-			return fmt.Errorf("user already in group")
+		group := LoadGroupInfo(ctx, repo, GID)
+		if group.DB.ID == 0 {
+			return ErrGroupNotFound
 		}
-
-		// Add user to group
-		db := dbase.GetDBConn()
-		db.Model(&UserInfo.DB).Association("Groups").Append(&group.DB)
-
-		// Log event
-		dbase.LogServerEvent("UpdateUser:HTTP", "User added to group: "+UserInfo.DB.Username+"\nGroup: "+group.DB.Name, "INFO")
-		return nil
+		return repo.AddUserToGroup(ctx, UserInfo.DB, group.DB)
 	}
 
 	// ###
@@ -162,9 +159,9 @@ func GetUserInfo(Username string) UserInfo {
 
 	UserInfo.GenerateAPIKey = func(desc string) error {
 		// Generate API Key
-		APIKey, err := dbase.CreateAPIKey(UserInfo.DB, desc)
-		if APIKey == nil {
-			dbase.LogServerError("UserInfo:GenerateAPIKey", err, "Error generating API Key for user: "+UserInfo.DB.Username)
+		_, err := repo.CreateAPIKey(ctx, UserInfo.DB, desc)
+		if err != nil {
+			dbase.LogServerErrorContext(ctx, "UserInfo:GenerateAPIKey", err, "Error generating API Key for user: "+UserInfo.DB.Username)
 			return fmt.Errorf("error generating API Key")
 		}
 		return nil
@@ -177,6 +174,44 @@ func GetUserInfo(Username string) UserInfo {
 	return UserInfo
 }
 
+// loadUser loads a user, including deleted users, with the API keys, groups
+// and security points needed to evaluate its security points
+func loadUser(db *gorm.DB, Username string) (dbase.User, error) {
+	var DBUser dbase.User
+	err := db.
+		Unscoped().
+		Preload("UserAddSecPoints").
+		Preload("UserDelSecPoints").
+		Preload("UserOvrSecPoints").
+		Preload("APIKeys").
+		Preload("Groups").
+		Preload("Groups.AddSecPoints").
+		Preload("Groups.DelSecPoints").
+		Preload("Groups.OvrSecPoints").
+		Where("Username = ?", Username).Find(&DBUser).Error
+	return DBUser, err
+}
+
+// RateLimitExempt returns the check of whether a user in repo holds the
+// RateLimitExempt security point, or is a superuser. Unlike SPCheck it logs no
+// server event, as it is evaluated for API requests.
+func RateLimitExempt(repo *dbase.Repository) func(ctx context.Context, Username string) (bool, error) {
+	return func(ctx context.Context, Username string) (bool, error) {
+		DBUser, err := loadUser(repo.DB().WithContext(ctx), Username)
+		if err != nil {
+			return false, err
+		}
+		if DBUser.ID == 0 {
+			return false, fmt.Errorf("%w: %v", dbase.ErrUserNotFound, Username)
+		}
+
+		SecPoints := enumSecurityPoints(DBUser)
+		_, exempt := SecPoints[SPRateLimitExempt]
+		_, superuser := SecPoints[1]
+		return exempt || superuser, nil
+	}
+}
+
 type EvalSP struct {
 	Group  *dbase.Group `json:"-"`
 	Source string       `json:"source"`
@@ -1,10 +1,15 @@
 package auth
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/gin-gonic/gin"
 	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/metrics"
+	"github.com/javitab/go-web/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -13,38 +18,66 @@ type ValidLoginMode string
 const (
 	WebLogin ValidLoginMode = "web_login"
 	CLILogin ValidLoginMode = "cli_login"
+	// APILogin is the exchange of an API key for a JWT
+	APILogin ValidLoginMode = "api_login"
 )
 
-func UserLogin(input LoginUserInput, login_mode ValidLoginMode, c *gin.Context) (string, error) {
+// UserLogin checks the credentials and login security point of a user in repo
+// and returns a JWT
+func UserLogin(ctx context.Context, repo *dbase.Repository, input LoginUserInput, login_mode ValidLoginMode) (string, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "auth.UserLogin", trace.WithAttributes(
+		attribute.String("auth.mode", string(login_mode)),
+		semconv.EnduserID(input.Username),
+	))
+	defer span.End()
 
 	//Check if user exists
-	userFound := GetUserInfo(input.Username)
+	userFound := LoadUserInfo(ctx, repo, input.Username)
+
+	method := metrics.LoginMethodLocal
+	if userFound.DB.IsLDAPUser {
+		method = metrics.LoginMethodLDAP
+	}
+	record := func(outcome string) {
+		metrics.RecordLogin(string(login_mode), method, outcome)
+		span.SetAttributes(attribute.String("auth.method", method), attribute.String("auth.outcome", outcome))
+	}
 
 	if userFound.DB.Username == "" {
-		dbase.LogServerEvent("UserLogin:UserNotFound", "User not found: "+input.Username, "LOGIN")
+		record(metrics.LoginUserNotFound)
+		dbase.LogServerEventContext(ctx, "UserLogin:UserNotFound", "User not found: "+input.Username, "LOGIN")
 		return "", fmt.Errorf(("user not found"))
 	}
 
 	if userFound.DB.DeletedAt.Valid {
-		dbase.LogServerEvent("UserLogin:UserDeleted", "User deleted: "+input.Username, "LOGIN")
+		record(metrics.LoginUserDeleted)
+		dbase.LogServerEventContext(ctx, "UserLogin:UserDeleted", "User deleted: "+input.Username, "LOGIN")
 		return "", fmt.Errorf("user deleted")
 	}
 
 	if userFound.DB.IsLDAPUser {
-		// Check if user in LDAP
-		if exists := LDAPUserExists(userFound.DB.Username); exists {
-			// Check password against LDAP if user exists
-			authenticated, err := LDAPAuth(input)
-			if (!authenticated) && (err != nil) {
-				dbase.LogServerEvent("UserLogin:InvalidLDAPPassword", fmt.Sprintf("Invalid password for user: %v", input.Username), "LOGIN")
-				return "", fmt.Errorf("invalid ldap password")
-			}
-			LDAPEvalGroups(userFound)
+		// LDAP users missing from the directory cannot authenticate
+		if exists := LDAPUserExists(ctx, userFound.DB.Username); !exists {
+			record(metrics.LoginUserNotFound)
+			dbase.LogServerEventContext(ctx, "UserLogin:LDAPUserNotFound", "User not found in LDAP: "+input.Username, "LOGIN")
+			return "", fmt.Errorf("user not found in ldap")
+		}
+		// Check password against LDAP
+		authenticated, err := LDAPAuth(ctx, input)
+		if (!authenticated) && (err != nil) {
+			record(metrics.LoginInvalidPassword)
+			dbase.LogServerEventContext(ctx, "UserLogin:InvalidLDAPPassword", fmt.Sprintf("Invalid password for user: %v", input.Username), "LOGIN")
+			return "", fmt.Errorf("invalid ldap password")
 		}
+		LDAPEvalGroups(ctx, repo, userFound)
+
+		// Reload user so security points reflect LDAP-synced groups
+		userFound = LoadUserInfo(ctx, repo, userFound.DB.Username)
 	} else {
 		//Check password against database if user does not exist
 		if err := bcrypt.CompareHashAndPassword([]byte(userFound.DB.Password), []byte(input.Password)); err != nil {
-			dbase.LogServerEvent("UserLogin:InvalidPassword", "Invalid password for user: "+input.Username, "LOGIN")
+			record(metrics.LoginInvalidPassword)
+			dbase.LogServerEventContext(ctx, "UserLogin:InvalidPassword", "Invalid password for user: "+input.Username, "LOGIN")
 			return "", fmt.Errorf("invalid user password")
 		}
 	}
@@ -54,12 +87,14 @@ func UserLogin(input LoginUserInput, login_mode ValidLoginMode, c *gin.Context)
 	switch login_mode {
 	case CLILogin:
 		if !userFound.SPCheck(4) {
-			dbase.LogServerEvent("UserLogin:Unauthorized", "User not authorized for CLI login: "+input.Username, "LOGIN")
+			record(metrics.LoginUnauthorized)
+			dbase.LogServerEventContext(ctx, "UserLogin:Unauthorized", "User not authorized for CLI login: "+input.Username, "LOGIN")
 			return "", fmt.Errorf("unauthorized login: missing Security Point 4")
 		}
 	case WebLogin:
 		if !userFound.SPCheck(5) {
-			dbase.LogServerEvent("UserLogin:Unauthorized", "User not authorized for Web login: "+input.Username, "LOGIN")
+			record(metrics.LoginUnauthorized)
+			dbase.LogServerEventContext(ctx, "UserLogin:Unauthorized", "User not authorized for Web login: "+input.Username, "LOGIN")
 			return "", fmt.Errorf("unauthorized login: missing Security Point 5")
 
 		}
@@ -69,10 +104,12 @@ func UserLogin(input LoginUserInput, login_mode ValidLoginMode, c *gin.Context)
 	// Generate JWT
 	token, err := dbase.GenerateJWT(userFound.DB.Username)
 	if err != nil {
-		dbase.LogServerError("UserLogin:ErrorGeneratingToken", err, "Error generating token for user: "+input.Username)
+		record(metrics.LoginError)
+		dbase.LogServerErrorContext(ctx, "UserLogin:ErrorGeneratingToken", err, "Error generating token for user: "+input.Username)
 		return "", fmt.Errorf("unable to generate token")
 	}
 
-	dbase.LogServerEvent("UserLogin:UserLoggedIn", "User logged in: "+input.Username, "LOGIN")
+	record(metrics.LoginSuccess)
+	dbase.LogServerEventContext(ctx, "UserLogin:UserLoggedIn", "User logged in: "+input.Username, "LOGIN")
 	return token, nil
 }
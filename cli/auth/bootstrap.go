@@ -0,0 +1,246 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/javitab/go-web/cli/command"
+	dbase "github.com/javitab/go-web/database"
+	"golang.org/x/term"
+)
+
+// Environment variables of unattended installs, used for flags that are
+// not set
+const (
+	EnvSuperuserUsername  = "SUPERUSER_USERNAME"
+	EnvSuperuserFirstName = "SUPERUSER_FIRST_NAME"
+	EnvSuperuserLastName  = "SUPERUSER_LAST_NAME"
+	EnvSuperuserEmail     = "SUPERUSER_EMAIL"
+	EnvSuperuserLDAP      = "SUPERUSER_LDAP"
+	EnvSuperuserPassword  = "SUPERUSER_PASSWORD"
+)
+
+// ExecCreateSuperuser runs the create_superuser mode and returns its exit
+// code. It needs no login and only runs while the database has no users.
+func ExecCreateSuperuser(args []string) int {
+	return createSuperuser(context.Background(), args, os.Getenv, os.Stdin, os.Stdout, os.Stderr)
+}
+
+func createSuperuser(ctx context.Context, args []string, getenv func(string) string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	var input dbase.NewUser
+	fs := flag.NewFlagSet("create_superuser", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&input.Username, "username", getenv(EnvSuperuserUsername), "username, or "+EnvSuperuserUsername)
+	fs.StringVar(&input.FirstName, "first-name", getenv(EnvSuperuserFirstName), "first name, or "+EnvSuperuserFirstName)
+	fs.StringVar(&input.LastName, "last-name", getenv(EnvSuperuserLastName), "last name, or "+EnvSuperuserLastName)
+	fs.StringVar(&input.Email, "email", getenv(EnvSuperuserEmail), "email address, or "+EnvSuperuserEmail)
+	ldapDefault, _ := strconv.ParseBool(getenv(EnvSuperuserLDAP))
+	fs.BoolVar(&input.IsLDAPUser, "ldap", ldapDefault, "authenticate against LDAP, no password is read, or "+EnvSuperuserLDAP)
+	if err := fs.Parse(args); err != nil {
+		return command.ExitUsage
+	}
+
+	fail := func(err error) int {
+		fmt.Fprintf(stderr, "Error while creating superuser: %v\n", err)
+		return command.ExitCode(err)
+	}
+
+	// Refuse before prompting, the transaction below checks again
+	repo := dbase.DefaultRepository()
+	hasUsers, err := repo.HasUsers(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	if hasUsers {
+		return fail(fmt.Errorf("%w, use ./go-web user create", dbase.ErrUsersExist))
+	}
+
+	// Prompt for missing values on a terminal
+	secrets := bootstrapSecrets(stdin)
+	if secrets.terminal {
+		reader := bufio.NewReader(stdin)
+		prompt(reader, stderr, "Enter Username: ", &input.Username)
+		prompt(reader, stderr, "Enter FirstName: ", &input.FirstName)
+		prompt(reader, stderr, "Enter LastName: ", &input.LastName)
+		prompt(reader, stderr, "Enter Email: ", &input.Email)
+	}
+	if err := requireFlag("username", input.Username); err != nil {
+		return fail(err)
+	}
+	if err := requireFlag("email", input.Email); err != nil {
+		return fail(err)
+	}
+
+	// LDAP users get a random password so they cannot log in locally
+	if input.IsLDAPUser {
+		input.Password, err = dbase.GenerateRandomString(32)
+	} else if password := getenv(EnvSuperuserPassword); password != "" {
+		input.Password = password
+	} else {
+		input.Password, err = secrets.read("Password: ", true)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	secPoints, err := dbase.LoadSecPointsFromEmbed()
+	if err != nil {
+		return fail(err)
+	}
+	groups, err := dbase.LoadGroupsFromEmbed()
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintln(stderr, "Migrating Groups and SecPoint definitions with the superuser")
+	created, err := repo.BootstrapSuperuser(ctx, input, secPoints, groups)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(stdout, "Created Superuser %v\n", created.Username)
+
+	// The superuser is created either way, a code can be issued later
+	if err := printRecoveryCode(ctx, repo, stdout); err != nil {
+		fmt.Fprintf(stderr, "Error while issuing recovery code, run ./go-web recovery: %v\n", err)
+	}
+	return command.ExitOK
+}
+
+// ExecRecoveryCode runs the recovery mode and returns its exit code. It needs
+// no login but direct database access, like recover.
+func ExecRecoveryCode(args []string) int {
+	return issueRecoveryCode(context.Background(), args, os.Stdout, os.Stderr)
+}
+
+func issueRecoveryCode(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("recovery", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		return command.ExitUsage
+	}
+	if err := printRecoveryCode(ctx, dbase.DefaultRepository(), stdout); err != nil {
+		fmt.Fprintf(stderr, "Error while issuing recovery code: %v\n", err)
+		return command.ExitCode(err)
+	}
+	return command.ExitOK
+}
+
+// printRecoveryCode issues a one-time break-glass recovery code, replacing
+// the unused ones, and prints it
+func printRecoveryCode(ctx context.Context, repo *dbase.Repository, w io.Writer) error {
+	code, expiresAt, err := repo.IssueRecoveryCode(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Break-glass recovery code, valid until %v: %v\n", expiresAt.Format(time.RFC3339), code)
+	return nil
+}
+
+// ExecRecover runs the recover mode and returns its exit code. It needs no
+// login but a recovery code issued by create_superuser or recovery.
+func ExecRecover(args []string) int {
+	return recoverSuperuser(context.Background(), args, os.Stdin, os.Stdout, os.Stderr)
+}
+
+func recoverSuperuser(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("recover", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	username := fs.String("username", "", "user to restore superuser access for")
+	if err := fs.Parse(args); err != nil {
+		return command.ExitUsage
+	}
+
+	fail := func(err error) int {
+		fmt.Fprintf(stderr, "Error while recovering superuser: %v\n", err)
+		return command.ExitCode(err)
+	}
+	if err := requireFlag("username", *username); err != nil {
+		return fail(err)
+	}
+
+	// The code and password are read from the terminal or from the first
+	// two lines of stdin
+	secrets := bootstrapSecrets(stdin)
+	code, err := secrets.read("Recovery code: ", false)
+	if err != nil {
+		return fail(err)
+	}
+	password, err := secrets.read("New password: ", true)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := dbase.DefaultRepository().RecoverSuperuser(ctx, code, *username, password, operator()); err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(stdout, "Recovered superuser access for %v\n", *username)
+	return command.ExitOK
+}
+
+// secretSource reads secrets from the terminal without echo, or from
+// successive lines of stdin
+type secretSource struct {
+	terminal bool
+	stdin    func(prompt string) (string, error)
+}
+
+func bootstrapSecrets(stdin io.Reader) secretSource {
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		return secretSource{terminal: true}
+	}
+	return secretSource{stdin: StdinSecret(stdin)}
+}
+
+// read reads a secret, asking twice on a terminal when confirm is set
+func (s secretSource) read(prompt string, confirm bool) (string, error) {
+	var secret string
+	var err error
+	if s.terminal {
+		secret, err = TerminalSecret(prompt)
+		if err == nil && confirm {
+			var again string
+			if again, err = TerminalSecret("Confirm " + strings.ToLower(prompt)); err == nil && again != secret {
+				err = errors.New("passwords do not match")
+			}
+		}
+	} else {
+		secret, err = s.stdin(prompt)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret: %w", err)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("%w: empty secret", command.ErrUsage)
+	}
+	return secret, nil
+}
+
+// prompt reads a line into value unless it is already set
+func prompt(reader *bufio.Reader, w io.Writer, label string, value *string) {
+	if *value != "" {
+		return
+	}
+	fmt.Fprint(w, label)
+	line, _ := reader.ReadString('\n')
+	*value = strings.TrimSpace(line)
+}
+
+// operator names the OS user running a recovery for the audit event
+func operator() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
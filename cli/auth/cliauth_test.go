@@ -1,12 +1,274 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	auth "github.com/javitab/go-web/auth"
+	"github.com/javitab/go-web/cli/command"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/service"
+	test_suite "github.com/javitab/go-web/tests"
 	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
 )
 
 func TestCLIAuthModule(t *testing.T) {
 
 	assert.Equal(t, true, true)
 }
+
+// execute runs a command as username with stdin supplying secrets
+func execute(username string, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	env := command.Env{User: auth.GetUserInfo(username), Repo: dbase.DefaultRepository(), Secret: StdinSecret(strings.NewReader(stdin))}
+	code := Commands.Execute(args, env, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	// Create a user, reading the password from stdin
+	code, stdout, stderr := execute("testuser", "scripted-password\n",
+		"user", "create", "--username", "scripted", "--first-name", "Script", "--last-name", "User",
+		"--email", "scripted@test.com", "--json")
+	assert.Equal(t, command.ExitOK, code, stderr)
+	var created UserResult
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &created))
+	assert.Equal(t, "scripted", created.Username)
+	assert.True(t, created.IsActive)
+	assert.Empty(t, created.Groups)
+
+	// Login tests read the password from stdin
+	code, stdout, _ = execute("testuser", "password\n", "user", "login-test", "--username", "testuser", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	assert.Contains(t, stdout, `"valid": true`)
+	code, _, _ = execute("testuser", "wrong\n", "user", "login-test", "--username", "testuser")
+	assert.Equal(t, command.ExitDenied, code)
+
+	code, _, stderr = execute("testuser", "password\n",
+		"user", "create", "--username", "scripted", "--email", "other@test.com")
+	assert.Equal(t, command.ExitError, code)
+	assert.Contains(t, stderr, "user already exists")
+
+	code, _, _ = execute("testuser", "", "user", "create", "--email", "missing@test.com")
+	assert.Equal(t, command.ExitUsage, code)
+
+	// Users without the security point of a command are denied
+	code, _, stderr = execute("scripted", "", "group", "add-member", "--username", "scripted", "--group", "User Group")
+	assert.Equal(t, command.ExitDenied, code)
+	assert.Contains(t, stderr, "missing security point 7")
+	code, _, stderr = execute("scripted", "password\n", "user", "login-test", "--username", "testuser")
+	assert.Equal(t, command.ExitDenied, code)
+	assert.Contains(t, stderr, "missing security point 17")
+
+	// Only their own password, unless they hold SetUserPassword
+	code, _, stderr = execute("scripted", "taken-over\n", "user", "set-password", "--username", "testuser")
+	assert.Equal(t, command.ExitDenied, code)
+	assert.Contains(t, stderr, "missing security point 16")
+	code, _, stderr = execute("scripted", "new-password\n", "user", "set-password", "--username", "scripted")
+	assert.Equal(t, command.ExitOK, code, stderr)
+
+	// Groups are referenced by name or ID
+	code, stdout, stderr = execute("testuser", "", "group", "add-member", "--username", "scripted", "--group", "User Group", "--output", "yaml")
+	assert.Equal(t, command.ExitOK, code, stderr)
+	assert.Equal(t, "username: scripted\ngroup: User Group\nmember: true\n", stdout)
+
+	code, _, stderr = execute("testuser", "", "group", "add-member", "--username", "scripted", "--group", "2")
+	assert.Equal(t, command.ExitError, code)
+	assert.Contains(t, stderr, "user already in group")
+
+	code, _, _ = execute("testuser", "", "group", "add-member", "--username", "scripted", "--group", "No Such Group")
+	assert.Equal(t, command.ExitNotFound, code)
+
+	code, stdout, _ = execute("testuser", "", "user", "check-sp", "--username", "scripted", "--spid", "5")
+	assert.Equal(t, command.ExitOK, code)
+	assert.Contains(t, stdout, "scripted  5     true     User Group:AddSecPoints")
+
+	code, stdout, _ = execute("testuser", "", "user", "get", "--username", "scripted", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	var fetched UserResult
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &fetched))
+	assert.Equal(t, []string{"User Group"}, fetched.Groups)
+	assert.Equal(t, []service.SecPointGrant{
+		{ID: 3, Name: "CreateAPIKey", Source: "User Group:AddSecPoints"},
+		{ID: 5, Name: "WebLogin", Source: "User Group:AddSecPoints"},
+	}, fetched.SecurityPoints)
+
+	code, _, _ = execute("testuser", "", "user", "get", "--username", "nobody")
+	assert.Equal(t, command.ExitNotFound, code)
+
+	// User-level security points
+	code, _, stderr = execute("testuser", "", "user", "add-sp", "--username", "scripted", "--spid", "11")
+	assert.Equal(t, command.ExitOK, code, stderr)
+	code, _, _ = execute("testuser", "", "user", "add-sp", "--username", "scripted", "--spid", "11", "--field", "all")
+	assert.Equal(t, command.ExitUsage, code)
+	code, stdout, _ = execute("testuser", "", "secpoint", "get", "--spid", "11", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	assert.Contains(t, stdout, `"name": "ViewMetrics"`)
+	code, _, _ = execute("testuser", "", "secpoint", "get", "--spid", "999")
+	assert.Equal(t, command.ExitNotFound, code)
+
+	// Membership changes and deletion
+	code, stdout, stderr = execute("testuser", "", "group", "remove-member", "--username", "scripted", "--group", "User Group", "--json")
+	assert.Equal(t, command.ExitOK, code, stderr)
+	assert.Contains(t, stdout, `"member": false`)
+
+	code, _, stderr = execute("testuser", "", "user", "delete", "--username", "testuser", "--reason", "test")
+	assert.Equal(t, command.ExitUsage, code)
+	assert.Contains(t, stderr, "cannot delete self")
+
+	code, stdout, _ = execute("testuser", "", "user", "delete", "--username", "scripted", "--reason", "INC-1", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	assert.Contains(t, stdout, `"is_active": false`)
+
+	code, stdout, _ = execute("testuser", "", "user", "list", "--search", "SCRIPT", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	assert.Equal(t, "[]\n", stdout)
+	code, stdout, _ = execute("testuser", "", "user", "list", "--search", "SCRIPT", "--deleted", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	var users UserList
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &users))
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "scripted", users[0].Username)
+		assert.False(t, users[0].IsActive)
+	}
+
+	// API keys are listed without the key and revoked by ID
+	code, stdout, _ = execute("testuser", "", "apikey", "create", "--description", "ci", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	var key APIKeyResult
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &key))
+	code, stdout, _ = execute("testuser", "", "apikey", "list", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	assert.NotContains(t, stdout, key.Key)
+	var keys APIKeyList
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &keys))
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, key.Key[len(key.Key)-4:], keys[0].Suffix)
+		code, _, stderr = execute("testuser", "", "apikey", "revoke", "--id", fmt.Sprint(keys[0].ID))
+		assert.Equal(t, command.ExitOK, code, stderr)
+		code, _, _ = execute("testuser", "", "apikey", "revoke", "--id", fmt.Sprint(keys[0].ID))
+		assert.Equal(t, command.ExitNotFound, code)
+	}
+	code, _, _ = execute("testuser", "", "apikey", "revoke")
+	assert.Equal(t, command.ExitUsage, code)
+
+	code, stdout, _ = execute("testuser", "", "secpoint", "list")
+	assert.Equal(t, command.ExitOK, code)
+	assert.Contains(t, stdout, "ViewMetrics")
+
+	code, stdout, _ = execute("testuser", "", "group", "list", "--json")
+	assert.Equal(t, command.ExitOK, code)
+	var groups GroupList
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &groups))
+	assert.Equal(t, "Admin Group", groups[0].Name)
+	assert.Contains(t, groups[0].AddSecPoints, uint(6))
+}
+
+func TestImportExportCommands(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "users.csv")
+	assert.NoError(t, os.WriteFile(file, []byte("username,email,groups\nimported,imported@test.com,User Group\n"), 0o600))
+
+	code, stdout, stderr := execute("testuser", "", "user", "import", "--file", file, "--dry-run")
+	assert.Equal(t, command.ExitOK, code, stderr)
+	assert.Contains(t, stdout, "imported  create")
+	_, err := dbase.DefaultRepository().GetUser(context.Background(), "imported")
+	assert.ErrorIs(t, err, dbase.ErrUserNotFound)
+
+	code, stdout, stderr = execute("testuser", "", "user", "import", "--file", file, "--json")
+	assert.Equal(t, command.ExitOK, code, stderr)
+	var report ImportResult
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &report))
+	assert.Equal(t, 1, report.Created)
+
+	// Row errors are reported on stderr
+	assert.NoError(t, os.WriteFile(file, []byte("username,email\nbroken,\n"), 0o600))
+	code, _, stderr = execute("testuser", "", "user", "import", "--file", file)
+	assert.Equal(t, command.ExitError, code)
+	assert.Contains(t, stderr, "row 2 (broken): email is required")
+
+	code, _, _ = execute("testuser", "", "user", "import", "--file", filepath.Join(dir, "users.txt"))
+	assert.Equal(t, command.ExitUsage, code)
+	code, _, _ = execute("imported", "", "user", "export", "--file", filepath.Join(dir, "denied.yaml"))
+	assert.Equal(t, command.ExitDenied, code)
+
+	// Exports are only readable by the owner
+	export := filepath.Join(dir, "export.yaml")
+	code, stdout, stderr = execute("testuser", "", "user", "export", "--file", export)
+	assert.Equal(t, command.ExitOK, code, stderr)
+	assert.Contains(t, stdout, "Exported 2 users")
+	info, err := os.Stat(export)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	data, _ := os.ReadFile(export)
+	assert.Contains(t, string(data), "- username: imported\n")
+
+	code, stdout, _ = execute("testuser", "", "user", "import", "--file", export, "--output", "yaml")
+	assert.Equal(t, command.ExitOK, code)
+	assert.Contains(t, stdout, "unchanged: 2")
+}
+
+func TestCreateSuperuser(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		env := map[string]string{EnvSuperuserUsername: "admin", EnvSuperuserFirstName: "Ada"}
+		getenv := func(key string) string { return env[key] }
+		run := func(stdin string, args ...string) (int, string, string) {
+			var stdout, stderr bytes.Buffer
+			code := createSuperuser(ctx, args, getenv, strings.NewReader(stdin), &stdout, &stderr)
+			return code, stdout.String(), stderr.String()
+		}
+
+		// Flags are required without a terminal to prompt on
+		code, _, stderr := run("password\n")
+		assert.Equal(t, command.ExitUsage, code)
+		assert.Contains(t, stderr, "--email is required")
+
+		// Flags override the environment, the password is read from stdin
+		code, stdout, stderr := run("bootstrap-password\n", "--email", "admin@test.com", "--last-name", "Admin")
+		assert.Equal(t, command.ExitOK, code, stderr)
+		assert.True(t, strings.HasPrefix(stdout, "Created Superuser admin\nBreak-glass recovery code, valid until "), stdout)
+		bootstrapCode := stdout[strings.LastIndex(stdout, " ")+1 : len(stdout)-1]
+		user := auth.GetUserInfo("admin")
+		assert.Equal(t, "Ada", user.DB.FirstName)
+		assert.True(t, user.SPCheck(2))
+		_, err := auth.UserLogin(ctx, dbase.DefaultRepository(), auth.LoginUserInput{Username: "admin", Password: "bootstrap-password"}, auth.CLILogin)
+		assert.NoError(t, err)
+
+		// Refused once a user exists
+		code, _, stderr = run("password\n", "--username", "second", "--email", "second@test.com")
+		assert.Equal(t, command.ExitDenied, code)
+		assert.Contains(t, stderr, "users already exist")
+
+		// Break-glass recovery reads the code and password from stdin
+		var out, errOut bytes.Buffer
+		assert.Equal(t, command.ExitDenied, recoverSuperuser(ctx, []string{"--username", "admin"}, strings.NewReader("wrong\nnew-password\n"), &out, &errOut))
+
+		// recovery replaces the code printed at bootstrap
+		assert.Equal(t, command.ExitOK, issueRecoveryCode(ctx, nil, &out, &errOut), errOut.String())
+		assert.True(t, strings.HasPrefix(out.String(), "Break-glass recovery code, valid until "), out.String())
+		recoveryCode := strings.TrimSpace(out.String()[strings.LastIndex(out.String(), " ")+1:])
+		assert.NotEqual(t, bootstrapCode, recoveryCode)
+		assert.Equal(t, command.ExitDenied, recoverSuperuser(ctx, []string{"--username", "admin"}, strings.NewReader(bootstrapCode+"\nnew-password\n"), &out, &errOut))
+		assert.Equal(t, command.ExitUsage, issueRecoveryCode(ctx, []string{"--username", "admin"}, &out, &errOut))
+		out.Reset()
+		errOut.Reset()
+		assert.Equal(t, command.ExitOK, recoverSuperuser(ctx, []string{"--username", "admin"}, strings.NewReader(recoveryCode+"\nnew-password\n"), &out, &errOut), errOut.String())
+		assert.Equal(t, "Recovered superuser access for admin\n", out.String())
+		_, err = auth.UserLogin(ctx, dbase.DefaultRepository(), auth.LoginUserInput{Username: "admin", Password: "new-password"}, auth.CLILogin)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,430 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/javitab/go-web/cli/command"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/service"
+)
+
+// Commands are the user, group, security point and LDAP commands. The
+// interactive utility menu runs the same commands, prompting for their flags.
+var Commands = command.Registry{
+	// ### ###
+	// ### ### User Commands
+	// ### ###
+	{
+		Group: "user", Name: "create", Summary: "Create a user, the password is read from stdin",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			var input dbase.NewUser
+			fs.StringVar(&input.Username, "username", "", "username of the new user")
+			fs.StringVar(&input.FirstName, "first-name", "", "first name")
+			fs.StringVar(&input.LastName, "last-name", "", "last name")
+			fs.StringVar(&input.Email, "email", "", "email address")
+			fs.BoolVar(&input.IsLDAPUser, "ldap", false, "authenticate the user against LDAP, no password is read")
+			return func(env command.Env) (any, error) {
+				user, err := env.Service().CreateUser(input, env.SecretFor("Password: "))
+				return UserResult(user), err
+			}
+		},
+	},
+	{
+		Group: "user", Name: "get", Summary: "Show a user and its effective security points",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			return func(env command.Env) (any, error) {
+				user, err := env.Service().GetUser(*username)
+				return UserResult(user), err
+			}
+		},
+	},
+	{
+		Group: "user", Name: "list", Summary: "List users, optionally matching a search",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			search := fs.String("search", "", "part of the username, name or email")
+			deleted := fs.Bool("deleted", false, "include soft deleted users")
+			return func(env command.Env) (any, error) {
+				users, err := env.Service().ListUsers(*search, *deleted)
+				return UserList(users), err
+			}
+		},
+	},
+	{
+		Group: "user", Name: "delete", Summary: "Soft delete a user",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			reason := fs.String("reason", "", "reason for the deletion (incident #, etc.)")
+			return func(env command.Env) (any, error) {
+				user, err := env.Service().DeleteUser(*username, *reason)
+				return UserResult(user), err
+			}
+		},
+	},
+	{
+		Group: "user", Name: "undelete", Summary: "Restore a soft deleted user",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			reason := fs.String("reason", "", "reason for the restore (incident #, etc.)")
+			return func(env command.Env) (any, error) {
+				user, err := env.Service().UndeleteUser(*username, *reason)
+				return UserResult(user), err
+			}
+		},
+	},
+	{
+		Group: "user", Name: "set-password", Summary: "Change the password of a user, read from stdin",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			return func(env command.Env) (any, error) {
+				// Users change their own password, others' need SetUserPassword
+				if err := env.Service().SetPassword(*username, env.SecretFor("New password: ")); err != nil {
+					return nil, err
+				}
+				return Message{Message: "Password changed for " + *username}, nil
+			}
+		},
+	},
+	{
+		Group: "user", Name: "set-ldap", Summary: "Set whether a user authenticates against LDAP",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			isLDAPUser := fs.Bool("ldap", false, "authenticate the user against LDAP")
+			return func(env command.Env) (any, error) {
+				user, err := env.Service().SetLDAPUser(*username, *isLDAPUser)
+				return UserResult(user), err
+			}
+		},
+	},
+	{
+		Group: "user", Name: "check-sp", Summary: "Evaluate a security point for a user",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			spid := fs.Int("spid", 0, "security point ID")
+			return func(env command.Env) (any, error) {
+				check, err := env.Service().CheckSecPoint(*username, *spid)
+				return SecPointCheck(check), err
+			}
+		},
+	},
+	{
+		Group: "user", Name: "add-sp", Summary: "Add a user-level security point",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			spid := fs.Int("spid", 0, "security point ID")
+			field := fs.String("field", "add", "user security point list: add, del or ovr")
+			return func(env command.Env) (any, error) {
+				return updateUserSecPoint(env, *username, *spid, *field, true)
+			}
+		},
+	},
+	{
+		Group: "user", Name: "remove-sp", Summary: "Remove a user-level security point",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			spid := fs.Int("spid", 0, "security point ID")
+			field := fs.String("field", "add", "user security point list: add, del or ovr")
+			return func(env command.Env) (any, error) {
+				return updateUserSecPoint(env, *username, *spid, *field, false)
+			}
+		},
+	},
+	{
+		Group: "user", Name: "import", Summary: "Create or update users from a CSV or YAML file", LocalOnly: true,
+		Flags: func(fs *flag.FlagSet) command.Run {
+			file := fs.String("file", "", "CSV or YAML file of users")
+			format := fs.String("format", "", "file format: csv or yaml, by default from the file extension")
+			dryRun := fs.Bool("dry-run", false, "only validate the file and report the changes")
+			return func(env command.Env) (any, error) {
+				return importUsers(env, *file, *format, *dryRun)
+			}
+		},
+	},
+	{
+		Group: "user", Name: "export", Summary: "Export active users to a CSV or YAML file", LocalOnly: true,
+		Flags: func(fs *flag.FlagSet) command.Run {
+			file := fs.String("file", "", "CSV or YAML file to write, readable by the owner only")
+			format := fs.String("format", "", "file format: csv or yaml, by default from the file extension")
+			return func(env command.Env) (any, error) {
+				return exportUsers(env, *file, *format)
+			}
+		},
+	},
+	{
+		Group: "user", Name: "login-test", Summary: "Test the credentials of a user, the password is read from stdin", LocalOnly: true,
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			return func(env command.Env) (any, error) {
+				login, err := env.Service().TestLogin(*username, env.SecretFor("Password: "))
+				return LoginResult(login), err
+			}
+		},
+	},
+
+	// ### ###
+	// ### ### API Key Commands
+	// ### ###
+	{
+		Group: "apikey", Name: "create", Summary: "Create an API key for the logged in user",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			description := fs.String("description", "", "description of the key usage")
+			return func(env command.Env) (any, error) {
+				key, err := env.Service().CreateAPIKey(*description)
+				return APIKeyResult(key), err
+			}
+		},
+	},
+	{
+		Group: "apikey", Name: "list", Summary: "List the API keys of the logged in user",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			return func(env command.Env) (any, error) {
+				keys, err := env.Service().ListAPIKeys()
+				return APIKeyList(keys), err
+			}
+		},
+	},
+	{
+		Group: "apikey", Name: "revoke", Summary: "Revoke an API key of the logged in user",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			id := fs.Uint("id", 0, "ID of the key, see apikey list")
+			return func(env command.Env) (any, error) {
+				if err := env.Service().RevokeAPIKey(*id); err != nil {
+					return nil, err
+				}
+				return Message{Message: fmt.Sprintf("Revoked API key %v", *id)}, nil
+			}
+		},
+	},
+
+	// ### ###
+	// ### ### Group Commands
+	// ### ###
+	{
+		Group: "group", Name: "list", Summary: "List groups by priority",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			return func(env command.Env) (any, error) {
+				groups, err := env.Service().ListGroups()
+				return GroupList(groups), err
+			}
+		},
+	},
+	{
+		Group: "group", Name: "get", Summary: "Show a group and its security points",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			group := fs.String("group", "", "group name or ID")
+			return func(env command.Env) (any, error) {
+				result, err := env.Service().GetGroup(*group)
+				return GroupResult(result), err
+			}
+		},
+	},
+	{
+		Group: "group", Name: "add-member", Summary: "Add a user to a group",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			group := fs.String("group", "", "group name or ID")
+			return func(env command.Env) (any, error) {
+				membership, err := env.Service().AddGroupMember(*username, *group)
+				return Membership(membership), err
+			}
+		},
+	},
+	{
+		Group: "group", Name: "remove-member", Summary: "Remove a user from a group",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "username of the user")
+			group := fs.String("group", "", "group name or ID")
+			return func(env command.Env) (any, error) {
+				membership, err := env.Service().RemoveGroupMember(*username, *group)
+				return Membership(membership), err
+			}
+		},
+	},
+
+	// ### ###
+	// ### ### Security Point Commands
+	// ### ###
+	{
+		Group: "secpoint", Name: "get", Summary: "Show a security point and the groups referencing it",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			spid := fs.Int("spid", 0, "security point ID")
+			return func(env command.Env) (any, error) {
+				sp, err := env.Service().GetSecPoint(*spid)
+				return SecPointResult(sp), err
+			}
+		},
+	},
+	{
+		Group: "secpoint", Name: "list", Summary: "List security points by ID",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			return func(env command.Env) (any, error) {
+				secPoints, err := env.Service().ListSecPoints()
+				return SecPointList(secPoints), err
+			}
+		},
+	},
+	{
+		Group: "secpoint", Name: "load", Summary: "Load groups and security points, from the embedded definitions by default", LocalOnly: true,
+		Flags: func(fs *flag.FlagSet) command.Run {
+			secPointsFile := fs.String("secpoints-file", "", "security points YAML file, e.g. config/auth/secPoints.yaml")
+			groupsFile := fs.String("groups-file", "", "groups YAML file, e.g. config/auth/groups.yaml")
+			return func(env command.Env) (any, error) {
+				return loadGroupsSecPoints(env, *secPointsFile, *groupsFile)
+			}
+		},
+	},
+
+	// ### ###
+	// ### ### LDAP Commands
+	// ### ###
+	{
+		Group: "ldap", Name: "get-user", Summary: "Look up a user in LDAP",
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "LDAP username")
+			return func(env command.Env) (any, error) {
+				user, err := env.Service().GetLDAPUser(*username)
+				return LDAPUserResult(user), err
+			}
+		},
+	},
+	{
+		Group: "ldap", Name: "login-test", Summary: "Test LDAP credentials, the password is read from stdin", LocalOnly: true,
+		Flags: func(fs *flag.FlagSet) command.Run {
+			username := fs.String("username", "", "LDAP username")
+			return func(env command.Env) (any, error) {
+				login, err := env.Service().TestLDAPLogin(*username, env.SecretFor("Password: "))
+				return LoginResult(login), err
+			}
+		},
+	},
+}
+
+// ### ###
+// ### ### Implementations
+// ### ###
+
+func requireFlag(name string, value string) error {
+	if value == "" {
+		return fmt.Errorf("%w: --%v is required", command.ErrUsage, name)
+	}
+	return nil
+}
+
+// userRecordFormat returns the format flag, or the format of the file
+// extension without one
+func userRecordFormat(file string, format string) (dbase.UserRecordFormat, error) {
+	var recordFormat dbase.UserRecordFormat
+	var err error
+	if format != "" {
+		recordFormat, err = dbase.ParseUserRecordFormat(format)
+	} else {
+		recordFormat, err = dbase.UserRecordFormatFromPath(file)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", command.ErrUsage, err)
+	}
+	return recordFormat, nil
+}
+
+func importUsers(env command.Env, file string, format string, dryRun bool) (ImportResult, error) {
+	if err := requireFlag("file", file); err != nil {
+		return ImportResult{}, err
+	}
+	recordFormat, err := userRecordFormat(file, format)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer f.Close()
+
+	records, err := dbase.ReadUserRecords(f, recordFormat)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	report, err := env.Service().ImportUsers(records, dryRun)
+	return ImportResult(report), err
+}
+
+func exportUsers(env command.Env, file string, format string) (Message, error) {
+	if err := requireFlag("file", file); err != nil {
+		return Message{}, err
+	}
+	recordFormat, err := userRecordFormat(file, format)
+	if err != nil {
+		return Message{}, err
+	}
+	records, err := env.Service().ExportUsers()
+	if err != nil {
+		return Message{}, err
+	}
+
+	// Exports hold personal data, only the owner may read them
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return Message{}, err
+	}
+	if err := dbase.WriteUserRecords(f, recordFormat, records); err != nil {
+		f.Close()
+		return Message{}, err
+	}
+	if err := f.Close(); err != nil {
+		return Message{}, err
+	}
+	return Message{Message: fmt.Sprintf("Exported %v users to %v", len(records), file)}, nil
+}
+
+// secPointFields maps the --field values to user security point lists
+var secPointFields = map[string]string{
+	"add": "UserAddSecPoints",
+	"del": "UserDelSecPoints",
+	"ovr": "UserOvrSecPoints",
+}
+
+func updateUserSecPoint(env command.Env, username string, spid int, field string, add bool) (UserResult, error) {
+	listField, ok := secPointFields[field]
+	if !ok {
+		return UserResult{}, fmt.Errorf("%w: --field must be add, del or ovr", command.ErrUsage)
+	}
+	var user service.User
+	var err error
+	if add {
+		user, err = env.Service().AddUserSecPoint(username, spid, listField)
+	} else {
+		user, err = env.Service().RemoveUserSecPoint(username, spid, listField)
+	}
+	return UserResult(user), err
+}
+
+// loadGroupsSecPoints creates or updates the security points, then the groups
+// referencing them
+func loadGroupsSecPoints(env command.Env, secPointsFile string, groupsFile string) (Message, error) {
+	var secPoints []dbase.SecPoint
+	var groups []dbase.GroupYAML
+	var err error
+	if secPointsFile != "" {
+		secPoints, err = dbase.LoadSecPointsFromYAML(secPointsFile)
+	} else {
+		secPoints, err = dbase.LoadSecPointsFromEmbed()
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	if groupsFile != "" {
+		groups, err = dbase.LoadGroupsFromYAML(groupsFile)
+	} else {
+		groups, err = dbase.LoadGroupsFromEmbed()
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := env.Service().LoadSecPointsAndGroups(secPoints, groups); err != nil {
+		return Message{}, err
+	}
+	return Message{Message: fmt.Sprintf("Loaded %d security points and %d groups", len(secPoints), len(groups))}, nil
+}
@@ -0,0 +1,197 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/javitab/go-web/cli/command"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/service"
+)
+
+// ### ###
+// ### ### Command Results
+// ### ###
+
+// The results of commands are the results of their service operations, with
+// the tables they are printed as
+
+// UserResult is the scriptable form of a user
+type UserResult service.User
+
+func (u UserResult) Table() command.Table {
+	var secPoints []string
+	for _, sp := range u.SecurityPoints {
+		secPoints = append(secPoints, fmt.Sprintf("%v %v (%v)", sp.ID, sp.Name, sp.Source))
+	}
+	return command.Table{
+		Header: []string{"FIELD", "VALUE"},
+		Rows: [][]string{
+			{"username", u.Username},
+			{"first_name", u.FirstName},
+			{"last_name", u.LastName},
+			{"email", u.Email},
+			{"is_ldap_user", fmt.Sprint(u.IsLDAPUser)},
+			{"is_active", fmt.Sprint(u.IsActive)},
+			{"groups", strings.Join(u.Groups, ", ")},
+			{"security_points", strings.Join(secPoints, ", ")},
+			{"add_sec_points", joinIDs(u.AddSecPoints)},
+			{"del_sec_points", joinIDs(u.DelSecPoints)},
+			{"ovr_sec_points", joinIDs(u.OvrSecPoints)},
+		},
+	}
+}
+
+// UserList is the result of listing users
+type UserList []service.UserSummary
+
+func (l UserList) Table() command.Table {
+	table := command.Table{Header: []string{"USERNAME", "NAME", "EMAIL", "LDAP", "ACTIVE", "GROUPS"}}
+	for _, u := range l {
+		table.Rows = append(table.Rows, []string{
+			u.Username, strings.TrimSpace(u.FirstName + " " + u.LastName), u.Email,
+			fmt.Sprint(u.IsLDAPUser), fmt.Sprint(u.IsActive), strings.Join(u.Groups, ", "),
+		})
+	}
+	return table
+}
+
+// GroupResult is the scriptable form of a group
+type GroupResult service.Group
+
+// joinIDs formats security point IDs for tables
+func joinIDs(ids []uint) string {
+	return strings.Trim(fmt.Sprint(ids), "[]")
+}
+
+func (g GroupResult) Table() command.Table {
+	return GroupList{service.Group(g)}.Table()
+}
+
+// GroupList is the result of listing groups
+type GroupList []service.Group
+
+func (l GroupList) Table() command.Table {
+	table := command.Table{Header: []string{"ID", "NAME", "PRIORITY", "LDAP GROUP", "ADD", "DEL", "OVR"}}
+	for _, g := range l {
+		table.Rows = append(table.Rows, []string{
+			fmt.Sprint(g.ID), g.Name, fmt.Sprint(g.Priority), g.LDAPGroup,
+			joinIDs(g.AddSecPoints), joinIDs(g.DelSecPoints), joinIDs(g.OvrSecPoints),
+		})
+	}
+	return table
+}
+
+// SecPointResult is the scriptable form of a security point and the groups
+// referencing it
+type SecPointResult service.SecPoint
+
+func (sp SecPointResult) Table() command.Table {
+	return command.Table{
+		Header: []string{"ID", "TYPE", "NAME", "DESC", "GROUPS"},
+		Rows:   [][]string{{fmt.Sprint(sp.ID), sp.Type, sp.Name, sp.Desc, strings.Join(sp.Groups, ", ")}},
+	}
+}
+
+// SecPointList is the result of listing security points
+type SecPointList []service.SecPoint
+
+func (l SecPointList) Table() command.Table {
+	table := command.Table{Header: []string{"ID", "TYPE", "NAME", "DESC"}}
+	for _, sp := range l {
+		table.Rows = append(table.Rows, []string{fmt.Sprint(sp.ID), sp.Type, sp.Name, sp.Desc})
+	}
+	return table
+}
+
+// SecPointCheck is the outcome of evaluating a security point for a user
+type SecPointCheck service.SecPointCheck
+
+func (c SecPointCheck) Table() command.Table {
+	return command.Table{
+		Header: []string{"USERNAME", "SPID", "GRANTED", "SOURCE"},
+		Rows:   [][]string{{c.Username, fmt.Sprint(c.SPID), fmt.Sprint(c.Granted), c.Source}},
+	}
+}
+
+// Membership is the outcome of a group membership change
+type Membership service.Membership
+
+func (m Membership) Table() command.Table {
+	return command.Table{
+		Header: []string{"USERNAME", "GROUP", "MEMBER"},
+		Rows:   [][]string{{m.Username, m.Group, fmt.Sprint(m.Member)}},
+	}
+}
+
+// APIKeyResult holds a generated API key, which is only shown once
+type APIKeyResult service.APIKey
+
+func (k APIKeyResult) Table() command.Table {
+	return command.Table{
+		Header: []string{"USERNAME", "DESCRIPTION", "API KEY"},
+		Rows:   [][]string{{k.Username, k.Description, k.Key}},
+	}
+}
+
+// APIKeyList is the result of listing API keys
+type APIKeyList []service.APIKeyInfo
+
+func (l APIKeyList) Table() command.Table {
+	table := command.Table{Header: []string{"ID", "DESCRIPTION", "KEY", "CREATED"}}
+	for _, k := range l {
+		table.Rows = append(table.Rows, []string{fmt.Sprint(k.ID), k.Description, "..." + k.Suffix, k.CreatedAt.Format(time.RFC3339)})
+	}
+	return table
+}
+
+// LoginResult is the outcome of a login test
+type LoginResult service.Login
+
+func (l LoginResult) Table() command.Table {
+	return command.Table{
+		Header: []string{"USERNAME", "VALID", "LDAP GROUPS", "TOKEN"},
+		Rows:   [][]string{{l.Username, fmt.Sprint(l.Valid), strings.Join(l.Groups, ", "), l.Token}},
+	}
+}
+
+// LDAPUserResult is the directory entry of a user
+type LDAPUserResult service.LDAPUser
+
+func (u LDAPUserResult) Table() command.Table {
+	return command.Table{
+		Header: []string{"FIELD", "VALUE"},
+		Rows: [][]string{
+			{"username", u.Username},
+			{"first_name", u.FirstName},
+			{"last_name", u.LastName},
+			{"email", u.Email},
+			{"groups", strings.Join(u.Groups, ", ")},
+		},
+	}
+}
+
+// ImportResult is the report of a user import, one row per record
+type ImportResult dbase.UserImportReport
+
+func (r ImportResult) Table() command.Table {
+	table := command.Table{Header: []string{"ROW", "USERNAME", "ACTION", "CHANGES"}}
+	for _, row := range r.Rows {
+		changes := strings.Join(row.Changes, ", ")
+		if row.Error != "" {
+			changes = row.Error
+		}
+		table.Rows = append(table.Rows, []string{fmt.Sprint(row.Row), row.Username, row.Action, changes})
+	}
+	return table
+}
+
+// Message reports the outcome of commands without another result
+type Message struct {
+	Message string `json:"message"`
+}
+
+func (m Message) Table() command.Table {
+	return command.Table{Rows: [][]string{{m.Message}}}
+}
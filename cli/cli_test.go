@@ -1,8 +1,14 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/javitab/go-web/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -10,3 +16,136 @@ func TestCLIModule(t *testing.T) {
 
 	assert.Equal(t, true, true)
 }
+
+func TestSelectCommand(t *testing.T) {
+	registry := UtilityMenus["auth"]
+
+	// Menu numbers follow the sorted groups and commands on every run
+	var first, second bytes.Buffer
+	cmd, ok := selectCommand(registry, bufio.NewReader(strings.NewReader("1\n")), &first)
+	assert.True(t, ok)
+	assert.Equal(t, "apikey create", cmd.Group+" "+cmd.Name)
+	selectCommand(registry, bufio.NewReader(strings.NewReader("1\n")), &second)
+	assert.Equal(t, first.String(), second.String())
+	assert.Contains(t, first.String(), "# 4: group add-member - Add a user to a group\n")
+
+	// The option after the commands and invalid input exit
+	exit := strconv.Itoa(len(registry) + 1)
+	_, ok = selectCommand(registry, bufio.NewReader(strings.NewReader(exit+"\n")), &first)
+	assert.False(t, ok)
+	assert.Contains(t, first.String(), "# "+exit+": Exit\n")
+	_, ok = selectCommand(registry, bufio.NewReader(strings.NewReader("x\n")), &first)
+	assert.False(t, ok)
+}
+
+func TestIsCommand(t *testing.T) {
+	assert.True(t, IsCommand([]string{"user", "create"}))
+	assert.True(t, IsCommand([]string{"group"}))
+	assert.False(t, IsCommand([]string{"util", "auth"}))
+	assert.False(t, IsCommand(nil))
+}
+
+func TestIsRemoteMode(t *testing.T) {
+	remote := config.CLIConfig{Server: "https://go-web.example.com"}
+	assert.True(t, IsRemoteMode(remote, []string{"user", "get"}))
+	assert.True(t, IsRemoteMode(config.CLIConfig{}, []string{"login"}))
+	assert.True(t, IsRemoteMode(remote, []string{"logout"}))
+	assert.False(t, IsRemoteMode(config.CLIConfig{}, []string{"user", "get"}))
+	assert.False(t, IsRemoteMode(remote, []string{"util", "auth"}))
+	assert.False(t, IsRemoteMode(remote, []string{"migrate", "up"}))
+}
+
+func TestComplete(t *testing.T) {
+	ctx := context.Background()
+	values := func(ctx context.Context, flag string) []string {
+		if flag == "username" {
+			return []string{"admin", "testuser"}
+		}
+		return nil
+	}
+	complete := func(words ...string) []string {
+		candidates, files := Complete(ctx, words, values)
+		assert.False(t, files, words)
+		names := make([]string, len(candidates))
+		for i, candidate := range candidates {
+			names[i], _, _ = strings.Cut(candidate, "\t")
+		}
+		return names
+	}
+
+	// Modes and command groups, but not the hidden mode
+	assert.Equal(t, []string{"migrate", "man"}, complete("m"))
+	assert.Contains(t, complete(""), "user")
+	assert.NotContains(t, complete(""), completeMode)
+	assert.Equal(t, []string{"status"}, complete("migrate", "st"))
+	assert.Equal(t, []string{"auth"}, complete("util", ""))
+	assert.Equal(t, completionShells(), complete("completion", ""))
+
+	// Configuration flags precede the mode
+	assert.Contains(t, complete("--http.p"), "--http.port")
+	assert.Contains(t, complete("--http.port", "8080", "us"), "user")
+	_, files := Complete(ctx, []string{"--config", ""}, values)
+	assert.True(t, files)
+
+	// Commands, their flags and flag values
+	assert.Equal(t, []string{"import"}, complete("user", "im"))
+	assert.Equal(t, []string{"--file", "--format"}, complete("user", "import", "--f"))
+	assert.Equal(t, []string{"csv", "yaml"}, complete("user", "import", "--format", ""))
+	assert.Equal(t, []string{"json", "table", "yaml"}, complete("user", "get", "--output", ""))
+	assert.Equal(t, []string{"testuser"}, complete("user", "get", "--username", "t"))
+	assert.Contains(t, complete("user", "get", "--json", ""), "--username")
+	_, files = Complete(ctx, []string{"user", "import", "--file", ""}, values)
+	assert.True(t, files)
+	assert.Empty(t, complete("nogroup", "nocommand", ""))
+}
+
+func TestWriteHelp(t *testing.T) {
+	var buf bytes.Buffer
+	WriteHelp(&buf)
+	help := buf.String()
+
+	// Every mode and command is documented, the help cannot drift
+	for _, mode := range Modes {
+		if mode.Hidden {
+			assert.NotContains(t, help, mode.Name)
+			continue
+		}
+		for _, usage := range mode.Usages {
+			assert.Contains(t, help, mode.usageLine(usage))
+		}
+	}
+	for _, group := range Commands.Groups() {
+		for _, cmd := range Commands.Commands(group) {
+			assert.Contains(t, help, cmd.Name+strings.Repeat(" ", 16-len(cmd.Name))+" "+cmd.Summary)
+		}
+	}
+	assert.NotContains(t, help, "production mode")
+}
+
+func TestCompletionScript(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		script, err := CompletionScript(shell)
+		assert.NoError(t, err, shell)
+		assert.Contains(t, script, completeMode, shell)
+		assert.Contains(t, script, fileDirective, shell)
+	}
+	_, err := CompletionScript("tcsh")
+	assert.Error(t, err)
+}
+
+func TestWriteManPage(t *testing.T) {
+	var buf bytes.Buffer
+	WriteManPage(&buf)
+	page := buf.String()
+
+	assert.True(t, strings.HasPrefix(page, ".TH GO-WEB 1 "))
+	assert.Contains(t, page, `\fBuser import\fR`)
+	assert.Contains(t, page, `\fB\-\-dry\-run\fR`)
+	assert.Contains(t, page, `\fB\-\-http.port\fR, \fBHTTP_PORT\fR`)
+	for _, line := range strings.Split(page, "\n") {
+		// Only the macros may start a line with a dot
+		if strings.HasPrefix(line, ".") {
+			assert.Regexp(t, `^\.(TH|SH|TP|IP|RS|RE|B|I|br)( |$)`, line)
+		}
+	}
+}
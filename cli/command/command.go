@@ -0,0 +1,256 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/service"
+)
+
+// Exit codes of non-interactive commands
+const (
+	ExitOK       = 0
+	ExitError    = 1
+	ExitUsage    = 2
+	ExitDenied   = 3
+	ExitNotFound = 4
+)
+
+var (
+	ErrUsage = errors.New("invalid usage")
+	// ErrDenied and ErrNotFound are the errors of the service operations
+	// commands run
+	ErrDenied   = service.ErrDenied
+	ErrNotFound = service.ErrNotFound
+)
+
+// Env is what a command runs with
+type Env struct {
+	Ctx context.Context
+	// User is the logged in user the command runs as
+	User auth.UserInfo
+	// Repo is the database the command reads and writes
+	Repo *dbase.Repository
+	// Secret reads a secret such as a password, which is never passed as a
+	// flag. Non-interactive commands read it from stdin, the interactive mode
+	// prompts for it without echo.
+	Secret func(prompt string) (string, error)
+}
+
+// Service returns the service running operations as the logged in user
+func (env Env) Service() *service.Service {
+	return service.New(env.Ctx, env.Repo, env.User)
+}
+
+// SecretFor returns the Secret of an operation, read from env.Secret with
+// prompt once the operation asks for it
+func (env Env) SecretFor(prompt string) service.Secret {
+	return func() (string, error) {
+		if env.Secret == nil {
+			return "", fmt.Errorf("no input available for secret")
+		}
+		secret, err := env.Secret(prompt)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret: %w", err)
+		}
+		return secret, nil
+	}
+}
+
+// Run runs a command with its parsed flags and returns the result to print
+type Run func(env Env) (any, error)
+
+// Command is a non-interactive command: ./go-web <Group> <Name> [flags]
+type Command struct {
+	Group   string
+	Name    string
+	Summary string
+	// SecPoint the logged in user needs to run the command, 0 for none
+	SecPoint int
+	// LocalOnly commands are not served over the API, because they read
+	// files of the machine they run on or test credentials without the login
+	// rate limit
+	LocalOnly bool
+	// Flags declares the flags of the command on fs and returns the function
+	// running the command once they are parsed
+	Flags func(fs *flag.FlagSet) Run
+}
+
+// Registry holds the available commands
+type Registry []Command
+
+// Find returns the command of group with the given name
+func (r Registry) Find(group, name string) (Command, bool) {
+	for _, cmd := range r {
+		if cmd.Group == group && cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return Command{}, false
+}
+
+// Groups returns the sorted command groups
+func (r Registry) Groups() []string {
+	seen := map[string]bool{}
+	var groups []string
+	for _, cmd := range r {
+		if !seen[cmd.Group] {
+			seen[cmd.Group] = true
+			groups = append(groups, cmd.Group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// Commands returns the commands of group sorted by name
+func (r Registry) Commands(group string) []Command {
+	var cmds []Command
+	for _, cmd := range r {
+		if cmd.Group == group {
+			cmds = append(cmds, cmd)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// FlagSet returns the flags of cmd, including the output flags shared by all
+// commands, and the function running it once they are parsed
+func (cmd Command) FlagSet(output io.Writer) (*flag.FlagSet, Run) {
+	fs := flag.NewFlagSet(cmd.Group+" "+cmd.Name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.String("output", string(FormatTable), "output format: json, table or yaml")
+	fs.Bool("json", false, "shorthand for --output json")
+	run := cmd.Flags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(output, "Usage: ./go-web %v %v [flags]\n%v\n\nFlags:\n", cmd.Group, cmd.Name, cmd.Summary)
+		fs.PrintDefaults()
+	}
+	return fs, run
+}
+
+// Execute parses args, <group> <name> [flags], runs the command as env.User
+// and writes its result to stdout. Errors are written to stderr and the exit
+// code is returned.
+func (r Registry) Execute(args []string, env Env, stdout, stderr io.Writer) int {
+	inv, code := r.parse(args, stderr)
+	if inv == nil {
+		return code
+	}
+
+	if env.Ctx == nil {
+		env.Ctx = context.Background()
+	}
+	result, err := inv.cmd.Execute(env, inv.run)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return ExitCode(err)
+	}
+	if err := Write(stdout, inv.format, result); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return ExitError
+	}
+	return ExitOK
+}
+
+// invocation is a command with its parsed flags
+type invocation struct {
+	cmd    Command
+	fs     *flag.FlagSet
+	run    Run
+	format Format
+}
+
+// parse finds the command of args and parses its flags, returning nil and
+// the exit code when args are invalid or help was requested
+func (r Registry) parse(args []string, stderr io.Writer) (*invocation, int) {
+	if len(args) < 2 {
+		r.PrintUsage(stderr, args)
+		return nil, ExitUsage
+	}
+	cmd, ok := r.Find(args[0], args[1])
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command: %q\n", args[0]+" "+args[1])
+		r.PrintUsage(stderr, args[:1])
+		return nil, ExitUsage
+	}
+
+	fs, run := cmd.FlagSet(stderr)
+	if err := fs.Parse(args[2:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, ExitOK
+		}
+		return nil, ExitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "Unexpected arguments: %q\n", fs.Args())
+		fs.Usage()
+		return nil, ExitUsage
+	}
+	format, err := ParseFormat(fs.Lookup("output").Value.String())
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return nil, ExitUsage
+	}
+	if fs.Lookup("json").Value.String() == "true" {
+		format = FormatJSON
+	}
+	return &invocation{cmd: cmd, fs: fs, run: run, format: format}, ExitOK
+}
+
+// Execute checks the security point of cmd and runs it
+func (cmd Command) Execute(env Env, run Run) (any, error) {
+	if cmd.SecPoint != 0 {
+		if err := RequireSecPoint(env, cmd.SecPoint); err != nil {
+			return nil, err
+		}
+	}
+	return run(env)
+}
+
+// RequireSecPoint returns ErrDenied unless the logged in user has the
+// security point, for commands checking it depending on their flags
+func RequireSecPoint(env Env, SPID int) error {
+	return env.Service().RequireSecPoint(SPID)
+}
+
+// PrintUsage lists the commands, of args[0] when it names a group
+func (r Registry) PrintUsage(w io.Writer, args []string) {
+	groups := r.Groups()
+	if len(args) > 0 && len(r.Commands(args[0])) > 0 {
+		groups = args[:1]
+	}
+	fmt.Fprintln(w, "Usage: ./go-web <group> <command> [flags]")
+	for _, group := range groups {
+		fmt.Fprintf(w, "\n%v commands:\n", group)
+		for _, cmd := range r.Commands(group) {
+			fmt.Fprintf(w, "     %-16v %v\n", cmd.Name, cmd.Summary)
+		}
+	}
+	fmt.Fprintln(w, "\nRun ./go-web <group> <command> --help for the flags of a command")
+}
+
+// ExitCode maps the error of a command to its exit code
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrUsage), errors.Is(err, service.ErrInvalidInput):
+		return ExitUsage
+	case errors.Is(err, ErrDenied),
+		errors.Is(err, dbase.ErrUsersExist),
+		errors.Is(err, dbase.ErrRecoveryCodeInvalid):
+		return ExitDenied
+	case service.IsNotFound(err):
+		return ExitNotFound
+	default:
+		return ExitError
+	}
+}
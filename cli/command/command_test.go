@@ -0,0 +1,202 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/stretchr/testify/assert"
+)
+
+type greeting struct {
+	Name    string `json:"name"`
+	Enabled string `json:"enabled"`
+}
+
+func (g greeting) Table() Table {
+	return Table{Header: []string{"NAME", "ENABLED"}, Rows: [][]string{{g.Name, g.Enabled}}}
+}
+
+func testRegistry() Registry {
+	return Registry{
+		{
+			Group: "greet", Name: "hello", Summary: "Say hello",
+			Flags: func(fs *flag.FlagSet) Run {
+				name := fs.String("name", "world", "who to greet")
+				loud := fs.Bool("loud", false, "shout")
+				return func(env Env) (any, error) {
+					if *name == "missing" {
+						return nil, fmt.Errorf("%w: %v", dbase.ErrUserNotFound, *name)
+					}
+					return greeting{Name: *name, Enabled: fmt.Sprint(*loud)}, nil
+				}
+			},
+		},
+		{
+			Group: "greet", Name: "admin", Summary: "Needs a security point", SecPoint: 2,
+			Flags: func(fs *flag.FlagSet) Run {
+				return func(env Env) (any, error) { return greeting{Name: "admin"}, nil }
+			},
+		},
+	}
+}
+
+func TestExecute(t *testing.T) {
+	registry := testRegistry()
+	user := auth.UserInfo{SPCheck: func(SPID int) bool { return false }}
+	execute := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := registry.Execute(args, Env{User: user}, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, stdout, _ := execute("greet", "hello", "--name", "go-web", "--json")
+	assert.Equal(t, ExitOK, code)
+	var result greeting
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &result))
+	assert.Equal(t, greeting{Name: "go-web", Enabled: "false"}, result)
+
+	// Strings that read as other YAML types stay strings
+	code, stdout, _ = execute("greet", "hello", "--loud", "--output", "yaml")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "name: world\nenabled: \"true\"\n", stdout)
+
+	code, stdout, _ = execute("greet", "hello")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "NAME   ENABLED\nworld  false\n", stdout)
+
+	code, _, stderr := execute("greet", "hello", "--output", "xml")
+	assert.Equal(t, ExitUsage, code)
+	assert.Contains(t, stderr, "unsupported output format")
+
+	code, _, _ = execute("greet", "hello", "--unknown")
+	assert.Equal(t, ExitUsage, code)
+	code, _, _ = execute("greet", "hello", "extra")
+	assert.Equal(t, ExitUsage, code)
+	code, _, stderr = execute("greet", "bye")
+	assert.Equal(t, ExitUsage, code)
+	assert.Contains(t, stderr, "hello")
+
+	code, stdout, stderr = execute("greet", "admin")
+	assert.Equal(t, ExitDenied, code)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "missing security point 2")
+
+	code, _, _ = execute("greet", "hello", "--name", "missing")
+	assert.Equal(t, ExitNotFound, code)
+
+	code, _, _ = execute("greet", "hello", "--help")
+	assert.Equal(t, ExitOK, code)
+}
+
+func TestRegistryOrder(t *testing.T) {
+	registry := testRegistry()
+	registry = append(registry, Command{Group: "alpha", Name: "one"})
+	assert.Equal(t, []string{"alpha", "greet"}, registry.Groups())
+	commands := registry.Commands("greet")
+	assert.Equal(t, "admin", commands[0].Name)
+	assert.Equal(t, "hello", commands[1].Name)
+}
+
+func TestPrompt(t *testing.T) {
+	cmd, _ := testRegistry().Find("greet", "hello")
+
+	// Flags are prompted in name order, empty answers keep the default
+	var out bytes.Buffer
+	err := cmd.Prompt(Env{}, bufio.NewReader(strings.NewReader("y\n\n")), &out)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out.String(), "world  true\n"), out.String())
+
+	err = cmd.Prompt(Env{}, bufio.NewReader(strings.NewReader("maybe\n")), &out)
+	assert.ErrorIs(t, err, ErrUsage)
+}
+
+func TestExecuteRemote(t *testing.T) {
+	registry := testRegistry()
+	registry = append(registry,
+		Command{
+			Group: "greet", Name: "secret", Summary: "Reads a secret",
+			Flags: func(fs *flag.FlagSet) Run {
+				return func(env Env) (any, error) {
+					secret, err := env.Secret("Secret: ")
+					if err != nil {
+						return nil, err
+					}
+					return greeting{Name: secret}, nil
+				}
+			},
+		},
+		Command{Group: "greet", Name: "local", LocalOnly: true, Flags: func(fs *flag.FlagSet) Run {
+			return func(env Env) (any, error) { return nil, nil }
+		}},
+	)
+	user := auth.UserInfo{SPCheck: func(SPID int) bool { return false }}
+
+	// The server side runs commands as the user of the request
+	var requests []Request
+	send := func(group string, name string, request Request) (Response, error) {
+		requests = append(requests, request)
+		_, response := registry.Serve(Env{User: user}, group, name, request)
+		return response, nil
+	}
+	execute := func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		secret := func(prompt string) (string, error) { return stdin, nil }
+		code := registry.ExecuteRemote(args, send, secret, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, stdout, _ := execute("", "greet", "hello", "--name", "remote", "--json")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "{\n  \"name\": \"remote\",\n  \"enabled\": \"false\"\n}\n", stdout)
+	assert.Equal(t, map[string]string{"name": "remote"}, requests[0].Flags)
+
+	code, stdout, _ = execute("", "greet", "hello", "--loud")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "NAME   ENABLED\nworld  true\n", stdout)
+
+	// Secrets are only sent once the server asks for them
+	requests = nil
+	code, stdout, _ = execute("s3cret", "greet", "secret", "--output", "yaml")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "name: s3cret\nenabled: \"\"\n", stdout)
+	assert.Len(t, requests, 2)
+	assert.Empty(t, requests[0].Secret)
+
+	code, _, stderr := execute("", "greet", "admin")
+	assert.Equal(t, ExitDenied, code)
+	assert.Contains(t, stderr, "missing security point 2")
+
+	code, _, _ = execute("", "greet", "hello", "--name", "missing")
+	assert.Equal(t, ExitNotFound, code)
+
+	code, _, _ = execute("", "greet", "local")
+	assert.Equal(t, ExitUsage, code)
+}
+
+func TestServe(t *testing.T) {
+	registry := testRegistry()
+	user := auth.UserInfo{SPCheck: func(SPID int) bool { return true }}
+
+	status, response := registry.Serve(Env{User: user}, "greet", "hello", Request{Flags: map[string]string{"name": "api", "output": "yaml"}})
+	assert.Equal(t, 200, status)
+	assert.JSONEq(t, `{"name":"api","enabled":"false"}`, string(response.Result))
+	assert.Equal(t, []string{"api", "false"}, response.Table.Rows[0])
+
+	status, response = registry.Serve(Env{User: user}, "greet", "hello", Request{Flags: map[string]string{"unknown": "x"}})
+	assert.Equal(t, 400, status)
+	assert.Equal(t, ExitUsage, response.ExitCode)
+
+	status, _ = registry.Serve(Env{User: user}, "greet", "bye", Request{})
+	assert.Equal(t, 404, status)
+
+	status, response = registry.Serve(Env{User: user}, "greet", "hello", Request{Flags: map[string]string{"name": "missing"}})
+	assert.Equal(t, 404, status)
+	assert.Equal(t, ExitNotFound, response.ExitCode)
+}
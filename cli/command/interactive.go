@@ -0,0 +1,54 @@
+package command
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Prompt runs cmd interactively: it asks for each flag on out, reading the
+// answers from in, then runs the command and prints its table form. Empty
+// answers keep the flag default.
+func (cmd Command) Prompt(env Env, in *bufio.Reader, out io.Writer) error {
+	fs, run := cmd.FlagSet(out)
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "output" || f.Name == "json" {
+			return
+		}
+		fmt.Fprintf(out, "%v (%v) [%v]: ", f.Name, f.Usage, f.DefValue)
+		answer, readErr := in.ReadString('\n')
+		if readErr != nil && !(errors.Is(readErr, io.EOF) && answer != "") {
+			err = readErr
+			return
+		}
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			return
+		}
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+			switch strings.ToLower(answer) {
+			case "y", "yes":
+				answer = "true"
+			case "n", "no":
+				answer = "false"
+			}
+		}
+		if setErr := fs.Set(f.Name, answer); setErr != nil {
+			err = fmt.Errorf("%w: invalid value for %v: %v", ErrUsage, f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	result, err := cmd.Execute(env, run)
+	if err != nil {
+		return err
+	}
+	return Write(out, FormatTable, result)
+}
@@ -0,0 +1,107 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the output format of command results
+type Format string
+
+const (
+	FormatTable Format = "table"
+	FormatJSON  Format = "json"
+	FormatYAML  Format = "yaml"
+)
+
+// ParseFormat validates an --output value
+func ParseFormat(value string) (Format, error) {
+	switch format := Format(strings.ToLower(value)); format {
+	case FormatTable, FormatJSON, FormatYAML:
+		return format, nil
+	}
+	return "", fmt.Errorf("%w: unsupported output format %q, use json, table or yaml", ErrUsage, value)
+}
+
+// Table is the table form of a command result
+type Table struct {
+	Header []string   `json:"header,omitempty"`
+	Rows   [][]string `json:"rows"`
+}
+
+// Tabler is implemented by results with a table form. Results without one
+// are printed as YAML in table output.
+type Tabler interface {
+	Table() Table
+}
+
+// Write writes result to w in format. JSON and YAML share the field names of
+// the JSON tags of result.
+func Write(w io.Writer, format Format, result any) error {
+	if result == nil {
+		return nil
+	}
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case FormatYAML:
+		return writeYAML(w, result)
+	case FormatTable:
+		tabler, ok := result.(Tabler)
+		if !ok {
+			return writeYAML(w, result)
+		}
+		return writeTable(w, tabler.Table())
+	}
+	return fmt.Errorf("unsupported output format %q", format)
+}
+
+// writeYAML converts result through JSON, keeping the field names and order
+// of its JSON form
+func writeYAML(w io.Writer, result any) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// blockStyle clears the flow style and quoting JSON parses into, strings
+// that would read as another type stay quoted
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+func writeTable(w io.Writer, table Table) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if len(table.Header) > 0 {
+		fmt.Fprintln(tw, strings.Join(table.Header, "\t"))
+	}
+	for _, row := range table.Rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,171 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/javitab/go-web/service"
+)
+
+// ErrSecretRequired is returned by Env.Secret of served commands when the
+// request holds no secret, so clients only read one when it is needed
+var ErrSecretRequired = errors.New("secret required")
+
+// Request runs a command over the API
+type Request struct {
+	// Flags of the command by name, output flags are ignored
+	Flags map[string]string `json:"flags"`
+	// Secret answers the Env.Secret prompt of the command
+	Secret string `json:"secret,omitempty"`
+}
+
+// Response is the outcome of a command run over the API
+type Response struct {
+	Result         json.RawMessage `json:"result,omitempty" swaggertype:"object"`
+	Table          *Table          `json:"table,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	ExitCode       int             `json:"exit_code"`
+	SecretRequired bool            `json:"secret_required,omitempty"`
+}
+
+// Serve runs a command for the API as env.User and returns the HTTP status
+// and response. Security points are checked as for local commands.
+func (r Registry) Serve(env Env, group string, name string, request Request) (int, Response) {
+	env.Secret = func(prompt string) (string, error) {
+		if request.Secret == "" {
+			return "", ErrSecretRequired
+		}
+		return request.Secret, nil
+	}
+
+	result, err := r.Run(env, group, name, request.Flags)
+	if err != nil {
+		exitCode := ExitCode(err)
+		if errors.Is(err, ErrUnknownCommand) {
+			exitCode = ExitUsage
+		}
+		return HTTPStatus(err), Response{
+			Error:          err.Error(),
+			ExitCode:       exitCode,
+			SecretRequired: errors.Is(err, ErrSecretRequired),
+		}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return http.StatusInternalServerError, Response{Error: err.Error(), ExitCode: ExitError}
+	}
+	response := Response{Result: data, ExitCode: ExitOK}
+	if tabler, ok := result.(Tabler); ok {
+		table := tabler.Table()
+		response.Table = &table
+	}
+	return http.StatusOK, response
+}
+
+// ErrUnknownCommand is returned by Run for commands that do not exist or are
+// not served
+var ErrUnknownCommand = fmt.Errorf("%w: unknown command", ErrNotFound)
+
+// Run runs a command with its flags by name as env.User, for the API and the
+// web UI. Output flags are ignored and security points are checked as for
+// local commands. LocalOnly commands are not run.
+func (r Registry) Run(env Env, group string, name string, flags map[string]string) (any, error) {
+	cmd, ok := r.Find(group, name)
+	if !ok || cmd.LocalOnly {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCommand, group+" "+name)
+	}
+
+	fs, run := cmd.FlagSet(io.Discard)
+	for flagName, value := range flags {
+		if flagName == "output" || flagName == "json" {
+			continue
+		}
+		if fs.Lookup(flagName) == nil {
+			return nil, fmt.Errorf("%w: unknown flag: %v", ErrUsage, flagName)
+		}
+		if err := fs.Set(flagName, value); err != nil {
+			return nil, fmt.Errorf("%w: invalid value for %v: %v", ErrUsage, flagName, err)
+		}
+	}
+	if env.Ctx == nil {
+		env.Ctx = context.Background()
+	}
+	return cmd.Execute(env, run)
+}
+
+// HTTPStatus maps the error of a command to an HTTP status
+func HTTPStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSecretRequired), errors.Is(err, ErrUsage):
+		return http.StatusBadRequest
+	default:
+		return service.HTTPStatus(err)
+	}
+}
+
+// Send runs a command on a server
+type Send func(group string, name string, request Request) (Response, error)
+
+// ExecuteRemote parses args like Execute and runs the command through send.
+// The secret is only read when the server asks for it.
+func (r Registry) ExecuteRemote(args []string, send Send, secret func(prompt string) (string, error), stdout, stderr io.Writer) int {
+	inv, code := r.parse(args, stderr)
+	if inv == nil {
+		return code
+	}
+	if inv.cmd.LocalOnly {
+		fmt.Fprintf(stderr, "error: %v %v is only available with a database connection\n", inv.cmd.Group, inv.cmd.Name)
+		return ExitUsage
+	}
+
+	request := Request{Flags: map[string]string{}}
+	inv.fs.Visit(func(f *flag.Flag) {
+		if f.Name != "output" && f.Name != "json" {
+			request.Flags[f.Name] = f.Value.String()
+		}
+	})
+	response, err := send(inv.cmd.Group, inv.cmd.Name, request)
+	if err == nil && response.SecretRequired && secret != nil {
+		request.Secret, err = secret("Password: ")
+		if err == nil {
+			response, err = send(inv.cmd.Group, inv.cmd.Name, request)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return ExitCode(err)
+	}
+	if response.ExitCode != ExitOK {
+		fmt.Fprintf(stderr, "error: %v\n", response.Error)
+		return response.ExitCode
+	}
+	if err := Write(stdout, inv.format, remoteResult{response}); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return ExitError
+	}
+	return ExitOK
+}
+
+// remoteResult prints a served result in the format of the local command
+type remoteResult struct {
+	response Response
+}
+
+func (r remoteResult) MarshalJSON() ([]byte, error) {
+	if r.response.Result == nil {
+		return []byte("null"), nil
+	}
+	return r.response.Result, nil
+}
+
+func (r remoteResult) Table() Table {
+	if r.response.Table == nil {
+		return Table{Rows: [][]string{{string(r.response.Result)}}}
+	}
+	return *r.response.Table
+}
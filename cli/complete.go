@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// completeMode is the hidden mode completion scripts call with the words of
+// the command line: ./go-web __complete <words...>
+const completeMode = "__complete"
+
+// fileDirective is printed instead of candidates when the shell should
+// complete file names
+const fileDirective = ":files"
+
+// ValueSource returns the candidates for the value of a flag without fixed
+// values, e.g. the usernames for --username. Candidates may carry a
+// description after a tab.
+type ValueSource func(ctx context.Context, flag string) []string
+
+// flagChoices are the fixed values of command flags
+var flagChoices = map[string][]string{
+	"output": {"json", "table", "yaml"},
+	"format": {"csv", "yaml"},
+	"field":  {"add", "del", "ovr"},
+}
+
+// Complete returns the candidates for the last of words, the arguments after
+// ./go-web, and whether the shell should complete file names instead
+func Complete(ctx context.Context, words []string, values ValueSource) ([]string, bool) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current := words[len(words)-1]
+	candidates, files := complete(ctx, words, values)
+	if files {
+		return nil, true
+	}
+
+	// Only offer candidates starting with the current word
+	var matches []string
+	for _, candidate := range candidates {
+		value, _, _ := strings.Cut(candidate, "\t")
+		if strings.HasPrefix(value, current) {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches, false
+}
+
+func complete(ctx context.Context, words []string, values ValueSource) ([]string, bool) {
+	last := len(words) - 1
+	current := words[last]
+
+	// Configuration flags precede the mode
+	i := 0
+	for i < last && strings.HasPrefix(words[i], "-") {
+		if strings.Contains(words[i], "=") {
+			i++
+			continue
+		}
+		if i+1 == last {
+			// Completing the value of a configuration flag
+			return nil, flagTakesFile(strings.TrimLeft(words[i], "-"))
+		}
+		i += 2
+	}
+	if i == last {
+		if strings.HasPrefix(current, "-") {
+			candidates := []string{"--config"}
+			for _, setting := range config.Settings() {
+				candidates = append(candidates, "--"+setting.Key+"\t"+setting.Usage)
+			}
+			return candidates, false
+		}
+		var candidates []string
+		for _, mode := range Modes {
+			if !mode.Hidden {
+				candidates = append(candidates, mode.Name+"\t"+mode.Summary)
+			}
+		}
+		for _, group := range Commands.Groups() {
+			candidates = append(candidates, group+"\t"+group+" commands")
+		}
+		return candidates, false
+	}
+
+	// Modes complete their own arguments
+	args := words[i:]
+	if mode, ok := FindMode(args[0]); ok {
+		if mode.Complete == nil {
+			return nil, false
+		}
+		return mode.Complete(args[1:]), false
+	}
+
+	// Commands: <group> <command> [flags]
+	group := args[0]
+	if len(args) == 2 {
+		var candidates []string
+		for _, cmd := range Commands.Commands(group) {
+			candidates = append(candidates, cmd.Name+"\t"+cmd.Summary)
+		}
+		return candidates, false
+	}
+	flags := commandFlags(group, args[1])
+	if flags == nil {
+		return nil, false
+	}
+	if previous := args[len(args)-2]; len(args) > 3 && strings.HasPrefix(previous, "-") && !strings.Contains(previous, "=") {
+		name := strings.TrimLeft(previous, "-")
+		for _, f := range flags {
+			if f.Name != name || f.IsBool {
+				continue
+			}
+			if flagTakesFile(name) {
+				return nil, true
+			}
+			if choices, ok := flagChoices[name]; ok {
+				return choices, false
+			}
+			if values != nil {
+				return values(ctx, name), false
+			}
+			return nil, false
+		}
+	}
+	var candidates []string
+	for _, f := range flags {
+		candidates = append(candidates, "--"+f.Name+"\t"+f.Usage)
+	}
+	return candidates, false
+}
+
+// ExecComplete prints the completions of words for the completion scripts.
+// Usernames, group and security point IDs are read from the database when
+// it is reachable, errors only leave them out.
+func ExecComplete(cfg config.Config, words []string, w io.Writer) {
+	candidates, files := Complete(context.Background(), words, databaseValues(cfg))
+	if files {
+		fmt.Fprintln(w, fileDirective)
+		return
+	}
+	for _, candidate := range candidates {
+		fmt.Fprintln(w, candidate)
+	}
+}
+
+// databaseValues completes usernames, group IDs and security point IDs from
+// the configured database, connecting on first use
+func databaseValues(cfg config.Config) ValueSource {
+	return func(ctx context.Context, flag string) []string {
+		if flag != "username" && flag != "group" && flag != "spid" {
+			return nil
+		}
+		if cfg.Database.Driver == "" || cfg.Database.DSN == "" {
+			return nil
+		}
+		// Opening a missing SQLite file would create it
+		if _, err := os.Stat(cfg.Database.DSN); cfg.Database.Driver == dbase.DriverSQLite && err != nil {
+			return nil
+		}
+		dbCfg := dbase.NewDBConfig(cfg.Database)
+		dbCfg.ConnectRetries = 0
+		conn, err := dbase.ConnectDB(dbCfg)
+		if err != nil {
+			return nil
+		}
+		if sqlDB, err := conn.DB(); err == nil {
+			defer sqlDB.Close()
+		}
+
+		// Completion output goes to stdout, keep the query log off it
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		db := conn.Session(&gorm.Session{Logger: logger.Discard, Context: ctx})
+
+		var candidates []string
+		switch flag {
+		case "username":
+			db.Model(&dbase.User{}).Order("username").Pluck("username", &candidates)
+		case "group":
+			var groups []dbase.Group
+			db.Order("id").Find(&groups)
+			for _, group := range groups {
+				candidates = append(candidates, fmt.Sprintf("%v\t%v", group.ID, group.Name))
+			}
+		case "spid":
+			var secPoints []dbase.SecPoint
+			db.Order("id").Find(&secPoints)
+			for _, sp := range secPoints {
+				candidates = append(candidates, fmt.Sprintf("%v\t%v", sp.ID, sp.Name))
+			}
+		}
+		return candidates
+	}
+}
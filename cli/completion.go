@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// completionScripts are the shell completion scripts by shell. They call the
+// hidden __complete mode with the words of the command line, so candidates
+// always follow the modes and command registry of the installed binary.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for go-web
+_go_web() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local out
+	out=$("${COMP_WORDS[0]}" __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null) || return
+	if [[ "$out" == ":files" ]]; then
+		COMPREPLY=($(compgen -f -- "$cur"))
+		compopt -o filenames 2>/dev/null
+		return
+	fi
+	local IFS=$'\n'
+	COMPREPLY=($(printf '%s\n' "$out" | cut -f1))
+}
+complete -F _go_web go-web ./go-web
+`,
+	"zsh": `#compdef go-web
+
+_go-web() {
+	local -a lines candidates
+	lines=("${(@f)$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ "${lines[1]}" == ":files" ]]; then
+		_files
+		return
+	fi
+	local line
+	for line in "${lines[@]}"; do
+		[[ -z "$line" ]] && continue
+		line="${line//:/\\:}"
+		candidates+=("${line/$'\t'/:}")
+	done
+	_describe 'go-web' candidates
+}
+
+if [[ "$funcstack[1]" == "_go-web" ]]; then
+	_go-web "$@"
+else
+	compdef _go-web go-web
+fi
+`,
+	"fish": `# fish completion for go-web
+function __go_web_complete
+	set -l tokens (commandline -opc)
+	set -l cmd $tokens[1]
+	set -e tokens[1]
+	set -l current (commandline -ct)
+	set -l out ($cmd __complete $tokens "$current" 2>/dev/null)
+	if test "$out[1]" = ":files"
+		__fish_complete_path "$current"
+		return
+	end
+	printf '%s\n' $out
+end
+
+complete -c go-web -f -a '(__go_web_complete)'
+`,
+}
+
+// completionShells returns the shells with completion scripts
+func completionShells() []string {
+	shells := make([]string, 0, len(completionScripts))
+	for shell := range completionScripts {
+		shells = append(shells, shell)
+	}
+	sort.Strings(shells)
+	return shells
+}
+
+// CompletionScript returns the completion script of a shell
+func CompletionScript(shell string) (string, error) {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return "", fmt.Errorf("unsupported shell %q, choose one of %v", shell, completionShells())
+	}
+	return script, nil
+}
+
+// ExecCompletion runs the completion mode: ./go-web completion <shell>
+func ExecCompletion(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: ./go-web completion %v\n", completionShells())
+		os.Exit(2)
+	}
+	script, err := CompletionScript(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fmt.Print(script)
+}
@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/javitab/go-web/config"
+)
+
+// ExecConfig runs the config mode: ./go-web config print [--redacted]
+func ExecConfig(cfg config.Config, args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Println("Usage: ./go-web config print [--redacted]")
+		os.Exit(1)
+	}
+
+	redact := false
+	for _, arg := range args[1:] {
+		switch arg {
+		case "--redacted", "-redacted":
+			redact = true
+		default:
+			fmt.Printf("Unknown config print option: %q\n", arg)
+			os.Exit(1)
+		}
+	}
+
+	// Validate before redacting, redacted secrets would fail validation
+	validateErr := cfg.Validate()
+	if redact {
+		cfg = cfg.Redacted()
+	}
+	out, err := cfg.YAML()
+	if err != nil {
+		fmt.Printf("Error rendering configuration: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(string(out))
+
+	// Report validation problems after the configuration they refer to
+	if validateErr != nil {
+		fmt.Println("\n# Invalid configuration:")
+		for _, line := range strings.Split(validateErr.Error(), "\n") {
+			fmt.Printf("#   %v\n", line)
+		}
+		os.Exit(1)
+	}
+}
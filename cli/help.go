@@ -1,35 +1,88 @@
 package cli
 
 import (
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 )
 
 func PrintHelpText() {
-	// Prints available functions
-
-	fmt.Println("\nPrinting Available CLI Arguments")
+	WriteHelp(os.Stdout)
+}
 
-	fmt.Println("./go-web <mode> <menu>")
+// WriteHelp prints the modes, commands and menus. It is generated from Modes
+// and Commands, like the man page and shell completion.
+func WriteHelp(w io.Writer) {
+	fmt.Fprintln(w, "\nPrinting Available CLI Arguments")
+	fmt.Fprintln(w, "./go-web [--config <file>] [--<setting> <value>] <mode|group> ...")
 
-	// Instructions for web mode
-	fmt.Println(
-		"\nTo run in webserver mode:\n" +
-			"     For production mode: ./go-web\n" +
-			"     For debug mode: ./go-web web debug")
+	// Modes
+	for _, mode := range Modes {
+		if mode.Hidden {
+			continue
+		}
+		fmt.Fprintf(w, "\n%v:\n", mode.Summary)
+		for _, usage := range mode.Usages {
+			fmt.Fprintf(w, "     %-40v %v\n", mode.usageLine(usage), usage.Summary)
+		}
+		for _, note := range mode.Notes {
+			fmt.Fprintf(w, "     Note: %v\n", note)
+		}
+	}
 
-	// CLI Utilities
+	// Non-interactive commands
+	fmt.Fprintln(w,
+		"\nTo run a command: ./go-web <group> <command> [flags] [--output json|table|yaml] [--json]\n"+
+			"     Passwords are read from the first line of stdin, never from flags\n"+
+			"     With cli.server (CLI_SERVER) set, commands run on that server after ./go-web login\n"+
+			"     Exit codes: 0 success, 1 error, 2 usage, 3 permission denied, 4 not found")
+	for _, group := range Commands.Groups() {
+		fmt.Fprintf(w, "   %v commands:\n", group)
+		for _, cmd := range Commands.Commands(group) {
+			fmt.Fprintf(w, "	%-16v %v\n", cmd.Name, cmd.Summary)
+		}
+	}
+	fmt.Fprintln(w, "     Run ./go-web <group> <command> --help for the flags of a command")
 
-	fmt.Printf("\nTo create the superuser: ./go-web create_superuser\n" +
-		"     Note: This is only available without login when no other users exist in the database" +
-		"     As part of this process, groups and security points will also be migrated.")
+	// Interactive menus over the same commands
+	for _, menu := range menuNames() {
+		fmt.Fprintf(w, "\nTo access the interactive %v utility menu: ./go-web util %v\n", menu, menu)
+		fmt.Fprintln(w, "     Prompts for the flags of the commands above")
+	}
+}
 
-	//Print Available modes
-	for util_menu := range UtilityMenus {
-		fmt.Printf("\nTo access %v utility menu: ./go-web util %v \n", util_menu, util_menu)
-		fmt.Printf("   Available %v menu utilities: \n", util_menu)
-		for utility := range UtilityMenus[util_menu] {
-			fmt.Printf("	%v\n", utility)
-		}
+// commandFlag is a flag of a command for help, man pages and completion
+type commandFlag struct {
+	Name    string
+	Usage   string
+	Default string
+	IsBool  bool
+}
 
+// commandFlags returns the flags of a command, including the output flags,
+// sorted by name
+func commandFlags(group string, name string) []commandFlag {
+	cmd, ok := Commands.Find(group, name)
+	if !ok {
+		return nil
 	}
+	fs, _ := cmd.FlagSet(io.Discard)
+	var flags []commandFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, commandFlag{
+			Name:    f.Name,
+			Usage:   f.Usage,
+			Default: f.DefValue,
+			IsBool:  ok && boolFlag.IsBoolFlag(),
+		})
+	})
+	return flags
+}
+
+// flagTakesFile reports whether a flag or setting names a file
+func flagTakesFile(name string) bool {
+	return name == "config" || strings.HasSuffix(name, "file")
 }
@@ -1,61 +1,77 @@
 package cli
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+
+	cli_auth "github.com/javitab/go-web/cli/auth"
+	"github.com/javitab/go-web/cli/command"
 )
 
-func ExecUtilMenu(modes map[string]func()) {
-	// ### ###
-	// ### ### Print Menu
-	// ### ###
-	var modeSelected string
-	var modeSelectFuncMap = map[string]func(){}
+// IsCommand reports whether args start with a command group
+func IsCommand(args []string) bool {
+	return len(args) > 0 && len(Commands.Commands(args[0])) > 0
+}
 
-	fmt.Println("\nSelect Utility to Run:")
-	var iter int
-	for key := range modes {
-		iter++
-		fmt.Printf("# %v: %v\n", iter, key)
-		modeSelectFuncMap[fmt.Sprintf("%v", iter)] = modes[key]
+// ExecCommand runs a non-interactive command as the logged in user and
+// returns its exit code. Secrets are read from the first line of stdin.
+func ExecCommand(args []string) int {
+	return Commands.Execute(args, cli_auth.Env(cli_auth.StdinSecret(os.Stdin)), os.Stdout, os.Stderr)
+}
+
+// ExecUtilMenu runs the commands of a utility menu interactively until Exit is
+// selected. Options are numbered in command order, so numbers are stable
+// between runs.
+func ExecUtilMenu(registry command.Registry) {
+	in := bufio.NewReader(os.Stdin)
+	for {
+		cmd, ok := selectCommand(registry, in, os.Stdout)
+		if !ok {
+			return
+		}
+		for {
+			if err := cmd.Prompt(cli_auth.Env(cli_auth.TerminalSecret), in, os.Stdout); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			fmt.Printf("\nContinue? (y/n): ")
+			if answer, _ := in.ReadString('\n'); strings.TrimSpace(answer) != "y" {
+				break
+			}
+		}
 	}
+}
 
+// selectCommand prints the menu of registry and reads the selected command,
+// returning false for Exit or unreadable input
+func selectCommand(registry command.Registry, in *bufio.Reader, out io.Writer) (command.Command, bool) {
 	// ### ###
-	// ### ### Add Additional Options
+	// ### ### Print Menu
 	// ### ###
-	var addlModes = map[string]func(){
-		"Exit": nil,
-	}
-	for key := range addlModes {
-		iter++
-		fmt.Printf("# %v: %v\n", iter, key)
-		modeSelectFuncMap[fmt.Sprintf("%v", iter)] = modes[key]
+	var options []command.Command
+	fmt.Fprintln(out, "\nSelect Utility to Run:")
+	for _, group := range registry.Groups() {
+		for _, cmd := range registry.Commands(group) {
+			options = append(options, cmd)
+			fmt.Fprintf(out, "# %v: %v %v - %v\n", len(options), cmd.Group, cmd.Name, cmd.Summary)
+		}
 	}
+	fmt.Fprintf(out, "# %v: Exit\n", len(options)+1)
 
 	// ### ###
-	// ### ### Execute Utility
+	// ### ### Read Selection
 	// ### ###
-	fmt.Print("Enter utility #: ")
-	fmt.Scanln(&modeSelected)
-	ExecFunc := modeSelectFuncMap[modeSelected]
-	if ExecFunc == nil {
-		os.Exit(0)
+	fmt.Fprint(out, "Enter utility #: ")
+	answer, err := in.ReadString('\n')
+	if err != nil && answer == "" {
+		return command.Command{}, false
 	}
-
-	if ExecFunc != nil {
-		ExecFunc()
-		var cont string
-		fmt.Printf("\nContinue? (y/n): ")
-		fmt.Scanln(&cont)
-		for cont == "y" {
-			ExecFunc()
-			fmt.Printf("\nContinue? (y/n): ")
-			fmt.Scanln(&cont)
-		}
-		// helpers.ClearScreen()
-		ExecUtilMenu(modes)
-
+	selected, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || selected < 1 || selected > len(options) {
+		return command.Command{}, false
 	}
-	os.Exit(0)
-
+	return options[selected-1], true
 }
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/javitab/go-web/cli/command"
+	"github.com/javitab/go-web/config"
+)
+
+// WriteManPage prints the go-web(1) man page in roff. It is generated from
+// Modes, Commands and the configuration settings, like help and completion.
+func WriteManPage(w io.Writer) {
+	fmt.Fprintln(w, `.TH GO-WEB 1 "" "go-web" "User Commands"`)
+
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintln(w, `go-web \- web server, administration commands and utilities of go-web`)
+
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintln(w, `.B go-web`)
+	fmt.Fprintln(w, `[\fB\-\-config\fR \fIfile\fR] [\fB\-\-\fIsetting\fR \fIvalue\fR]... \fImode\fR [\fIargs\fR]`)
+	fmt.Fprintln(w, ".br")
+	fmt.Fprintln(w, `.B go-web`)
+	fmt.Fprintln(w, `[\fB\-\-config\fR \fIfile\fR] \fIgroup\fR \fIcommand\fR [\fIflags\fR]`)
+
+	fmt.Fprintln(w, ".SH DESCRIPTION")
+	fmt.Fprintln(w, roffEscape("go-web runs the web server, manages the database schema and runs administration commands. "+
+		"Configuration flags precede the mode. Commands print tables, JSON or YAML and read passwords from the first line of stdin, never from flags. "+
+		"With cli.server set, commands run on that server after go-web login."))
+
+	fmt.Fprintln(w, ".SH MODES")
+	for _, mode := range Modes {
+		if mode.Hidden {
+			continue
+		}
+		for _, usage := range mode.Usages {
+			fmt.Fprintln(w, ".TP")
+			fmt.Fprintln(w, strings.TrimSpace(fmt.Sprintf("\\fB%v\\fR %v", roffEscape(mode.Name), roffEscape(usage.Args))))
+			fmt.Fprintln(w, roffEscape(usage.Summary))
+		}
+		for _, note := range mode.Notes {
+			fmt.Fprintln(w, ".IP")
+			fmt.Fprintln(w, roffEscape(note))
+		}
+	}
+
+	fmt.Fprintln(w, ".SH COMMANDS")
+	for _, group := range Commands.Groups() {
+		for _, cmd := range Commands.Commands(group) {
+			fmt.Fprintln(w, ".TP")
+			fmt.Fprintf(w, "\\fB%v %v\\fR\n", roffEscape(group), roffEscape(cmd.Name))
+			fmt.Fprintln(w, roffEscape(cmd.Summary))
+			for _, f := range commandFlags(group, cmd.Name) {
+				fmt.Fprintln(w, ".RS")
+				fmt.Fprintln(w, ".TP")
+				if f.IsBool {
+					fmt.Fprintf(w, "\\fB\\-\\-%v\\fR\n", roffEscape(f.Name))
+				} else {
+					fmt.Fprintf(w, "\\fB\\-\\-%v\\fR \\fIvalue\\fR\n", roffEscape(f.Name))
+				}
+				usage := f.Usage
+				if f.Default != "" && !f.IsBool {
+					usage += " (default " + f.Default + ")"
+				}
+				fmt.Fprintln(w, roffEscape(usage))
+				fmt.Fprintln(w, ".RE")
+			}
+		}
+	}
+
+	fmt.Fprintln(w, ".SH CONFIGURATION")
+	fmt.Fprintln(w, roffEscape("Settings are layered: defaults, the YAML file of --config, environment variables, then flags. "+
+		"Settings marked reloadable are applied by a running server on SIGHUP, all others require a restart."))
+	for _, setting := range config.Settings() {
+		fmt.Fprintln(w, ".TP")
+		fmt.Fprintf(w, "\\fB\\-\\-%v\\fR, \\fB%v\\fR\n", roffEscape(setting.Key), roffEscape(setting.Env))
+		usage := setting.Usage
+		if setting.Reloadable {
+			usage += " (reloadable)"
+		}
+		fmt.Fprintln(w, roffEscape(usage))
+	}
+
+	fmt.Fprintln(w, ".SH EXIT STATUS")
+	for _, status := range []struct {
+		code    int
+		summary string
+	}{
+		{command.ExitOK, "Success"},
+		{command.ExitError, "Error"},
+		{command.ExitUsage, "Usage error"},
+		{command.ExitDenied, "Permission denied or login required"},
+		{command.ExitNotFound, "Not found"},
+	} {
+		fmt.Fprintln(w, ".TP")
+		fmt.Fprintf(w, ".B %v\n", status.code)
+		fmt.Fprintln(w, status.summary)
+	}
+
+	fmt.Fprintln(w, ".SH FILES")
+	fmt.Fprintln(w, ".TP")
+	fmt.Fprintln(w, ".I .env")
+	fmt.Fprintln(w, roffEscape("Environment variables loaded from the working directory"))
+	fmt.Fprintln(w, ".TP")
+	fmt.Fprintln(w, ".I ~/.config/go-web/sessions.json")
+	fmt.Fprintln(w, roffEscape("Cached sessions of go-web login by server URL, readable only by the user"))
+
+	fmt.Fprintln(w, ".SH SEE ALSO")
+	fmt.Fprintln(w, roffEscape("go-web help, go-web completion bash|zsh|fish"))
+}
+
+// roffEscape escapes backslashes and dashes and keeps lines from starting
+// with a control character
+func roffEscape(text string) string {
+	text = strings.ReplaceAll(text, `\`, `\e`)
+	text = strings.ReplaceAll(text, "-", `\-`)
+	if strings.HasPrefix(text, ".") || strings.HasPrefix(text, "'") {
+		text = `\&` + text
+	}
+	return text
+}
+
+// ExecMan runs the man mode: ./go-web man
+func ExecMan() {
+	WriteManPage(os.Stdout)
+}
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	dbase "github.com/javitab/go-web/database"
+)
+
+// ExecMigrate runs the migrate mode: ./go-web migrate <up|down [steps]|status>
+func ExecMigrate(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: ./go-web migrate <up|down [steps]|status>")
+		os.Exit(1)
+	}
+
+	db := dbase.GetDBConn()
+
+	switch args[0] {
+	case "up":
+		ran, err := dbase.MigrateUp(db)
+		for _, m := range ran {
+			fmt.Printf("Applied migration %d: %v\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Printf("Error applying migrations: %v\n", err)
+			os.Exit(1)
+		}
+		if len(ran) == 0 {
+			fmt.Println("Schema is up to date")
+			return
+		}
+		dbase.LogServerEvent("MigrateSchema:Up", fmt.Sprintf("Applied %d migration(s)", len(ran)), "INFO")
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				fmt.Printf("Invalid number of steps: %q\n", args[1])
+				os.Exit(1)
+			}
+		}
+		ran, err := dbase.MigrateDown(db, steps)
+		for _, m := range ran {
+			fmt.Printf("Rolled back migration %d: %v\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Printf("Error rolling back migrations: %v\n", err)
+			os.Exit(1)
+		}
+		if len(ran) == 0 {
+			fmt.Println("No applied migrations to roll back")
+		}
+	case "status":
+		states, err := dbase.MigrationStatus(db)
+		if err != nil {
+			fmt.Printf("Error reading migration status: %v\n", err)
+			os.Exit(1)
+		}
+		for _, state := range states {
+			status := "pending"
+			if state.Applied {
+				status = "applied " + state.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if !state.Known {
+				status += " (unknown to this build)"
+			}
+			fmt.Printf("%5d  %-30v %v\n", state.Version, state.Name, status)
+		}
+		if err := dbase.CheckSchema(db); err != nil {
+			fmt.Println(err)
+			if errors.Is(err, dbase.ErrSchemaAhead) || errors.Is(err, dbase.ErrSchemaBehind) {
+				os.Exit(2)
+			}
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("Unknown migrate command: %q\n", args[0])
+		fmt.Println("Usage: ./go-web migrate <up|down [steps]|status>")
+		os.Exit(1)
+	}
+}
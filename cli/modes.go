@@ -0,0 +1,179 @@
+package cli
+
+import (
+	"sort"
+	"strings"
+)
+
+// Mode is a top-level mode of ./go-web besides the command groups. Help,
+// man pages and shell completion are generated from the modes and the
+// command registry.
+type Mode struct {
+	Name    string
+	Summary string
+	// Usages are the forms of the mode
+	Usages []Usage
+	// Notes are printed below the usages
+	Notes []string
+	// Complete returns the candidates for the last of args, the words after
+	// the mode
+	Complete func(args []string) []string
+	// Hidden modes are not listed in help
+	Hidden bool
+}
+
+// Usage is a form of a mode: ./go-web <mode> <Args>
+type Usage struct {
+	Args    string
+	Summary string
+}
+
+// Modes are the top-level modes, in help order
+var Modes = []Mode{
+	{
+		Name: "web", Summary: "Run the web server",
+		Usages: []Usage{
+			{"", "Run in release mode"},
+			{"debug", "Run in debug mode, reloading templates and static files from disk"},
+		},
+		Complete: positional([]string{"debug"}),
+	},
+	{
+		Name: "migrate", Summary: "Manage database schema migrations",
+		Usages: []Usage{
+			{"up", "Apply pending migrations"},
+			{"down [steps]", "Roll back migrations, one by default"},
+			{"status", "Show migration status"},
+		},
+		Notes:    []string{"All other modes refuse to start unless the schema is up to date"},
+		Complete: positional([]string{"up", "down", "status"}),
+	},
+	{
+		Name: "config", Summary: "Print the effective configuration",
+		Usages: []Usage{
+			{"print [--redacted]", "Print the configuration as YAML, --redacted hides secrets"},
+		},
+		Notes: []string{"Configuration flags such as --config <file> or --http.port <port> go before the mode"},
+		Complete: func(args []string) []string {
+			if len(args) == 1 {
+				return []string{"print"}
+			}
+			return []string{"--redacted"}
+		},
+	},
+	{
+		Name: "create_superuser", Summary: "Create the first user as a superuser",
+		Usages: []Usage{
+			{"", "Prompt for the superuser"},
+			{"--username <name> --email <email> [--first-name <name>] [--last-name <name>] [--ldap]", "Create the superuser unattended, the password is read from stdin"},
+		},
+		Notes: []string{
+			"Refuses to run once any user exists, use ./go-web user create instead",
+			"Flags default to SUPERUSER_USERNAME, SUPERUSER_FIRST_NAME, SUPERUSER_LAST_NAME, SUPERUSER_EMAIL and SUPERUSER_LDAP, the password to SUPERUSER_PASSWORD",
+			"Security points and groups are seeded with the superuser in one transaction",
+		},
+		Complete: flagNames("--username", "--first-name", "--last-name", "--email", "--ldap"),
+	},
+	{
+		Name: "recovery", Summary: "Issue a new break-glass recovery code",
+		Usages: []Usage{{"", "Print a one-time code for ./go-web recover, replacing the unused codes"}},
+		Notes: []string{
+			"Needs direct database access, the code is valid for 24 hours",
+			"create_superuser prints the first code",
+		},
+	},
+	{
+		Name: "recover", Summary: "Restore superuser access with a break-glass recovery code",
+		Usages: []Usage{{"--username <name>", "Undelete the user, set a local password and add it to the superuser group"}},
+		Notes: []string{
+			"Needs direct database access and a one-time code printed by create_superuser or recovery",
+			"The code and the new password are read from the terminal, or from the first two lines of stdin",
+		},
+		Complete: flagNames("--username"),
+	},
+	{
+		Name: "util", Summary: "Run an interactive utility menu",
+		Usages: []Usage{{"<menu>", "Prompt for the commands of a menu and their flags"}},
+		Complete: func(args []string) []string {
+			if len(args) > 1 {
+				return nil
+			}
+			return menuNames()
+		},
+	},
+	{
+		Name: "login", Summary: "Log in to cli.server for remote commands",
+		Usages: []Usage{
+			{"--username <name>", "Log in with a password read from the terminal or stdin"},
+			{"", "Log in with cli.api_key"},
+		},
+		Notes:    []string{"Sessions are cached in the user config dir, e.g. ~/.config/go-web/sessions.json"},
+		Complete: positional([]string{"--username"}),
+	},
+	{
+		Name: "logout", Summary: "Remove the cached session of cli.server",
+		Usages: []Usage{{"", "Log out"}},
+	},
+	{
+		Name: "completion", Summary: "Print a shell completion script",
+		Usages: []Usage{
+			{"bash", "Add `source <(./go-web completion bash)` to ~/.bashrc"},
+			{"zsh", "Write to a directory of $fpath as _go-web"},
+			{"fish", "Write to ~/.config/fish/completions/go-web.fish"},
+		},
+		Complete: positional(completionShells()),
+	},
+	{
+		Name: "man", Summary: "Print the go-web(1) man page",
+		Usages: []Usage{{"", "e.g. ./go-web man > /usr/local/share/man/man1/go-web.1"}},
+	},
+	{
+		Name: "help", Summary: "Print this help",
+		Usages: []Usage{{"", "List the modes and commands"}},
+	},
+	{
+		Name: completeMode, Summary: "Print the completions of a command line, used by completion scripts",
+		Hidden: true,
+	},
+}
+
+// FindMode returns the mode with the given name
+func FindMode(name string) (Mode, bool) {
+	for _, mode := range Modes {
+		if mode.Name == name {
+			return mode, true
+		}
+	}
+	return Mode{}, false
+}
+
+// positional completes the first argument after a mode from values
+func positional(values []string) func(args []string) []string {
+	return func(args []string) []string {
+		if len(args) > 1 {
+			return nil
+		}
+		return values
+	}
+}
+
+// flagNames completes the flags of a mode, which take no completable values
+func flagNames(flags ...string) func(args []string) []string {
+	return func(args []string) []string {
+		return flags
+	}
+}
+
+func menuNames() []string {
+	menus := make([]string, 0, len(UtilityMenus))
+	for menu := range UtilityMenus {
+		menus = append(menus, menu)
+	}
+	sort.Strings(menus)
+	return menus
+}
+
+// usageLine is the full form of a usage, e.g. ./go-web migrate down [steps]
+func (m Mode) usageLine(usage Usage) string {
+	return strings.TrimSpace("./go-web " + m.Name + " " + usage.Args)
+}
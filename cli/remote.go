@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	cli_auth "github.com/javitab/go-web/cli/auth"
+	"github.com/javitab/go-web/cli/command"
+	"github.com/javitab/go-web/cli/remote"
+	"github.com/javitab/go-web/config"
+	"golang.org/x/term"
+)
+
+// IsRemoteMode reports whether args run against cli.server instead of the
+// database: login, logout and commands when a server is configured
+func IsRemoteMode(cfg config.CLIConfig, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	if args[0] == "login" || args[0] == "logout" {
+		return true
+	}
+	return cfg.Remote() && IsCommand(args)
+}
+
+// ExecRemote runs login, logout or a command against the API of cli.server
+// and returns the exit code
+func ExecRemote(cfg config.CLIConfig, args []string) int {
+	client, err := remote.NewClient(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return command.ExitCode(err)
+	}
+	return execRemote(context.Background(), client, args, secretSource(os.Stdin), os.Stdout, os.Stderr)
+}
+
+func execRemote(ctx context.Context, client *remote.Client, args []string, secret func(prompt string) (string, error), stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "login":
+		return remoteLogin(ctx, client, args[1:], secret, stderr)
+	case "logout":
+		if err := client.Logout(); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return command.ExitError
+		}
+		fmt.Fprintf(stderr, "Logged out of %v\n", client.Server)
+		return command.ExitOK
+	default:
+		return Commands.ExecuteRemote(args, client.Send(ctx), secret, stdout, stderr)
+	}
+}
+
+// remoteLogin logs in with --username and a password, or exchanges the
+// configured API key without a username
+func remoteLogin(ctx context.Context, client *remote.Client, args []string, secret func(prompt string) (string, error), stderr io.Writer) int {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	username := fs.String("username", "", "username to log in as, the API key is used when empty")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return command.ExitOK
+		}
+		return command.ExitUsage
+	}
+
+	var err error
+	switch {
+	case *username != "":
+		var password string
+		password, err = secret("Enter password: ")
+		if err == nil {
+			err = client.Login(ctx, *username, password)
+		}
+	case client.APIKey != "":
+		err = client.LoginAPIKey(ctx)
+	default:
+		err = fmt.Errorf("%w: --username is required without cli.api_key", command.ErrUsage)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return command.ExitCode(err)
+	}
+	fmt.Fprintf(stderr, "Logged in to %v as %v\n", client.Server, client.Username())
+	return command.ExitOK
+}
+
+// secretSource reads secrets without echo from a terminal, or from the first
+// line of stdin when it is piped
+func secretSource(stdin *os.File) func(prompt string) (string, error) {
+	if term.IsTerminal(int(stdin.Fd())) {
+		return cli_auth.TerminalSecret
+	}
+	return cli_auth.StdinSecret(stdin)
+}
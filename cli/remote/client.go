@@ -0,0 +1,245 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/javitab/go-web/cli/command"
+	"github.com/javitab/go-web/config"
+)
+
+// ErrLoginRequired is returned when no session is cached for the server and
+// no API key is configured
+var ErrLoginRequired = fmt.Errorf("%w: not logged in, run ./go-web login", command.ErrDenied)
+
+// Client runs commands against the API of a go-web server
+type Client struct {
+	// Server is the base URL of the server
+	Server string
+	// APIKey, when set, is exchanged for tokens without prompting
+	APIKey   string
+	HTTP     *http.Client
+	Sessions *SessionStore
+}
+
+// NewClient returns a client for cfg.Server, caching sessions in the user
+// config dir
+func NewClient(cfg config.CLIConfig) (*Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if !cfg.Remote() {
+		return nil, fmt.Errorf("%w: cli.server is not configured (CLI_SERVER)", command.ErrUsage)
+	}
+	sessions, err := DefaultSessionStore()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read cli.ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in cli.ca_file %v", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &Client{
+		Server:   strings.TrimRight(cfg.Server, "/"),
+		APIKey:   cfg.APIKey,
+		HTTP:     &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		Sessions: sessions,
+	}, nil
+}
+
+// Login exchanges credentials for a token with /auth/login and caches it.
+// The server checks the CLILogin security point.
+func (c *Client) Login(ctx context.Context, username string, password string) error {
+	token, err := c.requestToken(ctx, "/auth/login", map[string]string{
+		"username": username,
+		"password": password,
+		"mode":     "cli_login",
+	})
+	if err != nil {
+		return err
+	}
+	return c.Sessions.Save(c.Server, token)
+}
+
+// LoginAPIKey exchanges the configured API key for a token with
+// /auth/generate_jwt and caches it
+func (c *Client) LoginAPIKey(ctx context.Context) error {
+	if c.APIKey == "" {
+		return ErrLoginRequired
+	}
+	token, err := c.requestToken(ctx, "/auth/generate_jwt", map[string]string{"key": c.APIKey})
+	if err != nil {
+		return err
+	}
+	return c.Sessions.Save(c.Server, token)
+}
+
+// Logout removes the cached session of the server
+func (c *Client) Logout() error {
+	return c.Sessions.Delete(c.Server)
+}
+
+// Username returns the user of the cached session, or "" without one
+func (c *Client) Username() string {
+	token, _ := c.Sessions.Load(c.Server)
+	claims := tokenClaims(token)
+	username, _ := claims["username"].(string)
+	return username
+}
+
+// Send returns the function running commands on the server. An expired or
+// rejected session is renewed once with the API key when one is configured.
+func (c *Client) Send(ctx context.Context) command.Send {
+	return func(group string, name string, request command.Request) (command.Response, error) {
+		token, err := c.token(ctx)
+		if err != nil {
+			return command.Response{}, err
+		}
+		path := "/api/commands/" + url.PathEscape(group) + "/" + url.PathEscape(name)
+		response, status, err := c.runCommand(ctx, path, token, request)
+		if err == nil && status == http.StatusUnauthorized {
+			if err := c.Sessions.Delete(c.Server); err != nil {
+				return command.Response{}, err
+			}
+			if c.APIKey == "" {
+				return command.Response{}, ErrLoginRequired
+			}
+			if err := c.LoginAPIKey(ctx); err != nil {
+				return command.Response{}, err
+			}
+			token, _ = c.Sessions.Load(c.Server)
+			response, status, err = c.runCommand(ctx, path, token, request)
+		}
+		if err == nil && status == http.StatusUnauthorized {
+			return command.Response{}, ErrLoginRequired
+		}
+		return response, err
+	}
+}
+
+// token returns the cached token, logging in with the API key when it is
+// missing or about to expire
+func (c *Client) token(ctx context.Context) (string, error) {
+	token, err := c.Sessions.Load(c.Server)
+	if err != nil {
+		return "", err
+	}
+	if exp, ok := tokenClaims(token)["exp"].(float64); ok && time.Until(time.Unix(int64(exp), 0)) > 30*time.Second {
+		return token, nil
+	}
+	if err := c.LoginAPIKey(ctx); err != nil {
+		return "", err
+	}
+	return c.Sessions.Load(c.Server)
+}
+
+// tokenClaims reads the claims of a token without verifying it, the server
+// verifies tokens
+func tokenClaims(token string) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	if token == "" {
+		return claims
+	}
+	_, _, _ = jwt.NewParser().ParseUnverified(token, claims)
+	return claims
+}
+
+func (c *Client) post(ctx context.Context, path string, token string, body any) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Server+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to %v failed: %w", c.Server, err)
+	}
+	return resp, nil
+}
+
+// requestToken posts credentials to a login endpoint returning a bearer token
+func (c *Client) requestToken(ctx context.Context, path string, credentials map[string]string) (string, error) {
+	resp, err := c.post(ctx, path, "", credentials)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+			Err   string `json:"err"`
+		}
+		_ = json.Unmarshal(body, &failure)
+		message := strings.TrimSpace(failure.Error + ": " + failure.Err)
+		if failure.Err == "" {
+			message = failure.Error
+		}
+		if message == "" {
+			message = resp.Status
+		}
+		return "", fmt.Errorf("%w: login failed: %v", command.ErrDenied, message)
+	}
+
+	token, ok := strings.CutPrefix(strings.TrimSpace(string(body)), "Bearer ")
+	if !ok || token == "" {
+		return "", errors.New("login response holds no bearer token")
+	}
+	return token, nil
+}
+
+// runCommand posts a command request and decodes the response, returning the
+// status so rejected sessions can be renewed
+func (c *Client) runCommand(ctx context.Context, path string, token string, request command.Request) (command.Response, int, error) {
+	resp, err := c.post(ctx, path, token, request)
+	if err != nil {
+		return command.Response{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	var response command.Response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(&response); err != nil && resp.StatusCode == http.StatusOK {
+		return command.Response{}, resp.StatusCode, fmt.Errorf("invalid command response: %w", err)
+	}
+	// Failures outside the command handler, e.g. rate limits, carry no exit code
+	if resp.StatusCode != http.StatusOK && response.ExitCode == command.ExitOK {
+		response.ExitCode = command.ExitError
+		if response.Error == "" {
+			response.Error = resp.Status
+		}
+	}
+	return response, resp.StatusCode, nil
+}
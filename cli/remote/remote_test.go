@@ -0,0 +1,111 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/javitab/go-web/api"
+	"github.com/javitab/go-web/auth"
+	"github.com/javitab/go-web/cli/command"
+	dbase "github.com/javitab/go-web/database"
+	test_suite "github.com/javitab/go-web/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStore(t *testing.T) {
+	store := &SessionStore{Path: filepath.Join(t.TempDir(), "go-web", "sessions.json")}
+
+	token, err := store.Load("https://one")
+	assert.NoError(t, err)
+	assert.Empty(t, token)
+
+	assert.NoError(t, store.Save("https://one", "token-one"))
+	assert.NoError(t, store.Save("https://two", "token-two"))
+	token, _ = store.Load("https://one")
+	assert.Equal(t, "token-one", token)
+
+	// Only the owner can read the cache
+	info, err := os.Stat(store.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	dir, _ := os.Stat(filepath.Dir(store.Path))
+	assert.Equal(t, os.FileMode(0o700), dir.Mode().Perm())
+
+	assert.NoError(t, store.Delete("https://one"))
+	token, _ = store.Load("https://one")
+	assert.Empty(t, token)
+	token, _ = store.Load("https://two")
+	assert.Equal(t, "token-two", token)
+
+	// Caches readable by other users are refused
+	assert.NoError(t, os.Chmod(store.Path, 0o644))
+	_, err = store.Load("https://two")
+	assert.ErrorContains(t, err, "accessible by other users")
+}
+
+func TestClient(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	router := test_suite.AppRouter()
+	auth.AuthRouterGroup(router, dbase.DefaultRepository())
+	api.ApiRouterGroup(router, dbase.DefaultRepository())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	ctx := context.Background()
+	client := &Client{
+		Server:   server.URL,
+		HTTP:     server.Client(),
+		Sessions: &SessionStore{Path: filepath.Join(t.TempDir(), "sessions.json")},
+	}
+
+	// Commands need a session
+	_, err := client.Send(ctx)("group", "list", command.Request{})
+	assert.ErrorIs(t, err, ErrLoginRequired)
+
+	assert.ErrorIs(t, client.Login(ctx, "testuser", "wrong"), command.ErrDenied)
+	assert.NoError(t, client.Login(ctx, "testuser", "password"))
+	assert.Equal(t, "testuser", client.Username())
+
+	response, err := client.Send(ctx)("group", "list", command.Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, command.ExitOK, response.ExitCode)
+	assert.Contains(t, string(response.Result), "Admin Group")
+	assert.NotNil(t, response.Table)
+
+	response, err = client.Send(ctx)("user", "get", command.Request{Flags: map[string]string{"username": "nobody"}})
+	assert.NoError(t, err)
+	assert.Equal(t, command.ExitNotFound, response.ExitCode)
+
+	// Local only commands are not served
+	response, _ = client.Send(ctx)("secpoint", "load", command.Request{})
+	assert.Equal(t, command.ExitUsage, response.ExitCode)
+
+	// API keys are exchanged for a session when none is cached
+	user, err := dbase.DefaultRepository().GetUser(ctx, "testuser")
+	assert.NoError(t, err)
+	key, err := dbase.DefaultRepository().CreateAPIKey(ctx, *user, "remote test")
+	assert.NoError(t, err)
+	assert.NoError(t, client.Logout())
+	client.APIKey = key.Key
+	response, err = client.Send(ctx)("user", "get", command.Request{Flags: map[string]string{"username": "testuser"}})
+	assert.NoError(t, err)
+	assert.Equal(t, command.ExitOK, response.ExitCode)
+	assert.Equal(t, "testuser", client.Username())
+
+	client.APIKey = "invalid"
+	assert.NoError(t, client.Logout())
+	_, err = client.Send(ctx)("group", "list", command.Request{})
+	assert.ErrorIs(t, err, command.ErrDenied)
+
+	// Failures outside the command handler still carry an exit code
+	response, status, err := client.runCommand(ctx, "/api/missing", "", command.Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, command.ExitError, response.ExitCode)
+}
@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// SessionStore caches the tokens of remote sessions by server URL in a file
+// only readable by the current user
+type SessionStore struct {
+	Path string
+}
+
+// DefaultSessionStore returns the store in the go-web directory of the user
+// config dir, e.g. ~/.config/go-web/sessions.json
+func DefaultSessionStore() (*SessionStore, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate the user config dir: %w", err)
+	}
+	return &SessionStore{Path: filepath.Join(dir, "go-web", "sessions.json")}, nil
+}
+
+// Load returns the cached token for server, or "" without a session
+func (s *SessionStore) Load(server string) (string, error) {
+	sessions, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	return sessions[server], nil
+}
+
+// Save caches the token for server
+func (s *SessionStore) Save(server string, token string) error {
+	sessions, err := s.read()
+	if err != nil {
+		return err
+	}
+	sessions[server] = token
+	return s.write(sessions)
+}
+
+// Delete removes the session of server
+func (s *SessionStore) Delete(server string) error {
+	sessions, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := sessions[server]; !ok {
+		return nil
+	}
+	delete(sessions, server)
+	return s.write(sessions)
+}
+
+// read loads the sessions, refusing a file other users can read
+func (s *SessionStore) read() (map[string]string, error) {
+	sessions := map[string]string{}
+	info, err := os.Stat(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("session cache %v is accessible by other users, remove it or chmod 600 it", s.Path)
+	}
+
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("invalid session cache %v: %w", s.Path, err)
+	}
+	return sessions, nil
+}
+
+// write replaces the cache file, so it is never partially written and always
+// created with 0600 permissions
+func (s *SessionStore) write(sessions map[string]string) error {
+	dir := filepath.Dir(s.Path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, ".sessions-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.Path)
+}
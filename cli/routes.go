@@ -2,8 +2,14 @@ package cli
 
 import (
 	cli_auth "github.com/javitab/go-web/cli/auth"
+	"github.com/javitab/go-web/cli/command"
 )
 
-var UtilityMenus = map[string]map[string]func(){
-	"auth": cli_auth.MenuFuncs,
+// Commands are the non-interactive commands: ./go-web <group> <command> [flags]
+var Commands = cli_auth.Commands
+
+// UtilityMenus are the interactive menus over the same commands:
+// ./go-web util <menu>
+var UtilityMenus = map[string]command.Registry{
+	"auth": cli_auth.Commands,
 }
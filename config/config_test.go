@@ -1,8 +1,13 @@
 package config
 
 import (
+	b64 "encoding/base64"
 	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,3 +23,207 @@ func TestConfigEmbeds(t *testing.T) {
 	assert.Equal(t, configLoaded, true)
 
 }
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "go-web.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+http:
+  port: 7000
+  host: file.local
+database:
+  driver: sqlite
+  dsn: file.db
+  statement_timeout: 5s
+`)
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("HTTP_HOST", "env.local")
+	t.Setenv("DB_DSN", "env.db")
+	t.Setenv("DB_MAX_OPEN_CONNS", "4")
+	t.Setenv("AUTH_INSECURE_COOKIES", "true")
+
+	cfg, args, err := Load([]string{"--config", path, "--database.dsn", "flag.db", "web", "debug"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"web", "debug"}, args)
+
+	// Defaults, file, env and flags in increasing precedence
+	assert.Equal(t, 5, cfg.Database.ConnectRetries)
+	assert.Equal(t, 7000, cfg.HTTP.Port)
+	assert.Equal(t, 5*time.Second, cfg.Database.StatementTimeout)
+	assert.Equal(t, "env.local", cfg.HTTP.Host)
+	assert.Equal(t, 4, cfg.Database.MaxOpenConns)
+	assert.Equal(t, "flag.db", cfg.Database.DSN)
+	assert.True(t, cfg.Auth.InsecureCookies)
+
+	// Malformed values and unknown keys are rejected
+	t.Setenv("AUTH_INSECURE_COOKIES", "sometimes")
+	_, _, err = Load([]string{"--config", path})
+	assert.ErrorContains(t, err, "AUTH_INSECURE_COOKIES")
+	t.Setenv("AUTH_INSECURE_COOKIES", "")
+	t.Setenv("DB_STATEMENT_TIMEOUT", "five seconds")
+	_, _, err = Load([]string{"--config", path})
+	assert.ErrorContains(t, err, "DB_STATEMENT_TIMEOUT")
+
+	_, _, err = Load([]string{"--config", writeConfigFile(t, "http:\n  prot: 80\n")})
+	assert.ErrorContains(t, err, "field prot not found")
+
+	_, _, err = Load([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")})
+	assert.Error(t, err)
+}
+
+func TestFilePath(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	assert.Equal(t, DefaultConfigFile, FilePath(nil))
+	assert.Equal(t, DefaultConfigFile, FilePath([]string{"--http.port", "9090"}))
+
+	t.Setenv("CONFIG_FILE", "env.yaml")
+	assert.Equal(t, "env.yaml", FilePath(nil))
+	assert.Equal(t, "flag.yaml", FilePath([]string{"--config", "flag.yaml"}))
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Database.DSN = "app.db"
+	cfg.Auth.JWTSecret = testJWTSecret
+	assert.NoError(t, cfg.Validate())
+
+	for secret, msg := range map[string]string{
+		"":                      "JWT signing key is required",
+		"Secret for JWT tokens": "known example value",
+		"too-short":             "at least 32 characters",
+	} {
+		invalid := cfg
+		invalid.Auth.JWTSecret = secret
+		assert.ErrorContains(t, invalid.Validate(), msg)
+	}
+
+	invalid := cfg
+	invalid.LDAP.Address = "ldap://ldap.local"
+	assert.ErrorContains(t, invalid.Validate(), "must be set together")
+	invalid.LDAP.BaseDN = "DC=LOCAL"
+	invalid.LDAP.BindCredentials = b64.StdEncoding.EncodeToString([]byte("no-separator"))
+	assert.ErrorContains(t, invalid.Validate(), "must encode user:pass")
+	invalid.LDAP.BindCredentials = b64.StdEncoding.EncodeToString([]byte("bind:pass"))
+	assert.NoError(t, invalid.Validate())
+
+	invalid = cfg
+	invalid.TLS.KeyFile = "server-key.pem"
+	assert.ErrorContains(t, invalid.Validate(), "tls.cert_file and tls.key_file must be set together")
+	invalid.TLS.CertFile = "server.pem"
+	invalid.TLS.MinVersion = "1.0"
+	assert.ErrorContains(t, invalid.Validate(), `unsupported tls.min_version "1.0"`)
+	invalid.TLS.MinVersion = "1.3"
+	invalid.TLS.ClientAuth = "require"
+	assert.ErrorContains(t, invalid.Validate(), "requires tls.cert_file and tls.client_ca_file")
+	invalid.TLS.ClientCAFile = "ca.pem"
+	assert.NoError(t, invalid.Validate())
+
+	invalid = cfg
+	invalid.RateLimit.API.Key = "cookie"
+	invalid.RateLimit.Web.Period = 0
+	err := invalid.Validate()
+	assert.ErrorContains(t, err, `unsupported rate_limit.api.key "cookie"`)
+	assert.ErrorContains(t, err, "rate_limit.web.period is required")
+
+	invalid = cfg
+	invalid.Metrics.Listen = "9090"
+	assert.ErrorContains(t, invalid.Validate(), "invalid metrics.listen")
+	invalid.Metrics.Listen = "127.0.0.1:9090"
+	assert.NoError(t, invalid.Validate())
+
+	invalid = cfg
+	invalid.Tracing.Exporter = "jaeger"
+	invalid.Tracing.Endpoint = "localhost:4318"
+	invalid.Tracing.SamplePercent = 150
+	err = invalid.Validate()
+	assert.ErrorContains(t, err, `unsupported tracing.exporter "jaeger"`)
+	assert.ErrorContains(t, err, "tracing.endpoint must be an http or https URL")
+	assert.ErrorContains(t, err, "tracing.sample_percent must be between 0 and 100")
+	invalid.Tracing.Exporter = "otlp"
+	invalid.Tracing.Endpoint = "http://localhost:4318"
+	invalid.Tracing.SamplePercent = 10
+	assert.NoError(t, invalid.Validate())
+
+	invalid = cfg
+	invalid.CLI.Server = "go-web.example.com"
+	assert.ErrorContains(t, invalid.Validate(), "cli.server must be an http or https URL")
+	invalid.CLI.Server = "https://go-web.example.com"
+	assert.NoError(t, invalid.Validate())
+
+	invalid = cfg
+	invalid.Log.Level = "verbose"
+	assert.ErrorContains(t, invalid.Validate(), `unsupported log.level "verbose"`)
+	invalid.Log.Level = "warn"
+	assert.NoError(t, invalid.Validate())
+
+	// All problems are reported together
+	invalid = Default()
+	invalid.Database.Driver = "mysql"
+	err = invalid.Validate()
+	assert.ErrorContains(t, err, `unsupported database driver: "mysql"`)
+	assert.ErrorContains(t, err, "database DSN is required")
+	assert.ErrorContains(t, err, "JWT signing key is required")
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.Database.DSN = "host=db user=app password=hunter2 dbname=app"
+	cfg.Auth.JWTSecret = testJWTSecret
+	cfg.CLI.APIKey = "cli-key"
+
+	redacted := cfg.Redacted()
+	assert.Equal(t, "host=db user=app password=REDACTED dbname=app", redacted.Database.DSN)
+	assert.Equal(t, "REDACTED", redacted.Auth.JWTSecret)
+	assert.Equal(t, "REDACTED", redacted.CLI.APIKey)
+	assert.Empty(t, redacted.LDAP.BindCredentials)
+	assert.Equal(t, testJWTSecret, cfg.Auth.JWTSecret)
+
+	cfg.Database.DSN = "postgres://app:hunter2@db:5432/app"
+	assert.Equal(t, "postgres://app:REDACTED@db:5432/app", cfg.Redacted().Database.DSN)
+
+	out, err := cfg.Redacted().YAML()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "hunter2")
+	assert.NotContains(t, string(out), testJWTSecret)
+}
+
+func TestDiffWithReloadable(t *testing.T) {
+	current := Default()
+	current.Auth.JWTSecret = testJWTSecret
+
+	next := current
+	next.HTTP.Port = 9090
+	next.Auth.JWTSecret = testJWTSecret + "-rotated"
+	next.CORS.AllowedOrigins = []string{"https://app.local"}
+	next.Retention.ServerEvents = 24 * time.Hour
+	next.Log.Level = "debug"
+
+	changes := Diff(current, next)
+	var keys []string
+	for _, change := range changes {
+		keys = append(keys, change.Key)
+		assert.NotContains(t, change.String(), testJWTSecret)
+	}
+	assert.Equal(t, []string{"http.port", "auth.jwt_secret", "cors.allowed_origins", "retention.server_events", "log.level"}, keys)
+	assert.Equal(t, `http.port: "8080" -> "9090" (ignored, restart required)`, changes[0].String())
+
+	// Only reloadable settings are taken from next
+	reloaded := current.WithReloadable(next)
+	assert.Equal(t, 8080, reloaded.HTTP.Port)
+	assert.Equal(t, testJWTSecret, reloaded.Auth.JWTSecret)
+	assert.Equal(t, []string{"https://app.local"}, reloaded.CORS.AllowedOrigins)
+	assert.Equal(t, 24*time.Hour, reloaded.Retention.ServerEvents)
+	assert.Equal(t, "debug", reloaded.Log.Level)
+
+	// The level of a configuration is applied once installed
+	defer SetConfig(GetConfig())
+	SetConfig(reloaded)
+	assert.Equal(t, slog.LevelDebug, LogLevel.Level())
+}
@@ -0,0 +1,845 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	b64 "encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the typed application configuration. Values are layered in a
+// fixed precedence: defaults, then the YAML config file, then environment
+// variables, then command line flags.
+type Config struct {
+	HTTP      HTTPConfig      `yaml:"http"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Auth      AuthConfig      `yaml:"auth"`
+	LDAP      LDAPConfig      `yaml:"ldap"`
+	CLI       CLIConfig       `yaml:"cli"`
+	CORS      CORSConfig      `yaml:"cors"`
+	Headers   HeadersConfig   `yaml:"headers"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Retention RetentionConfig `yaml:"retention"`
+	Policy    PolicyConfig    `yaml:"policy"`
+	Log       LogConfig       `yaml:"log"`
+
+	// File is the config file that was read, if any
+	File string `yaml:"-"`
+}
+
+type HTTPConfig struct {
+	Port            int           `yaml:"port"`
+	Host            string        `yaml:"host"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	TrustedProxies  []string      `yaml:"trusted_proxies"` // proxies whose X-Forwarded-For is trusted for the client IP
+}
+
+type TLSConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	MinVersion     string `yaml:"min_version"`     // 1.2 or 1.3
+	ClientCAFile   string `yaml:"client_ca_file"`  // CA bundle verifying client certificates
+	ClientAuth     string `yaml:"client_auth"`     // none, request or require
+	ClientIdentity string `yaml:"client_identity"` // cn or san, matched against usernames
+}
+
+// Enabled reports whether the server terminates TLS itself
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// TLS versions accepted as tls.min_version
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Version returns the crypto/tls constant of the minimum TLS version
+func (c TLSConfig) Version() (uint16, error) {
+	version, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("unsupported tls.min_version %q, use 1.2 or 1.3", c.MinVersion)
+	}
+	return version, nil
+}
+
+type DatabaseConfig struct {
+	Driver           string        `yaml:"driver"`
+	DSN              string        `yaml:"dsn"`
+	MaxOpenConns     int           `yaml:"max_open_conns"`
+	MaxIdleConns     int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime  time.Duration `yaml:"conn_max_lifetime"`
+	StatementTimeout time.Duration `yaml:"statement_timeout"`
+	ConnectRetries   int           `yaml:"connect_retries"`
+	ConnectRetryWait time.Duration `yaml:"connect_retry_wait"`
+}
+
+type AuthConfig struct {
+	JWTSecret       string `yaml:"jwt_secret"`
+	InsecureCookies bool   `yaml:"insecure_cookies"` // session cookies without the Secure attribute
+}
+
+type LDAPConfig struct {
+	Address         string `yaml:"address"`
+	BaseDN          string `yaml:"base_dn"`
+	BindCredentials string `yaml:"bind_credentials"` // base64 user:pass
+}
+
+// Enabled reports whether an LDAP server is configured
+func (c LDAPConfig) Enabled() bool {
+	return c.Address != ""
+}
+
+type CLIConfig struct {
+	APIKey string `yaml:"api_key"`
+	Server string `yaml:"server"`  // server URL commands run against instead of the database
+	CAFile string `yaml:"ca_file"` // PEM CA bundle verifying the server certificate
+}
+
+// Remote reports whether commands run against a server's API
+func (c CLIConfig) Remote() bool {
+	return c.Server != ""
+}
+
+// Validate checks the settings used by the CLI in remote mode, which runs
+// without the server configuration
+func (c CLIConfig) Validate() error {
+	if c.Server == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.Server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("cli.server must be an http or https URL, got %q", c.Server)
+	}
+	return nil
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// HeadersConfig holds the security headers sent with every response. The
+// Content-Security-Policy is chosen per route group, and {nonce} in a policy
+// is replaced by a fresh nonce for each request.
+type HeadersConfig struct {
+	CSP               string `yaml:"csp"`      // web pages and static files
+	CSPAPI            string `yaml:"csp_api"`  // JSON routes under /api and /auth
+	CSPDocs           string `yaml:"csp_docs"` // swagger UI
+	HSTS              string `yaml:"hsts"`     // sent over HTTPS only, empty disables
+	ReferrerPolicy    string `yaml:"referrer_policy"`
+	PermissionsPolicy string `yaml:"permissions_policy"`
+}
+
+// Route groups with their own Content-Security-Policy
+const (
+	CSPGroupWeb  = "web"
+	CSPGroupAPI  = "api"
+	CSPGroupDocs = "docs"
+)
+
+// Policy returns the Content-Security-Policy of a route group
+func (c HeadersConfig) Policy(group string) string {
+	switch group {
+	case CSPGroupAPI:
+		return c.CSPAPI
+	case CSPGroupDocs:
+		return c.CSPDocs
+	default:
+		return c.CSP
+	}
+}
+
+// RateLimitConfig holds the token bucket rules of the rate limited route
+// groups
+type RateLimitConfig struct {
+	Login RateLimitRule `yaml:"login"` // unauthenticated login, JWT and user creation endpoints
+	API   RateLimitRule `yaml:"api"`   // authenticated /api and /auth endpoints
+	Web   RateLimitRule `yaml:"web"`   // web pages
+}
+
+// RateLimitRule allows Requests per Period, refilled continuously, with
+// bursts of up to Burst requests. Requests of 0 disables the limit.
+type RateLimitRule struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst"` // defaults to Requests
+	Key      string        `yaml:"key"`   // ip, user or api_key
+}
+
+// Rate limited route groups
+const (
+	RateLimitGroupLogin = "login"
+	RateLimitGroupAPI   = "api"
+	RateLimitGroupWeb   = "web"
+)
+
+// Rate limit keys, requests without a user or API key fall back to ip
+const (
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyUser   = "user"
+	RateLimitKeyAPIKey = "api_key"
+)
+
+// Rule returns the rule of a rate limited route group
+func (c RateLimitConfig) Rule(group string) RateLimitRule {
+	switch group {
+	case RateLimitGroupLogin:
+		return c.Login
+	case RateLimitGroupAPI:
+		return c.API
+	default:
+		return c.Web
+	}
+}
+
+// Enabled reports whether the rule limits requests
+func (r RateLimitRule) Enabled() bool {
+	return r.Requests > 0 && r.Period > 0
+}
+
+// Capacity returns the size of the token bucket
+func (r RateLimitRule) Capacity() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Requests
+}
+
+// MetricsConfig selects where /metrics is served. Without a listen address
+// it is served by the application behind the ViewMetrics security point.
+type MetricsConfig struct {
+	Listen string `yaml:"listen"` // separate unauthenticated listener, e.g. 127.0.0.1:9090
+}
+
+// TracingConfig selects the OpenTelemetry span exporter
+type TracingConfig struct {
+	Exporter      string `yaml:"exporter"`       // none, stdout or otlp
+	Endpoint      string `yaml:"endpoint"`       // OTLP/HTTP collector URL, defaults to OTEL_EXPORTER_OTLP_ENDPOINT
+	SamplePercent int    `yaml:"sample_percent"` // traces started here that are sampled, 0-100
+	ServiceName   string `yaml:"service_name"`
+}
+
+// Tracing exporters
+const (
+	TracingExporterNone   = "none"
+	TracingExporterStdout = "stdout"
+	TracingExporterOTLP   = "otlp"
+)
+
+// Enabled reports whether spans are exported
+func (c TracingConfig) Enabled() bool {
+	return c.Exporter != TracingExporterNone
+}
+
+type RetentionConfig struct {
+	ServerEvents time.Duration `yaml:"server_events"` // archive events older than this, 0 keeps all
+}
+
+type PolicyConfig struct {
+	Dir string `yaml:"dir"` // directory holding secPoints.yaml and groups.yaml
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"` // debug, info, warn or error
+}
+
+// SlogLevel parses the log level
+func (c LogConfig) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return level, fmt.Errorf("unsupported log.level %q, use debug, info, warn or error", c.Level)
+	}
+	return level, nil
+}
+
+// MinJWTSecretLength is the minimum accepted length of the JWT signing key
+const MinJWTSecretLength = 32
+
+// Secrets shipped in examples, never accepted as the JWT signing key
+var weakJWTSecrets = []string{
+	"secret",
+	"secret for jwt tokens",
+	"changeme",
+	"password",
+}
+
+// Default returns the configuration used before any layer is applied
+func Default() Config {
+	return Config{
+		HTTP: HTTPConfig{
+			Port:            8080,
+			ShutdownTimeout: 15 * time.Second,
+		},
+		TLS: TLSConfig{
+			MinVersion:     "1.2",
+			ClientAuth:     "none",
+			ClientIdentity: "cn",
+		},
+		Database: DatabaseConfig{
+			Driver:           "postgres",
+			ConnectRetries:   5,
+			ConnectRetryWait: 2 * time.Second,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"http://localhost:3000", "http://localhost:8080"},
+		},
+		RateLimit: RateLimitConfig{
+			Login: RateLimitRule{Requests: 10, Period: time.Minute, Burst: 5, Key: RateLimitKeyIP},
+			API:   RateLimitRule{Requests: 600, Period: time.Minute, Burst: 100, Key: RateLimitKeyUser},
+			Web:   RateLimitRule{Requests: 300, Period: time.Minute, Burst: 50, Key: RateLimitKeyIP},
+		},
+		Tracing: TracingConfig{
+			Exporter:      TracingExporterNone,
+			SamplePercent: 100,
+			ServiceName:   "go-web",
+		},
+		Headers: HeadersConfig{
+			CSP:               "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'",
+			CSPAPI:            "default-src 'none'; frame-ancestors 'none'",
+			CSPDocs:           "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; frame-ancestors 'none'",
+			HSTS:              "max-age=31536000; includeSubDomains",
+			ReferrerPolicy:    "strict-origin-when-cross-origin",
+			PermissionsPolicy: "geolocation=(),midi=(),sync-xhr=(),microphone=(),camera=(),magnetometer=(),gyroscope=(),fullscreen=(self),payment=()",
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+	}
+}
+
+// ### ###
+// ### ### Settings
+// ### ###
+
+// setting binds a single configuration value to its environment variable and
+// command line flag. The flag name is the dotted YAML path of the value.
+// Reloadable settings are applied by a running server on reload, all others
+// require a restart.
+type setting struct {
+	Key        string
+	Env        string
+	Usage      string
+	Secret     bool
+	Reloadable bool
+	value      any // *string, *int, *bool, *time.Duration or *[]string inside a Config
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{Key: "http.port", Env: "HTTP_PORT", Usage: "HTTP listen port", value: &c.HTTP.Port},
+		{Key: "http.host", Env: "HTTP_HOST", Usage: "expected HTTP host", value: &c.HTTP.Host},
+		{Key: "http.shutdown_timeout", Env: "HTTP_SHUTDOWN_TIMEOUT", Usage: "time allowed for in-flight requests and workers on shutdown", value: &c.HTTP.ShutdownTimeout},
+		{Key: "http.trusted_proxies", Env: "HTTP_TRUSTED_PROXIES", Usage: "comma separated proxy IPs or CIDRs trusted for X-Forwarded-For", value: &c.HTTP.TrustedProxies},
+		{Key: "tls.cert_file", Env: "TLS_CERT_FILE", Usage: "PEM certificate, enables TLS, reloaded when changed", value: &c.TLS.CertFile},
+		{Key: "tls.key_file", Env: "TLS_KEY_FILE", Usage: "PEM private key of the certificate", value: &c.TLS.KeyFile},
+		{Key: "tls.min_version", Env: "TLS_MIN_VERSION", Usage: "minimum TLS version: 1.2 or 1.3", value: &c.TLS.MinVersion},
+		{Key: "tls.client_ca_file", Env: "TLS_CLIENT_CA_FILE", Usage: "PEM CA bundle verifying client certificates", value: &c.TLS.ClientCAFile},
+		{Key: "tls.client_auth", Env: "TLS_CLIENT_AUTH", Usage: "client certificates: none, request or require", value: &c.TLS.ClientAuth},
+		{Key: "tls.client_identity", Env: "TLS_CLIENT_IDENTITY", Usage: "client certificate field matched to usernames: cn or san", value: &c.TLS.ClientIdentity},
+		{Key: "database.driver", Env: "DB_DRIVER", Usage: "database driver: postgres or sqlite", value: &c.Database.Driver},
+		{Key: "database.dsn", Env: "DB_DSN", Usage: "database DSN, or file path for sqlite", Secret: true, value: &c.Database.DSN},
+		{Key: "database.max_open_conns", Env: "DB_MAX_OPEN_CONNS", Usage: "maximum open connections", value: &c.Database.MaxOpenConns},
+		{Key: "database.max_idle_conns", Env: "DB_MAX_IDLE_CONNS", Usage: "maximum idle connections", value: &c.Database.MaxIdleConns},
+		{Key: "database.conn_max_lifetime", Env: "DB_CONN_MAX_LIFETIME", Usage: "maximum connection lifetime", value: &c.Database.ConnMaxLifetime},
+		{Key: "database.statement_timeout", Env: "DB_STATEMENT_TIMEOUT", Usage: "timeout for statements without a deadline", value: &c.Database.StatementTimeout},
+		{Key: "database.connect_retries", Env: "DB_CONNECT_RETRIES", Usage: "connection attempts retried at startup", value: &c.Database.ConnectRetries},
+		{Key: "database.connect_retry_wait", Env: "DB_CONNECT_RETRY_WAIT", Usage: "wait between connection attempts", value: &c.Database.ConnectRetryWait},
+		{Key: "auth.jwt_secret", Env: "SECRET_JWT_KEY", Usage: "JWT signing key", Secret: true, value: &c.Auth.JWTSecret},
+		{Key: "auth.insecure_cookies", Env: "AUTH_INSECURE_COOKIES", Usage: "send browser session cookies over plain HTTP, for local development only", Reloadable: true, value: &c.Auth.InsecureCookies},
+		{Key: "ldap.address", Env: "LDAP_ADDRESS", Usage: "LDAP server URL", value: &c.LDAP.Address},
+		{Key: "ldap.base_dn", Env: "LDAP_BASE_DN", Usage: "LDAP search base DN", value: &c.LDAP.BaseDN},
+		{Key: "ldap.bind_credentials", Env: "LDAP_BIND_CREDENTIALS", Usage: "base64 user:pass for the LDAP bind account", Secret: true, value: &c.LDAP.BindCredentials},
+		{Key: "cli.api_key", Env: "CLI_API_KEY", Usage: "API key used for CLI login", Secret: true, value: &c.CLI.APIKey},
+		{Key: "cli.server", Env: "CLI_SERVER", Usage: "server URL commands run against instead of the database, e.g. https://go-web.example.com", value: &c.CLI.Server},
+		{Key: "cli.ca_file", Env: "CLI_CA_FILE", Usage: "PEM CA bundle verifying the cli.server certificate", value: &c.CLI.CAFile},
+		{Key: "cors.allowed_origins", Env: "CORS_ALLOWED_ORIGINS", Usage: "comma separated origins allowed by CORS", Reloadable: true, value: &c.CORS.AllowedOrigins},
+		{Key: "headers.csp", Env: "HEADERS_CSP", Usage: "Content-Security-Policy of web pages, {nonce} is replaced per request", Reloadable: true, value: &c.Headers.CSP},
+		{Key: "headers.csp_api", Env: "HEADERS_CSP_API", Usage: "Content-Security-Policy of /api and /auth", Reloadable: true, value: &c.Headers.CSPAPI},
+		{Key: "headers.csp_docs", Env: "HEADERS_CSP_DOCS", Usage: "Content-Security-Policy of the swagger UI", Reloadable: true, value: &c.Headers.CSPDocs},
+		{Key: "headers.hsts", Env: "HEADERS_HSTS", Usage: "Strict-Transport-Security sent over HTTPS, empty disables", Reloadable: true, value: &c.Headers.HSTS},
+		{Key: "headers.referrer_policy", Env: "HEADERS_REFERRER_POLICY", Usage: "Referrer-Policy header", Reloadable: true, value: &c.Headers.ReferrerPolicy},
+		{Key: "headers.permissions_policy", Env: "HEADERS_PERMISSIONS_POLICY", Usage: "Permissions-Policy header", Reloadable: true, value: &c.Headers.PermissionsPolicy},
+		{Key: "rate_limit.login.requests", Env: "RATE_LIMIT_LOGIN_REQUESTS", Usage: "login, JWT and user creation requests allowed per period, 0 disables", Reloadable: true, value: &c.RateLimit.Login.Requests},
+		{Key: "rate_limit.login.period", Env: "RATE_LIMIT_LOGIN_PERIOD", Usage: "login, JWT and user creation rate limit period", Reloadable: true, value: &c.RateLimit.Login.Period},
+		{Key: "rate_limit.login.burst", Env: "RATE_LIMIT_LOGIN_BURST", Usage: "login, JWT and user creation requests allowed in a burst", Reloadable: true, value: &c.RateLimit.Login.Burst},
+		{Key: "rate_limit.login.key", Env: "RATE_LIMIT_LOGIN_KEY", Usage: "login, JWT and user creation rate limit key: ip, user or api_key", Reloadable: true, value: &c.RateLimit.Login.Key},
+		{Key: "rate_limit.api.requests", Env: "RATE_LIMIT_API_REQUESTS", Usage: "authenticated API requests allowed per period, 0 disables", Reloadable: true, value: &c.RateLimit.API.Requests},
+		{Key: "rate_limit.api.period", Env: "RATE_LIMIT_API_PERIOD", Usage: "authenticated API rate limit period", Reloadable: true, value: &c.RateLimit.API.Period},
+		{Key: "rate_limit.api.burst", Env: "RATE_LIMIT_API_BURST", Usage: "authenticated API requests allowed in a burst", Reloadable: true, value: &c.RateLimit.API.Burst},
+		{Key: "rate_limit.api.key", Env: "RATE_LIMIT_API_KEY", Usage: "authenticated API rate limit key: ip, user or api_key", Reloadable: true, value: &c.RateLimit.API.Key},
+		{Key: "rate_limit.web.requests", Env: "RATE_LIMIT_WEB_REQUESTS", Usage: "web page requests allowed per period, 0 disables", Reloadable: true, value: &c.RateLimit.Web.Requests},
+		{Key: "rate_limit.web.period", Env: "RATE_LIMIT_WEB_PERIOD", Usage: "web page rate limit period", Reloadable: true, value: &c.RateLimit.Web.Period},
+		{Key: "rate_limit.web.burst", Env: "RATE_LIMIT_WEB_BURST", Usage: "web page requests allowed in a burst", Reloadable: true, value: &c.RateLimit.Web.Burst},
+		{Key: "rate_limit.web.key", Env: "RATE_LIMIT_WEB_KEY", Usage: "web page rate limit key: ip, user or api_key", Reloadable: true, value: &c.RateLimit.Web.Key},
+		{Key: "metrics.listen", Env: "METRICS_LISTEN", Usage: "separate address serving /metrics without authentication", value: &c.Metrics.Listen},
+		{Key: "tracing.exporter", Env: "TRACING_EXPORTER", Usage: "span exporter: none, stdout or otlp", value: &c.Tracing.Exporter},
+		{Key: "tracing.endpoint", Env: "TRACING_ENDPOINT", Usage: "OTLP/HTTP collector URL, e.g. http://localhost:4318", value: &c.Tracing.Endpoint},
+		{Key: "tracing.sample_percent", Env: "TRACING_SAMPLE_PERCENT", Usage: "percentage of new traces sampled, 0-100", value: &c.Tracing.SamplePercent},
+		{Key: "tracing.service_name", Env: "TRACING_SERVICE_NAME", Usage: "service name reported with spans", value: &c.Tracing.ServiceName},
+		{Key: "retention.server_events", Env: "RETENTION_SERVER_EVENTS", Usage: "archive server events older than this, 0 keeps all", Reloadable: true, value: &c.Retention.ServerEvents},
+		{Key: "policy.dir", Env: "POLICY_DIR", Usage: "directory holding secPoints.yaml and groups.yaml", value: &c.Policy.Dir},
+		{Key: "log.level", Env: "LOG_LEVEL", Usage: "lowest level logged: debug, info, warn or error", Reloadable: true, value: &c.Log.Level},
+	}
+}
+
+// SettingInfo describes a setting for generated help and completion
+type SettingInfo struct {
+	Key        string
+	Env        string
+	Usage      string
+	Reloadable bool
+}
+
+// Settings lists the settings in declaration order. Each is set by the
+// --<Key> flag before the mode, or the <Env> variable.
+func Settings() []SettingInfo {
+	var cfg Config
+	settings := cfg.settings()
+	infos := make([]SettingInfo, 0, len(settings))
+	for _, s := range settings {
+		infos = append(infos, SettingInfo{Key: s.Key, Env: s.Env, Usage: s.Usage, Reloadable: s.Reloadable})
+	}
+	return infos
+}
+
+func (s setting) set(raw string) error {
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %w", s.Key, err)
+		}
+		*v = parsed
+	case *bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %w", s.Key, err)
+		}
+		*v = parsed
+	case *time.Duration:
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %w", s.Key, err)
+		}
+		*v = parsed
+	case *[]string:
+		*v = []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*v = append(*v, item)
+			}
+		}
+	}
+	return nil
+}
+
+// copyFrom sets the value of s to the value of other, which must be the same
+// setting of another Config
+func (s setting) copyFrom(other setting) {
+	switch v := s.value.(type) {
+	case *string:
+		*v = *other.value.(*string)
+	case *int:
+		*v = *other.value.(*int)
+	case *bool:
+		*v = *other.value.(*bool)
+	case *time.Duration:
+		*v = *other.value.(*time.Duration)
+	case *[]string:
+		*v = append([]string(nil), *other.value.(*[]string)...)
+	}
+}
+
+func (s setting) String() string {
+	switch v := s.value.(type) {
+	case *string:
+		return *v
+	case *int:
+		return strconv.Itoa(*v)
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *time.Duration:
+		return v.String()
+	case *[]string:
+		return strings.Join(*v, ",")
+	}
+	return ""
+}
+
+func (s setting) isZero() bool {
+	return s.String() == "" || s.String() == "0" || s.String() == "0s" || s.String() == "false"
+}
+
+// ### ###
+// ### ### Loading
+// ### ###
+
+// DefaultConfigFile is read when present and no other file is given
+const DefaultConfigFile = "go-web.yaml"
+
+// Load builds the configuration from defaults, the YAML config file,
+// environment variables and the flags at the start of args, and returns the
+// arguments that follow the flags. The config file is given by --config,
+// then CONFIG_FILE, and otherwise DefaultConfigFile is read if it exists.
+// The result is not validated.
+func Load(args []string) (Config, []string, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	fs, configFile := newFlagSet(settings)
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	// YAML file
+	path, required := filePath(*configFile)
+	if err := cfg.loadFile(path, required); err != nil {
+		return cfg, nil, err
+	}
+
+	// Environment
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.Env); ok && value != "" {
+			if err := s.set(value); err != nil {
+				return cfg, nil, fmt.Errorf("%v: %w", s.Env, err)
+			}
+		}
+	}
+
+	// Flags, only those given on the command line
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.Key == f.Name && flagErr == nil {
+				flagErr = s.set(f.Value.String())
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, nil, flagErr
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// FilePath returns the config file Load reads with the given flags, which
+// may not exist yet
+func FilePath(args []string) string {
+	cfg := Default()
+	fs, configFile := newFlagSet(cfg.settings())
+	if err := fs.Parse(args); err != nil {
+		return ""
+	}
+	path, _ := filePath(*configFile)
+	return path
+}
+
+func newFlagSet(settings []setting) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("go-web", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", "", "path to YAML config file")
+	for _, s := range settings {
+		fs.String(s.Key, "", fmt.Sprintf("%v (env %v)", s.Usage, s.Env))
+	}
+	return fs, configFile
+}
+
+// filePath resolves the config file from the --config flag, CONFIG_FILE and
+// DefaultConfigFile, which is the only one not required to exist
+func filePath(flagValue string) (path string, required bool) {
+	if flagValue != "" {
+		return flagValue, true
+	}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path, true
+	}
+	return DefaultConfigFile, false
+}
+
+func (c *Config) loadFile(path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	c.File = path
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %v: %w", path, err)
+	}
+	return nil
+}
+
+// ### ###
+// ### ### Validation
+// ### ###
+
+// Validate reports every missing, malformed or weak value
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.HTTP.Port < 1 || c.HTTP.Port > 65535 {
+		errs = append(errs, fmt.Errorf("http.port must be between 1 and 65535, got %d", c.HTTP.Port))
+	}
+	if c.HTTP.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("http.shutdown_timeout must not be negative"))
+	}
+
+	if c.TLS.Enabled() || c.TLS.KeyFile != "" {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			errs = append(errs, fmt.Errorf("tls.cert_file and tls.key_file must be set together"))
+		}
+	}
+	if _, err := c.TLS.Version(); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.TLS.ClientAuth {
+	case "none":
+	case "request", "require":
+		if !c.TLS.Enabled() || c.TLS.ClientCAFile == "" {
+			errs = append(errs, fmt.Errorf("tls.client_auth %q requires tls.cert_file and tls.client_ca_file", c.TLS.ClientAuth))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported tls.client_auth %q, use none, request or require", c.TLS.ClientAuth))
+	}
+	if c.TLS.ClientIdentity != "cn" && c.TLS.ClientIdentity != "san" {
+		errs = append(errs, fmt.Errorf("unsupported tls.client_identity %q, use cn or san", c.TLS.ClientIdentity))
+	}
+
+	if c.Database.Driver != "postgres" && c.Database.Driver != "sqlite" {
+		errs = append(errs, fmt.Errorf("unsupported database driver: %q", c.Database.Driver))
+	}
+	if c.Database.DSN == "" {
+		errs = append(errs, fmt.Errorf("database DSN is required (DB_DSN)"))
+	}
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 || c.Database.ConnectRetries < 0 {
+		errs = append(errs, fmt.Errorf("database connection counts must not be negative"))
+	}
+
+	if err := validateJWTSecret(c.Auth.JWTSecret); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.LDAP.Enabled() || c.LDAP.BaseDN != "" || c.LDAP.BindCredentials != "" {
+		if c.LDAP.Address == "" || c.LDAP.BaseDN == "" || c.LDAP.BindCredentials == "" {
+			errs = append(errs, fmt.Errorf("ldap.address, ldap.base_dn and ldap.bind_credentials must be set together"))
+		} else if _, _, err := c.LDAP.DecodeBindCredentials(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, group := range []string{RateLimitGroupLogin, RateLimitGroupAPI, RateLimitGroupWeb} {
+		rule := c.RateLimit.Rule(group)
+		if rule.Requests < 0 || rule.Burst < 0 || rule.Period < 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.%v values must not be negative", group))
+		}
+		if rule.Requests > 0 && rule.Period == 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.%v.period is required", group))
+		}
+		switch rule.Key {
+		case RateLimitKeyIP, RateLimitKeyUser, RateLimitKeyAPIKey:
+		default:
+			errs = append(errs, fmt.Errorf("unsupported rate_limit.%v.key %q, use ip, user or api_key", group, rule.Key))
+		}
+	}
+
+	if err := c.CLI.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("invalid metrics.listen: %w", err))
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case TracingExporterNone, TracingExporterStdout, TracingExporterOTLP:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported tracing.exporter %q, use none, stdout or otlp", c.Tracing.Exporter))
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint must be an http or https URL, got %q", c.Tracing.Endpoint))
+		}
+	}
+	if c.Tracing.SamplePercent < 0 || c.Tracing.SamplePercent > 100 {
+		errs = append(errs, fmt.Errorf("tracing.sample_percent must be between 0 and 100, got %d", c.Tracing.SamplePercent))
+	}
+
+	if c.Retention.ServerEvents < 0 {
+		errs = append(errs, fmt.Errorf("retention.server_events must not be negative"))
+	}
+
+	if _, err := c.Log.SlogLevel(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateJWTSecret(secret string) error {
+	if secret == "" {
+		return fmt.Errorf("JWT signing key is required (SECRET_JWT_KEY)")
+	}
+	for _, weak := range weakJWTSecrets {
+		if strings.EqualFold(secret, weak) {
+			return fmt.Errorf("JWT signing key is a known example value, generate a random key")
+		}
+	}
+	if len(secret) < MinJWTSecretLength {
+		return fmt.Errorf("JWT signing key must be at least %d characters, got %d", MinJWTSecretLength, len(secret))
+	}
+	return nil
+}
+
+// DecodeBindCredentials decodes the base64 user:pass bind credentials
+func (c LDAPConfig) DecodeBindCredentials() (string, string, error) {
+	decoded, err := b64.StdEncoding.DecodeString(c.BindCredentials)
+	if err != nil {
+		return "", "", fmt.Errorf("ldap.bind_credentials is not valid base64: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", fmt.Errorf("ldap.bind_credentials must encode user:pass")
+	}
+	return username, password, nil
+}
+
+// ### ###
+// ### ### Reloading
+// ### ###
+
+// Change is a single setting that differs between two configurations
+type Change struct {
+	Key        string
+	Old        string
+	New        string
+	Reloadable bool
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%v: %q -> %q", c.Key, c.Old, c.New)
+	if !c.Reloadable {
+		s += " (ignored, restart required)"
+	}
+	return s
+}
+
+// Diff lists the settings that differ between old and new, in declaration
+// order. Secret values are never included.
+func Diff(old, new Config) []Change {
+	oldSettings, newSettings := old.settings(), new.settings()
+
+	var changes []Change
+	for i, o := range oldSettings {
+		n := newSettings[i]
+		if o.String() == n.String() {
+			continue
+		}
+		change := Change{Key: o.Key, Old: o.String(), New: n.String(), Reloadable: o.Reloadable}
+		if o.Secret {
+			change.Old, change.New = redacted, redacted
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// WithReloadable returns a copy of the configuration with the reloadable
+// settings taken from next
+func (c Config) WithReloadable(next Config) Config {
+	out := c
+	nextSettings := next.settings()
+	for i, s := range out.settings() {
+		if s.Reloadable {
+			s.copyFrom(nextSettings[i])
+		}
+	}
+	return out
+}
+
+// ### ###
+// ### ### Printing
+// ### ###
+
+const redacted = "REDACTED"
+
+var (
+	dsnPasswordKV  = regexp.MustCompile(`(?i)(password=)(\S+)`)
+	dsnPasswordURL = regexp.MustCompile(`(://[^:/@]+:)([^@]+)(@)`)
+)
+
+// Redacted returns a copy of the configuration with secrets masked. The
+// database DSN keeps everything but its password.
+func (c Config) Redacted() Config {
+	out := c
+	for _, s := range out.settings() {
+		if !s.Secret || s.isZero() {
+			continue
+		}
+		if s.Key == "database.dsn" {
+			dsn := dsnPasswordKV.ReplaceAllString(out.Database.DSN, "${1}"+redacted)
+			out.Database.DSN = dsnPasswordURL.ReplaceAllString(dsn, "${1}"+redacted+"${3}")
+			continue
+		}
+		s.set(redacted)
+	}
+	return out
+}
+
+// YAML renders the configuration in config file format
+func (c Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// ### ###
+// ### ### Current Configuration
+// ### ###
+
+var current atomic.Pointer[Config]
+
+// LogLevel is the lowest level logged, set from log.level by SetConfig so
+// loggers pick up a reloaded level
+var LogLevel = new(slog.LevelVar)
+
+// SetConfig installs the configuration returned by GetConfig. The
+// configuration is loaded and validated by the caller (main or the test
+// suite) and injected here.
+func SetConfig(cfg Config) {
+	current.Store(&cfg)
+	if level, err := cfg.Log.SlogLevel(); err == nil {
+		LogLevel.Set(level)
+	}
+}
+
+// GetConfig returns the configuration installed with SetConfig, or the
+// defaults if none has been installed
+func GetConfig() Config {
+	if cfg := current.Load(); cfg != nil {
+		return *cfg
+	}
+	return Default()
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUsersExist          = errors.New("users already exist, create_superuser only runs on an empty database")
+	ErrRecoveryCodeInvalid = errors.New("invalid, expired or used recovery code")
+)
+
+// SuperuserGroupID is the group the bootstrap and recovery users join
+const SuperuserGroupID uint = 1
+
+// RecoveryCodeTTL is how long an issued recovery code is valid
+const RecoveryCodeTTL = 24 * time.Hour
+
+// RecoveryCode is a one-time break-glass recovery code. Only the SHA-256 hash
+// of the code is stored, the code itself is only printed by the command
+// issuing it.
+type RecoveryCode struct {
+	gorm.Model
+	ServerRunID string
+	CodeHash    string `gorm:"uniqueIndex"`
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+	UsedBy      string
+}
+
+// ### ###
+// ### ### Bootstrap
+// ### ###
+
+// BootstrapSuperuser seeds the security points and groups and creates the
+// first user as a member of the superuser group, all in one transaction. It
+// returns ErrUsersExist once any user, including soft deleted users, exists.
+func (r *Repository) BootstrapSuperuser(ctx context.Context, input NewUser, secPoints []SecPoint, groups []GroupYAML) (*User, error) {
+	var user *User
+	err := r.Transaction(ctx, func(tx *Repository) error {
+		db := tx.db.WithContext(ctx)
+
+		// Keep concurrent bootstraps from both seeing an empty table
+		if db.Dialector.Name() == DriverPostgres {
+			if err := db.Exec("LOCK TABLE users IN EXCLUSIVE MODE").Error; err != nil {
+				return fmt.Errorf("failed to lock users: %w", err)
+			}
+		}
+		hasUsers, err := tx.HasUsers(ctx)
+		if err != nil {
+			return err
+		}
+		if hasUsers {
+			return ErrUsersExist
+		}
+
+		if err := tx.CreateSecPoints(ctx, secPoints); err != nil {
+			return err
+		}
+		if err := tx.CreateGroups(ctx, groups); err != nil {
+			return err
+		}
+		if user, err = tx.CreateUser(ctx, input); err != nil {
+			return err
+		}
+		if err := tx.AddUserToGroups(ctx, user.ID, []uint{SuperuserGroupID}); err != nil {
+			return err
+		}
+
+		details := fmt.Sprintf("Superuser created: %v\nSecurity points seeded: %v\nGroups seeded: %v", user.Username, len(secPoints), len(groups))
+		return tx.LogServerEvent(ctx, "BootstrapSuperuser", details, "INFO")
+	})
+	if err != nil {
+		if !errors.Is(err, ErrUsersExist) {
+			_ = r.LogServerError(ctx, "BootstrapSuperuser:Failed", err, "Username: "+input.Username)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// HasUsers reports whether any user, including soft deleted users, exists
+func (r *Repository) HasUsers(ctx context.Context) (bool, error) {
+	var count int64
+	if err := r.db.WithContext(ctx).Unscoped().Model(&User{}).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to count users: %w", err)
+	}
+	return count > 0, nil
+}
+
+// ### ###
+// ### ### Break-glass Recovery
+// ### ###
+
+// IssueRecoveryCode replaces the unused recovery codes with a new one-time
+// code and returns it. The code is valid for RecoveryCodeTTL.
+func (r *Repository) IssueRecoveryCode(ctx context.Context) (string, time.Time, error) {
+	code, err := GenerateRandomString(24)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	expiresAt := time.Now().Add(RecoveryCodeTTL).UTC()
+
+	err = r.Transaction(ctx, func(tx *Repository) error {
+		db := tx.db.WithContext(ctx)
+		if err := db.Unscoped().Where("used_at IS NULL").Delete(&RecoveryCode{}).Error; err != nil {
+			return fmt.Errorf("failed to revoke recovery codes: %w", err)
+		}
+		recoveryCode := &RecoveryCode{
+			ServerRunID: ServerRunID,
+			CodeHash:    hashRecoveryCode(code),
+			ExpiresAt:   expiresAt,
+		}
+		if err := db.Create(recoveryCode).Error; err != nil {
+			return fmt.Errorf("failed to save recovery code: %w", err)
+		}
+		return tx.LogServerEvent(ctx, "IssueRecoveryCode", "Recovery code issued, valid until "+expiresAt.Format(time.RFC3339), "INFO")
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return code, expiresAt, nil
+}
+
+// RecoverSuperuser consumes a recovery code and restores access for an
+// existing user: the user is undeleted, switched to a local password and
+// added to the superuser group. Failed attempts are logged.
+func (r *Repository) RecoverSuperuser(ctx context.Context, code string, username string, password string, operator string) error {
+	err := r.Transaction(ctx, func(tx *Repository) error {
+		db := tx.db.WithContext(ctx)
+
+		// Consume the code, a concurrent recovery finds it used
+		now := time.Now().UTC()
+		result := db.Model(&RecoveryCode{}).
+			Where("code_hash = ? AND used_at IS NULL AND expires_at > ?", hashRecoveryCode(code), now).
+			Updates(map[string]any{"used_at": now, "used_by": operator})
+		if result.Error != nil {
+			return fmt.Errorf("failed to check recovery code: %w", result.Error)
+		}
+		if result.RowsAffected != 1 {
+			return ErrRecoveryCodeInvalid
+		}
+
+		user, err := tx.GetUser(ctx, username)
+		if err != nil {
+			return err
+		}
+		if user.DeletedAt.Valid {
+			if err := db.Unscoped().Model(&User{}).Where("id", user.ID).Update("deleted_at", nil).Error; err != nil {
+				return fmt.Errorf("failed to undelete user %v: %w", username, err)
+			}
+		}
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return errors.New("error generating password hash")
+		}
+		err = db.Model(&User{}).Where("id", user.ID).Updates(map[string]any{
+			"password":     string(passwordHash),
+			"is_ldap_user": false,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to reset user %v: %w", username, err)
+		}
+		groupIDs, err := tx.UserGroupIDs(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(groupIDs, SuperuserGroupID) {
+			if err := tx.AddUserToGroups(ctx, user.ID, []uint{SuperuserGroupID}); err != nil {
+				return err
+			}
+		}
+
+		details := fmt.Sprintf("Superuser access recovered: %v\nOperator: %v\nUndeleted: %v", username, operator, user.DeletedAt.Valid)
+		return tx.LogServerEvent(ctx, "BreakGlassRecovery", details, "WARN")
+	})
+	if err != nil {
+		_ = r.LogServerError(ctx, "BreakGlassRecovery:Refused", err, fmt.Sprintf("Username: %v\nOperator: %v", username, operator))
+	}
+	return err
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
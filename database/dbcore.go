@@ -1,65 +1,301 @@
 package database
 
 import (
-	"flag"
-	"os"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
 
+	"github.com/javitab/go-web/config"
+	"github.com/javitab/go-web/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-var IsTestRunning bool
-
 var db_conn *gorm.DB
 
-func MigrateSchemas(db *gorm.DB) {
-	// Migrate the schema
-	db.AutoMigrate(ServerEvent{})
-	db.AutoMigrate(User{})
-	db.AutoMigrate(APIKey{})
-	db.AutoMigrate(Group{})
-	db.AutoMigrate(SecPoint{})
+// ErrDBNotInitialized is returned when no database handle is installed with
+// SetDBConn
+var ErrDBNotInitialized = errors.New("database connection not initialized")
 
+// DBConfig configures the database driver and connection pool
+type DBConfig struct {
+	Driver           string
+	DSN              string
+	MaxOpenConns     int
+	MaxIdleConns     int
+	ConnMaxLifetime  time.Duration
+	StatementTimeout time.Duration
+	ConnectRetries   int
+	ConnectRetryWait time.Duration
 }
 
-func GetDBConn() *gorm.DB {
-	if db_conn != nil {
-		return db_conn
+// Supported database drivers
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// NewDBConfig returns the database configuration from the application
+// configuration
+func NewDBConfig(cfg config.DatabaseConfig) DBConfig {
+	return DBConfig{
+		Driver:           cfg.Driver,
+		DSN:              cfg.DSN,
+		MaxOpenConns:     cfg.MaxOpenConns,
+		MaxIdleConns:     cfg.MaxIdleConns,
+		ConnMaxLifetime:  cfg.ConnMaxLifetime,
+		StatementTimeout: cfg.StatementTimeout,
+		ConnectRetries:   cfg.ConnectRetries,
+		ConnectRetryWait: cfg.ConnectRetryWait,
+	}
+}
+
+// Validate checks the configuration for unsupported or missing values
+func (cfg DBConfig) Validate() error {
+	if cfg.Driver != DriverPostgres && cfg.Driver != DriverSQLite {
+		return fmt.Errorf("unsupported database driver: %q", cfg.Driver)
+	}
+	if cfg.DSN == "" {
+		return fmt.Errorf("database DSN is required")
 	}
-	if flag.Lookup("test.v") == nil {
-		dsn := os.Getenv("DB_DSN")
-		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if cfg.MaxOpenConns < 0 || cfg.MaxIdleConns < 0 || cfg.ConnectRetries < 0 {
+		return fmt.Errorf("database connection counts must not be negative")
+	}
+	return nil
+}
+
+// OpenDB opens a connection pool for the configured driver without checking
+// connectivity
+func OpenDB(cfg DBConfig) (*gorm.DB, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var dialector gorm.Dialector
+	switch cfg.Driver {
+	case DriverPostgres:
+		dialector = postgres.Open(cfg.DSN)
+	case DriverSQLite:
+		dialector = sqlite.Open(cfg.DSN)
+		// SQLite allows a single writer, serialize access unless configured
+		if cfg.MaxOpenConns == 0 {
+			cfg.MaxOpenConns = 1
+		}
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v database: %w", cfg.Driver, err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+
+	if cfg.StatementTimeout > 0 {
+		if err := registerStatementTimeout(db, cfg.StatementTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := registerTracing(db, cfg.Driver); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// ConnectDB opens the database and pings it, retrying with a fixed wait
+// between attempts so the server can start alongside its database
+func ConnectDB(cfg DBConfig) (*gorm.DB, error) {
+	var err error
+	for attempt := 0; attempt <= cfg.ConnectRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Database connection attempt %d failed: %v, retrying in %v", attempt, err, cfg.ConnectRetryWait)
+			time.Sleep(cfg.ConnectRetryWait)
+		}
+
+		var db *gorm.DB
+		db, err = OpenDB(cfg)
 		if err != nil {
-			panic("failed to connect database")
+			continue
+		}
+		if err = PingDB(context.Background(), db); err != nil {
+			if sqlDB, dbErr := db.DB(); dbErr == nil {
+				sqlDB.Close()
+			}
+			continue
 		}
-		db_conn = db
-		return db_conn
-	} else {
-		return GetTestDBConn()
+		return db, nil
 	}
+	return nil, fmt.Errorf("unable to connect to database after %d attempt(s): %w", cfg.ConnectRetries+1, err)
+}
 
+// PingDB checks connectivity of the underlying connection pool
+func PingDB(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// registerStatementTimeout bounds every statement that does not already
+// carry a deadline. The results of Row and Rows are read after the callbacks
+// return, so their context is released when the timeout fires rather than
+// when the statement ends, which also bounds the reading of the rows.
+func registerStatementTimeout(db *gorm.DB, timeout time.Duration) error {
+	const cancelKey = "statement_timeout:cancel"
+
+	begin := func(tx *gorm.DB) {
+		if _, ok := tx.Statement.Context.Deadline(); ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(tx.Statement.Context, timeout)
+		tx.Statement.Context = ctx
+		tx.InstanceSet(cancelKey, cancel)
+	}
+	end := func(tx *gorm.DB) {
+		if cancel, ok := tx.InstanceGet(cancelKey); ok {
+			cancel.(context.CancelFunc)()
+		}
+	}
+	beginRow := func(tx *gorm.DB) {
+		if _, ok := tx.Statement.Context.Deadline(); ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(tx.Statement.Context, timeout)
+		tx.Statement.Context = ctx
+		time.AfterFunc(timeout, cancel)
+	}
+
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("*").Register("statement_timeout:begin_create", begin),
+		callbacks.Create().After("*").Register("statement_timeout:end_create", end),
+		callbacks.Query().Before("*").Register("statement_timeout:begin_query", begin),
+		callbacks.Query().After("*").Register("statement_timeout:end_query", end),
+		callbacks.Update().Before("*").Register("statement_timeout:begin_update", begin),
+		callbacks.Update().After("*").Register("statement_timeout:end_update", end),
+		callbacks.Delete().Before("*").Register("statement_timeout:begin_delete", begin),
+		callbacks.Delete().After("*").Register("statement_timeout:end_delete", end),
+		callbacks.Row().Before("*").Register("statement_timeout:begin_row", beginRow),
+		callbacks.Raw().Before("*").Register("statement_timeout:begin_raw", begin),
+		callbacks.Raw().After("*").Register("statement_timeout:end_raw", end),
+	)
+}
+
+// registerTracing wraps every statement in a span of the trace of its
+// context. Spans record the SQL with placeholders, never the bound values.
+func registerTracing(db *gorm.DB, driver string) error {
+	const spanKey = "tracing:span"
+
+	begin := func(operation string) func(tx *gorm.DB) {
+		return func(tx *gorm.DB) {
+			ctx, span := tracing.Tracer().Start(tx.Statement.Context, "gorm."+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(semconv.DBSystemKey.String(driver), semconv.DBOperationName(operation)),
+			)
+			tx.Statement.Context = ctx
+			tx.InstanceSet(spanKey, span)
+		}
+	}
+	end := func(tx *gorm.DB) {
+		value, ok := tx.InstanceGet(spanKey)
+		if !ok {
+			return
+		}
+		span := value.(trace.Span)
+		defer span.End()
+		span.SetAttributes(
+			semconv.DBQueryText(tx.Statement.SQL.String()),
+			semconv.DBCollectionName(tx.Statement.Table),
+			attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+		)
+		if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			tracing.SetError(span, tx.Error)
+		}
+	}
+
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("*").Register("tracing:begin_create", begin("create")),
+		callbacks.Create().After("*").Register("tracing:end_create", end),
+		callbacks.Query().Before("*").Register("tracing:begin_query", begin("query")),
+		callbacks.Query().After("*").Register("tracing:end_query", end),
+		callbacks.Update().Before("*").Register("tracing:begin_update", begin("update")),
+		callbacks.Update().After("*").Register("tracing:end_update", end),
+		callbacks.Delete().Before("*").Register("tracing:begin_delete", begin("delete")),
+		callbacks.Delete().After("*").Register("tracing:end_delete", end),
+		callbacks.Row().Before("*").Register("tracing:begin_row", begin("row")),
+		callbacks.Row().After("*").Register("tracing:end_row", end),
+		callbacks.Raw().Before("*").Register("tracing:begin_raw", begin("raw")),
+		callbacks.Raw().After("*").Register("tracing:end_raw", end),
+	)
 }
 
-func GetTestDBConn() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
+// SetDBConn installs the database handle used by GetDBConn. The handle is
+// opened by the caller (main or the test suite) and injected here.
+func SetDBConn(db *gorm.DB) {
+	db_conn = db
+}
+
+// DBConn returns the database handle installed with SetDBConn, or
+// ErrDBNotInitialized
+func DBConn() (*gorm.DB, error) {
+	if db_conn == nil {
+		return nil, ErrDBNotInitialized
+	}
+	return db_conn, nil
+}
+
+// GetDBConn returns the database handle installed with SetDBConn, for code
+// that only runs once main has connected, such as request handlers. Other
+// code gets a Repository passed in, or uses DBConn.
+func GetDBConn() *gorm.DB {
+	db, err := DBConn()
 	if err != nil {
-		panic("failed to connect test database")
+		panic(err)
 	}
 	return db
 }
 
+// CloseDBConn closes the installed database handle, if any
+func CloseDBConn() error {
+	if db_conn == nil {
+		return nil
+	}
+	sqlDB, err := db_conn.DB()
+	db_conn = nil
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// InitializeDB refuses to continue unless the schema of the installed
+// database matches the migrations known to this build
 func InitializeDB() {
 	// Get the database connection
 	db := GetDBConn()
-	MigrateSchemas(db)
-
-}
-
-func InitializeTestDB() {
-	// Get Database
-
-	db := GetTestDBConn()
-	MigrateSchemas(db)
+	if err := CheckSchema(db); err != nil {
+		log.Fatalf("Database schema check failed: %v", err)
+	}
 
 }
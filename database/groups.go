@@ -1,9 +1,10 @@
 package database
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
+	"strconv"
 
 	"github.com/javitab/go-web/config"
 	"gopkg.in/yaml.v3"
@@ -67,104 +68,128 @@ func LoadGroupsFromEmbed() ([]GroupYAML, error) {
 	return groups, nil
 }
 
-// CreateGroups creates groups in the database from a YAML file
-func CreateGroups(filePath *string) {
+// CreateGroups creates groups in the database from a YAML file, or from the
+// embedded defaults when filePath is nil
+func CreateGroups(filePath *string) error {
 	var groupYAMLs []GroupYAML
 	var err error
 	if filePath != nil {
 		groupYAMLs, err = LoadGroupsFromYAML(*filePath)
-		if err != nil {
-			log.Fatalf("Error loading groups from YAML: %v\n", err)
-		}
 	} else {
 		groupYAMLs, err = LoadGroupsFromEmbed()
-		if err != nil {
-			log.Fatalf("Error loading groups from YAML Embed: %v\n", err)
-		}
+	}
+	if err != nil {
+		return fmt.Errorf("error loading groups from YAML: %w", err)
 	}
 
-	db := GetDBConn()
-	for _, groupYAML := range groupYAMLs {
-		fmt.Printf("Evaluating Group: %v\n", groupYAML.ID)
-		// Check if the Group already exists
-		var existingGroup Group
-		db.Where("id = ?", groupYAML.ID).First(&existingGroup)
-
-		var AddSecPoints []SecPoint
-		var DelSecPoints []SecPoint
-		var OvrSecPoints []SecPoint
-
-		// Eval OvrSecPoints
-		for _, spid := range groupYAML.OvrSecPoints {
-			var secPoint SecPoint
-			db.Where("id = ?", spid).Find(&secPoint)
-			if secPoint.ID != 0 {
-				OvrSecPoints = append(OvrSecPoints, secPoint)
-			} else {
-				LogServerError("CreateGroups:NewGroup:EvalOvrSecPoints",
-					fmt.Errorf("security point with SPID %v does not exist", spid),
-					fmt.Sprintf("Group %v", groupYAML.Name))
-			}
-		}
-
-		// Eval AddSecPoints
-		for _, spid := range groupYAML.AddSecPoints {
-			var secPoint SecPoint
-			db.Where("id = ?", spid).First(&secPoint)
-			if secPoint.ID != 0 {
-				AddSecPoints = append(AddSecPoints, secPoint)
-			} else {
-				LogServerError("CreateGroups:NewGroup:EvalAddSecPoints",
-					fmt.Errorf("security point with SPID %v does not exist", spid),
-					fmt.Sprintf("Group %v", groupYAML.Name))
-			}
-		}
+	if err := DefaultRepository().CreateGroups(context.Background(), groupYAMLs); err != nil {
+		LogServerError("CreateGroups:CreateOrUpdateGroup", err, "Error creating groups")
+		return err
+	}
+	return nil
+}
 
-		// Eval DelSecPoints
-		for _, spid := range groupYAML.DelSecPoints {
-			var secPoint SecPoint
-			db.Where("id = ?", spid).First(&secPoint)
-			if secPoint.ID != 0 {
-				DelSecPoints = append(DelSecPoints, secPoint)
-			} else {
-				LogServerError("CreateGroups:NewGroup:EvalDelSecPoints",
-					fmt.Errorf("security point with SPID %v does not exist", spid),
-					fmt.Sprintf("Group %v", groupYAML.Name))
+// CreateGroups creates the given groups, or updates their security points
+// and LDAP group if they already exist. All groups are written in a single
+// transaction, so a group referencing a missing security point leaves the
+// database unchanged. The error names the failed group and is not logged
+// here: called within a caller's transaction, the event would be rolled back
+// with it, and on Postgres refused as the transaction is aborted. The
+// outermost caller logs it.
+func (r *Repository) CreateGroups(ctx context.Context, groupYAMLs []GroupYAML) error {
+	return r.Transaction(ctx, func(tx *Repository) error {
+		for _, groupYAML := range groupYAMLs {
+			if err := tx.createOrUpdateGroup(ctx, groupYAML); err != nil {
+				return fmt.Errorf("group %v: %w", groupYAML.Name, err)
 			}
 		}
+		return nil
+	})
+}
 
-		// If the Group does not exist, create it
-		if existingGroup.ID == 0 {
-
-			fmt.Println("No group found, creating new group")
-
-			group := Group{
-				ID:           groupYAML.ID,
-				Name:         groupYAML.Name,
-				Desc:         groupYAML.Desc,
-				LDAPGroup:    groupYAML.LDAPGroup,
-				AddSecPoints: AddSecPoints,
-				DelSecPoints: DelSecPoints,
-				OvrSecPoints: OvrSecPoints,
-			}
-			db.Create(&group)
+// FindGroup loads a group with its security points by name, or by ID when
+// ref is numeric. The group has ID 0 when none matches.
+func (r *Repository) FindGroup(ctx context.Context, ref string) (Group, error) {
+	query := r.db.WithContext(ctx).
+		Preload("AddSecPoints").Preload("DelSecPoints").Preload("OvrSecPoints")
+	if id, err := strconv.Atoi(ref); err == nil {
+		query = query.Where("id = ?", id)
+	} else {
+		query = query.Where("name = ?", ref)
+	}
+	var group Group
+	if err := query.Limit(1).Find(&group).Error; err != nil {
+		return group, fmt.Errorf("failed to look up group %v: %w", ref, err)
+	}
+	return group, nil
+}
 
-		} else {
+// ListGroups returns the groups with their security points, by priority
+func (r *Repository) ListGroups(ctx context.Context) ([]Group, error) {
+	var groups []Group
+	err := r.db.WithContext(ctx).
+		Preload("AddSecPoints").Preload("DelSecPoints").Preload("OvrSecPoints").
+		Order("priority").Order("id").Find(&groups).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+	return groups, nil
+}
 
-			fmt.Printf("Existing Group Found: %v\n", existingGroup.ID)
+func (r *Repository) createOrUpdateGroup(ctx context.Context, groupYAML GroupYAML) error {
+	db := r.db.WithContext(ctx)
 
-			// Clear existing Security Point Relationships
-			db.Exec("delete from group_add_sec_points where group_id = ?", existingGroup.ID)
-			db.Exec("delete from group_del_sec_points where group_id = ?", existingGroup.ID)
-			db.Exec("delete from group_ovr_sec_points where group_id = ?", existingGroup.ID)
+	AddSecPoints, err := r.secPointsByID(ctx, groupYAML.AddSecPoints)
+	if err != nil {
+		return err
+	}
+	DelSecPoints, err := r.secPointsByID(ctx, groupYAML.DelSecPoints)
+	if err != nil {
+		return err
+	}
+	OvrSecPoints, err := r.secPointsByID(ctx, groupYAML.OvrSecPoints)
+	if err != nil {
+		return err
+	}
 
-			existingGroup.AddSecPoints = AddSecPoints
-			existingGroup.DelSecPoints = DelSecPoints
-			existingGroup.OvrSecPoints = OvrSecPoints
-			existingGroup.LDAPGroup = groupYAML.LDAPGroup
+	// Check if the Group already exists
+	var existingGroup Group
+	if err := db.Where("id = ?", groupYAML.ID).Limit(1).Find(&existingGroup).Error; err != nil {
+		return fmt.Errorf("failed to look up group %v: %w", groupYAML.ID, err)
+	}
 
-			db.Save(existingGroup)
+	// If the Group does not exist, create it
+	if existingGroup.ID == 0 {
+		group := Group{
+			ID:           groupYAML.ID,
+			Priority:     groupYAML.Priority,
+			Name:         groupYAML.Name,
+			Desc:         groupYAML.Desc,
+			LDAPGroup:    groupYAML.LDAPGroup,
+			AddSecPoints: AddSecPoints,
+			DelSecPoints: DelSecPoints,
+			OvrSecPoints: OvrSecPoints,
+		}
+		if err := db.Create(&group).Error; err != nil {
+			return fmt.Errorf("failed to create group: %w", err)
+		}
+		return nil
+	}
 
+	// Replace existing Security Point Relationships
+	replacements := map[string][]SecPoint{
+		"AddSecPoints": AddSecPoints,
+		"DelSecPoints": DelSecPoints,
+		"OvrSecPoints": OvrSecPoints,
+	}
+	for field, secPoints := range replacements {
+		if err := db.Model(&existingGroup).Association(field).Replace(secPoints); err != nil {
+			return fmt.Errorf("failed to replace %v: %w", field, err)
 		}
 	}
+
+	if err := db.Model(&existingGroup).Update("ldap_group", groupYAML.LDAPGroup).Error; err != nil {
+		return fmt.Errorf("failed to update LDAP group: %w", err)
+	}
+	return nil
 }
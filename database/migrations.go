@@ -0,0 +1,410 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "github.com/javitab/go-web/database/schema/v1"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSchemaBehind = errors.New("database schema is behind, run: go-web migrate up")
+	ErrSchemaAhead  = errors.New("database schema is ahead of this build")
+)
+
+// Migration is a single versioned schema change. Up and Down run inside a
+// transaction together with the schema_migrations bookkeeping.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   uint `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationState describes a migration known to this build and/or recorded
+// in the database
+type MigrationState struct {
+	Version   uint       `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at"`
+	Known     bool       `json:"known"`
+}
+
+// Migrations lists all schema migrations in version order. New migrations
+// must be appended with the next version number; applied migrations must
+// never be edited. Migrations that create tables use the frozen model
+// snapshots in database/schema rather than the live models.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(
+				&v1.ServerEvent{},
+				&v1.User{},
+				&v1.APIKey{},
+				&v1.Group{},
+				&v1.SecPoint{},
+			)
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(
+				"user_groups",
+				"user_add_sec_points",
+				"user_del_sec_points",
+				"user_ovr_sec_points",
+				"group_add_sec_points",
+				"group_del_sec_points",
+				"group_ovr_sec_points",
+				&v1.APIKey{},
+				&v1.User{},
+				&v1.Group{},
+				&v1.SecPoint{},
+				&v1.ServerEvent{},
+			)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "server_event_request_id",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&serverEventRequestID{}, "RequestID"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&serverEventRequestID{}, "RequestID")
+		},
+		Down: func(tx *gorm.DB) error {
+			// SQLite drops the indexes of server_events when rebuilding it
+			// to drop a later column
+			if tx.Migrator().HasIndex(&serverEventRequestID{}, "RequestID") {
+				if err := tx.Migrator().DropIndex(&serverEventRequestID{}, "RequestID"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&serverEventRequestID{}, "RequestID")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "server_event_trace_id",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&serverEventTraceID{}, "TraceID"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&serverEventTraceID{}, "TraceID")
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Migrator().HasIndex(&serverEventTraceID{}, "TraceID") {
+				if err := tx.Migrator().DropIndex(&serverEventTraceID{}, "TraceID"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&serverEventTraceID{}, "TraceID")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "recovery_codes",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&recoveryCodeV4{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&recoveryCodeV4{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "server_event_username",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&serverEventUsername{}, "Username"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&serverEventUsername{}, "Username")
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Migrator().HasIndex(&serverEventUsername{}, "Username") {
+				if err := tx.Migrator().DropIndex(&serverEventUsername{}, "Username"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&serverEventUsername{}, "Username")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "api_key_hashes",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().RenameColumn(&apiKeyV6{}, "key_value", "key_hash"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&apiKeyV6{}, "KeySuffix"); err != nil {
+				return err
+			}
+			// Existing keys, revoked ones included, are replaced by their
+			// hash. Until then key_hash still holds the key.
+			var keys []apiKeyV6
+			if err := tx.Unscoped().Find(&keys).Error; err != nil {
+				return err
+			}
+			for _, key := range keys {
+				suffix := key.KeyHash
+				if len(suffix) > apiKeySuffixLen {
+					suffix = suffix[len(suffix)-apiKeySuffixLen:]
+				}
+				err := tx.Unscoped().Model(&apiKeyV6{}).Where("id = ?", key.ID).Updates(map[string]any{
+					"key_hash":   hashAPIKey(key.KeyHash),
+					"key_suffix": suffix,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		// The keys cannot be recovered from their hashes, keys created before
+		// rolling back must be generated again
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&apiKeyV6{}, "KeySuffix"); err != nil {
+				return err
+			}
+			return tx.Migrator().RenameColumn(&apiKeyV6{}, "key_hash", "key_value")
+		},
+	},
+}
+
+// serverEventRequestID is the server_events column added by migration 2
+type serverEventRequestID struct {
+	RequestID string `gorm:"index"`
+}
+
+func (serverEventRequestID) TableName() string {
+	return "server_events"
+}
+
+// serverEventTraceID is the server_events column added by migration 3
+type serverEventTraceID struct {
+	TraceID string `gorm:"index"`
+}
+
+func (serverEventTraceID) TableName() string {
+	return "server_events"
+}
+
+// serverEventUsername is the server_events column added by migration 5
+type serverEventUsername struct {
+	Username string `gorm:"index"`
+}
+
+func (serverEventUsername) TableName() string {
+	return "server_events"
+}
+
+// apiKeyV6 is the api_keys table after migration 6, which stores the hash
+// of keys in place of the key_value column
+type apiKeyV6 struct {
+	ID        uint
+	KeyHash   string `gorm:"unique"`
+	KeySuffix string
+}
+
+func (apiKeyV6) TableName() string {
+	return "api_keys"
+}
+
+// recoveryCodeV4 is the recovery_codes table created by migration 4
+type recoveryCodeV4 struct {
+	gorm.Model
+	ServerRunID string
+	CodeHash    string `gorm:"uniqueIndex"`
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+	UsedBy      string
+}
+
+func (recoveryCodeV4) TableName() string {
+	return "recovery_codes"
+}
+
+// ### ###
+// ### ### Migration Runner
+// ### ###
+
+// appliedMigrations reads the migrations recorded in schema_migrations. A
+// database without the table has none applied, only MigrateUp creates it.
+func appliedMigrations(db *gorm.DB) (map[uint]SchemaMigration, error) {
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return map[uint]SchemaMigration{}, nil
+	}
+
+	var rows []SchemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+
+	applied := make(map[uint]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// MigrateUp applies all pending migrations in version order and returns the
+// migrations that were applied
+func MigrateUp(db *gorm.DB) ([]Migration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkUnknownMigrations(applied); err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for _, m := range Migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %d %s failed: %w", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// MigrateDown rolls back the given number of most recently applied
+// migrations and returns the migrations that were rolled back
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkUnknownMigrations(applied); err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for i := len(Migrations) - 1; i >= 0 && len(ran) < steps; i-- {
+		m := Migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("rollback of migration %d %s failed: %w", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// MigrationStatus reports every known migration and any migration recorded
+// in the database that this build does not know about
+func MigrationStatus(db *gorm.DB) ([]MigrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	for _, m := range Migrations {
+		state := MigrationState{Version: m.Version, Name: m.Name, Known: true}
+		if row, ok := applied[m.Version]; ok {
+			state.Applied = true
+			state.AppliedAt = &row.AppliedAt
+			delete(applied, m.Version)
+		}
+		states = append(states, state)
+	}
+	for _, row := range applied {
+		states = append(states, MigrationState{
+			Version:   row.Version,
+			Name:      row.Name,
+			Applied:   true,
+			AppliedAt: &row.AppliedAt,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Version < states[j].Version
+	})
+
+	return states, nil
+}
+
+// CheckSchema returns ErrSchemaBehind or ErrSchemaAhead unless the database
+// has exactly the migrations known to this build applied
+func CheckSchema(db *gorm.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	if err := checkUnknownMigrations(applied); err != nil {
+		return err
+	}
+
+	var pending []uint
+	for _, m := range Migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m.Version)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w (pending versions: %v)", ErrSchemaBehind, pending)
+	}
+	return nil
+}
+
+func checkUnknownMigrations(applied map[uint]SchemaMigration) error {
+	known := make(map[uint]bool, len(Migrations))
+	for _, m := range Migrations {
+		known[m.Version] = true
+	}
+
+	var unknown []uint
+	for version := range applied {
+		if !known[version] {
+			unknown = append(unknown, version)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Slice(unknown, func(i, j int) bool { return unknown[i] < unknown[j] })
+		return fmt.Errorf("%w (unknown versions: %v)", ErrSchemaAhead, unknown)
+	}
+	return nil
+}
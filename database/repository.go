@@ -0,0 +1,140 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Repository provides typed queries and writes over the database models.
+// Queries are built with gorm rather than raw SQL so they run unchanged on
+// every supported driver. Every operation returns its error and runs on the
+// handle the Repository was built with, so passing a transaction to
+// NewRepository makes the operation part of that transaction.
+type Repository struct {
+	db *gorm.DB
+}
+
+// NewRepository returns a Repository backed by the given handle, which may
+// be a transaction
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// DefaultRepository returns a Repository backed by the handle installed with
+// SetDBConn
+func DefaultRepository() *Repository {
+	return NewRepository(GetDBConn())
+}
+
+// DB returns the handle the Repository runs on
+func (r *Repository) DB() *gorm.DB {
+	return r.db
+}
+
+// Transaction runs fn with a Repository bound to a single transaction, which
+// is committed if fn returns nil and rolled back otherwise. Nested calls use
+// savepoints.
+func (r *Repository) Transaction(ctx context.Context, fn func(tx *Repository) error) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(NewRepository(tx))
+	})
+}
+
+// UserGroup is a row of the users/groups many2many join table
+type UserGroup struct {
+	UserID  uint `gorm:"primaryKey"`
+	GroupID uint `gorm:"primaryKey"`
+}
+
+func (UserGroup) TableName() string {
+	return "user_groups"
+}
+
+// GroupIDsByLDAPGroups returns the IDs of groups mapped to any of the given
+// LDAP group names
+func (r *Repository) GroupIDsByLDAPGroups(ctx context.Context, ldapGroups []string) ([]uint, error) {
+	ids := []uint{}
+	if len(ldapGroups) == 0 {
+		return ids, nil
+	}
+	err := r.db.WithContext(ctx).
+		Model(&Group{}).
+		Where("ldap_group IN ?", ldapGroups).
+		Order("id").
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up groups by LDAP group: %w", err)
+	}
+	return ids, nil
+}
+
+// UserGroupIDs returns the IDs of all groups the user is a member of
+func (r *Repository) UserGroupIDs(ctx context.Context, userID uint) ([]uint, error) {
+	ids := []uint{}
+	err := r.db.WithContext(ctx).
+		Model(&UserGroup{}).
+		Where("user_id = ?", userID).
+		Order("group_id").
+		Pluck("group_id", &ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up groups for user %v: %w", userID, err)
+	}
+	return ids, nil
+}
+
+// AddUserToGroups adds memberships, ignoring groups the user is already in
+func (r *Repository) AddUserToGroups(ctx context.Context, userID uint, groupIDs []uint) error {
+	if len(groupIDs) == 0 {
+		return nil
+	}
+	rows := make([]UserGroup, 0, len(groupIDs))
+	for _, groupID := range groupIDs {
+		rows = append(rows, UserGroup{UserID: userID, GroupID: groupID})
+	}
+	err := r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&rows).Error
+	if err != nil {
+		return fmt.Errorf("failed to add user %v to groups %v: %w", userID, groupIDs, err)
+	}
+	return nil
+}
+
+// RemoveUserFromGroups removes memberships, ignoring groups the user is not in
+func (r *Repository) RemoveUserFromGroups(ctx context.Context, userID uint, groupIDs []uint) error {
+	if len(groupIDs) == 0 {
+		return nil
+	}
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND group_id IN ?", userID, groupIDs).
+		Delete(&UserGroup{}).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove user %v from groups %v: %w", userID, groupIDs, err)
+	}
+	return nil
+}
+
+// GroupIDsReferencingSecPoint returns the IDs of groups that add, delete or
+// override the given security point
+func (r *Repository) GroupIDsReferencingSecPoint(ctx context.Context, spid uint) ([]uint, error) {
+	db := r.db.WithContext(ctx)
+	refs := func(table string) *gorm.DB {
+		return db.Table(table).Select("group_id").Where("sec_point_id = ?", spid)
+	}
+
+	ids := []uint{}
+	err := db.Model(&Group{}).
+		Where("id IN (?) OR id IN (?) OR id IN (?)",
+			refs("group_add_sec_points"),
+			refs("group_del_sec_points"),
+			refs("group_ovr_sec_points")).
+		Order("id").
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up groups referencing security point %v: %w", spid, err)
+	}
+	return ids, nil
+}
@@ -0,0 +1,550 @@
+package database_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	dbase "github.com/javitab/go-web/database"
+	test_suite "github.com/javitab/go-web/tests"
+	"github.com/javitab/go-web/tracing"
+	"github.com/stretchr/testify/assert"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+func seedRepository(t *testing.T, db *gorm.DB) dbase.User {
+	t.Helper()
+	assert.NoError(t, dbase.CreateSecPoints(nil))
+	assert.NoError(t, dbase.CreateGroups(nil))
+
+	assert.NoError(t, dbase.CreateUser("repouser", "Repo", "User", "repouser@test.com", "password"))
+	var user dbase.User
+	db.Where("username = ?", "repouser").First(&user)
+	return user
+}
+
+func TestRepositoryGroupMembership(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		user := seedRepository(t, db)
+
+		ids, err := repo.GroupIDsByLDAPGroups(ctx, []string{"ITS_All", "AP.YH.AA.All.Dev", "Unmapped"})
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{1, 2}, ids)
+
+		ids, err = repo.GroupIDsByLDAPGroups(ctx, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, ids)
+
+		// Adding is idempotent
+		assert.NoError(t, repo.AddUserToGroups(ctx, user.ID, []uint{1, 2}))
+		assert.NoError(t, repo.AddUserToGroups(ctx, user.ID, []uint{2}))
+		ids, err = repo.UserGroupIDs(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{1, 2}, ids)
+
+		assert.NoError(t, repo.RemoveUserFromGroups(ctx, user.ID, []uint{1}))
+		ids, err = repo.UserGroupIDs(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{2}, ids)
+	})
+}
+
+func TestRepositoryGroupIDsReferencingSecPoint(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		seedRepository(t, db)
+
+		// SPID 5 is added by both default groups, SPID 7 only by the admin group
+		ids, err := repo.GroupIDsReferencingSecPoint(ctx, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{1, 2}, ids)
+
+		ids, err = repo.GroupIDsReferencingSecPoint(ctx, 7)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{1}, ids)
+
+		// References through del and ovr fields are included
+		assert.NoError(t, db.Exec("INSERT INTO group_del_sec_points (group_id, sec_point_id) VALUES (?, ?)", 2, 7).Error)
+		assert.NoError(t, db.Exec("INSERT INTO group_ovr_sec_points (group_id, sec_point_id) VALUES (?, ?)", 2, 9).Error)
+		ids, err = repo.GroupIDsReferencingSecPoint(ctx, 7)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{1, 2}, ids)
+		ids, err = repo.GroupIDsReferencingSecPoint(ctx, 9)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{1, 2}, ids)
+
+		ids, err = repo.GroupIDsReferencingSecPoint(ctx, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, ids)
+	})
+}
+
+func TestRepositoryTransactionRollback(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		user := seedRepository(t, db)
+
+		// A failing callback rolls back every write made through tx
+		errAbort := errors.New("abort")
+		err := repo.Transaction(ctx, func(tx *dbase.Repository) error {
+			if _, err := tx.CreateUser(ctx, dbase.NewUser{Username: "rolledback", Password: "password"}); err != nil {
+				return err
+			}
+			if err := tx.AddUserToGroups(ctx, user.ID, []uint{1}); err != nil {
+				return err
+			}
+			return errAbort
+		})
+		assert.ErrorIs(t, err, errAbort)
+
+		_, err = repo.GetUser(ctx, "rolledback")
+		assert.ErrorIs(t, err, dbase.ErrUserNotFound)
+		ids, err := repo.UserGroupIDs(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, ids)
+
+		// A group referencing a missing security point leaves all groups unchanged
+		err = repo.CreateGroups(ctx, []dbase.GroupYAML{
+			{ID: 10, Name: "Valid", AddSecPoints: []uint{5}},
+			{ID: 11, Name: "Invalid", AddSecPoints: []uint{999}},
+		})
+		assert.ErrorIs(t, err, dbase.ErrSecPointNotFound)
+		assert.ErrorContains(t, err, "group Invalid")
+		var count int64
+		db.Model(&dbase.Group{}).Where("id IN ?", []uint{10, 11}).Count(&count)
+		assert.Zero(t, count)
+	})
+}
+
+func TestRepositoryUserErrors(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		user := seedRepository(t, db)
+
+		_, err := repo.CreateUser(ctx, dbase.NewUser{Username: "repouser", Password: "password"})
+		assert.ErrorIs(t, err, dbase.ErrUserExists)
+		assert.ErrorIs(t, repo.ChangeUserPassword(ctx, "missing", "password"), dbase.ErrUserNotFound)
+
+		// API keys resolve to their active user only
+		key, err := repo.CreateAPIKey(ctx, user, "test")
+		assert.NoError(t, err)
+		owner, err := repo.GetUserByAPIKey(ctx, key.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, "repouser", owner.Username)
+		_, err = repo.GetUserByAPIKey(ctx, "missing")
+		assert.ErrorIs(t, err, dbase.ErrAPIKeyNotFound)
+
+		// Delete and undelete
+		request := dbase.DeleteUserRequest{Username: "repouser", RequestingUser: "admin", Reason: "test"}
+		request.Action = "delete_user"
+		assert.ErrorIs(t, repo.DeleteUser(ctx, request), dbase.ErrInvalidDeleteAction)
+		request.Action = "undelete"
+		assert.ErrorIs(t, repo.DeleteUser(ctx, request), dbase.ErrUserActive)
+		request.Action = "delete"
+		assert.NoError(t, repo.DeleteUser(ctx, request))
+		assert.ErrorIs(t, repo.DeleteUser(ctx, request), dbase.ErrUserDeleted)
+		_, err = repo.GetUserByAPIKey(ctx, key.Key)
+		assert.ErrorIs(t, err, dbase.ErrUserNotFound)
+		request.Action = "undelete"
+		assert.NoError(t, repo.DeleteUser(ctx, request))
+
+		// Group membership
+		group := dbase.Group{ID: 2, Name: "ITS_All"}
+		assert.ErrorIs(t, repo.RemoveUserFromGroup(ctx, user, group), dbase.ErrUserNotInGroup)
+		assert.NoError(t, repo.AddUserToGroup(ctx, user, group))
+		assert.ErrorIs(t, repo.AddUserToGroup(ctx, user, group), dbase.ErrUserInGroup)
+		assert.NoError(t, repo.RemoveUserFromGroup(ctx, user, group))
+
+		// User-level security points
+		assert.ErrorIs(t, repo.AddUserSecPoint(ctx, user, 5, "UserBadSecPoints"), dbase.ErrInvalidSecPointField)
+		assert.ErrorIs(t, repo.AddUserSecPoint(ctx, user, 999, "UserAddSecPoints"), dbase.ErrSecPointNotFound)
+		assert.NoError(t, repo.AddUserSecPoint(ctx, user, 5, "UserOvrSecPoints"))
+		var count int64
+		db.Table("user_ovr_sec_points").Where("user_id = ? AND sec_point_id = ?", user.ID, 5).Count(&count)
+		assert.Equal(t, int64(1), count)
+		assert.NoError(t, repo.RemoveUserSecPoint(ctx, user, 5, "UserOvrSecPoints"))
+		db.Table("user_ovr_sec_points").Where("user_id = ?", user.ID).Count(&count)
+		assert.Zero(t, count)
+	})
+}
+
+func TestRepositoryListUsersAPIKeys(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		user := seedRepository(t, db)
+		_, err := repo.CreateUser(ctx, dbase.NewUser{Username: "other_1", FirstName: "Ann", Email: "ann@example.com", Password: "password"})
+		assert.NoError(t, err)
+
+		usernames := func(search string, includeDeleted bool) []string {
+			users, err := repo.ListUsers(ctx, search, includeDeleted)
+			assert.NoError(t, err)
+			names := []string{}
+			for _, u := range users {
+				names = append(names, u.Username)
+			}
+			return names
+		}
+		assert.Equal(t, []string{"other_1", "repouser"}, usernames("", false))
+		assert.Equal(t, []string{"other_1"}, usernames("ANN", false))
+		assert.Equal(t, []string{"repouser"}, usernames("test.com", false))
+		// Wildcards are matched literally
+		assert.Equal(t, []string{"other_1"}, usernames("_", false))
+		assert.Empty(t, usernames("%", false))
+
+		request := dbase.DeleteUserRequest{Username: "other_1", RequestingUser: "admin", Reason: "test", Action: "delete"}
+		assert.NoError(t, repo.DeleteUser(ctx, request))
+		assert.Equal(t, []string{"repouser"}, usernames("", false))
+		assert.Equal(t, []string{"other_1", "repouser"}, usernames("", true))
+
+		// Revoked keys no longer authenticate, keys of other users are not found
+		first, err := repo.CreateAPIKey(ctx, user, "first")
+		assert.NoError(t, err)
+		_, err = repo.CreateAPIKey(ctx, user, "second")
+		assert.NoError(t, err)
+		keys, err := repo.ListAPIKeys(ctx, user.ID)
+		assert.NoError(t, err)
+		if assert.Len(t, keys, 2) {
+			assert.Equal(t, "second", keys[0].Description)
+		}
+		other, err := repo.GetUser(ctx, "other_1")
+		assert.NoError(t, err)
+		assert.ErrorIs(t, repo.RevokeAPIKey(ctx, *other, first.ID), dbase.ErrAPIKeyNotFound)
+		assert.NoError(t, repo.RevokeAPIKey(ctx, user, first.ID))
+		assert.ErrorIs(t, repo.RevokeAPIKey(ctx, user, first.ID), dbase.ErrAPIKeyNotFound)
+		_, err = repo.GetUserByAPIKey(ctx, first.Key)
+		assert.ErrorIs(t, err, dbase.ErrAPIKeyNotFound)
+		keys, err = repo.ListAPIKeys(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 1)
+	})
+}
+
+func TestRepositoryServerEvents(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		db.Where("1 = 1").Delete(&dbase.ServerEvent{})
+
+		at := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+		for _, event := range []dbase.ServerEvent{
+			{UUID_ID: "run-1", ServerRunID: "run-1", EventType: "StartingServer", Status: dbase.ServerStatusStopped, Details: "Starting Server\nListening on :8080\nStopped: interrupt", DateTime: at},
+			{UUID_ID: "e1", ServerRunID: "run-1", EventType: "CreateUser", Status: "INFO", Username: "alice", DateTime: at.Add(time.Minute)},
+			{UUID_ID: "e2", ServerRunID: "run-1", EventType: "StoppingServer:Drain", Status: "ERROR", DateTime: at.Add(2 * time.Minute), Archived: true},
+			{UUID_ID: "run-2", ServerRunID: "run-2", EventType: "StartingServer", Status: dbase.ServerStatusRunning, DateTime: at.Add(time.Hour)},
+			{UUID_ID: "e3", ServerRunID: "run-2", EventType: "CSRF:Invalid", Status: "DENY", Username: "bob", RequestID: "req-1", DateTime: at.Add(61 * time.Minute)},
+			{UUID_ID: "e4", ServerRunID: "run-2", EventType: "CSRF_Other", Status: "DENY", DateTime: at.Add(62 * time.Minute)},
+		} {
+			assert.NoError(t, db.Create(&event).Error)
+		}
+
+		uuids := func(filter dbase.ServerEventFilter) []string {
+			events, _, err := repo.ListServerEvents(ctx, filter)
+			assert.NoError(t, err)
+			ids := []string{}
+			for _, event := range events {
+				ids = append(ids, event.UUID_ID)
+			}
+			return ids
+		}
+		// Newest first, archived events only on request
+		assert.Equal(t, []string{"e4", "e3", "run-2", "e1", "run-1"}, uuids(dbase.ServerEventFilter{}))
+		assert.Equal(t, []string{"run-1", "e1", "e2"}, uuids(dbase.ServerEventFilter{ServerRunID: "run-1", Archived: true, Ascending: true}))
+		// Type prefixes match wildcards literally
+		assert.Equal(t, []string{"e3"}, uuids(dbase.ServerEventFilter{EventType: "CSRF:"}))
+		assert.Equal(t, []string{"e4"}, uuids(dbase.ServerEventFilter{EventType: "CSRF_"}))
+		assert.Equal(t, []string{"e3"}, uuids(dbase.ServerEventFilter{Username: "bob"}))
+		assert.Equal(t, []string{"e3"}, uuids(dbase.ServerEventFilter{RequestID: "req-1"}))
+		assert.Equal(t, []string{"e4", "e3"}, uuids(dbase.ServerEventFilter{Statuses: []string{"DENY"}}))
+		assert.Equal(t, []string{"e1", "run-1"}, uuids(dbase.ServerEventFilter{Since: at, Until: at.Add(time.Hour)}))
+
+		events, total, err := repo.ListServerEvents(ctx, dbase.ServerEventFilter{Limit: 2, Offset: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), total)
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, "run-2", events[0].UUID_ID)
+			assert.Equal(t, []string{"e4"}, uuids(dbase.ServerEventFilter{AfterID: events[0].ID + 1}))
+		}
+
+		eventTypes, statuses, err := repo.ServerEventValues(ctx)
+		assert.NoError(t, err)
+		assert.Contains(t, eventTypes, "CSRF:Invalid")
+		assert.Equal(t, []string{"DENY", "ERROR", "INFO", "RUNNING", "STOPPED"}, statuses)
+
+		// Runs count their events and failures, archived or not
+		runs, total, err := repo.ListServerRuns(ctx, 10, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), total)
+		if assert.Len(t, runs, 2) {
+			assert.Equal(t, "run-2", runs[0].Start.ServerRunID)
+			assert.Equal(t, int64(3), runs[0].Events)
+			assert.Equal(t, int64(0), runs[0].Failures)
+			assert.Equal(t, int64(3), runs[1].Events)
+			assert.Equal(t, int64(1), runs[1].Failures)
+		}
+		run, err := repo.GetServerRun(ctx, "run-1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), run.Failures)
+		_, err = repo.GetServerRun(ctx, "e1")
+		assert.ErrorIs(t, err, dbase.ErrServerRunNotFound)
+
+		// Events are stamped with the user of their context
+		assert.NoError(t, repo.LogServerEvent(dbase.WithUsername(ctx, "carol"), "Test", "", "INFO"))
+		assert.Len(t, uuids(dbase.ServerEventFilter{Username: "carol"}), 1)
+	})
+}
+
+func TestRepositoryTracing(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		seedRepository(t, db)
+		spans := test_suite.RecordSpans(t)
+
+		ctx, parent := tracing.Tracer().Start(context.Background(), "request")
+		_, err := dbase.NewRepository(db).GetUser(ctx, "repouser")
+		assert.NoError(t, err)
+		parent.End()
+
+		// Statements are children of the span of their context, with the
+		// SQL but not the bound values
+		ended := spans.Ended()
+		assert.Equal(t, []string{"gorm.query", "request"}, test_suite.SpanNames(spans))
+		query := ended[0]
+		assert.Equal(t, parent.SpanContext().SpanID(), query.Parent().SpanID())
+		for _, attr := range query.Attributes() {
+			if attr.Key == semconv.DBQueryTextKey {
+				assert.Contains(t, attr.Value.AsString(), "users")
+				assert.NotContains(t, attr.Value.AsString(), "repouser")
+			}
+		}
+		assert.Contains(t, query.Attributes(), semconv.DBCollectionName("users"))
+	})
+}
+
+func TestUserRecords(t *testing.T) {
+	records, err := dbase.ReadUserRecords(strings.NewReader(
+		"username,email,ldap,groups,add_sec_points\n"+
+			"jdoe, jdoe@test.com ,true,User Group;1,3;5\n"+
+			"nogroups,nogroups@test.com,,,\n"+
+			"bad,bad@test.com,maybe,,x\n"), dbase.UserRecordsCSV)
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, "jdoe@test.com", records[0].Email)
+	assert.True(t, records[0].IsLDAPUser)
+	assert.Equal(t, []string{"User Group", "1"}, records[0].Groups)
+	assert.Equal(t, []uint{3, 5}, records[0].AddSecPoints)
+	assert.Equal(t, 2, records[0].Row)
+	// Empty cells of present columns are empty lists, absent columns nil
+	assert.Equal(t, []string{}, records[1].Groups)
+	assert.Nil(t, records[1].OvrSecPoints)
+
+	_, err = dbase.ReadUserRecords(strings.NewReader("username,password\njdoe,secret\n"), dbase.UserRecordsCSV)
+	assert.ErrorIs(t, err, dbase.ErrInvalidUserRecords)
+	_, err = dbase.ReadUserRecords(strings.NewReader("username: jdoe\n"), dbase.UserRecordsYAML)
+	assert.ErrorIs(t, err, dbase.ErrInvalidUserRecords)
+
+	records, err = dbase.ReadUserRecords(strings.NewReader(
+		"- username: jdoe\n  email: jdoe@test.com\n  groups: [User Group]\n"+
+			"- username: other\n  password: secret\n"), dbase.UserRecordsYAML)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, records[0].Row)
+	assert.Equal(t, 4, records[1].Row)
+	assert.Nil(t, records[0].AddSecPoints)
+
+	// Writing and reading again returns the same records
+	exported := []dbase.UserRecord{{
+		Username: "jdoe", FirstName: "Jane", LastName: "Doe, Jr", Email: "jdoe@test.com",
+		Groups: []string{"Admin Group", "User Group"}, AddSecPoints: []uint{3}, DelSecPoints: []uint{}, OvrSecPoints: []uint{5, 8},
+	}}
+	for _, format := range []dbase.UserRecordFormat{dbase.UserRecordsCSV, dbase.UserRecordsYAML} {
+		var buf bytes.Buffer
+		assert.NoError(t, dbase.WriteUserRecords(&buf, format, exported))
+		records, err := dbase.ReadUserRecords(&buf, format)
+		assert.NoError(t, err)
+		assert.Len(t, records, 1)
+		assert.Equal(t, exported[0].LastName, records[0].LastName)
+		assert.Equal(t, exported[0].Groups, records[0].Groups)
+		assert.Equal(t, exported[0].OvrSecPoints, records[0].OvrSecPoints)
+		assert.Equal(t, []uint{}, records[0].DelSecPoints)
+	}
+
+	format, err := dbase.UserRecordFormatFromPath("users.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, dbase.UserRecordsYAML, format)
+	_, err = dbase.UserRecordFormatFromPath("users.json")
+	assert.ErrorIs(t, err, dbase.ErrUnsupportedUserFormat)
+}
+
+func TestRepositoryImportUsers(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		seedRepository(t, db)
+
+		file := "username,first_name,last_name,email,ldap,groups,add_sec_points\n" +
+			"repouser,User,Repo,repouser@test.com,false,User Group,3\n" +
+			"jdoe,Jane,Doe,jdoe@test.com,true,Admin Group;2,\n"
+		read := func(file string) []dbase.UserRecord {
+			records, err := dbase.ReadUserRecords(strings.NewReader(file), dbase.UserRecordsCSV)
+			assert.NoError(t, err)
+			return records
+		}
+
+		// Dry runs plan the changes without writing them
+		report, err := repo.ImportUsers(ctx, read(file), true)
+		assert.NoError(t, err)
+		assert.True(t, report.DryRun)
+		assert.Equal(t, 1, report.Created)
+		assert.Equal(t, 1, report.Updated)
+		assert.Equal(t, []string{"groups +User Group", "add_sec_points +3"}, report.Rows[0].Changes)
+		_, err = repo.GetUser(ctx, "jdoe")
+		assert.ErrorIs(t, err, dbase.ErrUserNotFound)
+
+		report, err = repo.ImportUsers(ctx, read(file), false)
+		assert.NoError(t, err)
+		assert.Equal(t, dbase.UserImportCreate, report.Rows[1].Action)
+		jdoe, err := repo.GetUser(ctx, "jdoe")
+		assert.NoError(t, err)
+		assert.True(t, jdoe.IsLDAPUser)
+		ids, _ := repo.UserGroupIDs(ctx, jdoe.ID)
+		assert.Equal(t, []uint{1, 2}, ids)
+
+		// Importing again changes nothing
+		report, err = repo.ImportUsers(ctx, read(file), false)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, report.Unchanged)
+
+		// Exports import unchanged
+		exported, err := repo.ExportUsers(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "jdoe", exported[0].Username)
+		assert.Equal(t, []string{"Admin Group", "User Group"}, exported[0].Groups)
+		assert.Equal(t, []uint{3}, exported[1].AddSecPoints)
+		report, err = repo.ImportUsers(ctx, exported, false)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, report.Unchanged)
+
+		// Absent columns are kept, present lists are synchronized
+		report, err = repo.ImportUsers(ctx, read("username,last_name,groups\njdoe,Smith,User Group\n"), false)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"last_name", "groups -Admin Group"}, report.Rows[0].Changes)
+		jdoe, _ = repo.GetUser(ctx, "jdoe")
+		assert.Equal(t, "Jane", jdoe.FirstName)
+		assert.Equal(t, "Smith", jdoe.LastName)
+		assert.True(t, jdoe.IsLDAPUser)
+
+		// Any invalid row fails the whole import with per-row errors
+		report, err = repo.ImportUsers(ctx, read(
+			"username,email,groups,ovr_sec_points\n"+
+				"new,new@test.com,,\n"+
+				",missing@test.com,,\n"+
+				"other,jdoe@test.com,,\n"+
+				"grouped,grouped@test.com,Missing Group,\n"+
+				"sp,sp@test.com,,999\n"+
+				"new,new2@test.com,,\n"), false)
+		assert.ErrorIs(t, err, dbase.ErrInvalidUserRecords)
+		assert.Equal(t, 5, report.Failed)
+		assert.Equal(t, dbase.UserImportCreate, report.Rows[0].Action)
+		assert.Equal(t, "username is required", report.Rows[1].Error)
+		assert.Equal(t, "email jdoe@test.com is used by user jdoe", report.Rows[2].Error)
+		assert.Equal(t, `group "Missing Group" not found`, report.Rows[3].Error)
+		assert.ErrorContains(t, err, "row 6 (sp): security point not found: 999 in ovr_sec_points")
+		assert.Equal(t, "duplicate username, first on row 2", report.Rows[5].Error)
+		_, err = repo.GetUser(ctx, "new")
+		assert.ErrorIs(t, err, dbase.ErrUserNotFound)
+
+		// Deleted users are not restored
+		request := dbase.DeleteUserRequest{Username: "jdoe", RequestingUser: "admin", Reason: "test", Action: "delete"}
+		assert.NoError(t, repo.DeleteUser(ctx, request))
+		report, err = repo.ImportUsers(ctx, read("username\njdoe\n"), false)
+		assert.ErrorIs(t, err, dbase.ErrInvalidUserRecords)
+		assert.Contains(t, report.Rows[0].Error, "user is deleted")
+		exported, _ = repo.ExportUsers(ctx)
+		assert.Len(t, exported, 1)
+	})
+}
+
+func TestRepositoryBootstrapSuperuser(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		secPoints, err := dbase.LoadSecPointsFromEmbed()
+		assert.NoError(t, err)
+		groups, err := dbase.LoadGroupsFromEmbed()
+		assert.NoError(t, err)
+
+		// A failing bootstrap leaves no security points, groups or users
+		_, err = repo.BootstrapSuperuser(ctx, dbase.NewUser{Username: "admin", Email: "admin@test.com", Password: "password"},
+			secPoints, append(groups, dbase.GroupYAML{ID: 10, Name: "Broken", AddSecPoints: []uint{999}}))
+		assert.ErrorIs(t, err, dbase.ErrSecPointNotFound)
+		hasUsers, err := repo.HasUsers(ctx)
+		assert.NoError(t, err)
+		assert.False(t, hasUsers)
+		var count int64
+		db.Model(&dbase.SecPoint{}).Count(&count)
+		assert.Zero(t, count)
+
+		user, err := repo.BootstrapSuperuser(ctx, dbase.NewUser{Username: "admin", Email: "admin@test.com", Password: "password"}, secPoints, groups)
+		assert.NoError(t, err)
+		ids, err := repo.UserGroupIDs(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{dbase.SuperuserGroupID}, ids)
+		db.Model(&dbase.ServerEvent{}).Where("event_type = ?", "BootstrapSuperuser").Count(&count)
+		assert.Equal(t, int64(1), count)
+
+		// Refused once any user exists, even a soft deleted one
+		assert.NoError(t, repo.DeleteUser(ctx, dbase.DeleteUserRequest{Username: "admin", Action: "delete"}))
+		_, err = repo.BootstrapSuperuser(ctx, dbase.NewUser{Username: "second", Email: "second@test.com", Password: "password"}, secPoints, groups)
+		assert.ErrorIs(t, err, dbase.ErrUsersExist)
+	})
+}
+
+func TestRepositoryRecoverSuperuser(t *testing.T) {
+	test_suite.ForEachDriver(t, func(t *testing.T, db *gorm.DB) {
+		ctx := context.Background()
+		repo := dbase.NewRepository(db)
+		seedRepository(t, db)
+		assert.NoError(t, repo.SetLDAPUser(ctx, "repouser", true))
+		assert.NoError(t, repo.DeleteUser(ctx, dbase.DeleteUserRequest{Username: "repouser", Action: "delete"}))
+
+		// Issuing a code revokes the unused ones
+		stale, _, err := repo.IssueRecoveryCode(ctx)
+		assert.NoError(t, err)
+		code, expiresAt, err := repo.IssueRecoveryCode(ctx)
+		assert.NoError(t, err)
+		assert.True(t, expiresAt.After(time.Now()))
+		assert.ErrorIs(t, repo.RecoverSuperuser(ctx, stale, "repouser", "recovered", "ops@host"), dbase.ErrRecoveryCodeInvalid)
+
+		// An unknown user leaves the code unused
+		assert.ErrorIs(t, repo.RecoverSuperuser(ctx, code, "missing", "recovered", "ops@host"), dbase.ErrUserNotFound)
+
+		assert.NoError(t, repo.RecoverSuperuser(ctx, code, "repouser", "recovered", "ops@host"))
+		user, err := repo.GetUser(ctx, "repouser")
+		assert.NoError(t, err)
+		assert.False(t, user.DeletedAt.Valid)
+		assert.False(t, user.IsLDAPUser)
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("recovered")))
+		ids, err := repo.UserGroupIDs(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Contains(t, ids, dbase.SuperuserGroupID)
+		var event dbase.ServerEvent
+		db.Where("event_type = ?", "BreakGlassRecovery").First(&event)
+		assert.Equal(t, "WARN", event.Status)
+		assert.Contains(t, event.Details, "ops@host")
+
+		// Codes are single use and only their hash is stored
+		assert.ErrorIs(t, repo.RecoverSuperuser(ctx, code, "repouser", "again", "ops@host"), dbase.ErrRecoveryCodeInvalid)
+		var stored int64
+		db.Model(&dbase.RecoveryCode{}).Where("code_hash = ?", code).Count(&stored)
+		assert.Zero(t, stored)
+	})
+}
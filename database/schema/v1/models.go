@@ -0,0 +1,67 @@
+// Package v1 is a frozen snapshot of the models created by schema migration
+// 1. The type names match the live models so that gorm derives the same
+// table, join column and constraint names.
+package v1
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ServerEvent struct {
+	gorm.Model
+	UUID_ID     string
+	ServerRunID string
+	Archived    bool      `gorm:"default:false"`
+	DateTime    time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+	EventType   string    `gorm:"default:'LoggedEvent'"`
+	Details     string
+	Status      string
+}
+
+type User struct {
+	gorm.Model
+	UUID_ID          uuid.UUID
+	Username         string `gorm:"unique"`
+	LastName         string
+	FirstName        string
+	Email            string `gorm:"unique"`
+	Password         string
+	IsLDAPUser       bool
+	APIKeys          []APIKey   `gorm:"foreignKey:UserID"`
+	Groups           []Group    `gorm:"many2many:user_groups;"`
+	UserAddSecPoints []SecPoint `gorm:"many2many:user_add_sec_points;"`
+	UserDelSecPoints []SecPoint `gorm:"many2many:user_del_sec_points;"`
+	UserOvrSecPoints []SecPoint `gorm:"many2many:user_ovr_sec_points;"`
+}
+
+type APIKey struct {
+	gorm.Model
+	UserID      uint
+	UUID_ID     uuid.UUID
+	KeyValue    string `gorm:"unique"`
+	Description string
+}
+
+type Group struct {
+	gorm.Model
+	ID           uint `gorm:"primarykey"`
+	Priority     uint
+	Name         string `gorm:"unique"`
+	Desc         string
+	LDAPGroup    string
+	AddSecPoints []SecPoint `gorm:"many2many:group_add_sec_points;"`
+	DelSecPoints []SecPoint `gorm:"many2many:group_del_sec_points;"`
+	OvrSecPoints []SecPoint `gorm:"many2many:group_ovr_sec_points;"`
+}
+
+type SecPoint struct {
+	gorm.Model
+	ID      uint `gorm:"primarykey"`
+	SPGroup string
+	Type    string
+	Name    string `gorm:"unique"`
+	Desc    string
+}
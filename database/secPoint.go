@@ -1,8 +1,9 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 
 	"github.com/javitab/go-web/config"
@@ -11,6 +12,8 @@ import (
 	"gorm.io/gorm"
 )
 
+var ErrSecPointNotFound = errors.New("security point not found")
+
 type SecPoint struct {
 	gorm.Model
 	ID      uint   `json:"ID" gorm:"primarykey"`
@@ -54,38 +57,90 @@ func LoadSecPointsFromEmbed() ([]SecPoint, error) {
 	return secPoints, nil
 }
 
-// CreateSecPoints creates security points in the database from a YAML file
-func CreateSecPoints(filePath *string) {
+// CreateSecPoints creates security points in the database from a YAML file,
+// or from the embedded defaults when filePath is nil
+func CreateSecPoints(filePath *string) error {
 	var secPoints []SecPoint
 	var err error
 	if filePath != nil {
 		secPoints, err = LoadSecPointsFromYAML(*filePath)
-		if err != nil {
-			log.Fatalf("Error loading security points from YAML: %v", err)
-		}
 	} else {
 		secPoints, err = LoadSecPointsFromEmbed()
-		if err != nil {
-			log.Fatalf("Error loading security points from YAML: %v", err)
+	}
+	if err != nil {
+		return fmt.Errorf("error loading security points from YAML: %w", err)
+	}
+
+	return DefaultRepository().CreateSecPoints(context.Background(), secPoints)
+}
+
+// GetSecPoint loads a security point, or returns ErrSecPointNotFound
+func (r *Repository) GetSecPoint(ctx context.Context, SPID uint) (SecPoint, error) {
+	var secPoint SecPoint
+	if err := r.db.WithContext(ctx).Where("id = ?", SPID).Limit(1).Find(&secPoint).Error; err != nil {
+		return secPoint, fmt.Errorf("failed to look up security point %v: %w", SPID, err)
+	}
+	if secPoint.ID == 0 {
+		return secPoint, fmt.Errorf("%w: %v", ErrSecPointNotFound, SPID)
+	}
+	return secPoint, nil
+}
+
+// ListSecPoints returns the security points by ID
+func (r *Repository) ListSecPoints(ctx context.Context) ([]SecPoint, error) {
+	var secPoints []SecPoint
+	if err := r.db.WithContext(ctx).Order("id").Find(&secPoints).Error; err != nil {
+		return nil, fmt.Errorf("failed to list security points: %w", err)
+	}
+	return secPoints, nil
+}
+
+// CreateSecPoints creates any of the given security points that do not
+// already exist. All security points are created in a single transaction.
+func (r *Repository) CreateSecPoints(ctx context.Context, secPoints []SecPoint) error {
+	return r.Transaction(ctx, func(tx *Repository) error {
+		db := tx.db.WithContext(ctx)
+		for _, secPoint := range secPoints {
+			// Check if the Security Point already exists
+			var count int64
+			if err := db.Model(&SecPoint{}).Where("id = ?", secPoint.ID).Count(&count).Error; err != nil {
+				return fmt.Errorf("failed to look up security point %v: %w", secPoint.ID, err)
+			}
+			if count > 0 {
+				continue
+			}
+
+			// If the Security Point does not exist, create it
+			if err := db.Create(&secPoint).Error; err != nil {
+				return fmt.Errorf("failed to create security point %v: %w", secPoint.ID, err)
+			}
+			if err := tx.LogServerEvent(ctx, "CreateSecPoints", "Created Security Point\n"+helpers.PrettyJSONString(secPoint), "INFO"); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
+
+// secPointsByID loads the security points with the given IDs, returning
+// ErrSecPointNotFound if any of them do not exist
+func (r *Repository) secPointsByID(ctx context.Context, spids []uint) ([]SecPoint, error) {
+	secPoints := []SecPoint{}
+	if len(spids) == 0 {
+		return secPoints, nil
+	}
+	if err := r.db.WithContext(ctx).Where("id IN ?", spids).Order("id").Find(&secPoints).Error; err != nil {
+		return nil, fmt.Errorf("failed to look up security points %v: %w", spids, err)
 	}
 
-	db := GetDBConn()
+	found := make(map[uint]bool, len(secPoints))
 	for _, secPoint := range secPoints {
-		fmt.Printf("Evaluating Security Point: %v\n", secPoint.ID)
-
-		// Check if the Security Point already exists
-		var existingSecPoint SecPoint
-		db.Where("id = ?", secPoint.ID).Find(&existingSecPoint)
-
-		// If the Security Point does not exist, create it
-		if existingSecPoint.ID == 0 {
-			fmt.Printf("Creating Security Point: %v\n", secPoint.ID)
-			db.Create(&secPoint)
-			LogServerEvent("CreateSecPoints", "Created Security Point", helpers.PrettyPrintJSONString(secPoint))
-		} else {
-			fmt.Printf("Security Point already exists: %v\n", secPoint.ID)
+		found[secPoint.ID] = true
+	}
+	for _, spid := range spids {
+		if !found[spid] {
+			return nil, fmt.Errorf("%w: %v", ErrSecPointNotFound, spid)
 		}
-
 	}
+	return secPoints, nil
 }
@@ -1,10 +1,17 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/javitab/go-web/tracing"
 	"gorm.io/gorm"
 )
 
@@ -14,6 +21,9 @@ type ServerEvent struct {
 	gorm.Model
 	UUID_ID     string
 	ServerRunID string
+	RequestID   string    `gorm:"index"`
+	TraceID     string    `gorm:"index"`
+	Username    string    `gorm:"index"`
 	Archived    bool      `gorm:"default:false"`
 	DateTime    time.Time `gorm:"default:CURRENT_TIMESTAMP"`
 	EventType   string    `gorm:"default:'LoggedEvent'"`
@@ -21,12 +31,28 @@ type ServerEvent struct {
 	Status      string
 }
 
+// refusedToken matches the refused tokens logged by CheckAuth. Older builds
+// logged the token itself, current ones the claimed username and a hash.
+var refusedToken = regexp.MustCompile(`Error validating token for user: \S*( \(token sha256:[0-9a-f]+\))?`)
+
+// Redacted returns the event with the tokens logged by older builds masked,
+// for display
+func (e ServerEvent) Redacted() ServerEvent {
+	e.Details = refusedToken.ReplaceAllStringFunc(e.Details, func(match string) string {
+		if strings.Contains(match, "(token sha256:") {
+			return match
+		}
+		return "Error validating token for user: REDACTED"
+	})
+	return e
+}
+
 func CreateServerStartEvent() {
 	db := GetDBConn()
 	se := &ServerEvent{}
 	se.EventType = "StartingServer"
 	se.Details = "Starting Server"
-	se.Status = "PENDING"
+	se.Status = ServerStatusPending
 	se.UUID_ID = uuid.NewString()
 	se.ServerRunID = se.UUID_ID
 	db.Create(&se)
@@ -48,17 +74,53 @@ func CreateServerStartFailureEvent(
 
 }
 
+// Statuses of the StartingServer event of a server run
+const (
+	ServerStatusPending = "PENDING"
+	ServerStatusRunning = "RUNNING"
+	ServerStatusStopped = "STOPPED"
+)
+
+// UpdateServerStartEvent sets the status of the StartingServer event of the
+// current server run and appends the given details to it
+func UpdateServerStartEvent(status string, details string) error {
+	return DefaultRepository().UpdateServerStartEvent(context.Background(), status, details)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the ID of the HTTP request it
+// belongs to. Server events logged with the context are stamped with it.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID of ctx, if any
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+type usernameKey struct{}
+
+// WithUsername returns a context carrying the user a request or command runs
+// as. Server events logged with the context are stamped with it.
+func WithUsername(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, usernameKey{}, username)
+}
+
+// UsernameFromContext returns the username of ctx, if any
+func UsernameFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(usernameKey{}).(string)
+	return username
+}
+
 func LogServerError(
 	EventType string,
 	err error,
 	details string,
 ) {
-	// err_str := fmt.Sprintf("%v", err)
-	err_str := err.Error()
-
-	err_str = "Error: \n" + err_str + "\nDetails: \n" + details
-	LogServerEvent(EventType, err_str, "ERROR")
-	//log.Printf("Server event logged:\nEventType: %v\nError: %v\nDetails: %v\n", EventType, err, details)
+	logServerError(context.Background(), EventType, err, details)
 }
 
 func LogServerEvent(
@@ -66,16 +128,300 @@ func LogServerEvent(
 	Details string,
 	Status string,
 ) {
+	logServerEvent(context.Background(), EventType, Details, Status)
+}
 
-	db := GetDBConn()
+// LogServerErrorContext records an error event stamped with the request ID
+// of ctx
+func LogServerErrorContext(
+	ctx context.Context,
+	EventType string,
+	err error,
+	details string,
+) {
+	logServerError(ctx, EventType, err, details)
+}
+
+// LogServerEventContext records an event stamped with the request ID of ctx
+func LogServerEventContext(
+	ctx context.Context,
+	EventType string,
+	Details string,
+	Status string,
+) {
+	logServerEvent(ctx, EventType, Details, Status)
+}
+
+// logServerError records an error event on the installed database
+func logServerError(ctx context.Context, EventType string, err error, details string) {
+	logServerEvent(ctx, EventType, serverErrorDetails(err, details), "ERROR")
+}
+
+// logServerEvent records an event on the installed database. Events logged
+// before the database is connected, such as configuration errors, are only
+// echoed.
+func logServerEvent(ctx context.Context, EventType string, Details string, Status string) {
+	db, err := DBConn()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Server event not saved, %v:\n     EventType: %v\n     Details: %v\n     Status: %v\n", err, EventType, Details, Status)
+		return
+	}
+	_ = NewRepository(db).LogServerEvent(ctx, EventType, Details, Status)
+}
+
+func serverErrorDetails(err error, details string) string {
+	return "Error: \n" + err.Error() + "\nDetails: \n" + details
+}
+
+// LogServerError records an error event on the repository handle, so that
+// errors logged inside a transaction roll back with it
+func (r *Repository) LogServerError(
+	ctx context.Context,
+	EventType string,
+	err error,
+	details string,
+) error {
+	return r.LogServerEvent(ctx, EventType, serverErrorDetails(err, details), "ERROR")
+}
+
+// LogServerEvent records an event on the repository handle, stamped with
+// the request ID and username of ctx
+func (r *Repository) LogServerEvent(
+	ctx context.Context,
+	EventType string,
+	Details string,
+	Status string,
+) error {
 	se := &ServerEvent{
 		ServerRunID: ServerRunID,
+		RequestID:   RequestIDFromContext(ctx),
+		TraceID:     tracing.TraceID(ctx),
+		Username:    UsernameFromContext(ctx),
 		EventType:   EventType,
 		Details:     Details,
 		Status:      Status,
 		UUID_ID:     uuid.NewString(),
 	}
-	db.Create(&se)
+	err := r.db.WithContext(ctx).Create(se).Error
+
+	// Echo to stderr, stdout carries command output
+	fmt.Fprintf(os.Stderr, "Server event logged:\n     EventType: %v\n     Details: %v\n     Status: %v\n", EventType, Details, Status)
+	if err != nil {
+		log.Printf("Unable to save server event %v: %v", EventType, err)
+		return fmt.Errorf("failed to save server event: %w", err)
+	}
+	return nil
+}
+
+// ArchiveServerEvents marks unarchived events logged before the given time
+// as archived and returns the number of events archived
+func (r *Repository) ArchiveServerEvents(ctx context.Context, before time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).
+		Model(&ServerEvent{}).
+		Where("archived = ? AND date_time < ?", false, before.UTC()).
+		Update("archived", true)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to archive server events: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// UpdateServerStartEvent sets the status of the StartingServer event of the
+// current server run and appends the given details to it
+func (r *Repository) UpdateServerStartEvent(ctx context.Context, status string, details string) error {
+	var se ServerEvent
+	err := r.db.WithContext(ctx).
+		Where("event_type = ? AND uuid_id = ?", "StartingServer", ServerRunID).
+		First(&se).Error
+	if err != nil {
+		return fmt.Errorf("failed to find start event of server run %v: %w", ServerRunID, err)
+	}
+
+	err = r.db.WithContext(ctx).Model(&se).Updates(map[string]any{
+		"status":  status,
+		"details": se.Details + "\n" + details,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update start event of server run %v: %w", ServerRunID, err)
+	}
+	log.Printf("Server run %v: %v", ServerRunID, status)
+	return nil
+}
+
+// ### ###
+// ### ### Server Event Queries
+// ### ###
+
+// ErrServerRunNotFound is returned for a server run without StartingServer
+// event
+var ErrServerRunNotFound = errors.New("server run not found")
+
+// FailureStatuses are the statuses of events reporting a failure
+var FailureStatuses = []string{"ERROR", "FAIL"}
+
+// ServerEventFilter selects server events, zero fields match all events
+type ServerEventFilter struct {
+	Since       time.Time
+	Until       time.Time
+	EventType   string // prefix of the event type, "CSRF" matches "CSRF:Invalid"
+	Statuses    []string
+	Username    string
+	ServerRunID string
+	RequestID   string
+	AfterID     uint // only events logged after this one, for tailing
+	Archived    bool // include archived events
+	Ascending   bool // oldest first, newest first otherwise
+	Limit       int
+	Offset      int
+}
+
+func (f ServerEventFilter) apply(db *gorm.DB) *gorm.DB {
+	if !f.Since.IsZero() {
+		db = db.Where("date_time >= ?", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		db = db.Where("date_time < ?", f.Until.UTC())
+	}
+	if f.EventType != "" {
+		db = db.Where(`event_type LIKE ? ESCAPE '\'`, likeEscaper.Replace(f.EventType)+"%")
+	}
+	if len(f.Statuses) > 0 {
+		db = db.Where("status IN ?", f.Statuses)
+	}
+	if f.Username != "" {
+		db = db.Where("username = ?", f.Username)
+	}
+	if f.ServerRunID != "" {
+		db = db.Where("server_run_id = ?", f.ServerRunID)
+	}
+	if f.RequestID != "" {
+		db = db.Where("request_id = ?", f.RequestID)
+	}
+	if f.AfterID != 0 {
+		db = db.Where("id > ?", f.AfterID)
+	}
+	if !f.Archived {
+		db = db.Where("archived = ?", false)
+	}
+	return db
+}
+
+// ListServerEvents returns a page of the events matching the filter and the
+// number of matching events
+func (r *Repository) ListServerEvents(ctx context.Context, filter ServerEventFilter) ([]ServerEvent, int64, error) {
+	var total int64
+	if err := filter.apply(r.db.WithContext(ctx).Model(&ServerEvent{})).Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count server events: %w", err)
+	}
 
-	fmt.Printf("Server event logged:\n     EventType: %v\n     Details: %v\n     Status: %v\n", EventType, Details, Status)
+	order := "id DESC"
+	if filter.Ascending {
+		order = "id"
+	}
+	query := filter.apply(r.db.WithContext(ctx)).Order(order).Offset(filter.Offset)
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	events := []ServerEvent{}
+	if err := query.Find(&events).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list server events: %w", err)
+	}
+	return events, total, nil
+}
+
+// ServerEventValues returns the distinct event types and statuses logged,
+// for filter choices
+func (r *Repository) ServerEventValues(ctx context.Context) (eventTypes []string, statuses []string, err error) {
+	db := r.db.WithContext(ctx).Model(&ServerEvent{})
+	if err := db.Distinct().Order("event_type").Pluck("event_type", &eventTypes).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to list server event types: %w", err)
+	}
+	db = r.db.WithContext(ctx).Model(&ServerEvent{})
+	if err := db.Distinct().Order("status").Pluck("status", &statuses).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to list server event statuses: %w", err)
+	}
+	return eventTypes, statuses, nil
+}
+
+// ServerRun is a run of the server, from its StartingServer event
+type ServerRun struct {
+	Start    ServerEvent
+	Events   int64 // events logged by the run
+	Failures int64 // events of the run with one of FailureStatuses
+}
+
+// ListServerRuns returns a page of server runs, the latest first, and the
+// number of runs
+func (r *Repository) ListServerRuns(ctx context.Context, limit int, offset int) ([]ServerRun, int64, error) {
+	var total int64
+	starts := r.db.WithContext(ctx).Model(&ServerEvent{}).Where("event_type = ?", "StartingServer")
+	if err := starts.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count server runs: %w", err)
+	}
+	var events []ServerEvent
+	err := r.db.WithContext(ctx).
+		Where("event_type = ?", "StartingServer").
+		Order("id DESC").Limit(limit).Offset(offset).
+		Find(&events).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list server runs: %w", err)
+	}
+	if len(events) == 0 {
+		return []ServerRun{}, total, nil
+	}
+
+	runIDs := make([]string, 0, len(events))
+	for _, event := range events {
+		runIDs = append(runIDs, event.ServerRunID)
+	}
+	var counts []struct {
+		ServerRunID string
+		Events      int64
+		Failures    int64
+	}
+	err = r.db.WithContext(ctx).Model(&ServerEvent{}).
+		Select("server_run_id, COUNT(*) AS events, SUM(CASE WHEN status IN ? THEN 1 ELSE 0 END) AS failures", FailureStatuses).
+		Where("server_run_id IN ?", runIDs).
+		Group("server_run_id").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count events of server runs: %w", err)
+	}
+
+	runs := make([]ServerRun, 0, len(events))
+	for _, event := range events {
+		run := ServerRun{Start: event}
+		for _, count := range counts {
+			if count.ServerRunID == event.ServerRunID {
+				run.Events, run.Failures = count.Events, count.Failures
+			}
+		}
+		runs = append(runs, run)
+	}
+	return runs, total, nil
+}
+
+// GetServerRun returns the server run with the given ID
+func (r *Repository) GetServerRun(ctx context.Context, runID string) (ServerRun, error) {
+	var start ServerEvent
+	err := r.db.WithContext(ctx).
+		Where("event_type = ? AND uuid_id = ?", "StartingServer", runID).
+		First(&start).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ServerRun{}, fmt.Errorf("%w: %v", ErrServerRunNotFound, runID)
+	} else if err != nil {
+		return ServerRun{}, fmt.Errorf("failed to find server run %v: %w", runID, err)
+	}
+
+	run := ServerRun{Start: start}
+	if err := r.db.WithContext(ctx).Model(&ServerEvent{}).Where("server_run_id = ?", runID).Count(&run.Events).Error; err != nil {
+		return ServerRun{}, fmt.Errorf("failed to count events of server run %v: %w", runID, err)
+	}
+	err = r.db.WithContext(ctx).Model(&ServerEvent{}).
+		Where("server_run_id = ? AND status IN ?", runID, FailureStatuses).
+		Count(&run.Failures).Error
+	if err != nil {
+		return ServerRun{}, fmt.Errorf("failed to count failures of server run %v: %w", runID, err)
+	}
+	return run, nil
 }
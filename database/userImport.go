@@ -0,0 +1,373 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Actions of user import rows
+const (
+	UserImportCreate    = "create"
+	UserImportUpdate    = "update"
+	UserImportUnchanged = "unchanged"
+	UserImportError     = "error"
+)
+
+// UserImportReport is the outcome of ImportUsers, with one row per record
+type UserImportReport struct {
+	DryRun    bool            `json:"dry_run"`
+	Created   int             `json:"created"`
+	Updated   int             `json:"updated"`
+	Unchanged int             `json:"unchanged"`
+	Failed    int             `json:"failed"`
+	Rows      []UserImportRow `json:"rows"`
+}
+
+// UserImportRow is the planned or applied action for one record
+type UserImportRow struct {
+	Row      int      `json:"row"`
+	Username string   `json:"username"`
+	Action   string   `json:"action"`
+	Changes  []string `json:"changes,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// userImportPlan holds what ImportUsers writes for a valid record
+type userImportPlan struct {
+	record   UserRecord
+	existing *User
+	// fields holds the changed user columns, fieldChanges their file columns
+	fields       map[string]any
+	fieldChanges []string
+	groups       idDiff
+	// secPoints holds the changes of the user-level security point fields
+	secPoints map[string]idDiff
+	// summary describes the changes for the server event
+	summary []string
+}
+
+type idDiff struct {
+	add    []uint
+	remove []uint
+}
+
+func diffIDs(current []uint, desired []uint) idDiff {
+	var diff idDiff
+	for _, id := range desired {
+		if !slices.Contains(current, id) {
+			diff.add = append(diff.add, id)
+		}
+	}
+	for _, id := range current {
+		if !slices.Contains(desired, id) {
+			diff.remove = append(diff.remove, id)
+		}
+	}
+	return diff
+}
+
+// ImportUsers creates users missing from the database and updates existing
+// users to match their records, so importing the same file twice changes
+// nothing. Every record is validated first: when any row fails nothing is
+// written and the error wraps ErrInvalidUserRecords with the row errors. A
+// dry run only validates and plans the changes.
+//
+// New local users get an unusable random password, to be set with
+// ChangeUserPassword. Soft deleted users are not restored.
+func (r *Repository) ImportUsers(ctx context.Context, records []UserRecord, dryRun bool) (UserImportReport, error) {
+	report := UserImportReport{DryRun: dryRun, Rows: make([]UserImportRow, 0, len(records))}
+
+	// ### ###
+	// ### ### Validate and Plan
+	// ### ###
+	lookup, err := r.newImportLookup(ctx)
+	if err != nil {
+		return report, err
+	}
+	var plans []userImportPlan
+	var rowErrs []error
+	usernames := map[string]int{}
+	emails := map[string]int{}
+	for _, record := range records {
+		row := UserImportRow{Row: record.Row, Username: record.Username}
+		plan, err := r.planUserImport(ctx, lookup, record)
+		if err == nil {
+			if first, ok := usernames[record.Username]; ok {
+				err = fmt.Errorf("duplicate username, first on row %v", first)
+			} else if first, ok := emails[strings.ToLower(record.Email)]; ok {
+				err = fmt.Errorf("duplicate email %v, first on row %v", record.Email, first)
+			}
+		}
+		if err != nil {
+			row.Action = UserImportError
+			row.Error = err.Error()
+			rowErrs = append(rowErrs, fmt.Errorf("row %v (%v): %w", record.Row, record.Username, err))
+			report.Failed++
+			report.Rows = append(report.Rows, row)
+			continue
+		}
+		usernames[record.Username] = record.Row
+		emails[strings.ToLower(record.Email)] = record.Row
+
+		row.Changes = plan.changes(lookup)
+		plan.summary = row.Changes
+		switch {
+		case plan.existing == nil:
+			row.Action = UserImportCreate
+			report.Created++
+		case len(row.Changes) > 0:
+			row.Action = UserImportUpdate
+			report.Updated++
+		default:
+			row.Action = UserImportUnchanged
+			report.Unchanged++
+		}
+		report.Rows = append(report.Rows, row)
+		plans = append(plans, plan)
+	}
+	if len(rowErrs) > 0 {
+		return report, fmt.Errorf("%w: %v of %v rows failed, nothing was imported\n%w",
+			ErrInvalidUserRecords, report.Failed, len(records), errors.Join(rowErrs...))
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	// ### ###
+	// ### ### Apply
+	// ### ###
+	err = r.Transaction(ctx, func(tx *Repository) error {
+		for _, plan := range plans {
+			if err := tx.applyUserImport(ctx, plan); err != nil {
+				return fmt.Errorf("row %v (%v): %w", plan.record.Row, plan.record.Username, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = r.LogServerError(ctx, "ImportUsers:Apply", err, "User import rolled back")
+		return report, err
+	}
+
+	summary := fmt.Sprintf("Users imported: %v created, %v updated, %v unchanged", report.Created, report.Updated, report.Unchanged)
+	return report, r.LogServerEvent(ctx, "ImportUsers", summary, "INFO")
+}
+
+// importLookup resolves the groups and security points referenced by records
+type importLookup struct {
+	groupsByName map[string]Group
+	groupsByID   map[uint]Group
+	secPoints    map[uint]bool
+}
+
+func (r *Repository) newImportLookup(ctx context.Context) (importLookup, error) {
+	lookup := importLookup{groupsByName: map[string]Group{}, groupsByID: map[uint]Group{}, secPoints: map[uint]bool{}}
+	var groups []Group
+	if err := r.db.WithContext(ctx).Find(&groups).Error; err != nil {
+		return lookup, fmt.Errorf("failed to load groups: %w", err)
+	}
+	for _, group := range groups {
+		lookup.groupsByName[group.Name] = group
+		lookup.groupsByID[group.ID] = group
+	}
+	var spids []uint
+	if err := r.db.WithContext(ctx).Model(&SecPoint{}).Pluck("id", &spids).Error; err != nil {
+		return lookup, fmt.Errorf("failed to load security points: %w", err)
+	}
+	for _, spid := range spids {
+		lookup.secPoints[spid] = true
+	}
+	return lookup, nil
+}
+
+// group resolves a group by name, or by ID when ref is numeric
+func (l importLookup) group(ref string) (Group, bool) {
+	if group, ok := l.groupsByName[ref]; ok {
+		return group, true
+	}
+	if id, err := strconv.ParseUint(ref, 10, 32); err == nil {
+		group, ok := l.groupsByID[uint(id)]
+		return group, ok
+	}
+	return Group{}, false
+}
+
+// planUserImport validates a record against the database and computes the
+// changes to apply
+func (r *Repository) planUserImport(ctx context.Context, lookup importLookup, record UserRecord) (userImportPlan, error) {
+	plan := userImportPlan{record: record, fields: map[string]any{}, secPoints: map[string]idDiff{}}
+	if record.parseErr != nil {
+		return plan, record.parseErr
+	}
+	if record.Username == "" {
+		return plan, errors.New("username is required")
+	}
+	if record.has("email") && record.Email == "" {
+		return plan, errors.New("email is required")
+	}
+
+	// Resolve references
+	var groupIDs []uint
+	for _, ref := range record.Groups {
+		group, ok := lookup.group(ref)
+		if !ok {
+			return plan, fmt.Errorf("group %q not found", ref)
+		}
+		if !slices.Contains(groupIDs, group.ID) {
+			groupIDs = append(groupIDs, group.ID)
+		}
+	}
+	for _, list := range record.secPointLists() {
+		for _, spid := range list.ids {
+			if !lookup.secPoints[spid] {
+				return plan, fmt.Errorf("%w: %v in %v", ErrSecPointNotFound, spid, list.column)
+			}
+		}
+	}
+
+	// Emails are unique across users, including soft deleted ones
+	db := r.db.WithContext(ctx)
+	if record.Email != "" {
+		var other User
+		if err := db.Unscoped().Where("email = ? AND username <> ?", record.Email, record.Username).Limit(1).Find(&other).Error; err != nil {
+			return plan, fmt.Errorf("failed to look up email: %w", err)
+		}
+		if other.ID != 0 {
+			return plan, fmt.Errorf("email %v is used by user %v", record.Email, other.Username)
+		}
+	}
+
+	existing, err := r.GetUser(ctx, record.Username)
+	if errors.Is(err, ErrUserNotFound) {
+		if record.Email == "" {
+			return plan, errors.New("email is required")
+		}
+		plan.groups = diffIDs(nil, groupIDs)
+		for _, list := range record.secPointLists() {
+			plan.secPoints[list.field] = diffIDs(nil, list.ids)
+		}
+		return plan, nil
+	}
+	if err != nil {
+		return plan, err
+	}
+	if existing.DeletedAt.Valid {
+		return plan, errors.New("user is deleted, undelete it before importing")
+	}
+	plan.existing = existing
+
+	// Compare fields and lists with the database, nil lists are kept
+	for _, field := range []struct {
+		column   string
+		dbColumn string
+		current  any
+		desired  any
+	}{
+		{"first_name", "first_name", existing.FirstName, record.FirstName},
+		{"last_name", "last_name", existing.LastName, record.LastName},
+		{"email", "email", existing.Email, record.Email},
+		{"ldap", "is_ldap_user", existing.IsLDAPUser, record.IsLDAPUser},
+	} {
+		if record.has(field.column) && field.current != field.desired {
+			plan.fields[field.dbColumn] = field.desired
+			plan.fieldChanges = append(plan.fieldChanges, field.column)
+		}
+	}
+	if record.Groups != nil {
+		current, err := r.UserGroupIDs(ctx, existing.ID)
+		if err != nil {
+			return plan, err
+		}
+		plan.groups = diffIDs(current, groupIDs)
+	}
+	for _, list := range record.secPointLists() {
+		if list.ids == nil {
+			continue
+		}
+		var current []uint
+		if err := db.Table(userSecPointTables[list.field]).Where("user_id = ?", existing.ID).Pluck("sec_point_id", &current).Error; err != nil {
+			return plan, fmt.Errorf("failed to load %v of user %v: %w", list.field, existing.Username, err)
+		}
+		plan.secPoints[list.field] = diffIDs(current, list.ids)
+	}
+	return plan, nil
+}
+
+// changes describes the plan for the import report, e.g. "email" or
+// "groups +User Group"
+func (p userImportPlan) changes(lookup importLookup) []string {
+	changes := slices.Clone(p.fieldChanges)
+	if p.existing == nil && !p.record.IsLDAPUser {
+		changes = append(changes, "password not set")
+	}
+	for _, id := range p.groups.add {
+		changes = append(changes, "groups +"+lookup.groupsByID[id].Name)
+	}
+	for _, id := range p.groups.remove {
+		changes = append(changes, "groups -"+lookup.groupsByID[id].Name)
+	}
+	for _, list := range p.record.secPointLists() {
+		for _, id := range p.secPoints[list.field].add {
+			changes = append(changes, fmt.Sprintf("%v +%v", list.column, id))
+		}
+		for _, id := range p.secPoints[list.field].remove {
+			changes = append(changes, fmt.Sprintf("%v -%v", list.column, id))
+		}
+	}
+	return changes
+}
+
+func (r *Repository) applyUserImport(ctx context.Context, plan userImportPlan) error {
+	record := plan.record
+	user := plan.existing
+	if user == nil {
+		// Local users set their password separately
+		password, err := GenerateRandomString(32)
+		if err != nil {
+			return err
+		}
+		user, err = r.CreateUser(ctx, NewUser{
+			Username:   record.Username,
+			FirstName:  record.FirstName,
+			LastName:   record.LastName,
+			Email:      record.Email,
+			Password:   password,
+			IsLDAPUser: record.IsLDAPUser,
+		})
+		if err != nil {
+			return err
+		}
+	} else if len(plan.fields) > 0 {
+		if err := r.db.WithContext(ctx).Model(&User{}).Where("id = ?", user.ID).Updates(plan.fields).Error; err != nil {
+			return fmt.Errorf("failed to update user %v: %w", user.Username, err)
+		}
+	}
+
+	if err := r.AddUserToGroups(ctx, user.ID, plan.groups.add); err != nil {
+		return err
+	}
+	if err := r.RemoveUserFromGroups(ctx, user.ID, plan.groups.remove); err != nil {
+		return err
+	}
+	for field, diff := range plan.secPoints {
+		for _, spid := range diff.add {
+			if err := r.AddUserSecPoint(ctx, *user, spid, field); err != nil {
+				return err
+			}
+		}
+		for _, spid := range diff.remove {
+			if err := r.RemoveUserSecPoint(ctx, *user, spid, field); err != nil {
+				return err
+			}
+		}
+	}
+
+	if plan.existing == nil || len(plan.summary) == 0 {
+		return nil
+	}
+	return r.LogServerEvent(ctx, "ImportUsers:UpdateUser", fmt.Sprintf("User updated: %v (%v)", user.Username, strings.Join(plan.summary, ", ")), "INFO")
+}
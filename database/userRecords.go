@@ -0,0 +1,336 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UserRecordFormat is the file format of bulk user imports and exports
+type UserRecordFormat string
+
+const (
+	UserRecordsCSV  UserRecordFormat = "csv"
+	UserRecordsYAML UserRecordFormat = "yaml"
+)
+
+var (
+	ErrInvalidUserRecords    = errors.New("invalid user records")
+	ErrUnsupportedUserFormat = errors.New("unsupported user records format, choose csv or yaml")
+)
+
+// userRecordColumns are the CSV columns, in export order. List columns hold
+// values separated by ";".
+var userRecordColumns = []string{
+	"username", "first_name", "last_name", "email", "ldap",
+	"groups", "add_sec_points", "del_sec_points", "ovr_sec_points",
+}
+
+// UserRecord is a user of a bulk import or export file. Groups are referenced
+// by name or ID, security points by ID. Nil lists leave the groups or
+// security points of existing users unchanged on import, empty lists remove
+// them all.
+type UserRecord struct {
+	Username     string   `json:"username" yaml:"username"`
+	FirstName    string   `json:"first_name" yaml:"first_name"`
+	LastName     string   `json:"last_name" yaml:"last_name"`
+	Email        string   `json:"email" yaml:"email"`
+	IsLDAPUser   bool     `json:"ldap" yaml:"ldap"`
+	Groups       []string `json:"groups" yaml:"groups"`
+	AddSecPoints []uint   `json:"add_sec_points" yaml:"add_sec_points"`
+	DelSecPoints []uint   `json:"del_sec_points" yaml:"del_sec_points"`
+	OvrSecPoints []uint   `json:"ovr_sec_points" yaml:"ovr_sec_points"`
+
+	// Row is the line of the record in the import file
+	Row int `json:"-" yaml:"-"`
+	// parseErr is reported for the row instead of failing the whole file
+	parseErr error
+	// columns holds the columns or keys present in the import file, nil when
+	// all are. Absent fields of existing users are kept.
+	columns map[string]bool
+}
+
+// has reports whether the record sets a column
+func (u UserRecord) has(column string) bool {
+	return u.columns == nil || u.columns[column]
+}
+
+// userSecPointList is a user-level security point list of a record
+type userSecPointList struct {
+	field  string
+	column string
+	ids    []uint
+}
+
+// secPointLists returns the user-level security point lists of the record
+func (u UserRecord) secPointLists() []userSecPointList {
+	return []userSecPointList{
+		{field: "UserAddSecPoints", column: "add_sec_points", ids: u.AddSecPoints},
+		{field: "UserDelSecPoints", column: "del_sec_points", ids: u.DelSecPoints},
+		{field: "UserOvrSecPoints", column: "ovr_sec_points", ids: u.OvrSecPoints},
+	}
+}
+
+// ParseUserRecordFormat parses csv, yaml or yml
+func ParseUserRecordFormat(name string) (UserRecordFormat, error) {
+	switch strings.ToLower(name) {
+	case "csv":
+		return UserRecordsCSV, nil
+	case "yaml", "yml":
+		return UserRecordsYAML, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedUserFormat, name)
+	}
+}
+
+// UserRecordFormatFromPath returns the format of a file by its extension
+func UserRecordFormatFromPath(path string) (UserRecordFormat, error) {
+	return ParseUserRecordFormat(strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// ReadUserRecords parses an import file. Malformed files fail as a whole,
+// invalid values are reported for their row by ImportUsers.
+func ReadUserRecords(r io.Reader, format UserRecordFormat) ([]UserRecord, error) {
+	switch format {
+	case UserRecordsCSV:
+		return readUserRecordsCSV(r)
+	case UserRecordsYAML:
+		return readUserRecordsYAML(r)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedUserFormat, format)
+	}
+}
+
+func readUserRecordsCSV(r io.Reader) ([]UserRecord, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUserRecords, err)
+	}
+	columns := map[string]int{}
+	present := map[string]bool{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(userRecordColumns, name) {
+			return nil, fmt.Errorf("%w: unknown column %q, columns are %v", ErrInvalidUserRecords, name, strings.Join(userRecordColumns, ","))
+		}
+		columns[name] = i
+		present[name] = true
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, fmt.Errorf("%w: missing username column", ErrInvalidUserRecords)
+	}
+
+	var records []UserRecord
+	for {
+		fields, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidUserRecords, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		record := UserRecord{Row: line, columns: present}
+		value := func(column string) (string, bool) {
+			i, ok := columns[column]
+			if !ok {
+				return "", false
+			}
+			return strings.TrimSpace(fields[i]), true
+		}
+		list := func(column string) []string {
+			cell, ok := value(column)
+			if !ok {
+				return nil
+			}
+			values := []string{}
+			for _, item := range strings.Split(cell, ";") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = append(values, item)
+				}
+			}
+			return values
+		}
+		secPoints := func(column string) []uint {
+			items := list(column)
+			if items == nil {
+				return nil
+			}
+			ids := []uint{}
+			for _, item := range items {
+				id, err := strconv.ParseUint(item, 10, 32)
+				if err != nil {
+					record.parseErr = fmt.Errorf("invalid security point ID %q in %v", item, column)
+					continue
+				}
+				ids = append(ids, uint(id))
+			}
+			return ids
+		}
+
+		record.Username, _ = value("username")
+		record.FirstName, _ = value("first_name")
+		record.LastName, _ = value("last_name")
+		record.Email, _ = value("email")
+		if cell, _ := value("ldap"); cell != "" {
+			if record.IsLDAPUser, err = strconv.ParseBool(cell); err != nil {
+				record.parseErr = fmt.Errorf("invalid ldap value %q, use true or false", cell)
+			}
+		}
+		record.Groups = list("groups")
+		record.AddSecPoints = secPoints("add_sec_points")
+		record.DelSecPoints = secPoints("del_sec_points")
+		record.OvrSecPoints = secPoints("ovr_sec_points")
+		records = append(records, record)
+	}
+}
+
+func readUserRecordsYAML(r io.Reader) ([]UserRecord, error) {
+	var document yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&document); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUserRecords, err)
+	}
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+	list := document.Content[0]
+	if list.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%w: expected a list of users", ErrInvalidUserRecords)
+	}
+
+	records := make([]UserRecord, 0, len(list.Content))
+	for _, node := range list.Content {
+		record := UserRecord{Row: node.Line, columns: map[string]bool{}}
+		if node.Kind != yaml.MappingNode {
+			record.parseErr = errors.New("expected a user mapping")
+		} else if err := node.Decode(&record); err != nil {
+			record.parseErr = err
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if !slices.Contains(userRecordColumns, key) && record.parseErr == nil {
+				record.parseErr = fmt.Errorf("unknown key %q", key)
+			}
+			record.columns[key] = true
+		}
+		record.Username = strings.TrimSpace(record.Username)
+		record.Email = strings.TrimSpace(record.Email)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// WriteUserRecords writes records in the format read by ReadUserRecords
+func WriteUserRecords(w io.Writer, format UserRecordFormat, records []UserRecord) error {
+	switch format {
+	case UserRecordsCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(userRecordColumns); err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := writer.Write([]string{
+				record.Username, record.FirstName, record.LastName, record.Email,
+				strconv.FormatBool(record.IsLDAPUser),
+				strings.Join(record.Groups, ";"),
+				joinIDs(record.AddSecPoints), joinIDs(record.DelSecPoints), joinIDs(record.OvrSecPoints),
+			}); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case UserRecordsYAML:
+		if records == nil {
+			records = []UserRecord{}
+		}
+		var buf bytes.Buffer
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(records); err != nil {
+			return err
+		}
+		if err := encoder.Close(); err != nil {
+			return err
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedUserFormat, format)
+	}
+}
+
+func joinIDs(ids []uint) string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(values, ";")
+}
+
+// ### ###
+// ### ### Export
+// ### ###
+
+// ExportUsers returns the active users with their groups and user-level
+// security points, ordered by username
+func (r *Repository) ExportUsers(ctx context.Context) ([]UserRecord, error) {
+	var users []User
+	err := r.db.WithContext(ctx).
+		Preload("Groups").
+		Preload("UserAddSecPoints").
+		Preload("UserDelSecPoints").
+		Preload("UserOvrSecPoints").
+		Order("username").
+		Find(&users).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load users: %w", err)
+	}
+
+	ids := func(secPoints []SecPoint) []uint {
+		list := make([]uint, 0, len(secPoints))
+		for _, sp := range secPoints {
+			list = append(list, sp.ID)
+		}
+		slices.Sort(list)
+		return list
+	}
+	records := make([]UserRecord, 0, len(users))
+	for _, user := range users {
+		record := UserRecord{
+			Username:     user.Username,
+			FirstName:    user.FirstName,
+			LastName:     user.LastName,
+			Email:        user.Email,
+			IsLDAPUser:   user.IsLDAPUser,
+			Groups:       make([]string, 0, len(user.Groups)),
+			AddSecPoints: ids(user.UserAddSecPoints),
+			DelSecPoints: ids(user.UserDelSecPoints),
+			OvrSecPoints: ids(user.UserOvrSecPoints),
+		}
+		for _, group := range user.Groups {
+			record.Groups = append(record.Groups, group.Name)
+		}
+		slices.Sort(record.Groups)
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -1,18 +1,22 @@
 package database
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/big"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
-	"github.com/javitab/go-web/helpers"
+	"github.com/javitab/go-web/config"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type User struct {
@@ -36,23 +40,74 @@ type APIKey struct {
 	UserID         uint
 	UUID_ID        uuid.UUID
 	expirationDate time.Time
-	KeyValue       string `gorm:"unique"`
+	KeyHash        string `gorm:"unique"`
+	KeySuffix      string
 	Description    string
+	// Key is the generated key, only set on keys returned by CreateAPIKey.
+	// The database only holds its hash.
+	Key string `gorm:"-" json:"-"`
 }
 
+// apiKeySuffixLen is the number of last characters of API keys kept to tell
+// keys apart
+const apiKeySuffixLen = 4
+
+// hashAPIKey returns the hash API keys are stored and looked up by
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// JWTLifetime is how long tokens, and the browser sessions holding them, are
+// valid
+const JWTLifetime = time.Hour
+
 func GenerateJWT(username string) (string, error) {
+	secret := config.GetConfig().Auth.JWTSecret
+	if secret == "" {
+		return "", errors.New("JWT signing key not configured")
+	}
 
 	generateToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"username": username,
-		"exp":      time.Now().Add(time.Hour * 1).Unix(),
+		"exp":      time.Now().Add(JWTLifetime).Unix(),
 	})
-	token, err := generateToken.SignedString([]byte(os.Getenv("SECRET_JWT_KEY")))
+	token, err := generateToken.SignedString([]byte(secret))
 	if err != nil {
 		return "", err
 	}
 	return token, nil
 }
 
+var (
+	ErrUserExists           = errors.New("user already exists")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrUserDeleted          = errors.New("user already deleted, cannot delete")
+	ErrUserActive           = errors.New("user currently active, cannot undelete")
+	ErrInvalidDeleteAction  = errors.New("invalid delete action, choose delete or undelete")
+	ErrUserInGroup          = errors.New("user already in group")
+	ErrUserNotInGroup       = errors.New("user not in group")
+	ErrInvalidSecPointField = errors.New("invalid security point field")
+	ErrAPIKeyNotFound       = errors.New("API key not found")
+)
+
+// User-level security point fields and their join tables
+var userSecPointTables = map[string]string{
+	"UserAddSecPoints": "user_add_sec_points",
+	"UserDelSecPoints": "user_del_sec_points",
+	"UserOvrSecPoints": "user_ovr_sec_points",
+}
+
+// NewUser holds the fields required to create a local user
+type NewUser struct {
+	Username   string
+	LastName   string
+	FirstName  string
+	Email      string
+	Password   string
+	IsLDAPUser bool
+}
+
 func CreateUser(
 	Username string,
 	LastName string,
@@ -60,67 +115,116 @@ func CreateUser(
 	Email string,
 	Password string,
 ) error {
-	db := GetDBConn()
+	_, err := DefaultRepository().CreateUser(context.Background(), NewUser{
+		Username:  Username,
+		LastName:  LastName,
+		FirstName: FirstName,
+		Email:     Email,
+		Password:  Password,
+	})
+	return err
+}
+
+// CreateUser creates a user with a hashed password, returning ErrUserExists
+// if the username is taken
+func (r *Repository) CreateUser(ctx context.Context, input NewUser) (*User, error) {
+	db := r.db.WithContext(ctx)
 
 	//Check if user exists
-	user := db.Where("username = ?", Username).Find(User{})
-	if user.RowsAffected > 0 {
-		return errors.New("User already exists")
+	var count int64
+	if err := db.Unscoped().Model(&User{}).Where("username = ?", input.Username).Count(&count).Error; err != nil {
+		return nil, fmt.Errorf("failed to check for existing user: %w", err)
+	}
+	if count > 0 {
+		return nil, ErrUserExists
 	}
 
 	//Generate password hash
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(Password), bcrypt.DefaultCost)
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 	if err != nil {
-		LogServerError("CreateUser:GeneratePasswordHash", err, "Error generating password hash for user: "+Username)
-		return errors.New("error creating user")
+		_ = r.LogServerError(ctx, "CreateUser:GeneratePasswordHash", err, "Error generating password hash for user: "+input.Username)
+		return nil, errors.New("error creating user")
 	}
 
 	//Create new user
 	newUser := &User{
-		Username:  Username,
-		LastName:  LastName,
-		FirstName: FirstName,
-		Email:     Email,
-		Password:  string(passwordHash),
-		UUID_ID:   uuid.New(),
+		Username:   input.Username,
+		LastName:   input.LastName,
+		FirstName:  input.FirstName,
+		Email:      input.Email,
+		Password:   string(passwordHash),
+		IsLDAPUser: input.IsLDAPUser,
+		UUID_ID:    uuid.New(),
 	}
 
 	//Save to database
-	db.Create(&newUser)
+	if err := db.Create(newUser).Error; err != nil {
+		return nil, fmt.Errorf("failed to create user %v: %w", input.Username, err)
+	}
 
 	//Log Server Event
-	LogServerEvent("CreateUser", "User created", "INFO")
+	if err := r.LogServerEvent(ctx, "CreateUser", "User created: "+input.Username, "INFO"); err != nil {
+		return nil, err
+	}
 
-	return nil
+	return newUser, nil
+}
+
+// GetUser returns the user with the given username, including soft deleted
+// users, or ErrUserNotFound
+func (r *Repository) GetUser(ctx context.Context, Username string) (*User, error) {
+	var user User
+	err := r.db.WithContext(ctx).Unscoped().Where("username = ?", Username).Limit(1).Find(&user).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user %v: %w", Username, err)
+	}
+	if user.ID == 0 {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
 }
 
 func ChangeUserPassword(Username string, NewPassword string) error {
-	db := GetDBConn()
+	return DefaultRepository().ChangeUserPassword(context.Background(), Username, NewPassword)
+}
 
+// ChangeUserPassword replaces the password hash of an existing user
+func (r *Repository) ChangeUserPassword(ctx context.Context, Username string, NewPassword string) error {
 	//Check if user exists
-	var user User
-	db.Where("username = ?", Username).Find(&user)
-	if user.ID == 0 {
-		return errors.New("user not found")
+	user, err := r.GetUser(ctx, Username)
+	if err != nil {
+		return err
 	}
 
 	//Generate password hash
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(NewPassword), bcrypt.DefaultCost)
 	if err != nil {
-		LogServerError("ChangeUserPassword:GeneratePasswordHash", err, "Error generating password hash for user: "+Username)
+		_ = r.LogServerError(ctx, "ChangeUserPassword:GeneratePasswordHash", err, "Error generating password hash for user: "+Username)
 		return errors.New("error changing password")
 	}
 
-	user.Password = string(passwordHash)
+	err = r.db.WithContext(ctx).Model(user).Update("password", string(passwordHash)).Error
+	if err != nil {
+		return fmt.Errorf("failed to change password for user %v: %w", Username, err)
+	}
 
-	_ = helpers.PrettyPrintJSONString(user)
+	//Log Server Event
+	return r.LogServerEvent(ctx, "ChangeUserPassword", "Password changed: "+Username, "INFO")
+}
 
-	db.Save(&user)
+// SetLDAPUser sets whether the user authenticates against LDAP
+func (r *Repository) SetLDAPUser(ctx context.Context, Username string, IsLDAPUser bool) error {
+	user, err := r.GetUser(ctx, Username)
+	if err != nil {
+		return err
+	}
 
-	//Log Server Event
-	LogServerEvent("ChangeUserPassword", "Password changed", "INFO")
+	err = r.db.WithContext(ctx).Model(user).Update("is_ldap_user", IsLDAPUser).Error
+	if err != nil {
+		return fmt.Errorf("failed to set IsLDAPUser for user %v: %w", Username, err)
+	}
 
-	return nil
+	return r.LogServerEvent(ctx, "SetLDAPUser", fmt.Sprintf("User: %v IsLDAPUser: %v", Username, IsLDAPUser), "INFO")
 }
 
 type DeleteUserRequest struct {
@@ -131,34 +235,42 @@ type DeleteUserRequest struct {
 }
 
 func DeleteUser(input DeleteUserRequest) error {
-	db := GetDBConn()
-	var DeleteUser User
+	return DefaultRepository().DeleteUser(context.Background(), input)
+}
+
+// DeleteUser soft deletes or undeletes a user depending on input.Action
+func (r *Repository) DeleteUser(ctx context.Context, input DeleteUserRequest) error {
+	db := r.db.WithContext(ctx)
+
 	//Check if user exists
-	db.Unscoped().Where("username = ?", input.Username).Find(&DeleteUser)
-	if DeleteUser.ID == 0 {
-		del_err := errors.New("user for delete not found")
-		LogServerError("DeleteUser:CheckForUser", del_err, "Unable to find user for deletion: "+input.Username)
-		return del_err
+	DeleteUser, err := r.GetUser(ctx, input.Username)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			_ = r.LogServerError(ctx, "DeleteUser:CheckForUser", err, "Unable to find user for deletion: "+input.Username)
+		}
+		return err
 	}
 
 	switch input.Action {
 	case "delete":
 		if DeleteUser.DeletedAt.Valid {
-			return errors.New("user already deleted, cannot delete")
+			return ErrUserDeleted
+		}
+		if err := db.Delete(DeleteUser).Error; err != nil {
+			return fmt.Errorf("failed to delete user %v: %w", input.Username, err)
 		}
-		db.Delete(&DeleteUser)
-		LogServerEvent("DeleteUser", fmt.Sprintf("User deleted: %v\nDeleted by: %v\nReason: %v", input.Username, input.RequestingUser, input.Reason), "INFO")
+		return r.LogServerEvent(ctx, "DeleteUser", fmt.Sprintf("User deleted: %v\nDeleted by: %v\nReason: %v", input.Username, input.RequestingUser, input.Reason), "INFO")
 	case "undelete":
 		if !DeleteUser.DeletedAt.Valid {
-			return errors.New("user currently active, cannot undelete")
+			return ErrUserActive
+		}
+		if err := db.Unscoped().Model(&User{}).Where("id", DeleteUser.ID).Update("deleted_at", nil).Error; err != nil {
+			return fmt.Errorf("failed to undelete user %v: %w", input.Username, err)
 		}
-		db.Unscoped().Model(&User{}).Where("id", DeleteUser.ID).Update("deleted_at", nil)
-		LogServerEvent("DeleteUser", fmt.Sprintf("User undeleted: %v\nUndeleted by: %v\nReason: %v", input.Username, input.RequestingUser, input.Reason), "INFO")
+		return r.LogServerEvent(ctx, "DeleteUser", fmt.Sprintf("User undeleted: %v\nUndeleted by: %v\nReason: %v", input.Username, input.RequestingUser, input.Reason), "INFO")
 	default:
-		fmt.Println("Invalid option selected, please choose delete or undelete")
+		return ErrInvalidDeleteAction
 	}
-
-	return nil
 }
 
 func GenerateRandomString(n int) (string, error) {
@@ -176,12 +288,16 @@ func GenerateRandomString(n int) (string, error) {
 }
 
 func CreateAPIKey(u User, description string) (*APIKey, error) {
-	db := GetDBConn()
+	return DefaultRepository().CreateAPIKey(context.Background(), u, description)
+}
 
+// CreateAPIKey generates and stores a new API key for the user. The key is
+// only returned here, in the Key field, the database only holds its hash.
+func (r *Repository) CreateAPIKey(ctx context.Context, u User, description string) (*APIKey, error) {
 	//Generate Secure String for API Key
 	apiKey, err := GenerateRandomString(64)
 	if err != nil {
-		LogServerError("CreateAPIKey:GenerateKey", err, "Error generating API Key for user: "+u.Username)
+		_ = r.LogServerError(ctx, "CreateAPIKey:GenerateKey", err, "Error generating API Key for user: "+u.Username)
 		return nil, errors.New("error generating API Key")
 	}
 
@@ -189,41 +305,194 @@ func CreateAPIKey(u User, description string) (*APIKey, error) {
 	newAPIKey := &APIKey{
 		UserID:         u.ID,
 		expirationDate: time.Now().AddDate(0, 1, 0),
-		KeyValue:       apiKey,
+		KeyHash:        hashAPIKey(apiKey),
+		KeySuffix:      apiKey[len(apiKey)-apiKeySuffixLen:],
 		UUID_ID:        uuid.New(),
 		Description:    description,
 	}
 
 	//Save to database
-	db.Create(&newAPIKey)
+	if err := r.db.WithContext(ctx).Create(newAPIKey).Error; err != nil {
+		return nil, fmt.Errorf("failed to save API key for user %v: %w", u.Username, err)
+	}
 
+	newAPIKey.Key = apiKey
 	return newAPIKey, nil
 }
 
+// GetUserByAPIKey returns the active user owning an API key, or
+// ErrAPIKeyNotFound. Keys of deleted users return ErrUserNotFound.
+func (r *Repository) GetUserByAPIKey(ctx context.Context, key string) (*User, error) {
+	db := r.db.WithContext(ctx)
+	if key == "" {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	var apiKey APIKey
+	if err := db.Where("key_hash = ?", hashAPIKey(key)).Limit(1).Find(&apiKey).Error; err != nil {
+		return nil, fmt.Errorf("failed to look up API key: %w", err)
+	}
+	if apiKey.ID == 0 {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	var user User
+	if err := db.Where("id = ?", apiKey.UserID).Limit(1).Find(&user).Error; err != nil {
+		return nil, fmt.Errorf("failed to look up API key user: %w", err)
+	}
+	if user.ID == 0 {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+// ListAPIKeys returns the active API keys of a user, newest first
+func (r *Repository) ListAPIKeys(ctx context.Context, userID uint) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := r.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at DESC").Order("id DESC").Find(&keys).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey soft deletes an API key of the user, so it no longer
+// authenticates, returning ErrAPIKeyNotFound for keys of other users
+func (r *Repository) RevokeAPIKey(ctx context.Context, u User, keyID uint) error {
+	result := r.db.WithContext(ctx).Where("id = ? AND user_id = ?", keyID, u.ID).Delete(&APIKey{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke API key %v: %w", keyID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return r.LogServerEvent(ctx, "RevokeAPIKey", fmt.Sprintf("API key %v revoked for user: %v", keyID, u.Username), "INFO")
+}
+
+// ListUsers returns the users whose username, name or email contains search,
+// ignoring case, ordered by username. Soft deleted users are only included
+// with includeDeleted.
+func (r *Repository) ListUsers(ctx context.Context, search string, includeDeleted bool) ([]User, error) {
+	db := r.db.WithContext(ctx).Preload("Groups").Order("username")
+	if includeDeleted {
+		db = db.Unscoped()
+	}
+	if search = strings.TrimSpace(search); search != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(search)) + "%"
+		db = db.Where(
+			`LOWER(username) LIKE ? ESCAPE '\' OR LOWER(first_name) LIKE ? ESCAPE '\' OR LOWER(last_name) LIKE ? ESCAPE '\' OR LOWER(email) LIKE ? ESCAPE '\'`,
+			pattern, pattern, pattern, pattern,
+		)
+	}
+	users := []User{}
+	if err := db.Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	return users, nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func AddUserToGroup(u User, g Group) error {
-	db := GetDBConn()
+	return DefaultRepository().AddUserToGroup(context.Background(), u, g)
+}
 
-	//Check if user is already in group
-	if db.Model(&u).Association("Groups").Find(&g); g.ID != 0 {
-		return errors.New("user already in group")
+// AddUserToGroup adds a single membership, returning ErrUserInGroup if the
+// user is already a member
+func (r *Repository) AddUserToGroup(ctx context.Context, u User, g Group) error {
+	inGroup, err := r.userInGroup(ctx, u.ID, g.ID)
+	if err != nil {
+		return err
+	}
+	if inGroup {
+		return ErrUserInGroup
 	}
 
 	//Add user to group
-	db.Model(&u).Association("Groups").Append(&g)
+	if err := r.AddUserToGroups(ctx, u.ID, []uint{g.ID}); err != nil {
+		return err
+	}
 
-	return nil
+	return r.LogServerEvent(ctx, "AddUserToGroup", "User added to group: "+u.Username+"\nGroup: "+g.Name, "INFO")
 }
 
 func RemoveUserFromGroup(u User, g Group) error {
-	db := GetDBConn()
+	return DefaultRepository().RemoveUserFromGroup(context.Background(), u, g)
+}
 
-	//Check if user is already in group
-	if db.Model(&u).Association("Groups").Find(&g); g.ID == 0 {
-		return errors.New("user not in group")
+// RemoveUserFromGroup removes a single membership, returning
+// ErrUserNotInGroup if the user is not a member
+func (r *Repository) RemoveUserFromGroup(ctx context.Context, u User, g Group) error {
+	inGroup, err := r.userInGroup(ctx, u.ID, g.ID)
+	if err != nil {
+		return err
+	}
+	if !inGroup {
+		return ErrUserNotInGroup
 	}
 
 	//Remove from Group
-	db.Model(&u).Association("Groups").Delete([]Group{g})
+	if err := r.RemoveUserFromGroups(ctx, u.ID, []uint{g.ID}); err != nil {
+		return err
+	}
+
+	return r.LogServerEvent(ctx, "RemoveUserFromGroup", "User removed from group: "+u.Username+"\nGroup: "+g.Name, "INFO")
+}
+
+func (r *Repository) userInGroup(ctx context.Context, userID uint, groupID uint) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).
+		Model(&UserGroup{}).
+		Where("user_id = ? AND group_id = ?", userID, groupID).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check membership of user %v in group %v: %w", userID, groupID, err)
+	}
+	return count > 0, nil
+}
+
+// AddUserSecPoint grants a user-level security point through one of the
+// UserAddSecPoints, UserDelSecPoints or UserOvrSecPoints fields
+func (r *Repository) AddUserSecPoint(ctx context.Context, u User, SPID uint, field string) error {
+	table, ok := userSecPointTables[field]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidSecPointField, field)
+	}
+
+	var count int64
+	if err := r.db.WithContext(ctx).Model(&SecPoint{}).Where("id = ?", SPID).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to look up security point %v: %w", SPID, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %v", ErrSecPointNotFound, SPID)
+	}
+
+	err := r.db.WithContext(ctx).
+		Table(table).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(map[string]any{"user_id": u.ID, "sec_point_id": SPID}).Error
+	if err != nil {
+		return fmt.Errorf("failed to add security point %v to %v for user %v: %w", SPID, field, u.Username, err)
+	}
+
+	return r.LogServerEvent(ctx, "AddUserSecPoint", fmt.Sprintf("User: %v SPID: %v Field: %v", u.Username, SPID, field), "INFO")
+}
+
+// RemoveUserSecPoint removes a user-level security point from the given field
+func (r *Repository) RemoveUserSecPoint(ctx context.Context, u User, SPID uint, field string) error {
+	table, ok := userSecPointTables[field]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidSecPointField, field)
+	}
+
+	err := r.db.WithContext(ctx).
+		Table(table).
+		Where("user_id = ? AND sec_point_id = ?", u.ID, SPID).
+		Delete(nil).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove security point %v from %v for user %v: %w", SPID, field, u.Username, err)
+	}
 
-	return nil
+	return r.LogServerEvent(ctx, "RemoveUserSecPoint", fmt.Sprintf("User: %v SPID: %v Field: %v", u.Username, SPID, field), "INFO")
 }
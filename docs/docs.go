@@ -22,6 +22,90 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/api/commands/{group}/{name}": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Runs a user, group, security point or LDAP command of the CLI as the authenticated user, with the same security point checks. Used by the CLI in remote mode. Commands reading a password answer with secret_required until the request holds a secret.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "api"
+                ],
+                "summary": "Run a CLI command",
+                "parameters": [
+                    {
+                        "enum": [
+                            "apikey",
+                            "group",
+                            "ldap",
+                            "secpoint",
+                            "user"
+                        ],
+                        "type": "string",
+                        "description": "command group",
+                        "name": "group",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "command name, e.g. create or add-member",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "command flags and secret",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/command.Request"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/command.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/command.Response"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/command.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/command.Response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/command.Response"
+                        }
+                    }
+                }
+            }
+        },
         "/api/server_events": {
             "get": {
                 "security": [
@@ -58,6 +142,18 @@ const docTemplate = `{
                         "description": "ServerRunID to filter for",
                         "name": "ServerRunID",
                         "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "X-Request-ID of the HTTP request that logged the events",
+                        "name": "RequestID",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "OpenTelemetry trace ID of the request that logged the events",
+                        "name": "TraceID",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -70,6 +166,140 @@ const docTemplate = `{
                 }
             }
         },
+        "/api/users/export": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Exports the active users with their groups and user-level security points in the format read by the import endpoint. Requires the ExportUsers security point.",
+                "produces": [
+                    "text/csv",
+                    "application/yaml"
+                ],
+                "tags": [
+                    "api"
+                ],
+                "summary": "Bulk export users",
+                "parameters": [
+                    {
+                        "enum": [
+                            "csv",
+                            "yaml"
+                        ],
+                        "type": "string",
+                        "default": "yaml",
+                        "description": "file format",
+                        "name": "format",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "users file",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users/import": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Creates missing users and updates existing users to match a CSV or YAML file of usernames, names, emails, LDAP flags, groups and user-level security points. All rows are validated first, nothing is written when any row fails. Importing the same file again changes nothing. Requires the ImportUsers security point.",
+                "consumes": [
+                    "text/csv",
+                    "application/yaml"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "api"
+                ],
+                "summary": "Bulk import users",
+                "parameters": [
+                    {
+                        "enum": [
+                            "csv",
+                            "yaml"
+                        ],
+                        "type": "string",
+                        "description": "file format, by default from the Content-Type",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "only validate the file and report the changes",
+                        "name": "dry_run",
+                        "in": "query"
+                    },
+                    {
+                        "description": "CSV with a header row, or a YAML list of users",
+                        "name": "file",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.ImportUsersResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ImportUsersResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "422": {
+                        "description": "rows failed validation, see report",
+                        "schema": {
+                            "$ref": "#/definitions/api.ImportUsersResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/auth/create_user": {
             "post": {
                 "security": [
@@ -77,7 +307,7 @@ const docTemplate = `{
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Create a new user given a CreateUserInput object",
+                "description": "Create a new user given a CreateUserInput object. Requires the CreateUser security point.",
                 "consumes": [
                     "application/json"
                 ],
@@ -100,11 +330,29 @@ const docTemplate = `{
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
+                    "201": {
+                        "description": "Created",
                         "schema": {
                             "$ref": "#/definitions/auth.CreateUserResponse"
                         }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
                     }
                 }
             }
@@ -225,7 +473,7 @@ const docTemplate = `{
         },
         "/auth/login": {
             "post": {
-                "description": "Authenticate a user given a LoginUserInput object. Returns a JWT token upon successful authentication",
+                "description": "Authenticate a user given a LoginUserInput object. Returns a JWT token upon successful authentication, web logins also set it as the session cookie",
                 "consumes": [
                     "application/json"
                 ],
@@ -307,7 +555,7 @@ const docTemplate = `{
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Given a username, will make given updates",
+                "description": "Given a username, will make given updates. Each action requires the security point of the matching command.",
                 "consumes": [
                     "application/json"
                 ],
@@ -373,6 +621,12 @@ const docTemplate = `{
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "403": {
+                        "description": "missing security point",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
             }
@@ -413,6 +667,75 @@ const docTemplate = `{
                     }
                 }
             }
+        },
+        "/healthz": {
+            "get": {
+                "description": "Reports that the server process is serving requests, without checking its dependencies",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Liveness probe",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/readyz": {
+            "get": {
+                "description": "Checks the database, schema migrations, LDAP when configured and the background workers. Returns 503 when any check fails. Errors and latencies are only reported to authenticated callers.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Readiness probe",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/health.Report"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/health.Report"
+                        }
+                    }
+                }
+            }
+        },
+        "/version": {
+            "get": {
+                "description": "Returns the build version and commit, and the ServerRunID of the running server",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Build version",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/health.BuildInfo"
+                        }
+                    }
+                }
+            }
         }
     },
     "definitions": {
@@ -430,6 +753,17 @@ const docTemplate = `{
                 }
             }
         },
+        "api.ImportUsersResponse": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "report": {
+                    "$ref": "#/definitions/database.UserImportReport"
+                }
+            }
+        },
         "auth.CreateUserInput": {
             "type": "object",
             "required": [
@@ -484,7 +818,7 @@ const docTemplate = `{
         "auth.GenerateAPIKeyResponse": {
             "type": "object",
             "properties": {
-                "apikey": {
+                "api_key": {
                     "type": "string"
                 },
                 "message": {
@@ -524,6 +858,18 @@ const docTemplate = `{
                 "username"
             ],
             "properties": {
+                "mode": {
+                    "description": "Mode selects the login security point checked by /auth/login, the CLI\nlogs in with cli_login",
+                    "enum": [
+                        "web_login",
+                        "cli_login"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/auth.ValidLoginMode"
+                        }
+                    ]
+                },
                 "password": {
                     "type": "string"
                 },
@@ -572,6 +918,75 @@ const docTemplate = `{
                 }
             }
         },
+        "auth.ValidLoginMode": {
+            "type": "string",
+            "enum": [
+                "web_login",
+                "cli_login",
+                "api_login"
+            ],
+            "x-enum-varnames": [
+                "WebLogin",
+                "CLILogin",
+                "APILogin"
+            ]
+        },
+        "command.Request": {
+            "type": "object",
+            "properties": {
+                "flags": {
+                    "description": "Flags of the command by name, output flags are ignored",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "secret": {
+                    "description": "Secret answers the Env.Secret prompt of the command",
+                    "type": "string"
+                }
+            }
+        },
+        "command.Response": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "exit_code": {
+                    "type": "integer"
+                },
+                "result": {
+                    "type": "object"
+                },
+                "secret_required": {
+                    "type": "boolean"
+                },
+                "table": {
+                    "$ref": "#/definitions/command.Table"
+                }
+            }
+        },
+        "command.Table": {
+            "type": "object",
+            "properties": {
+                "header": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "rows": {
+                    "type": "array",
+                    "items": {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "database.Group": {
             "type": "object",
             "properties": {
@@ -675,12 +1090,18 @@ const docTemplate = `{
                 "id": {
                     "type": "integer"
                 },
+                "requestID": {
+                    "type": "string"
+                },
                 "serverRunID": {
                     "type": "string"
                 },
                 "status": {
                     "type": "string"
                 },
+                "traceID": {
+                    "type": "string"
+                },
                 "updatedAt": {
                     "type": "string"
                 },
@@ -749,6 +1170,55 @@ const docTemplate = `{
                 }
             }
         },
+        "database.UserImportReport": {
+            "type": "object",
+            "properties": {
+                "created": {
+                    "type": "integer"
+                },
+                "dry_run": {
+                    "type": "boolean"
+                },
+                "failed": {
+                    "type": "integer"
+                },
+                "rows": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/database.UserImportRow"
+                    }
+                },
+                "unchanged": {
+                    "type": "integer"
+                },
+                "updated": {
+                    "type": "integer"
+                }
+            }
+        },
+        "database.UserImportRow": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "changes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "error": {
+                    "type": "string"
+                },
+                "row": {
+                    "type": "integer"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
         "gorm.DeletedAt": {
             "type": "object",
             "properties": {
@@ -760,6 +1230,64 @@ const docTemplate = `{
                     "type": "boolean"
                 }
             }
+        },
+        "health.BuildInfo": {
+            "type": "object",
+            "properties": {
+                "commit": {
+                    "type": "string"
+                },
+                "go_version": {
+                    "type": "string"
+                },
+                "modified": {
+                    "description": "built from a tree with uncommitted changes",
+                    "type": "boolean"
+                },
+                "server_run_id": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "string"
+                }
+            }
+        },
+        "health.Report": {
+            "type": "object",
+            "properties": {
+                "checks": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/health.Result"
+                    }
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "ok",
+                        "unavailable"
+                    ]
+                }
+            }
+        },
+        "health.Result": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "latency_ms": {
+                    "type": "number"
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "ok",
+                        "skipped",
+                        "unavailable"
+                    ]
+                }
+            }
         }
     },
     "securityDefinitions": {
@@ -0,0 +1,195 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Check reports whether a dependency of the server is ready. Checks should
+// return once ctx is done; a check still running at the timeout is reported
+// unavailable and left to finish in the background.
+type Check func(ctx context.Context) error
+
+// ErrSkipped is returned by checks of optional dependencies that are not
+// configured. Skipped checks do not fail readiness.
+var ErrSkipped = errors.New("not configured")
+
+// Check statuses
+const (
+	StatusOK          = "ok"
+	StatusSkipped     = "skipped"
+	StatusUnavailable = "unavailable"
+)
+
+// Result is the outcome of a single check
+type Result struct {
+	Status    string  `json:"status" enums:"ok,skipped,unavailable"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+}
+
+// Report is the outcome of all readiness checks, unavailable when any check
+// failed
+type Report struct {
+	Status string            `json:"status" enums:"ok,unavailable"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Statuses returns the report with only the status of each check, for
+// anonymous callers
+func (r Report) Statuses() Report {
+	out := Report{Status: r.Status, Checks: make(map[string]Result, len(r.Checks))}
+	for name, result := range r.Checks {
+		out.Checks[name] = Result{Status: result.Status}
+	}
+	return out
+}
+
+// Checker runs the readiness checks registered with it
+type Checker struct {
+	// Timeout bounds each check
+	Timeout time.Duration
+
+	mu     sync.RWMutex
+	checks map[string]Check
+}
+
+// NewChecker returns a Checker without checks
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{Timeout: timeout, checks: map[string]Check{}}
+}
+
+var defaultChecker = NewChecker(2 * time.Second)
+
+// Default returns the Checker served on /readyz
+func Default() *Checker {
+	return defaultChecker
+}
+
+// Register adds a check, replacing any check with the same name
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Cached returns a check reusing the outcome of check for ttl, for checks
+// too expensive to run on every probe. Concurrent probes wait for a single
+// run, and outcomes of runs cut short by ctx are not reused.
+func Cached(check Check, ttl time.Duration) Check {
+	var mu sync.Mutex
+	var checked time.Time
+	var last error
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			return last
+		}
+		err := check(ctx)
+		if ctx.Err() == nil {
+			checked, last = time.Now(), err
+		}
+		return err
+	}
+}
+
+// Run runs all checks concurrently, each bounded by Timeout
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := c.run(ctx, check)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result.Status == StatusUnavailable {
+				report.Status = StatusUnavailable
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %v", c.Timeout)
+	}
+	result := Result{Status: StatusOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	switch {
+	case errors.Is(err, ErrSkipped):
+		result.Status = StatusSkipped
+	case err != nil:
+		result.Status = StatusUnavailable
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// ### ###
+// ### ### Handlers
+// ### ###
+
+// Liveness godoc
+//
+//	@Summary		Liveness probe
+//	@Schemes		http
+//	@Tags			health
+//	@Description	Reports that the server process is serving requests, without checking its dependencies
+//	@Produce		json
+//	@Success		200	{object} map[string]string
+//	@Router			/healthz [get]
+func Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+}
+
+// Readiness godoc
+//
+//	@Summary		Readiness probe
+//	@Schemes		http
+//	@Tags			health
+//	@Description	Checks the database, schema migrations, LDAP when configured and the background workers. Returns 503 when any check fails. Errors and latencies are only reported to authenticated callers.
+//	@Produce		json
+//	@Success		200	{object} Report
+//	@Failure		503	{object} Report
+//	@Router			/readyz [get]
+func Readiness(c *gin.Context) {
+	report := Default().Run(c.Request.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	if c.GetString("currentUser") == "" {
+		report = report.Statuses()
+	}
+	c.JSON(status, report)
+}
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	checker := NewChecker(50 * time.Millisecond)
+	checker.Register("database", func(ctx context.Context) error { return nil })
+	checker.Register("ldap", func(ctx context.Context) error { return ErrSkipped })
+
+	report := checker.Run(context.Background())
+	assert.Equal(t, StatusOK, report.Status)
+	assert.Equal(t, StatusOK, report.Checks["database"].Status)
+	assert.Equal(t, StatusSkipped, report.Checks["ldap"].Status)
+
+	// Failed and hanging checks make the server unavailable
+	checker.Register("database", func(ctx context.Context) error { return errors.New("connection refused") })
+	checker.Register("workers", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	report = checker.Run(context.Background())
+	assert.Equal(t, StatusUnavailable, report.Status)
+	assert.Equal(t, Result{Status: StatusUnavailable, Error: "connection refused", LatencyMS: report.Checks["database"].LatencyMS}, report.Checks["database"])
+	assert.Equal(t, "timed out after 50ms", report.Checks["workers"].Error)
+	assert.Equal(t, StatusSkipped, report.Checks["ldap"].Status)
+}
+
+func TestCached(t *testing.T) {
+	runs := 0
+	fail := false
+	check := Cached(func(ctx context.Context) error {
+		runs++
+		if fail {
+			return errors.New("bind failed")
+		}
+		return nil
+	}, 50*time.Millisecond)
+	ctx := context.Background()
+
+	// The outcome is reused until it expires
+	assert.NoError(t, check(ctx))
+	fail = true
+	assert.NoError(t, check(ctx))
+	assert.Equal(t, 1, runs)
+	time.Sleep(60 * time.Millisecond)
+	assert.EqualError(t, check(ctx), "bind failed")
+	assert.EqualError(t, check(ctx), "bind failed")
+	assert.Equal(t, 2, runs)
+
+	// Runs cut short are not reused
+	time.Sleep(60 * time.Millisecond)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	fail = false
+	assert.NoError(t, check(cancelled))
+	assert.NoError(t, check(ctx))
+	assert.Equal(t, 4, runs)
+}
+
+func TestHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/healthz", Liveness)
+	router.GET("/readyz", Readiness)
+	router.GET("/readyz/authenticated", func(c *gin.Context) { c.Set("currentUser", "testuser") }, Readiness)
+	router.GET("/version", GetVersion)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+
+	Default().Register("database", func(ctx context.Context) error { return nil })
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+	Default().Register("database", func(ctx context.Context) error { return errors.New("connection refused") })
+	w := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var report Report
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, Result{Status: StatusUnavailable}, report.Checks["database"])
+
+	// Errors are only shown to authenticated callers
+	w = get("/readyz/authenticated")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, "connection refused", report.Checks["database"].Error)
+
+	dbase.ServerRunID = "run-1"
+	var info BuildInfo
+	assert.NoError(t, json.Unmarshal(get("/version").Body.Bytes(), &info))
+	assert.Equal(t, Version, info.Version)
+	assert.Equal(t, "run-1", info.ServerRunID)
+	assert.NotEmpty(t, info.GoVersion)
+}
@@ -0,0 +1,65 @@
+package health
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X github.com/javitab/go-web/health.Version=v1.2.0 -X github.com/javitab/go-web/health.Commit=$(git rev-parse HEAD)"
+//
+// The commit falls back to the VCS revision stamped by the go command.
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// BuildInfo describes the running build and server run
+type BuildInfo struct {
+	Version     string `json:"version"`
+	Commit      string `json:"commit"`
+	Modified    bool   `json:"modified"` // built from a tree with uncommitted changes
+	GoVersion   string `json:"go_version"`
+	ServerRunID string `json:"server_run_id"`
+}
+
+// GetBuildInfo returns the build information of the running binary
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:     Version,
+		Commit:      Commit,
+		GoVersion:   runtime.Version(),
+		ServerRunID: dbase.ServerRunID,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// GetVersion godoc
+//
+//	@Summary		Build version
+//	@Schemes		http
+//	@Tags			health
+//	@Description	Returns the build version and commit, and the ServerRunID of the running server
+//	@Produce		json
+//	@Success		200	{object} BuildInfo
+//	@Router			/version [get]
+func GetVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, GetBuildInfo())
+}
@@ -2,8 +2,11 @@ package helpers
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"runtime"
@@ -26,14 +29,19 @@ func init() {
 }
 
 func PrettyPrintJSONString(object ...any) string {
+	prettyJSON := PrettyJSONString(object...)
+	fmt.Println(prettyJSON)
+	return prettyJSON
+}
+
+// PrettyJSONString is PrettyPrintJSONString without printing
+func PrettyJSONString(object ...any) string {
 	data, _ := json.Marshal(object)
 	json_string := string(data)
 
 	var prettyJSON bytes.Buffer
 	_ = json.Indent(&prettyJSON, []byte(json_string), "", "	")
 
-	fmt.Println(prettyJSON.String())
-
 	return prettyJSON.String()
 }
 
@@ -45,3 +53,24 @@ func ClearScreen() {
 		panic("Your platform is unsupported! I can't clear terminal screen :(")
 	}
 }
+
+// FSVersion returns a version of the files of fsys, which changes when a file
+// is added, removed or modified. It stats the files rather than reading them.
+func FSVersion(fsys fs.FS) (string, error) {
+	hash := sha256.New()
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%v\x00%v\x00%v\n", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"testing"
+	"testing/fstest"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -10,3 +11,19 @@ func TestHelpers(t *testing.T) {
 
 	assert.Equal(t, nil, nil)
 }
+
+func TestFSVersion(t *testing.T) {
+	fsys := fstest.MapFS{"a.txt": {Data: []byte("a")}}
+	version, err := FSVersion(fsys)
+	assert.NoError(t, err)
+	same, _ := FSVersion(fsys)
+	assert.Equal(t, version, same)
+
+	fsys["a.txt"] = &fstest.MapFile{Data: []byte("ab")}
+	modified, _ := FSVersion(fsys)
+	assert.NotEqual(t, version, modified)
+
+	fsys["b.txt"] = &fstest.MapFile{Data: []byte("b")}
+	added, _ := FSVersion(fsys)
+	assert.NotEqual(t, modified, added)
+}
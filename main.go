@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -10,44 +13,135 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/javitab/go-web/cli"
 	cli_auth "github.com/javitab/go-web/cli/auth"
+	"github.com/javitab/go-web/config"
 	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/health"
+	"github.com/javitab/go-web/metrics"
 	"github.com/javitab/go-web/router"
+	"github.com/javitab/go-web/server"
+	"github.com/javitab/go-web/static_web"
+	"github.com/javitab/go-web/templates"
+	"github.com/javitab/go-web/tracing"
 	"github.com/joho/godotenv"
 )
 
-func StartWebServer() *gin.Engine {
+func StartWebServer(configArgs []string) {
 	// Log Server Start Attempt
 	dbase.CreateServerStartEvent()
 
-	router := router.AppRouter()
+	// Requests are served from the database main connected to
+	repo := dbase.DefaultRepository()
 
-	// Configure the HTTP Server
-	httpPort := os.Getenv("HTTP_PORT")
+	// Apply policy files before serving requests
+	if dir := config.GetConfig().Policy.Dir; dir != "" {
+		summary, err := server.ApplyPolicy(context.Background(), dir)
+		if err != nil {
+			dbase.CreateServerStartFailureEvent(err)
+			log.Fatal(err)
+		}
+		dbase.LogServerEvent("ApplyPolicy", summary, "INFO")
+	}
+
+	// Trace requests, queries and LDAP operations
+	shutdownTracing, err := tracing.Setup(context.Background(), config.GetConfig().Tracing, health.Version)
+	if err != nil {
+		dbase.CreateServerStartFailureEvent(err)
+		log.Fatal(err)
+	}
+
+	// Compile the templates, a broken template fails the start rather than
+	// the requests rendering it
+	if err := templates.Load(); err != nil {
+		dbase.CreateServerStartFailureEvent(err)
+		log.Fatal(err)
+	}
+
+	// Hash the static files for their cache-busting URLs
+	if err := static_web.Load(); err != nil {
+		dbase.CreateServerStartFailureEvent(err)
+		log.Fatal(err)
+	}
+
+	router := router.AppRouter(repo)
+
+	// Expose connection pool statistics with the metrics
+	if sqlDB, err := repo.DB().DB(); err == nil {
+		if err := metrics.RegisterDB(sqlDB); err != nil {
+			dbase.LogServerError("StartWebServer:Metrics", err, "Database pool metrics unavailable")
+		}
+	}
 
+	// Configure the HTTP Server
+	cfg := config.GetConfig()
 	srv := &http.Server{
-		Addr:    ":" + httpPort,
+		Addr:    fmt.Sprintf(":%d", cfg.HTTP.Port),
 		Handler: router,
 		// set timeout due CWE-400 - Potential Slowloris Attack
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	// Start the HTTP server
-	log.Println("Starting server on :8080...")
-	srv_err := srv.ListenAndServe()
+	// Terminate TLS, with mutual TLS when client certificates are configured
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := server.NewTLSConfig(cfg.TLS)
+		if err != nil {
+			dbase.CreateServerStartFailureEvent(err)
+			log.Fatal(err)
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	workers := []server.Worker{
+		// Reload safe settings and policy on SIGHUP or file change
+		{Name: "config reloader", Run: server.NewReloader(configArgs).Run},
+		// Archive expired server events
+		{Name: "event retention", Run: func(ctx context.Context) {
+			server.RunRetention(ctx, time.Hour)
+		}},
+	}
+	// Serve metrics on their own listener instead of the application router
+	if addr := cfg.Metrics.Listen; addr != "" {
+		workers = append(workers, server.Worker{Name: "metrics", Run: func(ctx context.Context) {
+			server.RunMetrics(ctx, addr)
+		}})
+	}
+	web := server.NewServer(srv, cfg.HTTP.ShutdownTimeout, workers...)
+	health.Default().Register("workers", web.CheckWorkers)
+
+	// Serve until SIGINT or SIGTERM, then drain and stop the workers
+	ctx, stop := server.SignalContext()
+	defer stop()
+	srv_err := web.Run(ctx)
+
+	// Flush buffered spans before exiting
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("Unable to flush spans: %v", err)
+	}
+	cancelFlush()
 
-	// Log the server start failure event
+	dbase.CloseDBConn()
 	if srv_err != nil {
-		dbase.CreateServerStartFailureEvent(srv_err)
 		log.Fatal(srv_err)
 	}
-
-	return router
 }
 
-func WebServerDefaultMode() *gin.Engine {
+func WebServerDefaultMode(configArgs []string) {
 	gin.SetMode(gin.ReleaseMode)
-	serve := StartWebServer()
-	return serve
+	StartWebServer(configArgs)
+}
+
+// WebServerDebugMode serves the templates and static files of the working
+// tree instead of the embedded ones. Edits are picked up without restart and
+// open pages reload themselves.
+func WebServerDebugMode(configArgs []string) {
+	if err := templates.LoadDir("templates"); err != nil {
+		log.Fatal(err)
+	}
+	if err := static_web.UseDir("static_web"); err != nil {
+		log.Fatal(err)
+	}
+	log.Print("Debug mode: serving templates/ and static_web/ from disk")
+	StartWebServer(configArgs)
 }
 
 // @title           Go Web API Documentation
@@ -70,18 +164,74 @@ func WebServerDefaultMode() *gin.Engine {
 
 func main() {
 
-	fmt.Println(os.Args)
-
 	if len(os.Args) == 1 {
 		fmt.Println("No arguments provided")
 		cli.PrintHelpText()
 		os.Exit(1)
 	}
 
-	// Load the .env file
+	// Load the .env file, it is optional
 	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "Error while loading .env file: %v\n", err)
+	}
+
+	// Load the layered configuration, flags precede the mode
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	configArgs := os.Args[1 : len(os.Args)-len(args)]
+	if len(args) == 0 {
+		fmt.Println("No mode provided")
+		cli.PrintHelpText()
+		os.Exit(1)
+	}
+
+	// Help, man pages and completion are generated from the command registry
+	switch args[0] {
+	case "help":
+		cli.PrintHelpText()
+		return
+	case "man":
+		cli.ExecMan()
+		return
+	case "completion":
+		cli.ExecCompletion(args[1:])
+		return
+	case "__complete":
+		cli.ExecComplete(cfg, args[1:], os.Stdout)
+		return
+	}
+
+	// Print the configuration before validating so it can be diagnosed
+	if args[0] == "config" {
+		cli.ExecConfig(cfg, args[1:])
+		return
+	}
+
+	// Run commands through the API of cli.server, no database needed
+	if cli.IsRemoteMode(cfg.CLI, args) {
+		os.Exit(cli.ExecRemote(cfg.CLI, args))
+	}
+
+	// Refuse to start with a missing or weak configuration
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	config.SetConfig(cfg)
+
+	// Connect to the database and inject the handle
+	db, err := dbase.ConnectDB(dbase.NewDBConfig(cfg.Database))
 	if err != nil {
-		fmt.Println("Error while loading .env file")
+		log.Fatalf("Database connection failed: %v", err)
+	}
+	dbase.SetDBConn(db)
+
+	// Run schema migrations before the schema check below
+	if args[0] == "migrate" {
+		cli.ExecMigrate(args[1:])
+		return
 	}
 
 	// Initialize the database
@@ -97,28 +247,40 @@ func main() {
 	// ### ### Start Web Server
 	// ### ###
 
-	if os.Args[1] == "web" {
+	if args[0] == "web" {
 
 		// Check if additional parameters provided
-		if len(os.Args) > 2 {
+		if len(args) > 1 {
 
 			// Evaluate web server run mode, if no mode, run in release mode
-			switch os.Args[2] {
+			switch args[1] {
 			case "debug":
-				_ = StartWebServer()
+				WebServerDebugMode(configArgs)
 			default:
-				_ = WebServerDefaultMode()
+				WebServerDefaultMode(configArgs)
 			}
 		} else {
 			// If no additional parameters, same as default above
-			_ = WebServerDefaultMode()
+			WebServerDefaultMode(configArgs)
 		}
 
 	} else {
 
-		if os.Args[1] == "create_superuser" {
-			cli_auth.CLICreateUser()
-			return
+		// Bootstrap and break-glass recovery run without login
+		switch args[0] {
+		case "create_superuser":
+			os.Exit(cli_auth.ExecCreateSuperuser(args[1:]))
+		case "recovery":
+			os.Exit(cli_auth.ExecRecoveryCode(args[1:]))
+		case "recover":
+			os.Exit(cli_auth.ExecRecover(args[1:]))
+		}
+
+		// Reject unknown modes before prompting for credentials
+		if !cli.IsCommand(args) && args[0] != "util" {
+			fmt.Printf("Unknown mode: %q\n", args[0])
+			cli.PrintHelpText()
+			os.Exit(2)
 		}
 
 		// ### ###
@@ -126,21 +288,22 @@ func main() {
 		// ### ###
 
 		cli_auth.CLIUserLogin()
-		// Print info for logged in user
-		// helpers.ClearScreen()
+
+		// Run non-interactive commands, exiting with their status
+		if cli.IsCommand(args) {
+			os.Exit(cli.ExecCommand(args))
+		}
+
+		// Run the interactive utility menu
+		if len(args) < 2 || cli.UtilityMenus[args[1]] == nil {
+			fmt.Println("Usage: ./go-web util <menu>")
+			os.Exit(2)
+		}
 		fmt.Println("Utility running as user: " + cli_auth.LoggedInUser.DB.Username)
 		if cli_auth.LoggedInUser.IsLDAPUser {
 			fmt.Println("User is authenticated with LDAP")
 		}
-
-		switch os.Args[1] {
-		case "util":
-			modes := cli.UtilityMenus[os.Args[2]]
-			cli.ExecUtilMenu(modes)
-		case "help":
-
-		}
-
+		cli.ExecUtilMenu(cli.UtilityMenus[args[1]])
 	}
 
 }
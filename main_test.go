@@ -7,6 +7,7 @@ import (
 	"os"
 	"testing"
 
+	dbase "github.com/javitab/go-web/database"
 	"github.com/javitab/go-web/router"
 	test_suite "github.com/javitab/go-web/tests"
 	"github.com/stretchr/testify/assert"
@@ -17,7 +18,7 @@ func TestMain(t *testing.T) {
 	tearDown := test_suite.SetupSuite(t)
 	defer tearDown(t)
 	// Start Web Server
-	router := router.AppRouter()
+	router := router.AppRouter(dbase.DefaultRepository())
 
 	// Send HTTP Request for Hello World
 	expectedResponse :=
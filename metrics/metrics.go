@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the name of every application metric
+const Namespace = "go_web"
+
+// Registry holds the application metrics together with the Go runtime and
+// process collectors. It is separate from the default registry so only
+// metrics registered here are exposed.
+var Registry = prometheus.NewRegistry()
+
+// ### ###
+// ### ### Collectors
+// ### ###
+
+var (
+	// HTTPRequestDuration observes handled requests by registered route
+	// pattern, so paths with IDs do not create new series
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// Logins counts login attempts by login mode, authentication method and
+	// outcome
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "auth",
+		Name:      "logins_total",
+		Help:      "Login attempts by mode, method and outcome.",
+	}, []string{"mode", "method", "outcome"})
+
+	// SecPointDenials counts failed security point checks by security point
+	SecPointDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "auth",
+		Name:      "sec_point_denials_total",
+		Help:      "Security point checks denied, by security point ID.",
+	}, []string{"spid"})
+
+	// LDAPRequestDuration observes LDAP operations, including failed ones
+	LDAPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "ldap",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of LDAP operations by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	// LDAPErrors counts failed LDAP operations
+	LDAPErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "ldap",
+		Name:      "errors_total",
+		Help:      "Failed LDAP operations by operation.",
+	}, []string{"operation"})
+)
+
+// Login outcomes
+const (
+	LoginSuccess         = "success"
+	LoginUserNotFound    = "user_not_found"
+	LoginUserDeleted     = "user_deleted"
+	LoginInvalidPassword = "invalid_password"
+	LoginUnauthorized    = "unauthorized"
+	LoginError           = "error"
+)
+
+// Login methods
+const (
+	LoginMethodLocal  = "local"
+	LoginMethodLDAP   = "ldap"
+	LoginMethodAPIKey = "api_key"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequestDuration,
+		Logins,
+		SecPointDenials,
+		LDAPRequestDuration,
+		LDAPErrors,
+	)
+}
+
+// Handler serves the metrics of Registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ### ###
+// ### ### Recording
+// ### ###
+
+// ObserveHTTPRequest records a handled request. Requests that matched no
+// route share the "unmatched" route.
+func ObserveHTTPRequest(method string, route string, status int, duration time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	HTTPRequestDuration.WithLabelValues(method, route, strconv.Itoa(status)).Observe(duration.Seconds())
+}
+
+// RecordLogin counts a login attempt
+func RecordLogin(mode string, method string, outcome string) {
+	Logins.WithLabelValues(mode, method, outcome).Inc()
+}
+
+// RecordSecPointDenial counts a denied security point check
+func RecordSecPointDenial(SPID int) {
+	SecPointDenials.WithLabelValues(strconv.Itoa(SPID)).Inc()
+}
+
+// ObserveLDAP records an LDAP operation started at start, and counts it as
+// failed when err is not nil
+func ObserveLDAP(operation string, start time.Time, err error) {
+	LDAPRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		LDAPErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// ### ###
+// ### ### Database
+// ### ###
+
+var dbStats prometheus.Collector
+
+// RegisterDB exposes the connection pool statistics of db, replacing those
+// of a previously registered connection
+func RegisterDB(db *sql.DB) error {
+	if dbStats != nil {
+		Registry.Unregister(dbStats)
+	}
+	dbStats = collectors.NewDBStatsCollector(db, Namespace)
+	return Registry.Register(dbStats)
+}
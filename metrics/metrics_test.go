@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"database/sql"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecording(t *testing.T) {
+	before := testutil.ToFloat64(Logins.WithLabelValues("web_login", LoginMethodLDAP, LoginInvalidPassword))
+	RecordLogin("web_login", LoginMethodLDAP, LoginInvalidPassword)
+	assert.Equal(t, before+1, testutil.ToFloat64(Logins.WithLabelValues("web_login", LoginMethodLDAP, LoginInvalidPassword)))
+
+	before = testutil.ToFloat64(SecPointDenials.WithLabelValues("8"))
+	RecordSecPointDenial(8)
+	assert.Equal(t, before+1, testutil.ToFloat64(SecPointDenials.WithLabelValues("8")))
+
+	// Latency is observed for every LDAP operation, errors only for failures
+	before = testutil.ToFloat64(LDAPErrors.WithLabelValues("search"))
+	ObserveLDAP("search", time.Now(), nil)
+	ObserveLDAP("search", time.Now(), assert.AnError)
+	assert.Equal(t, before+1, testutil.ToFloat64(LDAPErrors.WithLabelValues("search")))
+}
+
+func TestHandler(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "metrics.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Registering a new connection replaces the previous one
+	assert.NoError(t, RegisterDB(db))
+	assert.NoError(t, RegisterDB(db))
+
+	ObserveHTTPRequest("GET", "/api/server_events", 200, 30*time.Millisecond)
+	ObserveHTTPRequest("GET", "", 404, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, string(body), `go_web_http_request_duration_seconds_count{method="GET",route="/api/server_events",status="200"}`)
+	assert.Contains(t, string(body), `go_web_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, string(body), `go_sql_open_connections{db_name="go_web"}`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
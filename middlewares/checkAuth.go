@@ -1,92 +1,164 @@
 package middlewares
 
 import (
-	"flag"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/javitab/go-web/config"
 	dbase "github.com/javitab/go-web/database"
 )
 
-func CheckAuth(c *gin.Context) {
-
-	authHeader := c.GetHeader("Authorization")
+// CheckAuth authenticates API requests by client certificate, bearer token
+// or session cookie, and sets currentUser. Requests authenticated by the
+// session cookie also need a CSRF token unless their method is safe.
+// Unauthenticated requests are refused with 401. Users are looked up in repo.
+func CheckAuth(repo *dbase.Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if status, body := authenticate(c, repo); status != 0 {
+			c.AbortWithStatusJSON(status, body)
+		}
+	}
+}
 
-	if flag.Lookup(("test.v")) == nil {
+// OptionalAuth authenticates requests sending credentials like CheckAuth,
+// and lets requests without any through without currentUser
+func OptionalAuth(repo *dbase.Repository) gin.HandlerFunc {
+	checkAuth := CheckAuth(repo)
+	return func(c *gin.Context) {
+		if _, ok := ClientCertUser(c, repo); !ok && c.GetHeader("Authorization") == "" {
+			if cookie, err := c.Cookie(SessionCookie); err != nil || cookie == "" {
+				return
+			}
+		}
+		checkAuth(c)
+	}
+}
 
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is missing"})
-			c.AbortWithStatus(http.StatusUnauthorized)
+// CheckSession authenticates browser pages like CheckAuth. Unauthenticated
+// GET requests are redirected to loginPath, which returns to the page after
+// login.
+func CheckSession(repo *dbase.Repository, loginPath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, body := authenticate(c, repo)
+		switch {
+		case status == 0:
 			return
+		case status == http.StatusUnauthorized && c.Request.Method == http.MethodGet:
+			if _, err := c.Cookie(SessionCookie); err == nil {
+				ClearSessionCookie(c)
+			}
+			c.Redirect(http.StatusSeeOther, loginPath+"?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+			c.Abort()
+		default:
+			c.AbortWithStatusJSON(status, body)
 		}
+	}
+}
+
+// authenticate sets currentUser, or returns the status and body refusing the
+// request. Failed lookups are server errors, not refused credentials.
+func authenticate(c *gin.Context, repo *dbase.Repository) (int, gin.H) {
+	// Machine clients authenticate with a verified client certificate
+	if user, ok := ClientCertUser(c, repo); ok {
+		setCurrentUser(c, user.Username)
+		return 0, nil
+	}
 
+	var tokenString string
+	if authHeader := c.GetHeader("Authorization"); authHeader != "" {
 		authToken := strings.Split(authHeader, " ")
 		if len(authToken) != 2 || authToken[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token format"})
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+			return http.StatusUnauthorized, gin.H{"error": "Invalid token format"}
 		}
-
-		tokenString := authToken[1]
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(os.Getenv("SECRET_JWT_KEY")), nil
-		})
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":   "Invalid or expired token",
-				"message": err.Error(),
-			})
-			dbase.LogServerError("CheckAuth:JWT:InvalidOrExpired", err, "Error validating token for user: "+tokenString)
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+		tokenString = authToken[1]
+	} else if cookie, err := c.Cookie(SessionCookie); err == nil && cookie != "" {
+		// Browsers send the cookie with any request to this host
+		if !safeMethod(c.Request.Method) && !ValidCSRF(c) {
+			dbase.LogServerEventContext(c.Request.Context(), "CSRF:Invalid", "Refused "+c.Request.Method+" "+c.Request.URL.Path, "DENY")
+			return http.StatusForbidden, gin.H{"error": "invalid CSRF token"}
 		}
+		tokenString = cookie
+	} else {
+		return http.StatusUnauthorized, gin.H{"error": "Authorization header is missing"}
+	}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "token expired"})
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+		secret := config.GetConfig().Auth.JWTSecret
+		if secret == "" {
+			return nil, fmt.Errorf("JWT signing key not configured")
+		}
+		return []byte(secret), nil
+	})
+	if err != nil || !token.Valid {
+		dbase.LogServerErrorContext(c.Request.Context(), "CheckAuth:JWT:InvalidOrExpired", err, "Error validating token for user: "+tokenRef(token, tokenString))
+		return http.StatusUnauthorized, gin.H{
+			"error":   "Invalid or expired token",
+			"message": err.Error(),
 		}
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return http.StatusUnauthorized, gin.H{"error": "Invalid token"}
+	}
 
-		db := dbase.GetDBConn()
-		var user dbase.User
-		db.Where("Username=?", claims["username"]).Find(&user)
+	if exp, ok := claims["exp"].(float64); !ok || float64(time.Now().Unix()) > exp {
+		return http.StatusUnauthorized, gin.H{"error": "token expired"}
+	}
 
-		if user.ID == 0 {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":  "Username Not Found",
-				"claims": claims,
-			})
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+	username, _ := claims["username"].(string)
+	user, err := repo.GetUser(c.Request.Context(), username)
+	if errors.Is(err, dbase.ErrUserNotFound) {
+		return http.StatusUnauthorized, gin.H{
+			"error":  "Username Not Found",
+			"claims": claims,
 		}
+	}
+	if err != nil {
+		dbase.LogServerErrorContext(c.Request.Context(), "CheckAuth:GetUser", err, "Error looking up user: "+username)
+		return http.StatusInternalServerError, gin.H{"error": "error looking up user"}
+	}
 
-		if user.DeletedAt.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error":  "User is disabled",
-				"claims": claims,
-			})
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+	if user.DeletedAt.Valid {
+		return http.StatusUnauthorized, gin.H{
+			"error":  "User is disabled",
+			"claims": claims,
 		}
+	}
 
-		c.Set("currentUser", user.Username)
-	} else {
-		c.Set("currentUser", "testuser")
-		c.Next()
+	setCurrentUser(c, user.Username)
+	return 0, nil
+}
+
+// tokenRef identifies a refused token in server events without logging the
+// token itself: the username it claims, unverified, and a short hash
+func tokenRef(token *jwt.Token, tokenString string) string {
+	username := "unknown"
+	if token != nil {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			if claimed, ok := claims["username"].(string); ok && claimed != "" {
+				username = claimed
+			}
+		}
 	}
+	sum := sha256.Sum256([]byte(tokenString))
+	return fmt.Sprintf("%v (token sha256:%v)", username, hex.EncodeToString(sum[:])[:12])
+}
+
+// setCurrentUser sets the authenticated user, and stamps the server events
+// of the request with it
+func setCurrentUser(c *gin.Context, username string) {
+	c.Set("currentUser", username)
+	c.Request = c.Request.WithContext(dbase.WithUsername(c.Request.Context(), username))
 }
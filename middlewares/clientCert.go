@@ -0,0 +1,105 @@
+package middlewares
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// clientCertKey caches the outcome of ClientCertUser for the request, which
+// OptionalAuth and CheckAuth both ask for
+const clientCertKey = "clientCertUser"
+
+type clientCertResult struct {
+	user *dbase.User
+	ok   bool
+}
+
+// loggedClientCerts holds the certificates, by fingerprint and outcome, whose
+// use was logged. Machine clients and probes present the same certificate
+// with every request, so only its first use is logged.
+var loggedClientCerts sync.Map
+
+// logClientCertOnce logs the outcome of a certificate the first time it is
+// seen
+func logClientCertOnce(cert *x509.Certificate, outcome string, log func()) {
+	sum := sha256.Sum256(cert.Raw)
+	if _, seen := loggedClientCerts.LoadOrStore(hex.EncodeToString(sum[:])+":"+outcome, true); !seen {
+		log()
+	}
+}
+
+// ClientCertUser returns the active user mapped to the verified client
+// certificate of the request, if any. With tls.client_identity cn the
+// subject common name is matched against usernames, with san the DNS, email
+// and URI SANs are matched in that order and the first user found wins.
+// Users are looked up in repo once per request.
+func ClientCertUser(c *gin.Context, repo *dbase.Repository) (*dbase.User, bool) {
+	if cached, ok := c.Get(clientCertKey); ok {
+		result := cached.(clientCertResult)
+		return result.user, result.ok
+	}
+	user, ok := lookupClientCertUser(c, repo)
+	c.Set(clientCertKey, clientCertResult{user: user, ok: ok})
+	return user, ok
+}
+
+func lookupClientCertUser(c *gin.Context, repo *dbase.Repository) (*dbase.User, bool) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	cert := state.VerifiedChains[0][0]
+	ctx := c.Request.Context()
+
+	for _, identity := range ClientCertIdentities(cert, config.GetConfig().TLS.ClientIdentity) {
+		user, err := repo.GetUser(ctx, identity)
+		if errors.Is(err, dbase.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			dbase.LogServerErrorContext(ctx, "CheckAuth:ClientCert", err, "Error looking up user: "+identity)
+			return nil, false
+		}
+		if user.DeletedAt.Valid {
+			logClientCertOnce(cert, "disabled:"+identity, func() {
+				dbase.LogServerErrorContext(ctx, "CheckAuth:ClientCert:Disabled", fmt.Errorf("user %v is disabled", identity), "Subject: "+cert.Subject.String())
+			})
+			return nil, false
+		}
+		logClientCertOnce(cert, "user:"+identity, func() {
+			dbase.LogServerEventContext(ctx, "CheckAuth:ClientCert", fmt.Sprintf("Client certificate %v authenticated as user %v", cert.Subject.String(), identity), "AUTH")
+		})
+		return user, true
+	}
+
+	logClientCertOnce(cert, "nouser", func() {
+		dbase.LogServerErrorContext(ctx, "CheckAuth:ClientCert:NoUser", errors.New("no user matches client certificate"), "Subject: "+cert.Subject.String())
+	})
+	return nil, false
+}
+
+// ClientCertIdentities returns the names of cert matched against usernames
+// for the given tls.client_identity
+func ClientCertIdentities(cert *x509.Certificate, field string) []string {
+	if field != "san" {
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+		return []string{cert.Subject.CommonName}
+	}
+
+	identities := append([]string{}, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
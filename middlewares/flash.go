@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
+)
+
+// ### ###
+// ### ### Flash Messages
+// ### ###
+
+const (
+	// FlashCookie holds the flash messages of the next page
+	FlashCookie = "flash"
+
+	flashKey = "flashes"
+)
+
+// Flash is a message shown once on the next page rendered, such as the
+// outcome of a form after its redirect
+type Flash struct {
+	Level   string `json:"level"` // bootstrap alert level: success, info, warning or danger
+	Message string `json:"message"`
+}
+
+// AddFlash adds a message to the next page rendered by this browser
+func AddFlash(c *gin.Context, level string, message string) {
+	flashes := append(pendingFlashes(c), Flash{Level: level, Message: message})
+	c.Set(flashKey, flashes)
+	data, _ := json.Marshal(flashes)
+	value := b64.RawURLEncoding.EncodeToString(data)
+	setCookie(c, FlashCookie, value+"."+flashSignature(value), 0, http.SameSiteLaxMode)
+}
+
+// Flashes returns the messages added for this page, by this request or the
+// one redirecting to it, and clears them
+func Flashes(c *gin.Context) []Flash {
+	flashes := pendingFlashes(c)
+	if _, err := c.Cookie(FlashCookie); err == nil || len(flashes) > 0 {
+		ClearFlashes(c)
+	}
+	return flashes
+}
+
+// ClearFlashes drops the pending messages
+func ClearFlashes(c *gin.Context) {
+	c.Set(flashKey, []Flash{})
+	setCookie(c, FlashCookie, "", -1, http.SameSiteLaxMode)
+}
+
+// pendingFlashes returns the messages of this request, or of the flash cookie
+// when it is signed by this server
+func pendingFlashes(c *gin.Context) []Flash {
+	if flashes, ok := c.Get(flashKey); ok {
+		return flashes.([]Flash)
+	}
+	var flashes []Flash
+	cookie, _ := c.Cookie(FlashCookie)
+	value, signature, ok := strings.Cut(cookie, ".")
+	if ok && hmac.Equal([]byte(signature), []byte(flashSignature(value))) {
+		if data, err := b64.RawURLEncoding.DecodeString(value); err == nil {
+			_ = json.Unmarshal(data, &flashes)
+		}
+	}
+	c.Set(flashKey, flashes)
+	return flashes
+}
+
+// flashSignature keeps other sites and subdomains from setting messages shown
+// as if they came from this server
+func flashSignature(value string) string {
+	mac := hmac.New(sha256.New, []byte(config.GetConfig().Auth.JWTSecret))
+	mac.Write([]byte("flash\x00" + value))
+	return b64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
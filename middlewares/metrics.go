@@ -0,0 +1,18 @@
+package middlewares
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/metrics"
+)
+
+// Metrics observes the duration and status of every request by route
+// pattern. It runs before recovery so panics are counted as 500s.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		metrics.ObserveHTTPRequest(c.Request.Method, c.FullPath(), c.Writer.Status(), time.Since(start))
+	}
+}
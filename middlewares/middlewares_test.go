@@ -1,12 +1,391 @@
-package middlewares
+package middlewares_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/middlewares"
+	test_suite "github.com/javitab/go-web/tests"
 	"github.com/stretchr/testify/assert"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 func TestMiddlewares(t *testing.T) {
 
 	assert.Equal(t, nil, nil)
 }
+
+func TestClientCertUser(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	certs := test_suite.WriteTestCertificates(t, t.TempDir())
+
+	// A context whose request carries a verified client certificate
+	withCert := func(cert *x509.Certificate) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return c
+	}
+	cert := certs.ClientCertificate(t, "router01", "unknown.local", "testuser").Leaf
+
+	// The subject common name is matched by default
+	assert.Equal(t, []string{"router01"}, middlewares.ClientCertIdentities(cert, "cn"))
+	_, ok := middlewares.ClientCertUser(withCert(cert), dbase.DefaultRepository())
+	assert.False(t, ok)
+
+	// SANs are matched in order, the first existing user wins
+	cfg := config.GetConfig()
+	cfg.TLS.ClientIdentity = "san"
+	config.SetConfig(cfg)
+	assert.Equal(t, []string{"unknown.local", "testuser"}, middlewares.ClientCertIdentities(cert, "san"))
+	c := withCert(cert)
+	user, ok := middlewares.ClientCertUser(c, dbase.DefaultRepository())
+	assert.True(t, ok)
+	assert.Equal(t, "testuser", user.Username)
+
+	// The user is looked up once per request
+	user, ok = middlewares.ClientCertUser(c, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "testuser", user.Username)
+
+	// Only the first use of a certificate is logged
+	for range 3 {
+		middlewares.ClientCertUser(withCert(cert), dbase.DefaultRepository())
+	}
+	for eventType, count := range map[string]int64{"CheckAuth:ClientCert": 1, "CheckAuth:ClientCert:NoUser": 1} {
+		var events int64
+		dbase.GetDBConn().Model(&dbase.ServerEvent{}).Where("event_type = ?", eventType).Count(&events)
+		assert.Equal(t, count, events, eventType)
+	}
+
+	// Unverified certificates are ignored
+	c = withCert(cert)
+	c.Request.TLS.VerifiedChains = nil
+	_, ok = middlewares.ClientCertUser(c, dbase.DefaultRepository())
+	assert.False(t, ok)
+}
+
+func TestCheckAuth(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	router := test_suite.AppRouter()
+	whoami := func(c *gin.Context) { c.String(http.StatusOK, c.GetString("currentUser")) }
+	router.GET("/whoami", middlewares.CheckAuth(dbase.DefaultRepository()), whoami)
+	router.POST("/whoami", middlewares.CheckAuth(dbase.DefaultRepository()), whoami)
+
+	// A database that cannot be queried
+	down, err := dbase.ConnectDB(dbase.DBConfig{Driver: dbase.DriverSQLite, DSN: filepath.Join(t.TempDir(), "down.db")})
+	assert.NoError(t, err)
+	sqlDB, err := down.DB()
+	assert.NoError(t, err)
+	assert.NoError(t, sqlDB.Close())
+	router.GET("/down", middlewares.CheckAuth(dbase.NewRepository(down)), whoami)
+	router.GET("/token", middlewares.CSRF, func(c *gin.Context) { c.String(http.StatusOK, middlewares.CSRFToken(c)) })
+
+	serve := func(method string, setup func(req *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/whoami", nil)
+		setup(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	header := test_suite.AuthHeader(t, "testuser")
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	// No credentials, or credentials of unknown users, are refused
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", func(req *http.Request) {}).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", func(req *http.Request) { req.Header.Set("Authorization", "Token x") }).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", func(req *http.Request) {
+		req.Header.Set("Authorization", test_suite.AuthHeader(t, "nobody"))
+	}).Code)
+
+	// Bearer tokens and session cookies authenticate
+	w := serve("POST", func(req *http.Request) { req.Header.Set("Authorization", header) })
+	assert.Equal(t, "testuser", w.Body.String())
+	w = serve("GET", func(req *http.Request) { req.AddCookie(&http.Cookie{Name: middlewares.SessionCookie, Value: token}) })
+	assert.Equal(t, "testuser", w.Body.String())
+
+	// Unsafe requests of cookie sessions need the CSRF token of the session
+	req := httptest.NewRequest("GET", "/token", nil)
+	req.AddCookie(&http.Cookie{Name: middlewares.SessionCookie, Value: token})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var csrfCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == middlewares.CSRFCookie {
+			csrfCookie = cookie
+		}
+	}
+	if assert.NotNil(t, csrfCookie) {
+		assert.True(t, csrfCookie.HttpOnly)
+		assert.Equal(t, http.SameSiteStrictMode, csrfCookie.SameSite)
+	}
+	csrfToken := w.Body.String()
+	cookies := func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: middlewares.SessionCookie, Value: token})
+		req.AddCookie(csrfCookie)
+	}
+	assert.Equal(t, http.StatusForbidden, serve("POST", cookies).Code)
+	w = serve("POST", func(req *http.Request) {
+		cookies(req)
+		req.Header.Set(middlewares.CSRFHeader, csrfToken)
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "testuser", w.Body.String())
+
+	// Refused tokens are logged by the username they claim and a hash, never
+	// the token itself
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "testuser",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("not-the-server-jwt-signing-key-at-all"))
+	assert.NoError(t, err)
+	for _, setup := range []func(req *http.Request){
+		func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+forged) },
+		func(req *http.Request) { req.AddCookie(&http.Cookie{Name: middlewares.SessionCookie, Value: forged}) },
+	} {
+		assert.Equal(t, http.StatusUnauthorized, serve("GET", setup).Code)
+		var event dbase.ServerEvent
+		dbase.GetDBConn().Where("event_type = ?", "CheckAuth:JWT:InvalidOrExpired").Order("id desc").Limit(1).Find(&event)
+		assert.Contains(t, event.Details, "Error validating token for user: testuser (token sha256:")
+		assert.NotContains(t, event.Details, forged)
+	}
+
+	// Failed user lookups are server errors, not refused credentials
+	req = httptest.NewRequest("GET", "/down", nil)
+	req.Header.Set("Authorization", header)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestFlash(t *testing.T) {
+	config.SetConfig(test_suite.TestConfig())
+	router := gin.New()
+	router.POST("/add", func(c *gin.Context) {
+		middlewares.AddFlash(c, "success", "Saved")
+		middlewares.AddFlash(c, "info", "Again")
+		c.Status(http.StatusSeeOther)
+	})
+	router.GET("/show", func(c *gin.Context) {
+		c.JSON(http.StatusOK, middlewares.Flashes(c))
+	})
+	serve := func(method string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		path := "/show"
+		if method == "POST" {
+			path = "/add"
+		}
+		req := httptest.NewRequest(method, path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	cookies := serve("POST", nil).Result().Cookies()
+	flash := cookies[len(cookies)-1]
+	assert.Equal(t, middlewares.FlashCookie, flash.Name)
+	assert.True(t, flash.HttpOnly)
+
+	// Messages are shown once, then the cookie is cleared
+	w := serve("GET", flash)
+	assert.JSONEq(t, `[{"level":"success","message":"Saved"},{"level":"info","message":"Again"}]`, w.Body.String())
+	assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+
+	// Messages not signed by the server are dropped
+	value, _, _ := strings.Cut(flash.Value, ".")
+	assert.Equal(t, "null", serve("GET", &http.Cookie{Name: middlewares.FlashCookie, Value: value + ".forged"}).Body.String())
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := middlewares.NewMemoryRateLimitStore()
+	rule := config.RateLimitRule{Requests: 2, Period: time.Second}
+	now := time.Now()
+	ctx := context.Background()
+
+	// The bucket starts full and is emptied by a burst
+	for remaining := 1; remaining >= 0; remaining-- {
+		result, err := store.Take(ctx, "ip:a", rule, now)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+	result, _ := store.Take(ctx, "ip:a", rule, now)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+	assert.Equal(t, time.Second, result.Reset)
+
+	// Other keys have their own bucket, tokens refill over time
+	result, _ = store.Take(ctx, "ip:b", rule, now)
+	assert.True(t, result.Allowed)
+	result, _ = store.Take(ctx, "ip:a", rule, now.Add(500*time.Millisecond))
+	assert.True(t, result.Allowed)
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit.Login = config.RateLimitRule{Requests: 2, Period: time.Minute, Key: config.RateLimitKeyAPIKey}
+	cfg.RateLimit.API = config.RateLimitRule{Requests: 1, Period: time.Minute, Key: config.RateLimitKeyUser}
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	limits := middlewares.NewRateLimits(middlewares.NewMemoryRateLimitStore())
+	limits.Exempt = func(ctx context.Context, username string) (bool, error) {
+		return username == "svc-router", nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/generate_jwt", limits.Handler(config.RateLimitGroupLogin), func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(body))
+	})
+	router.GET("/api", func(c *gin.Context) {
+		c.Set("currentUser", c.Query("user"))
+	}, limits.Handler(config.RateLimitGroupAPI), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	// Requests are counted per API key, the body still reaches the handler
+	keyA := `{"key":"a"}`
+	w := do("POST", "/generate_jwt", keyA)
+	assert.Equal(t, keyA, w.Body.String())
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2;w=60;burst=2", w.Header().Get("RateLimit-Policy"))
+	do("POST", "/generate_jwt", keyA)
+	w = do("POST", "/generate_jwt", keyA)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, do("POST", "/generate_jwt", `{"key":"b"}`).Code)
+
+	// Requests are counted per user, exempt users are not limited
+	assert.Equal(t, http.StatusOK, do("GET", "/api?user=alice", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do("GET", "/api?user=alice", "").Code)
+	assert.Equal(t, http.StatusOK, do("GET", "/api?user=bob", "").Code)
+	for i := 0; i < 3; i++ {
+		w = do("GET", "/api?user=svc-router", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+
+	// Limits follow the running configuration
+	cfg.RateLimit.API.Requests = 0
+	config.SetConfig(cfg)
+	assert.Equal(t, http.StatusOK, do("GET", "/api?user=alice", "").Code)
+}
+
+func TestRequestIDAndAccessLog(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	var logs bytes.Buffer
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middlewares.RequestID(), middlewares.AccessLog(slog.New(slog.NewJSONHandler(&logs, nil))))
+	router.GET("/users/:name", func(c *gin.Context) {
+		c.Set("currentUser", "testuser")
+		dbase.LogServerEventContext(c.Request.Context(), "RequestIDTest", "Looked up "+c.Param("name"), "INFO")
+		c.String(http.StatusOK, "found")
+	})
+	get := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/users/alice", nil)
+		if requestID != "" {
+			req.Header.Set(middlewares.RequestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Request IDs from upstream are propagated, invalid ones replaced
+	assert.Equal(t, "upstream-42", get("upstream-42").Header().Get(middlewares.RequestIDHeader))
+	generated := get("bad id\n").Header().Get(middlewares.RequestIDHeader)
+	assert.Len(t, generated, 36)
+	assert.NotEqual(t, generated, get("").Header().Get(middlewares.RequestIDHeader))
+
+	// Server events logged during the request carry its ID
+	var event dbase.ServerEvent
+	dbase.GetDBConn().Where("request_id = ?", "upstream-42").Find(&event)
+	assert.Equal(t, "RequestIDTest", event.EventType)
+
+	// Access logs are JSON lines with the route pattern
+	var entry map[string]any
+	line, err := logs.ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(line, &entry))
+	assert.Equal(t, "request", entry["msg"])
+	assert.Equal(t, "upstream-42", entry["request_id"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/users/:name", entry["route"])
+	assert.Equal(t, "/users/alice", entry["path"])
+	assert.Equal(t, float64(http.StatusOK), entry["status"])
+	assert.Equal(t, float64(len("found")), entry["bytes"])
+	assert.Equal(t, "testuser", entry["user"])
+	assert.Contains(t, entry, "latency_ms")
+}
+
+func TestTracing(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	spans := test_suite.RecordSpans(t)
+
+	var logs bytes.Buffer
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middlewares.RequestID(), middlewares.Tracing(), middlewares.AccessLog(slog.New(slog.NewJSONHandler(&logs, nil))))
+	router.GET("/users/:name", func(c *gin.Context) {
+		c.Set("currentUser", "testuser")
+		dbase.LogServerEventContext(c.Request.Context(), "TracingTest", "Looked up "+c.Param("name"), "INFO")
+		c.String(http.StatusOK, "found")
+	})
+
+	// The trace of an incoming traceparent header is continued
+	const traceID = "4bf92f3577b34a736e36c6b1a6f3a0a1"
+	req := httptest.NewRequest("GET", "/users/alice", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	ended := spans.Ended()
+	server := ended[len(ended)-1]
+	assert.Equal(t, "GET /users/:name", server.Name())
+	assert.Equal(t, traceID, server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Contains(t, server.Attributes(), semconv.HTTPRoute("/users/:name"))
+	assert.Contains(t, server.Attributes(), semconv.HTTPResponseStatusCode(http.StatusOK))
+	assert.Contains(t, server.Attributes(), semconv.EnduserID("testuser"))
+
+	// The server event insert is a child span, and the event records the trace
+	assert.Contains(t, test_suite.SpanNames(spans), "gorm.create")
+	var event dbase.ServerEvent
+	dbase.GetDBConn().Where("event_type = ?", "TracingTest").Find(&event)
+	assert.Equal(t, traceID, event.TraceID)
+
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, traceID, entry["trace_id"])
+}
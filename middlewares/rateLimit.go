@@ -0,0 +1,256 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
+)
+
+// RateLimitResult is the state of a token bucket after a request
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next token, when not allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore holds the token buckets of rate limited clients. The
+// default MemoryRateLimitStore is local to the process, a shared store lets
+// several instances enforce a common limit.
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key, refilled according to
+	// rule, and reports whether one was available
+	Take(ctx context.Context, key string, rule config.RateLimitRule, now time.Time) (RateLimitResult, error)
+}
+
+// ### ###
+// ### ### Memory Store
+// ### ###
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket is full again and can be dropped
+}
+
+// MemoryRateLimitStore keeps token buckets in memory. Buckets are dropped
+// once they have refilled, so idle clients use no memory.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimitStore returns an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*bucket{}}
+}
+
+// Take implements RateLimitStore
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rule config.RateLimitRule, now time.Time) (RateLimitResult, error) {
+	capacity := float64(rule.Capacity())
+	perToken := rule.Period / time.Duration(rule.Requests)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	b, exists := s.buckets[key]
+	if !exists {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	elapsed := now.Sub(b.updated)
+	b.tokens = math.Min(capacity, b.tokens+float64(elapsed)/float64(perToken))
+	b.updated = now
+
+	result := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = time.Duration((capacity - b.tokens) * float64(perToken))
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep drops full buckets at most once a minute
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// ### ###
+// ### ### Middleware
+// ### ###
+
+// RateLimits applies the rate_limit rules of the route groups. Rules are
+// read per request so reloads take effect.
+type RateLimits struct {
+	Store RateLimitStore
+	// Exempt reports whether an authenticated user is exempt from rate
+	// limits, results are cached for ExemptTTL
+	Exempt    func(ctx context.Context, username string) (bool, error)
+	ExemptTTL time.Duration
+
+	mu     sync.Mutex
+	exempt map[string]exemption
+}
+
+type exemption struct {
+	exempt  bool
+	expires time.Time
+}
+
+// NewRateLimits returns RateLimits using the given store
+func NewRateLimits(store RateLimitStore) *RateLimits {
+	return &RateLimits{
+		Store:     store,
+		ExemptTTL: time.Minute,
+		exempt:    map[string]exemption{},
+	}
+}
+
+var defaultRateLimits = NewRateLimits(NewMemoryRateLimitStore())
+
+// DefaultRateLimits returns the RateLimits used by RateLimit
+func DefaultRateLimits() *RateLimits {
+	return defaultRateLimits
+}
+
+// RateLimit limits requests of a route group, one of the
+// config.RateLimitGroup constants, with DefaultRateLimits. Groups keyed by
+// user must run it after CheckAuth.
+func RateLimit(group string) gin.HandlerFunc {
+	return DefaultRateLimits().Handler(group)
+}
+
+// Handler limits requests of a route group and sets the RateLimit headers.
+// Requests over the limit are answered with 429 and Retry-After.
+func (l *RateLimits) Handler(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rule := config.GetConfig().RateLimit.Rule(group)
+		if !rule.Enabled() {
+			c.Next()
+			return
+		}
+
+		username := c.GetString("currentUser")
+		if username != "" && l.isExempt(c.Request.Context(), username) {
+			c.Next()
+			return
+		}
+
+		key := group + ":" + rateLimitKey(c, rule.Key, username)
+		result, err := l.Store.Take(c.Request.Context(), key, rule, time.Now())
+		if err != nil {
+			// Fail open, an unavailable store must not take the API down
+			log.Printf("Rate limit store error for %v: %v", group, err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Limit", strconv.Itoa(rule.Capacity()))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", rule.Requests, seconds(rule.Period), rule.Capacity()))
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// isExempt looks up and caches the exemption of a user. Lookup errors are
+// not cached and do not exempt.
+func (l *RateLimits) isExempt(ctx context.Context, username string) bool {
+	if l.Exempt == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	cached, ok := l.exempt[username]
+	l.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.exempt
+	}
+
+	exempt, err := l.Exempt(ctx, username)
+	if err != nil {
+		log.Printf("Rate limit exemption lookup failed for %v: %v", username, err)
+		return false
+	}
+	l.mu.Lock()
+	l.exempt[username] = exemption{exempt: exempt, expires: time.Now().Add(l.ExemptTTL)}
+	l.mu.Unlock()
+	return exempt
+}
+
+// rateLimitKey returns the client a request is counted against. API keys
+// are hashed so they are not kept in memory or sent to a shared store.
+func rateLimitKey(c *gin.Context, keyType string, username string) string {
+	switch keyType {
+	case config.RateLimitKeyUser:
+		if username != "" {
+			return "user:" + username
+		}
+	case config.RateLimitKeyAPIKey:
+		if key := requestAPIKey(c); key != "" {
+			sum := sha256.Sum256([]byte(key))
+			return "api_key:" + hex.EncodeToString(sum[:])
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// requestAPIKey reads the key of a generate_jwt request body and restores
+// the body for the handler
+func requestAPIKey(c *gin.Context) string {
+	if c.Request.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<16))
+	c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+	if err != nil {
+		return ""
+	}
+	var input struct {
+		Key string `json:"key"`
+	}
+	if json.Unmarshal(body, &input) != nil {
+		return ""
+	}
+	return input.Key
+}
+
+// seconds rounds a duration up to whole seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
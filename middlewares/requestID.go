@@ -0,0 +1,77 @@
+package middlewares
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/tracing"
+)
+
+// RequestIDHeader carries the request ID between clients, proxies and the
+// server
+const RequestIDHeader = "X-Request-ID"
+
+const requestIDKey = "requestID"
+
+// Request IDs accepted from clients, anything else is replaced
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID propagates the X-Request-ID of the request, or assigns a new
+// one, and echoes it in the response. The ID is added to the request context
+// so server events logged with it are stamped with the request.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+
+		c.Set(requestIDKey, requestID)
+		c.Header(RequestIDHeader, requestID)
+		c.Request = c.Request.WithContext(dbase.WithRequestID(c.Request.Context(), requestID))
+		c.Next()
+	}
+}
+
+// GetRequestID returns the ID assigned to the request by RequestID
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// AccessLog writes a structured log entry for every request once it has
+// been handled. The route is the registered path pattern, so entries can be
+// aggregated without the IDs in the URL.
+func AccessLog(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		level := slog.LevelInfo
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+		logger.LogAttrs(context.Background(), level, "request",
+			slog.String("request_id", GetRequestID(c)),
+			slog.String("trace_id", tracing.TraceID(c.Request.Context())),
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", c.Writer.Status()),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("user", c.GetString("currentUser")),
+			slog.String("user_agent", c.Request.UserAgent()),
+		)
+	}
+}
+
+// accessLogger writes JSON access logs to stdout, at or above log.level
+var accessLogger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: config.LogLevel}))
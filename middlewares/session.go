@@ -0,0 +1,136 @@
+package middlewares
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// ### ###
+// ### ### Session Cookie
+// ### ###
+
+// SessionCookie holds the JWT of a browser session
+const SessionCookie = "session"
+
+// SetSessionCookie starts a browser session with a JWT. The cookie expires
+// with the token and is HttpOnly, SameSite=Lax and Secure unless
+// auth.insecure_cookies is set. No domain is set, so it is only sent to this
+// host.
+func SetSessionCookie(c *gin.Context, token string) {
+	setCookie(c, SessionCookie, token, int(dbase.JWTLifetime.Seconds()), http.SameSiteLaxMode)
+}
+
+// ClearSessionCookie ends the browser session
+func ClearSessionCookie(c *gin.Context) {
+	setCookie(c, SessionCookie, "", -1, http.SameSiteLaxMode)
+}
+
+func setCookie(c *gin.Context, name string, value string, maxAge int, sameSite http.SameSite) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   !config.GetConfig().Auth.InsecureCookies,
+		HttpOnly: true,
+		SameSite: sameSite,
+	})
+}
+
+// ### ###
+// ### ### CSRF Protection
+// ### ###
+
+const (
+	// CSRFCookie holds the random value CSRF tokens are derived from
+	CSRFCookie = "csrf"
+	// CSRFField is the form field of CSRF tokens
+	CSRFField = "csrf_token"
+	// CSRFHeader carries CSRF tokens of requests that are not forms
+	CSRFHeader = "X-CSRF-Token"
+
+	csrfTokenKey = "csrfToken"
+)
+
+// CSRF protects the state-changing requests of browser pages. Requests with
+// another method than GET, HEAD or OPTIONS need the token of CSRFToken in the
+// csrf_token form field or the X-CSRF-Token header, or are refused with 403.
+//
+// Tokens are an HMAC of the csrf cookie and the session cookie, so they only
+// validate for the browser and session they were rendered for, and no state
+// is kept on the server.
+func CSRF(c *gin.Context) {
+	CSRFWith(func(c *gin.Context) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid CSRF token"})
+	})(c)
+}
+
+// CSRFWith is CSRF answering refused requests with refuse, which must abort
+// them
+func CSRFWith(refuse gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret, err := c.Cookie(CSRFCookie)
+		if err != nil || secret == "" {
+			value := make([]byte, 32)
+			_, _ = rand.Read(value)
+			secret = b64.RawURLEncoding.EncodeToString(value)
+			setCookie(c, CSRFCookie, secret, 0, http.SameSiteStrictMode)
+			// Forms rendered before the first cookie have no valid token yet
+			c.Request.AddCookie(&http.Cookie{Name: CSRFCookie, Value: secret})
+		}
+		c.Set(csrfTokenKey, csrfToken(c))
+
+		if !safeMethod(c.Request.Method) && !ValidCSRF(c) {
+			dbase.LogServerEventContext(c.Request.Context(), "CSRF:Invalid", "Refused "+c.Request.Method+" "+c.Request.URL.Path, "DENY")
+			refuse(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// CSRFToken returns the CSRF token of the request, for the csrf_token field
+// of forms in templates
+func CSRFToken(c *gin.Context) string {
+	if token := c.GetString(csrfTokenKey); token != "" {
+		return token
+	}
+	return csrfToken(c)
+}
+
+// ValidCSRF reports whether the request holds the CSRF token of its cookies
+func ValidCSRF(c *gin.Context) bool {
+	expected := csrfToken(c)
+	if expected == "" {
+		return false
+	}
+	token := c.GetHeader(CSRFHeader)
+	if token == "" {
+		token = c.PostForm(CSRFField)
+	}
+	return hmac.Equal([]byte(token), []byte(expected))
+}
+
+// csrfToken derives the token of the csrf and session cookies, empty without
+// a csrf cookie
+func csrfToken(c *gin.Context) string {
+	secret, err := c.Cookie(CSRFCookie)
+	if err != nil || secret == "" {
+		return ""
+	}
+	session, _ := c.Cookie(SessionCookie)
+	mac := hmac.New(sha256.New, []byte(config.GetConfig().Auth.JWTSecret))
+	mac.Write([]byte("csrf\x00" + secret + "\x00" + session))
+	return b64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
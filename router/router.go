@@ -1,62 +1,100 @@
 package router
 
 import (
+	"context"
+	"net/http"
+	"strings"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/javitab/go-web/api"
 	"github.com/javitab/go-web/auth"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
 	docs "github.com/javitab/go-web/docs"
+	"github.com/javitab/go-web/health"
+	"github.com/javitab/go-web/metrics"
+	"github.com/javitab/go-web/middlewares"
 	"github.com/javitab/go-web/static_web"
 	"github.com/javitab/go-web/web"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
 
-func AppRouter() *gin.Engine {
-	// Set the router as the default one shipped with Gin
-	router := gin.Default()
+// readyCacheTTL is how long readiness probes reuse the outcome of the
+// migrations and ldap checks, which query the schema and bind to the
+// directory
+const readyCacheTTL = 30 * time.Second
+
+// AppRouter returns the application router, serving the database of repo
+func AppRouter(repo *dbase.Repository) *gin.Engine {
+	// Logging and recovery are part of the shared middleware
+	router := gin.New()
 	// expectedHost := os.Getenv("HTTP_HOST")
 
-	// Setup CORS
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:3000", "http://localhost:8080"},
-		AllowMethods:     []string{"PUT", "PATCH", "GET", "POST", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-Requested-With", "Accept", "Access-Control-Allow-Origin"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
-
-	// Setup Security Headers
-	router.Use(func(c *gin.Context) {
-		c.Header("X-Frame-Options", "DENY")
-		c.Header("Content-Security-Policy", "default-src 'self'; connect-src *; font-src *; script-src-elem * 'unsafe-inline'; img-src * data:; style-src * 'unsafe-inline';")
-		c.Header("X-XSS-Protection", "1; mode=block")
-		c.Header("Strict-Transport-Security", "max-age=31536000; includeSubDomains; preload")
-		// c.Header("Referrer-Policy", "strict-origin")
-		// c.Header("X-Content-Type-Options", "nosniff")
-		c.Header("Permissions-Policy", "geolocation=(),midi=(),sync-xhr=(),microphone=(),camera=(),magnetometer=(),gyroscope=(),fullscreen=(self),payment=()")
-		c.Next()
-	})
+	// Only trust X-Forwarded-For from configured proxies, client IPs key
+	// rate limits and logs
+	if err := router.SetTrustedProxies(config.GetConfig().HTTP.TrustedProxies); err != nil {
+		dbase.LogServerError("AppRouter:TrustedProxies", err, "Ignoring http.trusted_proxies")
+		_ = router.SetTrustedProxies(nil)
+	}
+
+	// Service accounts holding the RateLimitExempt security point are not
+	// rate limited
+	middlewares.DefaultRateLimits().Exempt = auth.RateLimitExempt(repo)
+
+	// Setup CORS and security headers
+	router.Use(middlewares.Defaults()...)
 
 	docs.SwaggerInfo.Title = "Go Web"
 	docs.SwaggerInfo.BasePath = "/"
-	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	router.GET("/swagger/*any", middlewares.ContentSecurityPolicy(config.CSPGroupDocs), ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-	// Serve frontend static files
-	web_fs, _ := static_web.HTTPFS()
-	router.StaticFS("/static", web_fs)
+	// Serve frontend static files, embedded or from disk in debug mode
+	static := gin.WrapH(http.StripPrefix(strings.TrimSuffix(static_web.Prefix, "/"), static_web.Default()))
+	router.GET(static_web.Prefix+"*filepath", static)
+	router.HEAD(static_web.Prefix+"*filepath", static)
+
+	// Probes and build information, unauthenticated for load balancers and
+	// orchestrators
+	checks := health.Default()
+	checks.Register("database", func(ctx context.Context) error {
+		return dbase.PingDB(ctx, repo.DB())
+	})
+	checks.Register("migrations", health.Cached(func(ctx context.Context) error {
+		return dbase.CheckSchema(repo.DB().WithContext(ctx))
+	}, readyCacheTTL))
+	checks.Register("ldap", health.Cached(auth.CheckLDAP, readyCacheTTL))
+	probes := router.Group("", middlewares.ContentSecurityPolicy(config.CSPGroupAPI))
+	{
+		probes.GET("/healthz", health.Liveness)
+		probes.GET("/readyz", middlewares.OptionalAuth(repo), health.Readiness)
+		probes.GET("/version", health.GetVersion)
+	}
+
+	// Metrics are served here unless they have their own listener
+	if config.GetConfig().Metrics.Listen == "" {
+		router.GET("/metrics",
+			middlewares.ContentSecurityPolicy(config.CSPGroupAPI),
+			middlewares.CheckAuth(repo),
+			middlewares.RateLimit(config.RateLimitGroupAPI),
+			auth.RequireSecPoint(repo, auth.SPViewMetrics),
+			gin.WrapH(metrics.Handler()),
+		)
+	}
 
 	// Setup route group for API
-	api.ApiRouterGroup(router)
+	api.ApiRouterGroup(router, repo)
 
 	// Setup route group for web
-	web.WebRouterGroup(router)
+	web.WebRouterGroup(router, repo)
+
+	// Setup route group for auth, with the endpoints running through the
+	// service
+	api.AuthRoutes(auth.AuthRouterGroup(router, repo), repo)
 
-	// Setup route group for auth
-	auth.AuthRouterGroup(router)
+	// Browser pages get the 404 page, other clients JSON
+	router.NoRoute(web.NotFound)
 
 	// Return the router instance
 	return router
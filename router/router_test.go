@@ -1,8 +1,19 @@
 package router
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/javitab/go-web/auth"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/health"
+	test_suite "github.com/javitab/go-web/tests"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -10,3 +21,143 @@ func TestRouter(t *testing.T) {
 
 	assert.Equal(t, nil, nil)
 }
+
+func serve(path string, setup func(req *http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if setup != nil {
+		setup(req)
+	}
+	w := httptest.NewRecorder()
+	AppRouter(dbase.DefaultRepository()).ServeHTTP(w, req)
+	return w
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	headers := config.GetConfig().Headers
+
+	// Headers common to every route group
+	for _, path := range []string{"/web/test", "/auth", "/swagger/index.html", "/missing"} {
+		w := serve(path, nil)
+		assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"), path)
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"), path)
+		assert.Equal(t, headers.ReferrerPolicy, w.Header().Get("Referrer-Policy"), path)
+		assert.Equal(t, headers.PermissionsPolicy, w.Header().Get("Permissions-Policy"), path)
+		assert.Empty(t, w.Header().Get("Strict-Transport-Security"), path)
+	}
+
+	// Each route group has its own policy, web pages get a fresh nonce
+	web := serve("/web/test", nil).Header().Get("Content-Security-Policy")
+	assert.Contains(t, web, "script-src 'self' 'nonce-")
+	assert.NotContains(t, web, "unsafe-inline")
+	assert.NotContains(t, web, "{nonce}")
+	assert.NotEqual(t, web, serve("/web/test", nil).Header().Get("Content-Security-Policy"))
+	assert.Equal(t, headers.CSPAPI, serve("/auth", nil).Header().Get("Content-Security-Policy"))
+	assert.Equal(t, headers.CSPAPI, serve("/api/", nil).Header().Get("Content-Security-Policy"))
+	assert.Equal(t, headers.CSPDocs, serve("/swagger/index.html", nil).Header().Get("Content-Security-Policy"))
+
+	// HSTS is only sent over HTTPS
+	w := serve("/web/test", func(req *http.Request) { req.TLS = &tls.ConnectionState{} })
+	assert.Equal(t, headers.HSTS, w.Header().Get("Strict-Transport-Security"))
+	w = serve("/web/test", func(req *http.Request) { req.Header.Set("X-Forwarded-Proto", "https") })
+	assert.Equal(t, headers.HSTS, w.Header().Get("Strict-Transport-Security"))
+
+	// Headers follow the running configuration
+	cfg := config.GetConfig()
+	cfg.Headers.CSP = "default-src 'none'"
+	cfg.Headers.ReferrerPolicy = ""
+	config.SetConfig(cfg)
+	w = serve("/web/test", nil)
+	assert.Equal(t, "default-src 'none'", w.Header().Get("Content-Security-Policy"))
+	assert.NotContains(t, w.Header(), "Referrer-Policy")
+}
+
+func TestCORS(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	cfg := config.GetConfig()
+	cfg.CORS.AllowedOrigins = []string{"https://app.local"}
+	config.SetConfig(cfg)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "/api/", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		AppRouter(dbase.DefaultRepository()).ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight("https://app.local")
+	assert.Equal(t, "https://app.local", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	w = preflight("http://localhost:3000")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestMetrics(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	ctx := context.Background()
+
+	// Scraping requires the ViewMetrics security point
+	authorize := func(req *http.Request) { req.Header.Set("Authorization", test_suite.AuthHeader(t, "testuser")) }
+	assert.Equal(t, http.StatusUnauthorized, serve("/metrics", nil).Code)
+	assert.Equal(t, http.StatusForbidden, serve("/metrics", authorize).Code)
+
+	testuser, err := dbase.DefaultRepository().GetUser(ctx, "testuser")
+	assert.NoError(t, err)
+	assert.NoError(t, dbase.DefaultRepository().AddUserSecPoint(ctx, *testuser, auth.SPViewMetrics, "UserAddSecPoints"))
+	serve("/web/test", nil)
+	w := serve("/metrics", authorize)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `go_web_http_request_duration_seconds_count{method="GET",route="/web/test",status="200"}`)
+	assert.Contains(t, w.Body.String(), `go_web_auth_sec_point_denials_total{spid="11"}`)
+
+	// A separate listener replaces the authenticated route
+	cfg := config.GetConfig()
+	cfg.Metrics.Listen = "127.0.0.1:0"
+	config.SetConfig(cfg)
+	assert.Equal(t, http.StatusNotFound, serve("/metrics", authorize).Code)
+}
+
+func TestProbes(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+
+	assert.Equal(t, http.StatusOK, serve("/healthz", nil).Code)
+	assert.Equal(t, http.StatusOK, serve("/version", nil).Code)
+
+	// The database and schema are checked, LDAP only when configured
+	w := serve("/readyz", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report health.Report
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, health.StatusOK, report.Checks["database"].Status)
+	assert.Equal(t, health.StatusOK, report.Checks["migrations"].Status)
+	assert.Equal(t, health.StatusSkipped, report.Checks["ldap"].Status)
+
+	// Rolled back migrations make the server unready, the error is only
+	// shown to authenticated callers
+	_, err := dbase.MigrateDown(dbase.GetDBConn(), 1)
+	assert.NoError(t, err)
+	w = serve("/readyz", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, health.Result{Status: health.StatusUnavailable}, report.Checks["migrations"])
+
+	w = serve("/readyz", func(req *http.Request) { req.Header.Set("Authorization", test_suite.AuthHeader(t, "testuser")) })
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	latest := dbase.Migrations[len(dbase.Migrations)-1].Version
+	assert.Contains(t, report.Checks["migrations"].Error, fmt.Sprintf("pending versions: [%d]", latest))
+
+	// Invalid credentials are refused rather than treated as anonymous
+	w = serve("/readyz", func(req *http.Request) { req.Header.Set("Authorization", "Bearer invalid") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
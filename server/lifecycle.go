@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	dbase "github.com/javitab/go-web/database"
+)
+
+// Worker is a background task run for the lifetime of a Server. Run must
+// return once its context is done.
+type Worker struct {
+	Name string
+	Run  func(ctx context.Context)
+}
+
+// Server runs the HTTP server and its background workers. The StartingServer
+// event of the server run moves from PENDING to RUNNING once listening, and
+// to STOPPED with the reason once the server and its workers have stopped.
+type Server struct {
+	HTTP *http.Server
+	// ShutdownTimeout bounds the drain of in-flight requests and the stop of
+	// the workers once shutdown begins
+	ShutdownTimeout time.Duration
+	// Workers are started in order before serving and stopped in reverse
+	// order after the HTTP server has drained
+	Workers []Worker
+
+	mu      sync.Mutex
+	serving bool
+	running []*runningWorker
+}
+
+// NewServer returns a Server for the given HTTP server
+func NewServer(srv *http.Server, shutdownTimeout time.Duration, workers ...Worker) *Server {
+	return &Server{
+		HTTP:            srv,
+		ShutdownTimeout: shutdownTimeout,
+		Workers:         workers,
+	}
+}
+
+// SignalContext returns a context canceled on SIGINT or SIGTERM, with the
+// signal as its cause
+func SignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			cancel(fmt.Errorf("received signal %v", sig))
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// Run listens on the HTTP server address, with TLS when the HTTP server has
+// a TLS configuration, and serves until ctx is done or the server fails
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.HTTP.Addr)
+	if err != nil {
+		dbase.CreateServerStartFailureEvent(err)
+		s.setStatus(dbase.ServerStatusStopped, "Stopped: "+err.Error())
+		return err
+	}
+	if s.HTTP.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.HTTP.TLSConfig)
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve serves on listener until ctx is done or the server fails, then
+// drains in-flight requests and stops the workers. The returned error is nil
+// when the server was stopped through ctx.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	running := make([]*runningWorker, 0, len(s.Workers))
+	for _, worker := range s.Workers {
+		running = append(running, startWorker(workerCtx, worker))
+	}
+	s.setServing(true, running)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.HTTP.Serve(listener)
+	}()
+	log.Printf("Starting server on %v...", listener.Addr())
+	s.setStatus(dbase.ServerStatusRunning, fmt.Sprintf("Listening on %v", listener.Addr()))
+
+	var reason string
+	var err error
+	select {
+	case <-ctx.Done():
+		reason = context.Cause(ctx).Error()
+	case err = <-serveErr:
+		dbase.CreateServerStartFailureEvent(err)
+		reason = "server error: " + err.Error()
+	}
+	log.Printf("Shutting down server: %v", reason)
+	s.setServing(false, running)
+
+	// Drain in-flight requests, then stop the workers with what is left of
+	// the timeout
+	deadline := time.Now().Add(s.ShutdownTimeout)
+	drainCtx, cancelDrain := context.WithDeadline(context.Background(), deadline)
+	defer cancelDrain()
+	if shutdownErr := s.HTTP.Shutdown(drainCtx); shutdownErr != nil {
+		dbase.LogServerError("StoppingServer:Drain", shutdownErr, "In-flight requests were cut off after "+s.ShutdownTimeout.String())
+		s.HTTP.Close()
+	}
+	s.stopWorkers(running, deadline)
+
+	s.setStatus(dbase.ServerStatusStopped, "Stopped: "+reason)
+	return err
+}
+
+func (s *Server) setServing(serving bool, running []*runningWorker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serving = serving
+	s.running = running
+}
+
+// CheckWorkers returns an error when the server is not serving or one of its
+// workers has stopped, for readiness probes
+func (s *Server) CheckWorkers(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.serving {
+		return errors.New("server is not serving")
+	}
+	var stopped []string
+	for _, worker := range s.running {
+		select {
+		case <-worker.done:
+			stopped = append(stopped, worker.Name)
+		default:
+		}
+	}
+	if len(stopped) > 0 {
+		return fmt.Errorf("stopped workers: %v", strings.Join(stopped, ", "))
+	}
+	return nil
+}
+
+// setStatus records a lifecycle transition on the StartingServer event
+func (s *Server) setStatus(status string, details string) {
+	if err := dbase.UpdateServerStartEvent(status, details); err != nil {
+		log.Printf("Unable to record server status %v: %v", status, err)
+	}
+}
+
+// ### ###
+// ### ### Workers
+// ### ###
+
+type runningWorker struct {
+	Worker
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startWorker(ctx context.Context, worker Worker) *runningWorker {
+	ctx, cancel := context.WithCancel(ctx)
+	running := &runningWorker{Worker: worker, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(running.done)
+		worker.Run(ctx)
+	}()
+	return running
+}
+
+// stopWorkers stops the workers one at a time in reverse start order. A
+// worker still running at the deadline is abandoned and logged.
+func (s *Server) stopWorkers(running []*runningWorker, deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	for i := len(running) - 1; i >= 0; i-- {
+		worker := running[i]
+		worker.cancel()
+		select {
+		case <-worker.done:
+			log.Printf("Stopped worker %v", worker.Name)
+		case <-ctx.Done():
+			dbase.LogServerError("StoppingServer:Worker", errors.New("worker did not stop in time"), "Worker: "+worker.Name)
+		}
+	}
+}
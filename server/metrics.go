@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/metrics"
+)
+
+// RunMetrics serves /metrics on addr, the metrics.listen setting, until ctx
+// is done. The listener is not authenticated, so addr should only be
+// reachable by the scraper.
+func RunMetrics(ctx context.Context, addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		dbase.LogServerError("Metrics:Listen", err, "Unable to serve metrics on "+addr)
+		return
+	}
+	ServeMetrics(ctx, listener)
+}
+
+// ServeMetrics serves /metrics on listener until ctx is done
+func ServeMetrics(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+	log.Printf("Serving metrics on %v", listener.Addr())
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			dbase.LogServerError("Metrics:Serve", err, "Metrics listener stopped")
+		}
+	}
+}
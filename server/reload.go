@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// Policy files read from policy.dir
+const (
+	SecPointsFile = "secPoints.yaml"
+	GroupsFile    = "groups.yaml"
+)
+
+// Reloader re-reads the configuration and policy files of a running server.
+// Reloadable settings are swapped in atomically, changes to any other
+// setting are reported and ignored until restart. Policy files are applied
+// with the repository create/update logic in a single transaction, and the
+// configuration is only swapped once they have been applied.
+type Reloader struct {
+	// Args are the configuration flags given at startup, reapplied on reload
+	Args []string
+	// Interval between checks of the watched files for changes
+	Interval time.Duration
+
+	mu          sync.Mutex
+	fingerprint string
+}
+
+// NewReloader returns a Reloader that reapplies the given startup flags
+func NewReloader(args []string) *Reloader {
+	return &Reloader{
+		Args:     args,
+		Interval: 2 * time.Second,
+	}
+}
+
+// Run reloads on SIGHUP and whenever the config file or a policy file
+// changes, until ctx is done
+func (r *Reloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	r.mu.Lock()
+	r.fingerprint = r.watchedFingerprint(config.GetConfig())
+	r.mu.Unlock()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.Reload(ctx, "SIGHUP")
+		case <-ticker.C:
+			r.mu.Lock()
+			changed := r.watchedFingerprint(config.GetConfig()) != r.fingerprint
+			r.mu.Unlock()
+			if changed {
+				r.Reload(ctx, "file change")
+			}
+		}
+	}
+}
+
+// Reload loads and validates the configuration, applies the policy files
+// and installs the reloadable settings. Every reload is logged as a server
+// event with a summary of the changes, a rejected reload leaves the running
+// configuration and policy untouched.
+func (r *Reloader) Reload(ctx context.Context, trigger string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := config.GetConfig()
+	r.fingerprint = r.watchedFingerprint(current)
+
+	summary := []string{"Trigger: " + trigger}
+	reject := func(err error) error {
+		dbase.LogServerError("ConfigReload:Rejected", err, strings.Join(summary, "\n"))
+		return err
+	}
+
+	next, _, err := config.Load(r.Args)
+	if err != nil {
+		return reject(err)
+	}
+	if err := next.Validate(); err != nil {
+		return reject(err)
+	}
+
+	changes := config.Diff(current, next)
+	if len(changes) == 0 {
+		summary = append(summary, "Changes: none")
+	} else {
+		summary = append(summary, "Changes:")
+		for _, change := range changes {
+			summary = append(summary, "  "+change.String())
+		}
+	}
+
+	if current.Policy.Dir != "" {
+		policy, err := ApplyPolicy(ctx, current.Policy.Dir)
+		if err != nil {
+			return reject(err)
+		}
+		summary = append(summary, "Policy: "+policy)
+	}
+
+	config.SetConfig(current.WithReloadable(next))
+	dbase.LogServerEvent("ConfigReload", strings.Join(summary, "\n"), "INFO")
+	return nil
+}
+
+// ApplyPolicy creates and updates security points and groups from the
+// policy files in dir in a single transaction, and returns a summary
+func ApplyPolicy(ctx context.Context, dir string) (string, error) {
+	secPoints, err := dbase.LoadSecPointsFromYAML(filepath.Join(dir, SecPointsFile))
+	if err != nil {
+		return "", err
+	}
+	groups, err := dbase.LoadGroupsFromYAML(filepath.Join(dir, GroupsFile))
+	if err != nil {
+		return "", err
+	}
+
+	err = dbase.DefaultRepository().Transaction(ctx, func(tx *dbase.Repository) error {
+		if err := tx.CreateSecPoints(ctx, secPoints); err != nil {
+			return err
+		}
+		return tx.CreateGroups(ctx, groups)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to apply policy from %v: %w", dir, err)
+	}
+
+	return fmt.Sprintf("%d security point(s) and %d group(s) applied from %v", len(secPoints), len(groups), dir), nil
+}
+
+// watchedFingerprint hashes the config file and policy files so changes can
+// be detected by polling. The config file is the one the startup flags
+// resolve to, so a default go-web.yaml created after startup is noticed too.
+func (r *Reloader) watchedFingerprint(cfg config.Config) string {
+	paths := []string{config.FilePath(r.Args)}
+	if cfg.Policy.Dir != "" {
+		paths = append(paths,
+			filepath.Join(cfg.Policy.Dir, SecPointsFile),
+			filepath.Join(cfg.Policy.Dir, GroupsFile))
+	}
+
+	hash := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(hash, "%s\x00", path)
+		if data, err := os.ReadFile(path); err == nil {
+			hash.Write(data)
+		}
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// RunRetention archives expired server events every interval until ctx is
+// done. The retention period is read on every run so reloads take effect.
+func RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := ArchiveExpiredEvents(ctx); err != nil {
+			dbase.LogServerError("Retention:ArchiveServerEvents", err, "Error archiving expired server events")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ArchiveExpiredEvents archives server events older than
+// retention.server_events, if set, and returns the number archived
+func ArchiveExpiredEvents(ctx context.Context) (int64, error) {
+	period := config.GetConfig().Retention.ServerEvents
+	if period <= 0 {
+		return 0, nil
+	}
+
+	archived, err := dbase.DefaultRepository().ArchiveServerEvents(ctx, time.Now().Add(-period))
+	if err != nil {
+		return 0, err
+	}
+	if archived > 0 {
+		dbase.LogServerEvent("Retention:ArchiveServerEvents", fmt.Sprintf("Archived %d server event(s) older than %v", archived, period), "INFO")
+	}
+	return archived, nil
+}
@@ -0,0 +1,437 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/middlewares"
+	test_suite "github.com/javitab/go-web/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+http:
+  port: 8080
+database:
+  driver: sqlite
+  dsn: test.db
+auth:
+  jwt_secret: server-test-jwt-signing-key-not-for-production
+policy:
+  dir: %POLICY%
+cors:
+  allowed_origins: [%ORIGINS%]
+`
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+// setupReload installs a configuration loaded from a temporary config file
+// and policy directory, and returns the reloader and a function rewriting
+// the config file
+func setupReload(t *testing.T) (*Reloader, string, func(port string, origins string)) {
+	t.Helper()
+	dir := t.TempDir()
+	policyDir := filepath.Join(dir, "policy")
+	assert.NoError(t, os.Mkdir(policyDir, 0o700))
+	for _, name := range []string{SecPointsFile, GroupsFile} {
+		data, err := config.GetFile("auth/" + name)
+		assert.NoError(t, err)
+		writeFile(t, filepath.Join(policyDir, name), string(data))
+	}
+
+	path := filepath.Join(dir, "go-web.yaml")
+	write := func(port string, origins string) {
+		replacer := strings.NewReplacer("8080", port, "%POLICY%", policyDir, "%ORIGINS%", origins)
+		writeFile(t, path, replacer.Replace(testConfig))
+	}
+	write("8080", "http://a.local")
+
+	args := []string{"--config", path}
+	cfg, _, err := config.Load(args)
+	assert.NoError(t, err)
+	config.SetConfig(cfg)
+
+	return NewReloader(args), policyDir, write
+}
+
+func lastEvent(t *testing.T, eventType string) dbase.ServerEvent {
+	t.Helper()
+	var event dbase.ServerEvent
+	dbase.GetDBConn().Where("event_type = ?", eventType).Order("id desc").Limit(1).Find(&event)
+	return event
+}
+
+func TestReload(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	reloader, policyDir, write := setupReload(t)
+	ctx := context.Background()
+
+	// Reloadable settings are applied, others are reported and ignored
+	write("9090", "http://a.local, http://b.local")
+	data, err := os.ReadFile(config.FilePath(reloader.Args))
+	assert.NoError(t, err)
+	writeFile(t, config.FilePath(reloader.Args), string(data)+"log:\n  level: warn\n")
+	writeFile(t, filepath.Join(policyDir, GroupsFile), `
+- id: 3
+  name: "Reloaded Group"
+  priority: 2
+  add_sec_points: [3]
+`)
+	assert.NoError(t, reloader.Reload(ctx, "test"))
+
+	cfg := config.GetConfig()
+	assert.Equal(t, []string{"http://a.local", "http://b.local"}, cfg.CORS.AllowedOrigins)
+	assert.Equal(t, 8080, cfg.HTTP.Port)
+	assert.Equal(t, slog.LevelWarn, config.LogLevel.Level())
+
+	event := lastEvent(t, "ConfigReload")
+	assert.Equal(t, "INFO", event.Status)
+	assert.Contains(t, event.Details, `cors.allowed_origins: "http://a.local" -> "http://a.local,http://b.local"`)
+	assert.Contains(t, event.Details, `http.port: "8080" -> "9090" (ignored, restart required)`)
+	assert.Contains(t, event.Details, "1 group(s) applied")
+
+	var group dbase.Group
+	dbase.GetDBConn().Where("id = ?", 3).Find(&group)
+	assert.Equal(t, "Reloaded Group", group.Name)
+}
+
+func TestWatchedFingerprint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go-web.yaml")
+	reloader := NewReloader([]string{"--config", path})
+
+	// A config file missing at startup is noticed once created
+	cfg := config.Default()
+	missing := reloader.watchedFingerprint(cfg)
+	writeFile(t, path, "http:\n  port: 8080\n")
+	created := reloader.watchedFingerprint(cfg)
+	assert.NotEqual(t, missing, created)
+
+	writeFile(t, path, "http:\n  port: 9090\n")
+	assert.NotEqual(t, created, reloader.watchedFingerprint(cfg))
+}
+
+func TestReloadRejected(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	reloader, policyDir, write := setupReload(t)
+	ctx := context.Background()
+
+	// Invalid config files are rejected
+	write("not-a-port", "http://b.local")
+	assert.Error(t, reloader.Reload(ctx, "test"))
+	assert.Equal(t, []string{"http://a.local"}, config.GetConfig().CORS.AllowedOrigins)
+	assert.Equal(t, "ERROR", lastEvent(t, "ConfigReload:Rejected").Status)
+
+	// Invalid policy rejects the whole reload, including valid settings
+	write("8080", "http://b.local")
+	writeFile(t, filepath.Join(policyDir, GroupsFile), `
+- id: 3
+  name: "Broken Group"
+  add_sec_points: [999]
+`)
+	err := reloader.Reload(ctx, "test")
+	assert.ErrorIs(t, err, dbase.ErrSecPointNotFound)
+	assert.Equal(t, []string{"http://a.local"}, config.GetConfig().CORS.AllowedOrigins)
+
+	var count int64
+	dbase.GetDBConn().Model(&dbase.Group{}).Where("id = ?", 3).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestArchiveExpiredEvents(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	db := dbase.GetDBConn()
+
+	old := dbase.ServerEvent{EventType: "OldEvent", DateTime: time.Now().Add(-48 * time.Hour)}
+	assert.NoError(t, db.Create(&old).Error)
+
+	// Retention is disabled by default
+	archived, err := ArchiveExpiredEvents(context.Background())
+	assert.NoError(t, err)
+	assert.Zero(t, archived)
+
+	cfg := config.GetConfig()
+	cfg.Retention.ServerEvents = 24 * time.Hour
+	config.SetConfig(cfg)
+
+	archived, err = ArchiveExpiredEvents(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), archived)
+
+	var remaining int64
+	db.Model(&dbase.ServerEvent{}).Where("archived = ?", false).Where("event_type = ?", "OldEvent").Count(&remaining)
+	assert.Zero(t, remaining)
+}
+
+func TestServerLifecycle(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	dbase.CreateServerStartEvent()
+
+	// A slow request is in flight when shutdown begins
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var mu sync.Mutex
+	var stopped []string
+	worker := func(name string) Worker {
+		return Worker{Name: name, Run: func(ctx context.Context) {
+			<-ctx.Done()
+			mu.Lock()
+			stopped = append(stopped, name)
+			mu.Unlock()
+		}}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := NewServer(&http.Server{Handler: handler}, 5*time.Second, worker("sync"), worker("archival"))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, listener) }()
+
+	response := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			response <- 0
+			return
+		}
+		resp.Body.Close()
+		response <- resp.StatusCode
+	}()
+	<-started
+	assert.Equal(t, dbase.ServerStatusRunning, lastEvent(t, "StartingServer").Status)
+
+	// Shutdown waits for the in-flight request before stopping the workers
+	cancel(errors.New("received signal terminated"))
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	assert.Equal(t, http.StatusOK, <-response)
+	assert.NoError(t, <-served)
+
+	assert.Equal(t, []string{"archival", "sync"}, stopped)
+	event := lastEvent(t, "StartingServer")
+	assert.Equal(t, dbase.ServerStatusStopped, event.Status)
+	assert.Contains(t, event.Details, "Listening on "+listener.Addr().String())
+	assert.Contains(t, event.Details, "Stopped: received signal terminated")
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	dbase.CreateServerStartEvent()
+
+	// A worker ignoring its context is abandoned at the shutdown deadline
+	block := make(chan struct{})
+	defer close(block)
+	stuck := Worker{Name: "stuck", Run: func(ctx context.Context) { <-block }}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := NewServer(&http.Server{Handler: http.NotFoundHandler()}, 100*time.Millisecond, stuck)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, srv.Serve(ctx, listener))
+
+	assert.Contains(t, lastEvent(t, "StoppingServer:Worker").Details, "Worker: stuck")
+	assert.Equal(t, dbase.ServerStatusStopped, lastEvent(t, "StartingServer").Status)
+}
+
+func TestCheckWorkers(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	dbase.CreateServerStartEvent()
+
+	// A worker returning early, such as a metrics listener that could not
+	// bind, fails readiness
+	quit := make(chan struct{})
+	quitter := Worker{Name: "metrics", Run: func(ctx context.Context) { <-quit }}
+	steady := Worker{Name: "event retention", Run: func(ctx context.Context) { <-ctx.Done() }}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := NewServer(&http.Server{Handler: http.NotFoundHandler()}, 5*time.Second, quitter, steady)
+	assert.EqualError(t, srv.CheckWorkers(context.Background()), "server is not serving")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, listener) }()
+	assert.Eventually(t, func() bool {
+		return srv.CheckWorkers(context.Background()) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(quit)
+	assert.Eventually(t, func() bool {
+		err := srv.CheckWorkers(context.Background())
+		return err != nil && err.Error() == "stopped workers: metrics"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-served)
+	assert.EqualError(t, srv.CheckWorkers(context.Background()), "server is not serving")
+}
+
+// touch moves the modification time of path forward so a change is seen
+// regardless of the file system timestamp resolution
+func touch(t *testing.T, path string, offset time.Duration) {
+	t.Helper()
+	when := time.Now().Add(offset)
+	assert.NoError(t, os.Chtimes(path, when, when))
+}
+
+func TestCertReloader(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	certs := test_suite.WriteTestCertificates(t, t.TempDir())
+
+	reloader, err := NewCertReloader(certs.CertFile, certs.KeyFile)
+	assert.NoError(t, err)
+	reloader.Interval = 0
+
+	serial := func() int64 {
+		cert, err := reloader.GetCertificate(nil)
+		assert.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.NoError(t, err)
+		return leaf.SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), serial())
+
+	// A renewed certificate is served without a restart
+	certs.RenewServer(t, 3)
+	touch(t, certs.CertFile, time.Minute)
+	assert.Equal(t, int64(3), serial())
+	assert.Equal(t, "INFO", lastEvent(t, "TLS:ReloadCertificate").Status)
+
+	// A broken certificate is logged and the previous one kept
+	writeFile(t, certs.CertFile, "not a certificate")
+	touch(t, certs.CertFile, 2*time.Minute)
+	assert.Equal(t, int64(3), serial())
+	assert.Equal(t, "ERROR", lastEvent(t, "TLS:ReloadCertificate").Status)
+}
+
+func TestMutualTLS(t *testing.T) {
+	tearDown := test_suite.SetupSuite(t)
+	defer tearDown(t)
+	dbase.CreateServerStartEvent()
+	certs := test_suite.WriteTestCertificates(t, t.TempDir())
+
+	_, err := dbase.DefaultRepository().CreateUser(context.Background(), dbase.NewUser{
+		Username: "modality01", LastName: "Modality", FirstName: "CT", Email: "ct@test.com", Password: "password",
+	})
+	assert.NoError(t, err)
+
+	cfg := config.GetConfig()
+	cfg.TLS = config.TLSConfig{
+		CertFile:       certs.CertFile,
+		KeyFile:        certs.KeyFile,
+		MinVersion:     "1.3",
+		ClientCAFile:   certs.CAFile,
+		ClientAuth:     "require",
+		ClientIdentity: "cn",
+	}
+	assert.NoError(t, cfg.Validate())
+	config.SetConfig(cfg)
+	tlsConfig, err := NewTLSConfig(cfg.TLS)
+	assert.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/whoami", middlewares.CheckAuth(dbase.DefaultRepository()), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("currentUser"))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := NewServer(&http.Server{Handler: router, TLSConfig: tlsConfig}, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, tls.NewListener(listener, tlsConfig)) }()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-served)
+	}()
+
+	get := func(clientTLS *tls.Config) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		resp, err := client.Get("https://" + listener.Addr().String() + "/whoami")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// The client certificate subject maps to the user
+	user, err := get(&tls.Config{
+		RootCAs:      certs.CAPool,
+		Certificates: []tls.Certificate{certs.ClientCertificate(t, "modality01")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "modality01", user)
+
+	// Clients without a certificate, or below the minimum version, are refused
+	_, err = get(&tls.Config{RootCAs: certs.CAPool})
+	assert.Error(t, err)
+	_, err = get(&tls.Config{
+		RootCAs:      certs.CAPool,
+		Certificates: []tls.Certificate{certs.ClientCertificate(t, "modality01")},
+		MaxVersion:   tls.VersionTLS12,
+	})
+	assert.Error(t, err)
+}
+
+func TestServeMetrics(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ServeMetrics(ctx, listener)
+		close(done)
+	}()
+
+	// The metrics listener needs no authentication
+	resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "go_goroutines")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("metrics listener did not stop")
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// Client certificate policies accepted as tls.client_auth
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// NewTLSConfig returns the TLS configuration of the server, with the
+// certificate served from a CertReloader
+func NewTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	version, err := cfg.Version()
+	if err != nil {
+		return nil, err
+	}
+	certs, err := NewCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     version,
+		GetCertificate: certs.GetCertificate,
+		ClientAuth:     clientAuthTypes[cfg.ClientAuth],
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls.client_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls.client_ca_file %v", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// CertReloader serves a certificate and key pair from disk and reloads it
+// when either file changes, so certificates can be renewed without a
+// restart. A pair that fails to load is logged and the previous one kept.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	// Interval between checks of the files for changes
+	Interval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTimes  [2]time.Time
+	checkedAt time.Time
+}
+
+// NewCertReloader loads the certificate and key pair
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Interval: time.Second,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key pair from disk
+func (r *CertReloader) Reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.checkedAt = time.Now()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate, reloading the pair
+// first if a file changed since the last check
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	stale := time.Since(r.checkedAt) >= r.Interval
+	if stale {
+		r.checkedAt = time.Now()
+	}
+	cert, modTimes := r.cert, r.modTimes
+	r.mu.Unlock()
+
+	if stale {
+		if current, err := r.stat(); err == nil && current != modTimes {
+			if err := r.Reload(); err != nil {
+				// Log a broken pair once, not on every handshake
+				r.mu.Lock()
+				r.modTimes = current
+				r.mu.Unlock()
+				dbase.LogServerError("TLS:ReloadCertificate", err, "Serving the previous certificate")
+			} else {
+				dbase.LogServerEvent("TLS:ReloadCertificate", "Reloaded TLS certificate "+r.CertFile, "INFO")
+				r.mu.Lock()
+				cert = r.cert
+				r.mu.Unlock()
+			}
+		}
+	}
+	return cert, nil
+}
+
+func (r *CertReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
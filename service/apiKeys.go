@@ -0,0 +1,58 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	dbase "github.com/javitab/go-web/database"
+)
+
+// APIKey holds a generated API key, which is only shown once
+type APIKey struct {
+	Username    string `json:"username"`
+	Description string `json:"description"`
+	Key         string `json:"api_key"`
+}
+
+// APIKeyInfo describes an API key without the key, only its last characters
+// help to tell keys apart
+type APIKeyInfo struct {
+	ID          uint      `json:"id"`
+	Description string    `json:"description"`
+	Suffix      string    `json:"suffix"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newAPIKeyInfo(key dbase.APIKey) APIKeyInfo {
+	return APIKeyInfo{ID: key.ID, Description: key.Description, Suffix: key.KeySuffix, CreatedAt: key.CreatedAt}
+}
+
+// CreateAPIKey creates an API key for the user the Service runs as
+func (s *Service) CreateAPIKey(description string) (APIKey, error) {
+	key, err := s.repo.CreateAPIKey(s.ctx, s.user.DB, description)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return APIKey{Username: s.user.DB.Username, Description: key.Description, Key: key.Key}, nil
+}
+
+// ListAPIKeys returns the API keys of the user the Service runs as
+func (s *Service) ListAPIKeys() ([]APIKeyInfo, error) {
+	keys, err := s.repo.ListAPIKeys(s.ctx, s.user.DB.ID)
+	if err != nil {
+		return nil, err
+	}
+	list := []APIKeyInfo{}
+	for _, key := range keys {
+		list = append(list, newAPIKeyInfo(key))
+	}
+	return list, nil
+}
+
+// RevokeAPIKey revokes an API key of the user the Service runs as
+func (s *Service) RevokeAPIKey(id uint) error {
+	if id == 0 {
+		return fmt.Errorf("%w: id is required", ErrInvalidInput)
+	}
+	return s.repo.RevokeAPIKey(s.ctx, s.user.DB, id)
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+
+	auth "github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// ### ###
+// ### ### Results
+// ### ###
+
+// Group is a group and its security points
+type Group struct {
+	ID           uint   `json:"id"`
+	Name         string `json:"name"`
+	Desc         string `json:"desc"`
+	Priority     uint   `json:"priority"`
+	LDAPGroup    string `json:"ldap_group"`
+	AddSecPoints []uint `json:"add_sec_points"`
+	DelSecPoints []uint `json:"del_sec_points"`
+	OvrSecPoints []uint `json:"ovr_sec_points"`
+}
+
+func newGroup(group dbase.Group) Group {
+	return Group{
+		ID:           group.ID,
+		Name:         group.Name,
+		Desc:         group.Desc,
+		Priority:     group.Priority,
+		LDAPGroup:    group.LDAPGroup,
+		AddSecPoints: secPointIDs(group.AddSecPoints),
+		DelSecPoints: secPointIDs(group.DelSecPoints),
+		OvrSecPoints: secPointIDs(group.OvrSecPoints),
+	}
+}
+
+// secPointIDs returns the sorted IDs of secPoints
+func secPointIDs(secPoints []dbase.SecPoint) []uint {
+	spids := []uint{}
+	for _, sp := range secPoints {
+		spids = append(spids, sp.ID)
+	}
+	sort.Slice(spids, func(i, j int) bool { return spids[i] < spids[j] })
+	return spids
+}
+
+// Membership is the outcome of a group membership change
+type Membership struct {
+	Username string `json:"username"`
+	Group    string `json:"group"`
+	Member   bool   `json:"member"`
+}
+
+// SecPoint is a security point, and the groups referencing it when looked up
+// on its own
+type SecPoint struct {
+	ID     uint     `json:"id"`
+	Type   string   `json:"type"`
+	Name   string   `json:"name"`
+	Desc   string   `json:"desc"`
+	Groups []string `json:"groups"`
+}
+
+// ### ###
+// ### ### Groups
+// ### ###
+
+// findGroup loads a group with its security points by name, or by ID when
+// ref is numeric
+func (s *Service) findGroup(ref string) (dbase.Group, error) {
+	if err := require("group", ref); err != nil {
+		return dbase.Group{}, err
+	}
+	group, err := s.repo.FindGroup(s.ctx, ref)
+	if err != nil {
+		return group, err
+	}
+	if group.ID == 0 {
+		return group, fmt.Errorf("%w: %v", auth.ErrGroupNotFound, ref)
+	}
+	return group, nil
+}
+
+// GetGroup returns a group by name, or by ID when ref is numeric
+func (s *Service) GetGroup(ref string) (Group, error) {
+	if err := s.RequireSecPoint(auth.SPViewUsers); err != nil {
+		return Group{}, err
+	}
+	group, err := s.findGroup(ref)
+	if err != nil {
+		return Group{}, err
+	}
+	return newGroup(group), nil
+}
+
+// ListGroups returns the groups by priority
+func (s *Service) ListGroups() ([]Group, error) {
+	if err := s.RequireSecPoint(auth.SPViewUsers); err != nil {
+		return nil, err
+	}
+	groups, err := s.repo.ListGroups(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := []Group{}
+	for _, group := range groups {
+		list = append(list, newGroup(group))
+	}
+	return list, nil
+}
+
+// AddGroupMember adds a user to a group, referenced by name or ID
+func (s *Service) AddGroupMember(username string, groupRef string) (Membership, error) {
+	return s.updateMembership(username, groupRef, true)
+}
+
+// RemoveGroupMember removes a user from a group, referenced by name or ID
+func (s *Service) RemoveGroupMember(username string, groupRef string) (Membership, error) {
+	return s.updateMembership(username, groupRef, false)
+}
+
+func (s *Service) updateMembership(username string, groupRef string, add bool) (Membership, error) {
+	SPID := auth.SPAddUserToGroup
+	if !add {
+		SPID = auth.SPRemoveUserFromGroup
+	}
+	if err := s.RequireSecPoint(SPID); err != nil {
+		return Membership{}, err
+	}
+	user, err := s.findUser(username)
+	if err != nil {
+		return Membership{}, err
+	}
+	group, err := s.findGroup(groupRef)
+	if err != nil {
+		return Membership{}, err
+	}
+	if add {
+		err = s.repo.AddUserToGroup(s.ctx, user.DB, group)
+	} else {
+		err = s.repo.RemoveUserFromGroup(s.ctx, user.DB, group)
+	}
+	if err != nil {
+		return Membership{}, err
+	}
+	return Membership{Username: user.DB.Username, Group: group.Name, Member: add}, nil
+}
+
+// ### ###
+// ### ### Security Points
+// ### ###
+
+// GetSecPoint returns a security point and the groups referencing it
+func (s *Service) GetSecPoint(spid int) (SecPoint, error) {
+	if err := s.RequireSecPoint(auth.SPViewUsers); err != nil {
+		return SecPoint{}, err
+	}
+	info := auth.LoadSecPointInfo(s.ctx, s.repo, spid)
+	if info.DB.ID == 0 {
+		return SecPoint{}, fmt.Errorf("%w: %v", dbase.ErrSecPointNotFound, spid)
+	}
+	result := SecPoint{ID: info.DB.ID, Type: info.DB.Type, Name: info.DB.Name, Desc: info.DB.Desc, Groups: []string{}}
+	for _, group := range info.ReferencingGroups {
+		result.Groups = append(result.Groups, group.DB.Name)
+	}
+	sort.Strings(result.Groups)
+	return result, nil
+}
+
+// ListSecPoints returns the security points by ID
+func (s *Service) ListSecPoints() ([]SecPoint, error) {
+	if err := s.RequireSecPoint(auth.SPViewUsers); err != nil {
+		return nil, err
+	}
+	secPoints, err := s.repo.ListSecPoints(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := []SecPoint{}
+	for _, sp := range secPoints {
+		list = append(list, SecPoint{ID: sp.ID, Type: sp.Type, Name: sp.Name, Desc: sp.Desc})
+	}
+	return list, nil
+}
+
+// LoadSecPointsAndGroups creates or updates the security points, then the
+// groups referencing them, in a single transaction
+func (s *Service) LoadSecPointsAndGroups(secPoints []dbase.SecPoint, groups []dbase.GroupYAML) error {
+	if err := s.RequireSecPoint(auth.SPUpdateSecPoints); err != nil {
+		return err
+	}
+	return s.repo.Transaction(s.ctx, func(tx *dbase.Repository) error {
+		if err := tx.CreateSecPoints(s.ctx, secPoints); err != nil {
+			return err
+		}
+		return tx.CreateGroups(s.ctx, groups)
+	})
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"fmt"
+
+	auth "github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// Login is the outcome of a login test
+type Login struct {
+	Username string   `json:"username"`
+	Valid    bool     `json:"valid"`
+	Token    string   `json:"token,omitempty"`
+	Groups   []string `json:"ldap_groups,omitempty"`
+}
+
+// LDAPUser is the directory entry of a user
+type LDAPUser struct {
+	Username  string   `json:"username"`
+	FirstName string   `json:"first_name"`
+	LastName  string   `json:"last_name"`
+	Email     string   `json:"email"`
+	Groups    []string `json:"groups"`
+}
+
+// GetLDAPUser looks up a user in LDAP
+func (s *Service) GetLDAPUser(username string) (LDAPUser, error) {
+	if err := s.RequireSecPoint(auth.SPViewUsers); err != nil {
+		return LDAPUser{}, err
+	}
+	if err := require("username", username); err != nil {
+		return LDAPUser{}, err
+	}
+	info, err := auth.LDAPGetUserInfo(s.ctx, username)
+	if err != nil {
+		return LDAPUser{}, err
+	}
+	return LDAPUser{
+		Username:  username,
+		FirstName: info.FirstName,
+		LastName:  info.LastName,
+		Email:     info.Email,
+		Groups:    info.Groups,
+	}, nil
+}
+
+// TestLogin tests the credentials of a user like a CLI login, without the
+// login rate limit
+func (s *Service) TestLogin(username string, password Secret) (Login, error) {
+	if err := s.RequireSecPoint(auth.SPTestLogin); err != nil {
+		return Login{}, err
+	}
+	if err := require("username", username); err != nil {
+		return Login{}, err
+	}
+	value, err := password.read()
+	if err != nil {
+		return Login{}, err
+	}
+	token, err := auth.UserLogin(s.ctx, s.repo, auth.LoginUserInput{Username: username, Password: value}, auth.CLILogin)
+	if err != nil {
+		return Login{}, fmt.Errorf("%w: %v", ErrDenied, err)
+	}
+	return Login{Username: username, Valid: true, Token: token}, nil
+}
+
+// TestLDAPLogin tests LDAP credentials, without the login rate limit
+func (s *Service) TestLDAPLogin(username string, password Secret) (Login, error) {
+	if err := s.RequireSecPoint(auth.SPTestLogin); err != nil {
+		return Login{}, err
+	}
+	if err := require("username", username); err != nil {
+		return Login{}, err
+	}
+	value, err := password.read()
+	if err != nil {
+		return Login{}, err
+	}
+	if _, err := auth.LDAPAuth(s.ctx, auth.LoginUserInput{Username: username, Password: value}); err != nil {
+		return Login{}, fmt.Errorf("%w: %v", ErrDenied, err)
+	}
+	dbase.LogServerEventContext(s.ctx, "auth_utils:ldap_login", "Login successful for: "+username, "OK")
+	return Login{Username: username, Valid: true, Groups: auth.LDAPGroups(s.ctx, username)}, nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	auth "github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+)
+
+var (
+	ErrInvalidInput = errors.New("invalid input")
+	ErrDenied       = errors.New("permission denied")
+	ErrNotFound     = errors.New("not found")
+)
+
+// Service runs the user, group, security point and API key operations as a
+// user. Each operation checks the security point it needs, so the CLI, the
+// command API, the auth endpoints and the admin UI apply the same checks.
+type Service struct {
+	ctx  context.Context
+	user auth.UserInfo
+	repo *dbase.Repository
+}
+
+// New returns the Service running as user on repo. Events are stamped with
+// the request of ctx.
+func New(ctx context.Context, repo *dbase.Repository, user auth.UserInfo) *Service {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Service{ctx: ctx, user: user, repo: repo}
+}
+
+// User returns the user the Service runs as
+func (s *Service) User() auth.UserInfo {
+	return s.user
+}
+
+// RequireSecPoint returns ErrDenied unless the user holds the security point
+func (s *Service) RequireSecPoint(SPID int) error {
+	if s.user.SPCheck == nil || !s.user.SPCheck(SPID) {
+		return fmt.Errorf("%w: user %v missing security point %v", ErrDenied, s.user.DB.Username, SPID)
+	}
+	return nil
+}
+
+// Secret returns a secret such as a password. Operations only read it once
+// their checks passed, so the CLI only prompts when it is needed.
+type Secret func() (string, error)
+
+// Password is the Secret of a password the caller already holds
+func Password(password string) Secret {
+	return func() (string, error) {
+		return password, nil
+	}
+}
+
+// read reads a secret, which must not be empty
+func (secret Secret) read() (string, error) {
+	if secret == nil {
+		return "", fmt.Errorf("no input available for secret")
+	}
+	value, err := secret()
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", fmt.Errorf("%w: empty secret", ErrInvalidInput)
+	}
+	return value, nil
+}
+
+func require(name string, value string) error {
+	if value == "" {
+		return fmt.Errorf("%w: %v is required", ErrInvalidInput, name)
+	}
+	return nil
+}
+
+// IsNotFound reports whether err is about a missing user, group, security
+// point, API key or server run
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) ||
+		errors.Is(err, dbase.ErrUserNotFound) ||
+		errors.Is(err, dbase.ErrSecPointNotFound) ||
+		errors.Is(err, dbase.ErrAPIKeyNotFound) ||
+		errors.Is(err, dbase.ErrServerRunNotFound) ||
+		errors.Is(err, auth.ErrGroupNotFound)
+}
+
+// HTTPStatus maps the error of an operation to an HTTP status. Errors not
+// caused by the request are failed database operations and server errors.
+func HTTPStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidInput),
+		errors.Is(err, dbase.ErrInvalidDeleteAction),
+		errors.Is(err, dbase.ErrInvalidSecPointField):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrDenied):
+		return http.StatusForbidden
+	case IsNotFound(err):
+		return http.StatusNotFound
+	case errors.Is(err, dbase.ErrUserExists),
+		errors.Is(err, dbase.ErrUserDeleted),
+		errors.Is(err, dbase.ErrUserActive),
+		errors.Is(err, dbase.ErrUserInGroup),
+		errors.Is(err, dbase.ErrUserNotInGroup),
+		errors.Is(err, auth.ErrUserHasSecPoint):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+
+	auth "github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+)
+
+// ### ###
+// ### ### Results
+// ### ###
+
+// User is a user with its effective security points
+type User struct {
+	Username       string          `json:"username"`
+	FirstName      string          `json:"first_name"`
+	LastName       string          `json:"last_name"`
+	Email          string          `json:"email"`
+	IsLDAPUser     bool            `json:"is_ldap_user"`
+	IsActive       bool            `json:"is_active"`
+	Groups         []string        `json:"groups"`
+	SecurityPoints []SecPointGrant `json:"security_points"`
+	// User-level security point lists, applied after the groups
+	AddSecPoints []uint `json:"add_sec_points"`
+	DelSecPoints []uint `json:"del_sec_points"`
+	OvrSecPoints []uint `json:"ovr_sec_points"`
+}
+
+// SecPointGrant is an effective security point of a user and where it comes
+// from
+type SecPointGrant struct {
+	ID     uint   `json:"id"`
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+func newUser(user auth.UserInfo) User {
+	result := User{
+		Username:       user.DB.Username,
+		FirstName:      user.DB.FirstName,
+		LastName:       user.DB.LastName,
+		Email:          user.DB.Email,
+		IsLDAPUser:     user.DB.IsLDAPUser,
+		IsActive:       user.IsActiveUser,
+		Groups:         []string{},
+		SecurityPoints: []SecPointGrant{},
+		AddSecPoints:   secPointIDs(user.DB.UserAddSecPoints),
+		DelSecPoints:   secPointIDs(user.DB.UserDelSecPoints),
+		OvrSecPoints:   secPointIDs(user.DB.UserOvrSecPoints),
+	}
+	for _, group := range user.DB.Groups {
+		result.Groups = append(result.Groups, group.Name)
+	}
+	sort.Strings(result.Groups)
+	for id, sp := range user.SecurityPoints {
+		result.SecurityPoints = append(result.SecurityPoints, SecPointGrant{ID: id, Name: sp.SP.Name, Source: sp.Source})
+	}
+	sort.Slice(result.SecurityPoints, func(i, j int) bool {
+		return result.SecurityPoints[i].ID < result.SecurityPoints[j].ID
+	})
+	return result
+}
+
+// UserSummary is a user in a user list
+type UserSummary struct {
+	Username   string   `json:"username"`
+	FirstName  string   `json:"first_name"`
+	LastName   string   `json:"last_name"`
+	Email      string   `json:"email"`
+	IsLDAPUser bool     `json:"is_ldap_user"`
+	IsActive   bool     `json:"is_active"`
+	Groups     []string `json:"groups"`
+}
+
+func newUserSummary(user dbase.User) UserSummary {
+	summary := UserSummary{
+		Username:   user.Username,
+		FirstName:  user.FirstName,
+		LastName:   user.LastName,
+		Email:      user.Email,
+		IsLDAPUser: user.IsLDAPUser,
+		IsActive:   !user.DeletedAt.Valid,
+		Groups:     []string{},
+	}
+	for _, group := range user.Groups {
+		summary.Groups = append(summary.Groups, group.Name)
+	}
+	sort.Strings(summary.Groups)
+	return summary
+}
+
+// SecPointCheck is the outcome of evaluating a security point for a user
+type SecPointCheck struct {
+	Username string `json:"username"`
+	SPID     int    `json:"spid"`
+	Granted  bool   `json:"granted"`
+	Source   string `json:"source,omitempty"`
+}
+
+// ### ###
+// ### ### Users
+// ### ###
+
+// findUser loads a user, including soft deleted users
+func (s *Service) findUser(username string) (auth.UserInfo, error) {
+	if err := require("username", username); err != nil {
+		return auth.UserInfo{}, err
+	}
+	user := auth.LoadUserInfo(s.ctx, s.repo, username)
+	if user.DB.ID == 0 {
+		return user, fmt.Errorf("%w: %v", dbase.ErrUserNotFound, username)
+	}
+	return user, nil
+}
+
+// reloadUser returns a user as it is after a change
+func (s *Service) reloadUser(username string) User {
+	return newUser(auth.LoadUserInfo(s.ctx, s.repo, username))
+}
+
+// GetUser returns a user and its effective security points. Users view
+// their own record, others' need the ViewUsers security point.
+func (s *Service) GetUser(username string) (User, error) {
+	if username != s.user.DB.Username {
+		if err := s.RequireSecPoint(auth.SPViewUsers); err != nil {
+			return User{}, err
+		}
+	}
+	user, err := s.findUser(username)
+	if err != nil {
+		return User{}, err
+	}
+	return newUser(user), nil
+}
+
+// ListUsers returns the users matching a search of their username, name or
+// email, all users without one
+func (s *Service) ListUsers(search string, includeDeleted bool) ([]UserSummary, error) {
+	if err := s.RequireSecPoint(auth.SPViewUsers); err != nil {
+		return nil, err
+	}
+	users, err := s.repo.ListUsers(s.ctx, search, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	list := []UserSummary{}
+	for _, user := range users {
+		list = append(list, newUserSummary(user))
+	}
+	return list, nil
+}
+
+// CreateUser creates a user. Local users get their password from password,
+// LDAP users a random one so they cannot log in locally.
+func (s *Service) CreateUser(input dbase.NewUser, password Secret) (User, error) {
+	if err := s.RequireSecPoint(auth.SPCreateUser); err != nil {
+		return User{}, err
+	}
+	if err := require("username", input.Username); err != nil {
+		return User{}, err
+	}
+	if err := require("email", input.Email); err != nil {
+		return User{}, err
+	}
+
+	var err error
+	if input.IsLDAPUser {
+		input.Password, err = dbase.GenerateRandomString(32)
+	} else {
+		input.Password, err = password.read()
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if _, err := s.repo.CreateUser(s.ctx, input); err != nil {
+		return User{}, err
+	}
+	return s.reloadUser(input.Username), nil
+}
+
+// DeleteUser soft deletes a user, other than the caller
+func (s *Service) DeleteUser(username string, reason string) (User, error) {
+	return s.deleteUser(username, reason, "delete")
+}
+
+// UndeleteUser restores a soft deleted user
+func (s *Service) UndeleteUser(username string, reason string) (User, error) {
+	return s.deleteUser(username, reason, "undelete")
+}
+
+func (s *Service) deleteUser(username string, reason string, action string) (User, error) {
+	if err := s.RequireSecPoint(auth.SPDeleteUser); err != nil {
+		return User{}, err
+	}
+	if err := require("reason", reason); err != nil {
+		return User{}, err
+	}
+	user, err := s.findUser(username)
+	if err != nil {
+		return User{}, err
+	}
+	if action == "delete" && user.DB.Username == s.user.DB.Username {
+		return User{}, fmt.Errorf("%w: user cannot delete self", ErrInvalidInput)
+	}
+	err = s.repo.DeleteUser(s.ctx, dbase.DeleteUserRequest{
+		Username:       user.DB.Username,
+		RequestingUser: s.user.DB.Username,
+		Reason:         reason,
+		Action:         action,
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return s.reloadUser(user.DB.Username), nil
+}
+
+// SetPassword changes the password of a user. Users change their own
+// password, others' need the SetUserPassword security point.
+func (s *Service) SetPassword(username string, password Secret) error {
+	user, err := s.findUser(username)
+	if err != nil {
+		return err
+	}
+	if user.DB.Username != s.user.DB.Username {
+		if err := s.RequireSecPoint(auth.SPSetUserPassword); err != nil {
+			return err
+		}
+	}
+	value, err := password.read()
+	if err != nil {
+		return err
+	}
+	return s.repo.ChangeUserPassword(s.ctx, user.DB.Username, value)
+}
+
+// SetLDAPUser sets whether a user authenticates against LDAP
+func (s *Service) SetLDAPUser(username string, isLDAPUser bool) (User, error) {
+	if err := s.RequireSecPoint(auth.SPSetLDAPUser); err != nil {
+		return User{}, err
+	}
+	user, err := s.findUser(username)
+	if err != nil {
+		return User{}, err
+	}
+	if err := user.SetLDAPUser(isLDAPUser); err != nil {
+		return User{}, err
+	}
+	return newUser(user), nil
+}
+
+// CheckSecPoint evaluates a security point like SPCheck, without logging
+// denials of the user being inspected
+func (s *Service) CheckSecPoint(username string, spid int) (SecPointCheck, error) {
+	if err := s.RequireSecPoint(auth.SPViewUsers); err != nil {
+		return SecPointCheck{}, err
+	}
+	user, err := s.findUser(username)
+	if err != nil {
+		return SecPointCheck{}, err
+	}
+	check := SecPointCheck{Username: user.DB.Username, SPID: spid}
+	if sp, ok := user.SecurityPoints[uint(spid)]; ok {
+		check.Granted, check.Source = true, sp.Source
+	} else if sp, ok := user.SecurityPoints[1]; ok {
+		check.Granted, check.Source = true, sp.Source+" (SuperUser)"
+	}
+	return check, nil
+}
+
+// AddUserSecPoint adds a security point to a user-level list: UserAddSecPoints,
+// UserDelSecPoints or UserOvrSecPoints
+func (s *Service) AddUserSecPoint(username string, spid int, field string) (User, error) {
+	return s.updateUserSecPoint(username, spid, field, true)
+}
+
+// RemoveUserSecPoint removes a security point from a user-level list
+func (s *Service) RemoveUserSecPoint(username string, spid int, field string) (User, error) {
+	return s.updateUserSecPoint(username, spid, field, false)
+}
+
+func (s *Service) updateUserSecPoint(username string, spid int, field string, add bool) (User, error) {
+	if err := s.RequireSecPoint(auth.SPUpdateSecPoints); err != nil {
+		return User{}, err
+	}
+	user, err := s.findUser(username)
+	if err != nil {
+		return User{}, err
+	}
+	if add {
+		err = user.SetUserSecPoint(spid, field)
+	} else {
+		err = user.RemoveUserSecPoint(spid, field)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return s.reloadUser(user.DB.Username), nil
+}
+
+// ImportUsers creates or updates users from records, see
+// Repository.ImportUsers
+func (s *Service) ImportUsers(records []dbase.UserRecord, dryRun bool) (dbase.UserImportReport, error) {
+	if err := s.RequireSecPoint(auth.SPImportUsers); err != nil {
+		return dbase.UserImportReport{}, err
+	}
+	return s.repo.ImportUsers(s.ctx, records, dryRun)
+}
+
+// ExportUsers returns the active users as records for ImportUsers
+func (s *Service) ExportUsers() ([]dbase.UserRecord, error) {
+	if err := s.RequireSecPoint(auth.SPExportUsers); err != nil {
+		return nil, err
+	}
+	return s.repo.ExportUsers(s.ctx)
+}
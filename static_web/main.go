@@ -1,9 +1,21 @@
 package static_web
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/javitab/go-web/helpers"
 )
 
 //go:embed *
@@ -18,6 +30,195 @@ func GetFile(name string) ([]byte, error) {
 	return file, err
 }
 
-func HTTPFS() (http.FileSystem, error) {
-	return http.FS(Web_fs), nil
+// ### ###
+// ### ### Assets
+// ### ###
+
+const (
+	// Prefix is the path the static files are served under
+	Prefix = "/static/"
+
+	// Cache headers of hashed URLs, whose content never changes, of other
+	// URLs of embedded files, and of files served from disk
+	immutableCache  = "public, max-age=31536000, immutable"
+	revalidateCache = "no-cache"
+	devCache        = "no-store"
+
+	hashLength = 12
+)
+
+// Assets serves the static files under Prefix.
+//
+// Embedded assets are linked by URL with the hash of their content in the
+// file name, e.g. /static/bs/css/bootstrap.min.0123456789ab.css, which
+// browsers cache for a year: a build changing a file changes its URL. The
+// plain URLs are served too, revalidated with the hash as ETag.
+//
+// Assets of a directory are read from disk on every request and never
+// cached, for development.
+type Assets struct {
+	fsys   fs.FS
+	dev    bool
+	hashes map[string]string // file name -> content hash
+	hashed map[string]string // hashed file name -> file name
+}
+
+// NewAssets hashes the files of fsys
+func NewAssets(fsys fs.FS) (*Assets, error) {
+	a := &Assets{fsys: fsys, hashes: map[string]string{}, hashed: map[string]string{}}
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !servable(name) {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])[:hashLength]
+		a.hashes[name] = hash
+		a.hashed[hashedName(name, hash)] = name
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash static files: %w", err)
+	}
+	return a, nil
+}
+
+// DirAssets serves the files of a directory from disk, for development
+func DirAssets(dir string) *Assets {
+	return &Assets{fsys: os.DirFS(dir), dev: true}
+}
+
+// servable reports whether a file is served, the Go sources embedded with the
+// assets are not
+func servable(name string) bool {
+	return path.Ext(name) != ".go"
+}
+
+// hashedName inserts a content hash before the extension of a file name
+func hashedName(name string, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// URL returns the URL of a static file, hashed for embedded assets. Unknown
+// files get their plain URL.
+func (a *Assets) URL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if hash, ok := a.hashes[name]; ok {
+		return Prefix + hashedName(name, hash)
+	}
+	return Prefix + name
+}
+
+// Dev reports whether the assets are served from disk
+func (a *Assets) Dev() bool {
+	return a.dev
+}
+
+// Version returns the version of the assets served from disk, which changes
+// when a file is edited. Embedded assets don't change.
+func (a *Assets) Version() (string, error) {
+	if !a.dev {
+		return "", nil
+	}
+	return helpers.FSVersion(a.fsys)
+}
+
+// ServeHTTP serves a static file by its path relative to Prefix, without
+// directory listings
+func (a *Assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	cache := revalidateCache
+	if a.dev {
+		cache = devCache
+	} else if file, ok := a.hashed[name]; ok {
+		name, cache = file, immutableCache
+	}
+	if name == "" || !servable(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := a.fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	w.Header().Set("Cache-Control", cache)
+	if hash, ok := a.hashes[name]; ok {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// ### ###
+// ### ### Default Assets
+// ### ###
+
+var (
+	loadOnce      sync.Once
+	defaultAssets *Assets
+	loadErr       error
+)
+
+// Load hashes the embedded assets once, unless UseDir was called first. The
+// web server calls it at start, Default on first use otherwise.
+func Load() error {
+	loadOnce.Do(func() {
+		defaultAssets, loadErr = NewAssets(Web_fs)
+	})
+	return loadErr
+}
+
+// UseDir serves the static files of a directory instead of the embedded
+// ones, for development. It must be called before Load or the first use of
+// Default.
+func UseDir(dir string) error {
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("failed to serve static files: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("failed to serve static files: %v is not a directory", dir)
+	}
+	loaded := false
+	loadOnce.Do(func() {
+		loaded = true
+		defaultAssets = DirAssets(dir)
+	})
+	if !loaded {
+		return errors.New("static files are already loaded")
+	}
+	return nil
+}
+
+// Default returns the assets served by the web server. Embedded assets that
+// failed to hash are served under their plain URLs.
+func Default() *Assets {
+	if Load() != nil {
+		return &Assets{fsys: Web_fs}
+	}
+	return defaultAssets
+}
+
+// URL returns the URL of a static file of the default assets
+func URL(name string) string {
+	return Default().URL(name)
 }
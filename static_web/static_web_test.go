@@ -0,0 +1,84 @@
+package static_web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(handler http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestAssets(t *testing.T) {
+	assets, err := NewAssets(fstest.MapFS{
+		"css/site.css": {Data: []byte("body {}")},
+		"main.go":      {Data: []byte("package static_web")},
+	})
+	assert.NoError(t, err)
+	assert.False(t, assets.Dev())
+
+	// Embedded files are linked by the hash of their content
+	url := assets.URL("css/site.css")
+	assert.Regexp(t, `^/static/css/site\.[0-9a-f]{12}\.css$`, url)
+	assert.Equal(t, url, assets.URL("/css/site.css"))
+	assert.Equal(t, "/static/css/missing.css", assets.URL("css/missing.css"))
+
+	// Hashed URLs are cached for good, plain URLs revalidated by ETag
+	w := get(assets, url[len(Prefix)-1:], nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "body {}", w.Body.String())
+	assert.Equal(t, immutableCache, w.Header().Get("Cache-Control"))
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/css")
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	w = get(assets, "/css/site.css", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, revalidateCache, w.Header().Get("Cache-Control"))
+	w = get(assets, "/css/site.css", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// Stale hashes, directories and Go sources are not served
+	assert.Equal(t, http.StatusNotFound, get(assets, "/css/site.000000000000.css", nil).Code)
+	assert.Equal(t, http.StatusNotFound, get(assets, "/css", nil).Code)
+	assert.Equal(t, http.StatusNotFound, get(assets, "/main.go", nil).Code)
+	assert.Equal(t, http.StatusNotFound, get(assets, "/../main.go", nil).Code)
+
+	// The embedded bootstrap files are hashed
+	assert.NoError(t, Load())
+	assert.Regexp(t, `^/static/bs/css/bootstrap\.min\.[0-9a-f]{12}\.css$`, URL("bs/css/bootstrap.min.css"))
+}
+
+func TestDirAssets(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "site.css")
+	assert.NoError(t, os.WriteFile(file, []byte("body {}"), 0o644))
+
+	// Files are read from disk on every request, with their plain URLs
+	assets := DirAssets(dir)
+	assert.True(t, assets.Dev())
+	assert.Equal(t, "/static/site.css", assets.URL("site.css"))
+	version, err := assets.Version()
+	assert.NoError(t, err)
+
+	w := get(assets, "/site.css", nil)
+	assert.Equal(t, "body {}", w.Body.String())
+	assert.Equal(t, devCache, w.Header().Get("Cache-Control"))
+
+	assert.NoError(t, os.WriteFile(file, []byte("body { margin: 0 }"), 0o644))
+	assert.Equal(t, "body { margin: 0 }", get(assets, "/site.css", nil).Body.String())
+	changed, _ := assets.Version()
+	assert.NotEqual(t, version, changed)
+}
@@ -1,22 +1,267 @@
 package templates
 
 import (
+	"bytes"
 	"embed"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
 
+	"github.com/javitab/go-web/helpers"
+	"github.com/javitab/go-web/static_web"
 	"github.com/noirbizarre/gonja"
+	"github.com/noirbizarre/gonja/config"
 	"github.com/noirbizarre/gonja/exec"
 )
 
+// The templates are named by their path in this directory. Pages extend a
+// layout of layouts/ and include the partials of partials/.
+
 //go:embed *
 var templates embed.FS
 
-func GetTemplate(name string) (*exec.Template, error) {
-	template, err := templates.ReadFile(name)
+// ErrTemplateNotFound is returned for names without template
+var ErrTemplateNotFound = errors.New("template not found")
+
+// templateExts are the extensions of the files compiled as templates
+var templateExts = map[string]bool{".j2": true, ".html": true}
+
+// fsLoader loads templates, and the templates they include or extend, from a
+// file system
+type fsLoader struct {
+	fs fs.FS
+}
+
+func (l fsLoader) Get(path string) (io.Reader, error) {
+	data, err := fs.ReadFile(l.fs, path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// Registry holds the compiled templates of a file system. Templates are
+// rendered with HTML autoescaping, values are only output unescaped with the
+// safe filter.
+type Registry struct {
+	fsys   fs.FS
+	reload bool
+
+	mu         sync.RWMutex
+	templates  map[string]*exec.Template
+	version    string
+	compileErr error
+}
+
+// NewRegistry compiles every template of fsys, so that a broken template
+// fails here rather than when a request renders it. The error lists every
+// template that failed to compile.
+func NewRegistry(fsys fs.FS) (*Registry, error) {
+	tmpls, err := compile(fsys)
 	if err != nil {
-		fmt.Printf("Unable to load template %v", name)
 		return nil, err
-	} //
-	tmpl := gonja.Must(gonja.FromBytes(template))
-	return tmpl, err
+	}
+	return &Registry{fsys: fsys, templates: tmpls}, nil
+}
+
+// NewReloadingRegistry compiles the templates of fsys like NewRegistry, and
+// compiles them again when a file of fsys changes, for development. Until a
+// broken template is fixed, renders return its compile error.
+func NewReloadingRegistry(fsys fs.FS) (*Registry, error) {
+	version, err := helpers.FSVersion(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates: %w", err)
+	}
+	r, err := NewRegistry(fsys)
+	if err != nil {
+		return nil, err
+	}
+	r.reload = true
+	r.version = version
+	return r, nil
+}
+
+// compile compiles every template of fsys. Templates link static files with
+// asset(name), which returns their cache-busting URL.
+func compile(fsys fs.FS) (map[string]*exec.Template, error) {
+	cfg := config.NewConfig()
+	cfg.Autoescape = true
+	env := gonja.NewEnvironment(cfg, fsLoader{fs: fsys})
+	env.Globals.Set("asset", static_web.URL)
+
+	tmpls := map[string]*exec.Template{}
+	var errs []error
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !templateExts[path.Ext(name)] {
+			return nil
+		}
+		tmpl, err := env.FromFile(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to compile template %v: %w", name, err))
+			return nil
+		}
+		tmpls[name] = tmpl
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates: %w", err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return tmpls, nil
+}
+
+// refresh compiles the templates again when a reloading registry has changed
+// files, and returns the compile error of the current files
+func (r *Registry) refresh() error {
+	if !r.reload {
+		return nil
+	}
+	version, err := helpers.FSVersion(r.fsys)
+	if err != nil {
+		return fmt.Errorf("failed to read templates: %w", err)
+	}
+	r.mu.RLock()
+	current, compileErr := r.version, r.compileErr
+	r.mu.RUnlock()
+	if version == current {
+		return compileErr
+	}
+
+	tmpls, err := compile(r.fsys)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.version, r.compileErr = version, err
+	if err == nil {
+		r.templates = tmpls
+	}
+	return err
+}
+
+// lookup returns a compiled template
+func (r *Registry) lookup(name string) (*exec.Template, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tmpl, ok := r.templates[name]
+	return tmpl, ok
+}
+
+// Render renders a template
+func (r *Registry) Render(name string, ctx gonja.Context) (string, error) {
+	if err := r.refresh(); err != nil {
+		return "", err
+	}
+	tmpl, ok := r.lookup(name)
+	if !ok {
+		return "", fmt.Errorf("%w: %v", ErrTemplateNotFound, name)
+	}
+	out, err := tmpl.Execute(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to render template %v: %w", name, err)
+	}
+	return out, nil
+}
+
+// Has reports whether the registry holds a template
+func (r *Registry) Has(name string) bool {
+	_ = r.refresh()
+	_, ok := r.lookup(name)
+	return ok
+}
+
+// Names returns the names of the templates, sorted
+func (r *Registry) Names() []string {
+	_ = r.refresh()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.templates))
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reloading reports whether the registry compiles changed templates again
+func (r *Registry) Reloading() bool {
+	return r.reload
+}
+
+// Version returns the version of the files of a reloading registry, which
+// changes when a template is edited, empty for other registries
+func (r *Registry) Version() string {
+	_ = r.refresh()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.version
+}
+
+// ### ###
+// ### ### Default Templates
+// ### ###
+
+var (
+	loadOnce        sync.Once
+	defaultRegistry *Registry
+	loadErr         error
+)
+
+// Load compiles the embedded templates once, unless LoadDir was called
+// first. The web server calls it at start, Render on first use otherwise.
+func Load() error {
+	loadOnce.Do(func() {
+		defaultRegistry, loadErr = NewRegistry(templates)
+	})
+	return loadErr
+}
+
+// LoadDir serves the templates of a directory instead of the embedded ones,
+// compiled again when they change, for development. It must be called before
+// Load or the first render.
+func LoadDir(dir string) error {
+	loaded := false
+	loadOnce.Do(func() {
+		loaded = true
+		defaultRegistry, loadErr = NewReloadingRegistry(os.DirFS(dir))
+	})
+	if !loaded {
+		return errors.New("templates are already loaded")
+	}
+	return loadErr
+}
+
+// Render renders a template of the default registry
+func Render(name string, ctx gonja.Context) (string, error) {
+	if err := Load(); err != nil {
+		return "", err
+	}
+	return defaultRegistry.Render(name, ctx)
+}
+
+// Has reports whether a template of the default registry exists
+func Has(name string) bool {
+	return Load() == nil && defaultRegistry.Has(name)
+}
+
+// Reloading reports whether the default templates are served from a
+// directory by LoadDir
+func Reloading() bool {
+	return Load() == nil && defaultRegistry.Reloading()
+}
+
+// Version returns the version of the templates served by LoadDir
+func Version() string {
+	if Load() != nil {
+		return ""
+	}
+	return defaultRegistry.Version()
 }
@@ -1,20 +1,105 @@
 package templates
 
 import (
-	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/fstest"
 
+	"github.com/noirbizarre/gonja"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestTemplateEmbeds(t *testing.T) {
-	templateLoaded := false
-	_, err := GetTemplate("hello.html")
-	if err != nil {
-		fmt.Println("Template loaded successfully")
-		templateLoaded = true
+	// Every embedded template compiles, with its layout and partials
+	assert.NoError(t, Load())
+	names := defaultRegistry.Names()
+	for _, name := range []string{"layouts/base.j2", "partials/navbar.j2", "hello.j2", "login.j2", "errors/404.j2", "admin/users.j2"} {
+		assert.Contains(t, names, name)
 	}
+	assert.NotContains(t, names, "main.go")
 
-	assert.Equal(t, templateLoaded, true)
+	out, err := Render("hello.j2", gonja.Context{"message": "<b>hi</b>"})
+	assert.NoError(t, err)
+	assert.Contains(t, out, `class="navbar`)
+	assert.Regexp(t, `href="/static/bs/css/bootstrap.min.[0-9a-f]{12}.css"`, out)
+	assert.Contains(t, out, "&lt;b&gt;hi&lt;/b&gt;")
 
+	_, err = Render("hello.html", nil)
+	assert.ErrorIs(t, err, ErrTemplateNotFound)
+	assert.False(t, Has("hello.html"))
+}
+
+func TestRegistry(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/base.j2":   {Data: []byte(`<title>{% block title %}{% endblock %}</title>{% block content %}{% endblock %}`)},
+		"partials/item.j2":  {Data: []byte(`<li>{{ item }}</li>`)},
+		"page.j2":           {Data: []byte(`{% extends "layouts/base.j2" %}{% block title %}Page{% endblock %}{% block content %}{% for item in items %}{% include "partials/item.j2" %}{% endfor %}{% endblock %}`)},
+		"static/readme.txt": {Data: []byte(`{% not a template`)},
+	}
+	registry, err := NewRegistry(fsys)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"layouts/base.j2", "page.j2", "partials/item.j2"}, registry.Names())
+	out, err := registry.Render("page.j2", gonja.Context{"items": []string{"a", "<b>"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "<title>Page</title><li>a</li><li>&lt;b&gt;</li>", out)
+
+	// Broken templates fail the registry rather than the requests rendering
+	// them
+	fsys["broken.j2"] = &fstest.MapFile{Data: []byte(`{% if %}`)}
+	fsys["missing.j2"] = &fstest.MapFile{Data: []byte(`{% include "partials/missing.j2" %}`)}
+	_, err = NewRegistry(fsys)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "broken.j2")
+		assert.Contains(t, err.Error(), "partials/missing.j2")
+	}
+}
+
+func TestReloadingRegistry(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data string) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644))
+	}
+	write("layouts/base.j2", `[{% block content %}{% endblock %}]`)
+	write("page.j2", `{% extends "layouts/base.j2" %}{% block content %}one{% endblock %}`)
+
+	registry, err := NewReloadingRegistry(os.DirFS(dir))
+	assert.NoError(t, err)
+	assert.True(t, registry.Reloading())
+	version := registry.Version()
+	out, err := registry.Render("page.j2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "[one]", out)
+
+	// Edits of pages and layouts are picked up on the next render
+	write("layouts/base.j2", `<{% block content %}{% endblock %}>`)
+	write("page.j2", `{% extends "layouts/base.j2" %}{% block content %}two{% endblock %}`)
+	out, err = registry.Render("page.j2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "<two>", out)
+	assert.NotEqual(t, version, registry.Version())
+
+	// New templates too
+	assert.False(t, registry.Has("new.j2"))
+	write("new.j2", `new`)
+	assert.True(t, registry.Has("new.j2"))
+
+	// A broken template fails renders until it is fixed
+	write("page.j2", `{% if %}`)
+	_, err = registry.Render("new.j2", nil)
+	assert.ErrorContains(t, err, "page.j2")
+	write("page.j2", `{% extends "layouts/base.j2" %}{% block content %}fixed{% endblock %}`)
+	out, err = registry.Render("page.j2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "<fixed>", out)
+
+	// Registries of NewRegistry keep the templates they compiled
+	static, err := NewRegistry(os.DirFS(dir))
+	assert.NoError(t, err)
+	assert.False(t, static.Reloading())
+	write("page.j2", `changed`)
+	out, _ = static.Render("page.j2", nil)
+	assert.Equal(t, "<fixed>", out)
+	assert.Equal(t, "", static.Version())
 }
@@ -0,0 +1,114 @@
+package test_suite
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	dbase "github.com/javitab/go-web/database"
+	"gorm.io/gorm"
+)
+
+// ForEachDriver runs fn as a subtest against a freshly migrated database for
+// every supported driver. The database is also installed with SetDBConn for
+// the duration of the subtest, so package-level helpers use it.
+//
+// SQLite always runs. Postgres uses TEST_POSTGRES_DSN when set (the schema
+// is rolled back and re-applied, so point it at a dedicated database), and
+// otherwise starts an embedded Postgres server from downloaded binaries. The
+// Postgres subtest is skipped when neither is available.
+func ForEachDriver(t *testing.T, fn func(t *testing.T, db *gorm.DB)) {
+	t.Run(dbase.DriverSQLite, func(t *testing.T) {
+		cfg := dbase.DBConfig{
+			Driver: dbase.DriverSQLite,
+			DSN:    filepath.Join(t.TempDir(), "test.db"),
+		}
+		runWithDriver(t, cfg, false, fn)
+	})
+
+	t.Run(dbase.DriverPostgres, func(t *testing.T) {
+		if dsn := os.Getenv("TEST_POSTGRES_DSN"); dsn != "" {
+			runWithDriver(t, dbase.DBConfig{Driver: dbase.DriverPostgres, DSN: dsn}, true, fn)
+			return
+		}
+		dsn := startEmbeddedPostgres(t)
+		runWithDriver(t, dbase.DBConfig{Driver: dbase.DriverPostgres, DSN: dsn}, false, fn)
+	})
+}
+
+func runWithDriver(t *testing.T, cfg dbase.DBConfig, reset bool, fn func(t *testing.T, db *gorm.DB)) {
+	t.Helper()
+
+	db, err := dbase.ConnectDB(cfg)
+	if err != nil {
+		t.Fatalf("Error connecting to %v test database: %v", cfg.Driver, err)
+	}
+	if reset {
+		if _, err := dbase.MigrateDown(db, len(dbase.Migrations)); err != nil {
+			t.Fatalf("Error resetting %v test database: %v", cfg.Driver, err)
+		}
+	}
+	if _, err := dbase.MigrateUp(db); err != nil {
+		t.Fatalf("Error migrating %v test database: %v", cfg.Driver, err)
+	}
+
+	dbase.SetDBConn(db)
+	t.Cleanup(func() {
+		dbase.CloseDBConn()
+	})
+
+	fn(t, db)
+}
+
+func startEmbeddedPostgres(t *testing.T) string {
+	t.Helper()
+
+	// Postgres refuses to initialize a data directory as root
+	if os.Geteuid() == 0 {
+		t.Skip("embedded postgres cannot run as root, set TEST_POSTGRES_DSN to test against postgres")
+	}
+
+	port, err := freePort()
+	if err != nil {
+		t.Skipf("embedded postgres unavailable: %v", err)
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+
+	var logs bytes.Buffer
+	runtimeDir := t.TempDir()
+	pg := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(port).
+		RuntimePath(runtimeDir).
+		DataPath(filepath.Join(runtimeDir, "data")).
+		CachePath(filepath.Join(cacheDir, "go-web", "embedded-postgres")).
+		StartTimeout(time.Minute).
+		Logger(&logs))
+	if err := pg.Start(); err != nil {
+		t.Skipf("embedded postgres unavailable: %v\n%v", err, logs.String())
+	}
+	t.Cleanup(func() {
+		if err := pg.Stop(); err != nil {
+			t.Logf("Error stopping embedded postgres: %v", err)
+		}
+	})
+
+	return fmt.Sprintf("host=localhost port=%d user=postgres password=postgres dbname=postgres sslmode=disable", port)
+}
+
+func freePort() (uint32, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return uint32(listener.Addr().(*net.TCPAddr).Port), nil
+}
@@ -0,0 +1,367 @@
+package test_suite
+
+import (
+	"embed"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/javitab/go-web/config"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+// LDAPFixtures describes the directory served by the fake LDAP server
+type LDAPFixtures struct {
+	BaseDN string            `yaml:"base_dn"`
+	Bind   LDAPBindFixture   `yaml:"bind"`
+	Users  []LDAPUserFixture `yaml:"users"`
+}
+
+// LDAPBindFixture is the service account used by GetLdapConnection
+type LDAPBindFixture struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// LDAPUserFixture is a single directory user
+type LDAPUserFixture struct {
+	Username  string   `yaml:"username"`
+	Password  string   `yaml:"password"`
+	FirstName string   `yaml:"first_name"`
+	LastName  string   `yaml:"last_name"`
+	Mail      string   `yaml:"mail"`
+	MemberOf  []string `yaml:"member_of"`
+}
+
+// DN returns the distinguished name the user is published under
+func (u LDAPUserFixture) DN(baseDN string) string {
+	return fmt.Sprintf("CN=%s,OU=Users,%s", u.Username, baseDN)
+}
+
+// LoadLDAPFixtures loads LDAP fixtures from the embedded fixtures directory
+func LoadLDAPFixtures(name string) (LDAPFixtures, error) {
+	var f LDAPFixtures
+
+	data, err := fixtures.ReadFile("fixtures/" + name)
+	if err != nil {
+		return f, fmt.Errorf("failed to read LDAP fixtures: %w", err)
+	}
+
+	err = yaml.Unmarshal(data, &f)
+	if err != nil {
+		return f, fmt.Errorf("failed to unmarshal LDAP fixtures: %w", err)
+	}
+
+	return f, nil
+}
+
+// FakeLDAPServer is a minimal in-process LDAP server supporting simple bind
+// and search, enough to exercise the auth package's LDAP paths offline
+type FakeLDAPServer struct {
+	Addr     string
+	Fixtures LDAPFixtures
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+}
+
+// StartFakeLDAP starts a fake LDAP server seeded from the named fixture file
+// and points LDAP_ADDRESS, LDAP_BASE_DN and LDAP_BIND_CREDENTIALS at it for
+// the duration of the test
+func StartFakeLDAP(t *testing.T, fixtureName string) *FakeLDAPServer {
+	t.Helper()
+
+	f, err := LoadLDAPFixtures(fixtureName)
+	if err != nil {
+		t.Fatalf("Error loading LDAP fixtures: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake LDAP server: %v", err)
+	}
+
+	srv := &FakeLDAPServer{
+		Addr:     listener.Addr().String(),
+		Fixtures: f,
+		listener: listener,
+		conns:    map[net.Conn]struct{}{},
+	}
+	srv.wg.Add(1)
+	go srv.serve()
+	t.Cleanup(srv.Close)
+
+	// Wire the server through the same configuration the real client uses
+	creds := f.Bind.Username + ":" + f.Bind.Password
+	prev := config.GetConfig()
+	cfg := prev
+	cfg.LDAP = config.LDAPConfig{
+		Address:         "ldap://" + srv.Addr,
+		BaseDN:          f.BaseDN,
+		BindCredentials: b64.StdEncoding.EncodeToString([]byte(creds)),
+	}
+	config.SetConfig(cfg)
+	t.Cleanup(func() {
+		config.SetConfig(prev)
+	})
+
+	return srv
+}
+
+// Close stops the server and drops all open client connections
+func (s *FakeLDAPServer) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *FakeLDAPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *FakeLDAPServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		msgID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{s.handleBind(msgID, op)}
+		case ldap.ApplicationSearchRequest:
+			responses = s.handleSearch(msgID, op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		default:
+			responses = []*ber.Packet{
+				ldapResult(msgID, ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform, "operation not supported"),
+			}
+		}
+
+		for _, resp := range responses {
+			if _, err := conn.Write(resp.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *FakeLDAPServer) handleBind(msgID any, op *ber.Packet) *ber.Packet {
+	if len(op.Children) < 3 {
+		return ldapResult(msgID, ldap.ApplicationBindResponse, ldap.LDAPResultProtocolError, "malformed bind request")
+	}
+	name, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+
+	// Anonymous bind
+	if name == "" && password == "" {
+		return ldapResult(msgID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "")
+	}
+
+	if strings.EqualFold(name, s.Fixtures.Bind.Username) && password == s.Fixtures.Bind.Password {
+		return ldapResult(msgID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "")
+	}
+
+	for _, u := range s.Fixtures.Users {
+		if strings.EqualFold(name, u.DN(s.Fixtures.BaseDN)) || strings.EqualFold(name, u.Username) {
+			if password == u.Password {
+				return ldapResult(msgID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "")
+			}
+			break
+		}
+	}
+
+	return ldapResult(msgID, ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials, "invalid credentials")
+}
+
+func (s *FakeLDAPServer) handleSearch(msgID any, op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{
+			ldapResult(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError, "malformed search request"),
+		}
+	}
+	baseDN, _ := op.Children[0].Value.(string)
+	filter := op.Children[6]
+	var attributes []string
+	for _, attr := range op.Children[7].Children {
+		if name, ok := attr.Value.(string); ok {
+			attributes = append(attributes, name)
+		}
+	}
+
+	if !underDN(baseDN, s.Fixtures.BaseDN) {
+		return []*ber.Packet{
+			ldapResult(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject, "base DN not found"),
+		}
+	}
+
+	var responses []*ber.Packet
+	for _, u := range s.Fixtures.Users {
+		entry := s.entryAttributes(u)
+		match, err := matchFilter(filter, entry)
+		if err != nil {
+			return []*ber.Packet{
+				ldapResult(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultFilterError, err.Error()),
+			}
+		}
+		if match && underDN(u.DN(s.Fixtures.BaseDN), baseDN) {
+			responses = append(responses, searchEntry(msgID, u.DN(s.Fixtures.BaseDN), entry, attributes))
+		}
+	}
+
+	return append(responses, ldapResult(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""))
+}
+
+// underDN reports whether dn is base or one of its descendants, comparing
+// DNs case-insensitively as Active Directory does
+func underDN(dn string, base string) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	return dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+func (s *FakeLDAPServer) entryAttributes(u LDAPUserFixture) map[string][]string {
+	return map[string][]string{
+		"objectclass":    {"top", "person", "user"},
+		"cn":             {u.Username},
+		"samaccountname": {u.Username},
+		"givenname":      {u.FirstName},
+		"sn":             {u.LastName},
+		"mail":           {u.Mail},
+		"memberof":       u.MemberOf,
+	}
+}
+
+// matchFilter evaluates the subset of LDAP filters used by the auth package:
+// and, or, not, equality and presence. anr is treated as an equality match
+// against the naming attributes, as Active Directory does for exact values.
+func matchFilter(filter *ber.Packet, entry map[string][]string) (bool, error) {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if ok, err := matchFilter(child, entry); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if ok, err := matchFilter(child, entry); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case ldap.FilterNot:
+		if len(filter.Children) != 1 {
+			return false, errors.New("malformed not filter")
+		}
+		ok, err := matchFilter(filter.Children[0], entry)
+		return !ok, err
+	case ldap.FilterPresent:
+		_, ok := entry[strings.ToLower(filter.Data.String())]
+		return ok, nil
+	case ldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false, errors.New("malformed equality filter")
+		}
+		attr := strings.ToLower(filter.Children[0].Data.String())
+		value := filter.Children[1].Data.String()
+		if attr == "anr" {
+			for _, anrAttr := range []string{"samaccountname", "cn", "givenname", "sn", "mail"} {
+				if containsFold(entry[anrAttr], value) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return containsFold(entry[attr], value), nil
+	default:
+		return false, fmt.Errorf("unsupported filter: %v", ldap.FilterMap[uint64(filter.Tag)])
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func ldapResult(msgID any, app ber.Tag, code uint16, message string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, app, nil, ldap.ApplicationMap[uint8(app)])
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "diagnosticMessage"))
+	packet.AppendChild(result)
+	return packet
+}
+
+func searchEntry(msgID any, dn string, entry map[string][]string, attributes []string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "objectName"))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for _, name := range attributes {
+		values, ok := entry[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "partialAttribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	result.AppendChild(attrs)
+	packet.AppendChild(result)
+	return packet
+}
@@ -1,74 +1,85 @@
 package test_suite
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
 	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/middlewares"
 	"github.com/stretchr/testify/assert"
 )
 
+// AppRouter returns a router with the middleware of the application router
+// and no route groups, for tests registering a single group
 func AppRouter() *gin.Engine {
-	// Set the router as the default one shipped with Gin
-	router := gin.Default()
-
-	// Setup Security Headers
-	router.Use(func(c *gin.Context) {
-		c.Header("X-Frame-Options", "DENY")
-		c.Header("Content-Security-Policy", "default-src 'self'; connect-src *; font-src *; script-src-elem * 'unsafe-inline'; img-src * data:; style-src * 'unsafe-inline';")
-		c.Header("X-XSS-Protection", "1; mode=block")
-		c.Header("Strict-Transport-Security", "max-age=31536000; includeSubDomains; preload")
-		c.Header("Referrer-Policy", "strict-origin")
-		c.Header("X-Content-Type-Options", "nosniff")
-		c.Header("Permissions-Policy", "geolocation=(),midi=(),sync-xhr=(),microphone=(),camera=(),magnetometer=(),gyroscope=(),fullscreen=(self),payment=()")
-		c.Next()
-	})
-
-	// Return the router instance
+	router := gin.New()
+	router.Use(middlewares.Defaults()...)
 	return router
+}
 
+// TestConfig returns a valid configuration for tests. The database is
+// configured separately by SetupSuite and ForEachDriver.
+func TestConfig() config.Config {
+	cfg := config.Default()
+	cfg.Database.Driver = dbase.DriverSQLite
+	cfg.Database.DSN = "test.db"
+	cfg.Auth.JWTSecret = "test-suite-jwt-signing-key-not-for-production"
+	return cfg
 }
 
 func SetupSuite(t *testing.T) func(t *testing.T) {
 	log.Println("setup suite")
 
-	// Delete prior copy of DB
+	// Close and delete prior copy of DB
+	dbase.CloseDBConn()
 	os.Remove("test.db")
 
 	// Initialize DB
-	dbase.InitializeTestDB()
-
-	// Get Database Connection
-	db := dbase.GetDBConn()
+	db, err := dbase.ConnectDB(dbase.DBConfig{Driver: dbase.DriverSQLite, DSN: "test.db"})
+	if err != nil {
+		t.Fatalf("Error connecting to test database: %v", err)
+	}
+	if _, err := dbase.MigrateUp(db); err != nil {
+		t.Fatalf("Error migrating test database: %v", err)
+	}
+	dbase.SetDBConn(db)
+	config.SetConfig(TestConfig())
+	// Start without the requests of earlier tests, such as logins
+	middlewares.DefaultRateLimits().Store = middlewares.NewMemoryRateLimitStore()
 
 	// Create Security Points
-	dbase.CreateSecPoints(nil)
+	if err := dbase.CreateSecPoints(nil); err != nil {
+		t.Fatalf("Error creating security points: %v", err)
+	}
 	// Create Groups
-	dbase.CreateGroups(nil)
+	if err := dbase.CreateGroups(nil); err != nil {
+		t.Fatalf("Error creating groups: %v", err)
+	}
 
 	fmt.Println("This user will automatically be created as a super user")
 
 	// Define User
-	err := dbase.CreateUser(
-		"testuser",
-		"Test",
-		"User",
-		"testuser@test.com",
-		"password",
-	)
+	repo := dbase.DefaultRepository()
+	User, err := repo.CreateUser(context.Background(), dbase.NewUser{
+		Username:  "testuser",
+		LastName:  "Test",
+		FirstName: "User",
+		Email:     "testuser@test.com",
+		Password:  "password",
+	})
 	if err != nil {
-		fmt.Printf("Error occurred during test user creation: %v", err)
+		t.Fatalf("Error occurred during test user creation: %v", err)
 	}
-	User := dbase.User{
-		Username: "testuser",
-	}
-	db.Model(&User).Find(&User)
 
 	fmt.Printf("Creating Superuser %v", User.Username)
-	db.Exec("INSERT INTO user_groups(user_id,group_id) VALUES(? , ?)", User.Username, 1)
+	if err := repo.AddUserToGroups(context.Background(), User.ID, []uint{1}); err != nil {
+		t.Fatalf("Error adding test user to superuser group: %v", err)
+	}
 
 	// Get all users
 	var users []dbase.User
@@ -79,5 +90,17 @@ func SetupSuite(t *testing.T) func(t *testing.T) {
 	// Return a function to teardown the test
 	return func(t *testing.T) {
 		log.Println("teardown suite")
+		dbase.CloseDBConn()
+	}
+}
+
+// AuthHeader returns the Authorization header of a JWT for username, signed
+// with the test configuration
+func AuthHeader(t *testing.T, username string) string {
+	t.Helper()
+	token, err := dbase.GenerateJWT(username)
+	if err != nil {
+		t.Fatalf("Error generating token for %v: %v", username, err)
 	}
+	return "Bearer " + token
 }
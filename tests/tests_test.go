@@ -3,6 +3,8 @@ package test_suite
 import (
 	"testing"
 
+	"github.com/go-ldap/ldap/v3"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -10,3 +12,50 @@ func TestTestSuite(t *testing.T) {
 
 	assert.Equal(t, nil, nil)
 }
+
+func TestFakeLDAP(t *testing.T) {
+	srv := StartFakeLDAP(t, "ldap.yaml")
+
+	conn, err := ldap.DialURL("ldap://" + srv.Addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// Service account and user binds
+	assert.NoError(t, conn.Bind(srv.Fixtures.Bind.Username, srv.Fixtures.Bind.Password))
+	assert.Error(t, conn.Bind(srv.Fixtures.Bind.Username, "wrong_password"))
+	assert.NoError(t, conn.Bind("CN=ldapuser,OU=Users,DC=TEST,DC=LOCAL", "ldapuser_password"))
+
+	// Search by sAMAccountName returns requested attributes only
+	result, err := conn.Search(ldap.NewSearchRequest(
+		srv.Fixtures.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(sAMAccountName=ldapadmin)",
+		[]string{"mail", "memberOf"},
+		nil,
+	))
+	assert.NoError(t, err)
+	assert.Len(t, result.Entries, 1)
+	assert.Equal(t, "ldapadmin@test.local", result.Entries[0].GetAttributeValue("mail"))
+	assert.Len(t, result.Entries[0].GetAttributeValues("memberOf"), 2)
+	assert.Empty(t, result.Entries[0].GetAttributeValue("sn"))
+
+	// Searches under a child OU find the entries of that OU only, searches
+	// above the base DN find nothing
+	search := func(baseDN string) (*ldap.SearchResult, error) {
+		return conn.Search(ldap.NewSearchRequest(
+			baseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			"(sAMAccountName=ldapadmin)",
+			[]string{"mail"},
+			nil,
+		))
+	}
+	result, err = search("ou=users," + srv.Fixtures.BaseDN)
+	assert.NoError(t, err)
+	assert.Len(t, result.Entries, 1)
+	result, err = search("OU=Groups," + srv.Fixtures.BaseDN)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Entries)
+	_, err = search("DC=LOCAL")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject))
+}
@@ -0,0 +1,124 @@
+package test_suite
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCertificates is a CA with a server certificate for 127.0.0.1 written
+// to disk, used to exercise TLS and mutual TLS
+type TestCertificates struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	CAPool   *x509.CertPool
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+}
+
+// WriteTestCertificates writes a CA and a server certificate signed by it
+// to dir
+func WriteTestCertificates(t *testing.T, dir string) *TestCertificates {
+	t.Helper()
+	caKey := newKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-web test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create test CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	certs := &TestCertificates{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAPool:   x509.NewCertPool(),
+		ca:       ca,
+		caKey:    caKey,
+	}
+	certs.CAPool.AddCert(ca)
+	writePEM(t, certs.CAFile, "CERTIFICATE", der)
+	certs.RenewServer(t, 2)
+	return certs
+}
+
+// RenewServer replaces the server certificate on disk with one carrying the
+// given serial number
+func (c *TestCertificates) RenewServer(t *testing.T, serial int64) {
+	t.Helper()
+	cert := c.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("failed to marshal test key: %v", err)
+	}
+	writePEM(t, c.CertFile, "CERTIFICATE", cert.Certificate[0])
+	writePEM(t, c.KeyFile, "EC PRIVATE KEY", key)
+}
+
+// ClientCertificate issues a client certificate with the given subject
+// common name and DNS SANs
+func (c *TestCertificates) ClientCertificate(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	return c.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func (c *TestCertificates) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key := newKey(t)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, c.ca, &key.PublicKey, c.caKey)
+	if err != nil {
+		t.Fatalf("failed to issue test certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/javitab/go-web/config"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestSetup(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+	ctx := context.Background()
+
+	cfg := config.Default().Tracing
+	shutdown, err := Setup(ctx, cfg, "v1.2.0")
+	assert.NoError(t, err)
+	defer shutdown(ctx)
+
+	// Spans get trace IDs without an exporter
+	assert.Empty(t, TraceID(ctx))
+	spanCtx, span := Tracer().Start(ctx, "request")
+	assert.Len(t, TraceID(spanCtx), 32)
+	span.End()
+
+	// Trace context is propagated with W3C headers
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(spanCtx, carrier)
+	assert.Contains(t, carrier["traceparent"], TraceID(spanCtx))
+}
+
+func TestNewExporter(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.Default().Tracing
+
+	exporter, err := NewExporter(ctx, cfg, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, exporter)
+
+	cfg.Exporter = config.TracingExporterOTLP
+	cfg.Endpoint = "http://localhost:4318"
+	exporter, err = NewExporter(ctx, cfg, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, exporter)
+
+	// The stdout exporter writes a JSON document per span
+	var out bytes.Buffer
+	cfg.Exporter = config.TracingExporterStdout
+	exporter, err = NewExporter(ctx, cfg, &out)
+	assert.NoError(t, err)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	_, span := provider.Tracer(TracerName).Start(ctx, "auth.UserLogin")
+	span.End()
+	assert.NoError(t, provider.Shutdown(ctx))
+	assert.Contains(t, out.String(), `"Name":"auth.UserLogin"`)
+}
@@ -1,5 +1,21 @@
 #!/bin/bash
 
-while inotifywait -r -e modify,create,delete .; do
-  go run main.go
+# Run the web server in debug mode, rebuilding and restarting it when Go
+# files or configuration change. Templates and static files are reloaded by
+# the server itself, open pages reload on their own.
+
+bin=$(mktemp -d)/go-web
+trap 'kill $pid 2>/dev/null; rm -rf "$(dirname "$bin")"' EXIT
+
+while true; do
+  pid=
+  if go build -o "$bin" .; then
+    "$bin" web debug &
+    pid=$!
+  fi
+  inotifywait -qq -r -e modify,create,delete,move --include '(\.go|\.yaml|go\.mod|go\.sum)$' .
+  if [ -n "$pid" ]; then
+    kill $pid
+    wait $pid 2>/dev/null
+  fi
 done
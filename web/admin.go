@@ -0,0 +1,334 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	auth "github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/middlewares"
+	"github.com/javitab/go-web/service"
+	"github.com/noirbizarre/gonja"
+)
+
+// The admin UI runs every action through the service, with the same security
+// point checks as the CLI and the command API.
+
+// AdminRouterGroup adds the admin pages to the web group
+func AdminRouterGroup(web *gin.RouterGroup, repo *dbase.Repository) *gin.RouterGroup {
+	admin := web.Group("/admin", middlewares.CheckSession(repo, LoginPath), requireActiveUser(repo), requirePageSecPoint(auth.SPViewUsers, "users"))
+	{
+		admin.GET("", func(c *gin.Context) {
+			c.Redirect(http.StatusFound, "/web/admin/users")
+		})
+		admin.GET("/users", adminUsersHandler)
+		admin.GET("/users/:username", adminUserHandler)
+		admin.POST("/users/:username/groups", adminUserGroupsHandler)
+		admin.POST("/users/:username/secpoints", adminUserSecPointsHandler)
+		admin.GET("/groups", adminGroupsHandler)
+		admin.GET("/groups/:id", adminGroupHandler)
+		admin.GET("/secpoints", adminSecPointsHandler)
+		admin.GET("/apikeys", adminAPIKeysHandler)
+		admin.POST("/apikeys", adminCreateAPIKeyHandler)
+		admin.POST("/apikeys/:id/revoke", adminRevokeAPIKeyHandler)
+	}
+	return admin
+}
+
+// requireActiveUser loads the logged in user the service runs as from repo
+func requireActiveUser(repo *dbase.Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := auth.LoadUserInfo(c.Request.Context(), repo, c.GetString("currentUser"))
+		if user.DB.ID == 0 || !user.IsActiveUser {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set("userInfo", user)
+		c.Next()
+	}
+}
+
+// userService returns the service running as the logged in user
+func userService(c *gin.Context) *service.Service {
+	user := c.MustGet("userInfo").(auth.UserInfo)
+	return service.New(c.Request.Context(), dbase.DefaultRepository(), user)
+}
+
+// renderPage renders a page of a section of the navbar, with the error of a
+// failed form
+func renderPage(c *gin.Context, status int, name string, section string, data gonja.Context, pageErr error) {
+	data["section"] = section
+	if pageErr != nil {
+		data["error"] = pageErr.Error()
+		if status >= http.StatusInternalServerError {
+			dbase.LogServerErrorContext(c.Request.Context(), "WebUI:"+c.FullPath(), pageErr, "reqUser: "+c.GetString("currentUser"))
+		}
+	}
+	render(c, status, name, data)
+}
+
+// renderPageError renders the error page of a failed command
+func renderPageError(c *gin.Context, section string, err error) {
+	renderError(c, service.HTTPStatus(err), section, err)
+}
+
+// redirectFlash redirects to the page showing the outcome of a form
+func redirectFlash(c *gin.Context, path string, message string) {
+	middlewares.AddFlash(c, "success", message)
+	c.Redirect(http.StatusSeeOther, path)
+}
+
+// formAdd reports whether the action form field adds or removes
+func formAdd(c *gin.Context) (bool, error) {
+	switch c.PostForm("action") {
+	case "add":
+		return true, nil
+	case "remove":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: action must be add or remove", service.ErrInvalidInput)
+	}
+}
+
+// secPointFields maps the field form values to user security point lists
+var secPointFields = map[string]string{
+	"add": "UserAddSecPoints",
+	"del": "UserDelSecPoints",
+	"ovr": "UserOvrSecPoints",
+}
+
+// formInt parses a numeric form field
+func formInt(c *gin.Context, field string) (int, error) {
+	value, err := strconv.Atoi(c.PostForm(field))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v must be a number", service.ErrInvalidInput, field)
+	}
+	return value, nil
+}
+
+// ### ###
+// ### ### Users
+// ### ###
+
+func adminUsersHandler(c *gin.Context) {
+	search := c.Query("search")
+	deleted := c.Query("deleted") == "true"
+	users, err := userService(c).ListUsers(search, deleted)
+	if err != nil {
+		renderPageError(c, "users", err)
+		return
+	}
+	renderPage(c, http.StatusOK, "admin/users.j2", "users", gonja.Context{
+		"users":   users,
+		"search":  search,
+		"deleted": deleted,
+	}, nil)
+}
+
+// secPointRef is a security point of a user or group list
+type secPointRef struct {
+	Field string
+	ID    uint
+	Name  string
+}
+
+// secPointRefs names the security points of the add, del and ovr lists
+func secPointRefs(secPoints []service.SecPoint, add []uint, del []uint, ovr []uint) []secPointRef {
+	names := map[uint]string{}
+	for _, sp := range secPoints {
+		names[sp.ID] = sp.Name
+	}
+	var refs []secPointRef
+	for _, list := range []struct {
+		field string
+		ids   []uint
+	}{{"add", add}, {"del", del}, {"ovr", ovr}} {
+		for _, id := range list.ids {
+			refs = append(refs, secPointRef{Field: list.field, ID: id, Name: names[id]})
+		}
+	}
+	return refs
+}
+
+// renderUser renders the page of a user, with the error of a failed form
+func renderUser(c *gin.Context, status int, formErr error) {
+	svc := userService(c)
+	user, err := svc.GetUser(c.Param("username"))
+	if err != nil {
+		renderPageError(c, "users", err)
+		return
+	}
+	groups, err := svc.ListGroups()
+	if err != nil {
+		renderPageError(c, "users", err)
+		return
+	}
+	secPoints, err := svc.ListSecPoints()
+	if err != nil {
+		renderPageError(c, "users", err)
+		return
+	}
+
+	// Only offer the groups the user is not a member of
+	var available []service.Group
+	for _, group := range groups {
+		if !slices.Contains(user.Groups, group.Name) {
+			available = append(available, group)
+		}
+	}
+	renderPage(c, status, "admin/user.j2", "users", gonja.Context{
+		"user":      user,
+		"groups":    available,
+		"secpoints": secPoints,
+		"grants":    secPointRefs(secPoints, user.AddSecPoints, user.DelSecPoints, user.OvrSecPoints),
+	}, formErr)
+}
+
+func adminUserHandler(c *gin.Context) {
+	renderUser(c, http.StatusOK, nil)
+}
+
+func adminUserGroupsHandler(c *gin.Context) {
+	add, err := formAdd(c)
+	if err == nil {
+		if add {
+			_, err = userService(c).AddGroupMember(c.Param("username"), c.PostForm("group"))
+		} else {
+			_, err = userService(c).RemoveGroupMember(c.Param("username"), c.PostForm("group"))
+		}
+	}
+	if err != nil {
+		renderUser(c, service.HTTPStatus(err), err)
+		return
+	}
+	redirectFlash(c, "/web/admin/users/"+url.PathEscape(c.Param("username")), "Group membership updated")
+}
+
+func adminUserSecPointsHandler(c *gin.Context) {
+	add, err := formAdd(c)
+	var spid int
+	if err == nil {
+		spid, err = formInt(c, "spid")
+	}
+	field, ok := secPointFields[c.DefaultPostForm("field", "add")]
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: field must be add, del or ovr", service.ErrInvalidInput)
+	}
+	if err == nil {
+		if add {
+			_, err = userService(c).AddUserSecPoint(c.Param("username"), spid, field)
+		} else {
+			_, err = userService(c).RemoveUserSecPoint(c.Param("username"), spid, field)
+		}
+	}
+	if err != nil {
+		renderUser(c, service.HTTPStatus(err), err)
+		return
+	}
+	redirectFlash(c, "/web/admin/users/"+url.PathEscape(c.Param("username")), "Security points updated")
+}
+
+// ### ###
+// ### ### Groups and Security Points
+// ### ###
+
+func adminGroupsHandler(c *gin.Context) {
+	groups, err := userService(c).ListGroups()
+	if err != nil {
+		renderPageError(c, "groups", err)
+		return
+	}
+	renderPage(c, http.StatusOK, "admin/groups.j2", "groups", gonja.Context{"groups": groups}, nil)
+}
+
+func adminGroupHandler(c *gin.Context) {
+	svc := userService(c)
+	group, err := svc.GetGroup(c.Param("id"))
+	if err != nil {
+		renderPageError(c, "groups", err)
+		return
+	}
+	secPoints, err := svc.ListSecPoints()
+	if err != nil {
+		renderPageError(c, "groups", err)
+		return
+	}
+	users, err := svc.ListUsers("", false)
+	if err != nil {
+		renderPageError(c, "groups", err)
+		return
+	}
+
+	var members []service.UserSummary
+	for _, user := range users {
+		if slices.Contains(user.Groups, group.Name) {
+			members = append(members, user)
+		}
+	}
+	renderPage(c, http.StatusOK, "admin/group.j2", "groups", gonja.Context{
+		"group":   group,
+		"grants":  secPointRefs(secPoints, group.AddSecPoints, group.DelSecPoints, group.OvrSecPoints),
+		"members": members,
+	}, nil)
+}
+
+func adminSecPointsHandler(c *gin.Context) {
+	secPoints, err := userService(c).ListSecPoints()
+	if err != nil {
+		renderPageError(c, "secpoints", err)
+		return
+	}
+	renderPage(c, http.StatusOK, "admin/secpoints.j2", "secpoints", gonja.Context{"secpoints": secPoints}, nil)
+}
+
+// ### ###
+// ### ### API Keys
+// ### ###
+
+// renderAPIKeys renders the API keys of the logged in user, with a key just
+// created or the error of a failed form
+func renderAPIKeys(c *gin.Context, status int, created *service.APIKey, formErr error) {
+	keys, err := userService(c).ListAPIKeys()
+	if err != nil {
+		renderPageError(c, "apikeys", err)
+		return
+	}
+	data := gonja.Context{"keys": keys}
+	if created != nil {
+		data["created"] = *created
+	}
+	renderPage(c, status, "admin/apikeys.j2", "apikeys", data, formErr)
+}
+
+func adminAPIKeysHandler(c *gin.Context) {
+	renderAPIKeys(c, http.StatusOK, nil, nil)
+}
+
+// adminCreateAPIKeyHandler shows the new key on the response page only, the
+// key list only shows the last characters of keys
+func adminCreateAPIKeyHandler(c *gin.Context) {
+	created, err := userService(c).CreateAPIKey(c.PostForm("description"))
+	if err != nil {
+		renderAPIKeys(c, service.HTTPStatus(err), nil, err)
+		return
+	}
+	renderAPIKeys(c, http.StatusCreated, &created, nil)
+}
+
+func adminRevokeAPIKeyHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err == nil {
+		err = userService(c).RevokeAPIKey(uint(id))
+	} else {
+		err = fmt.Errorf("%w: invalid API key ID", service.ErrInvalidInput)
+	}
+	if err != nil {
+		renderAPIKeys(c, service.HTTPStatus(err), nil, err)
+		return
+	}
+	redirectFlash(c, "/web/admin/apikeys", "API key revoked")
+}
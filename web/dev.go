@@ -0,0 +1,29 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/static_web"
+	"github.com/javitab/go-web/templates"
+)
+
+// ### ###
+// ### ### Debug Mode
+// ### ###
+
+// DevVersionPath answers the version of the templates and static files served
+// from disk in debug mode
+const DevVersionPath = "/web/dev/version"
+
+// devVersionHandler answers the version of the files served from disk, pages
+// of debug mode reload when it changes
+func devVersionHandler(c *gin.Context) {
+	assets, err := static_web.Default().Version()
+	if err != nil {
+		dbase.LogServerErrorContext(c.Request.Context(), "WebUI:DevVersion", err, "Failed to read static files")
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"version": templates.Version() + "." + assets})
+}
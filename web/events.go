@@ -0,0 +1,425 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	auth "github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/middlewares"
+	"github.com/javitab/go-web/service"
+	"github.com/javitab/go-web/templates"
+	"github.com/noirbizarre/gonja"
+)
+
+const (
+	// eventPageSize is the number of events or server runs of a page
+	eventPageSize = 50
+	// tailLimit caps the events returned by one live tail poll
+	tailLimit = 200
+	// timelineLimit caps the events of a server run timeline
+	timelineLimit = 500
+	// eventTimeInput is the format of datetime-local filter fields, in UTC
+	eventTimeInput = "2006-01-02T15:04"
+	// eventTime is the format events are shown with
+	eventTime = "2006-01-02 15:04:05"
+)
+
+// EventsRouterGroup adds the server event viewer to the web group
+func EventsRouterGroup(web *gin.RouterGroup, repo *dbase.Repository) *gin.RouterGroup {
+	events := web.Group("/events", middlewares.CheckSession(repo, LoginPath), requireActiveUser(repo), requirePageSecPoint(auth.SPViewServerEvents, "events"))
+	{
+		events.GET("", eventsHandler)
+		events.GET("/tail", eventsTailHandler)
+		events.GET("/runs", serverRunsHandler)
+		events.GET("/runs/:id", serverRunHandler)
+	}
+	return events
+}
+
+// requirePageSecPoint renders the error page for users without the security
+// point. It must follow requireActiveUser.
+func requirePageSecPoint(SPID int, section string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("userInfo").(auth.UserInfo)
+		if !user.SPCheck(SPID) {
+			renderPageError(c, section, fmt.Errorf("%w: user %v missing security point %v", service.ErrDenied, user.DB.Username, SPID))
+			return
+		}
+		c.Next()
+	}
+}
+
+// ### ###
+// ### ### Filters
+// ### ###
+
+// eventQuery holds the filter fields of the events page
+type eventQuery struct {
+	Since    string
+	Until    string
+	Type     string
+	Status   string
+	User     string
+	Run      string
+	Request  string
+	Archived bool
+	Tail     bool
+}
+
+func newEventQuery(c *gin.Context) eventQuery {
+	return eventQuery{
+		Since:    c.Query("since"),
+		Until:    c.Query("until"),
+		Type:     strings.TrimSpace(c.Query("type")),
+		Status:   c.Query("status"),
+		User:     strings.TrimSpace(c.Query("user")),
+		Run:      strings.TrimSpace(c.Query("run")),
+		Request:  strings.TrimSpace(c.Query("request")),
+		Archived: c.Query("archived") == "true",
+		Tail:     c.Query("tail") == "true",
+	}
+}
+
+// filter returns the database filter of the query
+func (q eventQuery) filter() (dbase.ServerEventFilter, error) {
+	filter := dbase.ServerEventFilter{
+		EventType:   q.Type,
+		Username:    q.User,
+		ServerRunID: q.Run,
+		RequestID:   q.Request,
+		Archived:    q.Archived,
+	}
+	if q.Status != "" {
+		filter.Statuses = []string{q.Status}
+	}
+	var err error
+	if filter.Since, err = parseEventTime("since", q.Since); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = parseEventTime("until", q.Until); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// values returns the query string of the filter, without page and tail
+func (q eventQuery) values() url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"since":   q.Since,
+		"until":   q.Until,
+		"type":    q.Type,
+		"status":  q.Status,
+		"user":    q.User,
+		"run":     q.Run,
+		"request": q.Request,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if q.Archived {
+		values.Set("archived", "true")
+	}
+	return values
+}
+
+// parseEventTime parses a datetime-local field in UTC, empty is no limit
+func parseEventTime(field string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{eventTimeInput, "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: %v must be a date and time such as 2006-01-02T15:04", service.ErrInvalidInput, field)
+}
+
+// pageParam returns the page query parameter, from 1
+func pageParam(c *gin.Context) (int, error) {
+	if c.Query("page") == "" {
+		return 1, nil
+	}
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		return 0, fmt.Errorf("%w: page must be a positive number", service.ErrInvalidInput)
+	}
+	return page, nil
+}
+
+// pagination holds the page links of a list
+type pagination struct {
+	Page  int
+	Pages int
+	Total int64
+	Prev  string
+	Next  string
+}
+
+func newPagination(path string, values url.Values, page int, total int64) pagination {
+	p := pagination{Page: page, Pages: int((total + eventPageSize - 1) / eventPageSize), Total: total}
+	link := func(page int) string {
+		values.Set("page", strconv.Itoa(page))
+		return path + "?" + values.Encode()
+	}
+	if page > 1 {
+		p.Prev = link(page - 1)
+	}
+	if page < p.Pages {
+		p.Next = link(page + 1)
+	}
+	values.Del("page")
+	return p
+}
+
+// ### ###
+// ### ### Event Rows
+// ### ###
+
+// eventRow is a server event as shown in tables and timelines
+type eventRow struct {
+	dbase.ServerEvent
+	Time        string
+	Summary     string // first line of the details
+	StatusClass string // bootstrap badge class of the status
+	RunShort    string
+}
+
+// statusClasses are the badge classes of event statuses, others are light
+var statusClasses = map[string]string{
+	"ERROR":                   "text-bg-danger",
+	"FAIL":                    "text-bg-danger",
+	"DENY":                    "text-bg-warning",
+	"WARN":                    "text-bg-warning",
+	dbase.ServerStatusPending: "text-bg-info",
+	dbase.ServerStatusRunning: "text-bg-success",
+	dbase.ServerStatusStopped: "text-bg-secondary",
+	"INFO":                    "text-bg-light",
+}
+
+func newEventRow(event dbase.ServerEvent) eventRow {
+	event = event.Redacted()
+	summary, _, _ := strings.Cut(strings.TrimSpace(event.Details), "\n")
+	if len(summary) > 120 {
+		summary = summary[:117] + "..."
+	}
+	class, ok := statusClasses[event.Status]
+	if !ok {
+		class = "text-bg-light"
+	}
+	runShort := event.ServerRunID
+	if len(runShort) > 8 {
+		runShort = runShort[:8]
+	}
+	return eventRow{
+		ServerEvent: event,
+		Time:        formatEventTime(event.DateTime),
+		Summary:     summary,
+		StatusClass: class,
+		RunShort:    runShort,
+	}
+}
+
+func newEventRows(events []dbase.ServerEvent) []eventRow {
+	rows := make([]eventRow, 0, len(events))
+	for _, event := range events {
+		rows = append(rows, newEventRow(event))
+	}
+	return rows
+}
+
+func formatEventTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(eventTime)
+}
+
+// ### ###
+// ### ### Events
+// ### ###
+
+func eventsHandler(c *gin.Context) {
+	query := newEventQuery(c)
+	data := gonja.Context{"query": query, "events": []eventRow{}}
+
+	eventTypes, statuses, err := dbase.DefaultRepository().ServerEventValues(c.Request.Context())
+	if err != nil {
+		renderPageError(c, "events", err)
+		return
+	}
+	data["event_types"] = eventTypes
+	data["statuses"] = statuses
+
+	page, err := pageParam(c)
+	filter, filterErr := query.filter()
+	if err == nil {
+		err = filterErr
+	}
+	if err != nil {
+		renderPage(c, service.HTTPStatus(err), "events/events.j2", "events", data, err)
+		return
+	}
+	filter.Limit = eventPageSize
+	filter.Offset = (page - 1) * eventPageSize
+
+	events, total, err := dbase.DefaultRepository().ListServerEvents(c.Request.Context(), filter)
+	if err != nil {
+		renderPageError(c, "events", err)
+		return
+	}
+	values := query.values()
+	data["events"] = newEventRows(events)
+	data["pagination"] = newPagination("/web/events", values, page, total)
+	data["filter_query"] = values.Encode()
+	// Tailing only makes sense on the page of the newest events
+	data["can_tail"] = page == 1
+	data["last_id"] = 0
+	if len(events) > 0 {
+		data["last_id"] = events[0].ID
+	}
+	renderPage(c, http.StatusOK, "events/events.j2", "events", data, nil)
+}
+
+// eventsTailHandler returns the rows of the events matching the filter logged
+// after the event of the after parameter, newest first, for the live tail of
+// the events page
+func eventsTailHandler(c *gin.Context) {
+	filter, err := newEventQuery(c).filter()
+	if err == nil {
+		var after uint64
+		after, err = strconv.ParseUint(c.Query("after"), 10, 64)
+		if err != nil {
+			err = fmt.Errorf("%w: after must be an event ID", service.ErrInvalidInput)
+		}
+		filter.AfterID = uint(after)
+	}
+	if err != nil {
+		c.String(service.HTTPStatus(err), err.Error())
+		return
+	}
+	filter.Limit = tailLimit
+
+	events, _, err := dbase.DefaultRepository().ListServerEvents(c.Request.Context(), filter)
+	if err != nil {
+		dbase.LogServerErrorContext(c.Request.Context(), "EventsUI:Tail", err, "Filter: "+c.Request.URL.RawQuery)
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	out, err := templates.Render("partials/event_rows.j2", gonja.Context{"events": newEventRows(events)})
+	if err != nil {
+		dbase.LogServerErrorContext(c.Request.Context(), "EventsUI:Render", err, "Template: admin/event_rows.j2")
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(out))
+}
+
+// ### ###
+// ### ### Server Runs
+// ### ###
+
+// serverRunRow is a server run as shown in the list and on its timeline
+type serverRunRow struct {
+	dbase.ServerRun
+	Started     string
+	Stopped     string // empty while the run is not stopped
+	StatusClass string
+}
+
+func newServerRunRow(run dbase.ServerRun) serverRunRow {
+	row := serverRunRow{ServerRun: run, Started: formatEventTime(run.Start.DateTime), StatusClass: newEventRow(run.Start).StatusClass}
+	// The StartingServer event is last updated when the run stops
+	if run.Start.Status == dbase.ServerStatusStopped {
+		row.Stopped = formatEventTime(run.Start.UpdatedAt)
+	}
+	return row
+}
+
+func serverRunsHandler(c *gin.Context) {
+	page, err := pageParam(c)
+	if err != nil {
+		renderPageError(c, "events", err)
+		return
+	}
+	runs, total, err := dbase.DefaultRepository().ListServerRuns(c.Request.Context(), eventPageSize, (page-1)*eventPageSize)
+	if err != nil {
+		renderPageError(c, "events", err)
+		return
+	}
+	rows := make([]serverRunRow, 0, len(runs))
+	for _, run := range runs {
+		rows = append(rows, newServerRunRow(run))
+	}
+	renderPage(c, http.StatusOK, "events/runs.j2", "events", gonja.Context{
+		"runs":       rows,
+		"pagination": newPagination("/web/events/runs", url.Values{}, page, total),
+	}, nil)
+}
+
+// timelineEntry is a step of a server run: its startup, an event and its
+// shutdown
+type timelineEntry struct {
+	Kind  string // start, event or stop
+	Title string
+	Time  string
+	Event eventRow
+	Lines []string
+}
+
+// serverRunHandler shows the timeline of a server run: its startup, the
+// failures it logged, or all its events with all=true, and its shutdown
+func serverRunHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	run, err := dbase.DefaultRepository().GetServerRun(ctx, c.Param("id"))
+	if err != nil {
+		renderPageError(c, "events", err)
+		return
+	}
+	all := c.Query("all") == "true"
+	filter := dbase.ServerEventFilter{
+		ServerRunID: run.Start.ServerRunID,
+		Archived:    true,
+		Ascending:   true,
+		Limit:       timelineLimit,
+	}
+	if !all {
+		filter.Statuses = dbase.FailureStatuses
+	}
+	events, total, err := dbase.DefaultRepository().ListServerEvents(ctx, filter)
+	if err != nil {
+		renderPageError(c, "events", err)
+		return
+	}
+
+	// The StartingServer event holds every lifecycle transition of the run,
+	// one per line
+	lines := strings.Split(strings.TrimSpace(run.Start.Details), "\n")
+	timeline := []timelineEntry{{Kind: "start", Title: "Startup", Time: formatEventTime(run.Start.DateTime), Event: newEventRow(run.Start), Lines: lines}}
+	for _, event := range events {
+		if event.ID == run.Start.ID {
+			continue
+		}
+		timeline = append(timeline, timelineEntry{Kind: "event", Title: event.EventType, Time: formatEventTime(event.DateTime), Event: newEventRow(event)})
+	}
+	row := newServerRunRow(run)
+	if row.Stopped != "" {
+		timeline = append(timeline, timelineEntry{Kind: "stop", Title: "Shutdown", Time: row.Stopped, Lines: lines[len(lines)-1:]})
+	}
+
+	renderPage(c, http.StatusOK, "events/run.j2", "events", gonja.Context{
+		"run":       row,
+		"timeline":  timeline,
+		"all":       all,
+		"truncated": total > int64(len(events)),
+		"limit":     timelineLimit,
+	}, nil)
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	auth "github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/middlewares"
+	"github.com/noirbizarre/gonja"
+)
+
+// LoginPath is the login page of browser sessions
+const LoginPath = "/web/login"
+
+// defaultNext is the page shown after login without a next page
+const defaultNext = "/web/admin"
+
+// renderLogin renders the login form
+func renderLogin(c *gin.Context, status int, next string, username string, loginErr string) {
+	render(c, status, "login.j2", gonja.Context{
+		"section":  "login",
+		"next":     next,
+		"username": username,
+		"error":    loginErr,
+	})
+}
+
+// safeNext returns next when it is a path on this site, so the login form
+// cannot redirect to other sites
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n") {
+		return defaultNext
+	}
+	return next
+}
+
+func loginPageHandler(c *gin.Context) {
+	renderLogin(c, http.StatusOK, safeNext(c.Query("next")), "", "")
+}
+
+// loginHandler starts a cookie session with the JWT of a web login, needing
+// the WebLogin security point like POST /auth/login
+func loginHandler(repo *dbase.Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		next := safeNext(c.PostForm("next"))
+		input := auth.LoginUserInput{Username: c.PostForm("username"), Password: c.PostForm("password")}
+		token, err := auth.UserLogin(c.Request.Context(), repo, input, auth.WebLogin)
+		if err != nil {
+			// UserLogin logs the reason, the form does not tell it apart
+			renderLogin(c, http.StatusUnauthorized, next, input.Username, "Invalid username or password")
+			return
+		}
+		middlewares.SetSessionCookie(c, token)
+		c.Redirect(http.StatusSeeOther, next)
+	}
+}
+
+// logoutHandler ends the cookie session
+func logoutHandler(c *gin.Context) {
+	middlewares.ClearSessionCookie(c)
+	middlewares.AddFlash(c, "info", "You have been signed out")
+	c.Redirect(http.StatusSeeOther, LoginPath)
+}
@@ -0,0 +1,133 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	auth "github.com/javitab/go-web/auth"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/middlewares"
+	"github.com/javitab/go-web/templates"
+	"github.com/noirbizarre/gonja"
+)
+
+// Pages are rendered from the template registry with pageContext, the values
+// shared by the layout, navbar and partials of every page.
+
+// pageContext returns the values every page is rendered with: the logged in
+// user and a has_sec_point lookup of its security points, the CSRF token and
+// CSP nonce, the flash messages, and whether the page is served in debug mode
+func pageContext(c *gin.Context) gonja.Context {
+	data := gonja.Context{
+		"dev_mode":      templates.Reloading(),
+		"csp_nonce":     middlewares.CSPNonce(c),
+		"csrf_token":    middlewares.CSRFToken(c),
+		"flashes":       middlewares.Flashes(c),
+		"path":          c.Request.URL.Path,
+		"request_id":    middlewares.GetRequestID(c),
+		"current_user":  "",
+		"sec_points":    map[uint]auth.EvalSP{},
+		"has_sec_point": func(SPID int) bool { return false },
+	}
+	if value, ok := c.Get("userInfo"); ok {
+		user := value.(auth.UserInfo)
+		data["current_user"] = user.DB.Username
+		data["sec_points"] = user.SecurityPoints
+		data["has_sec_point"] = func(SPID int) bool { return hasSecPoint(user, SPID) }
+	}
+	return data
+}
+
+// hasSecPoint reports whether the user has a security point, like SPCheck
+// but without logging denials, for showing what the user may do
+func hasSecPoint(user auth.UserInfo, SPID int) bool {
+	_, ok := user.SecurityPoints[uint(SPID)]
+	_, superUser := user.SecurityPoints[1]
+	return ok || superUser
+}
+
+// render renders a page with the values of pageContext, data overrides them
+func render(c *gin.Context, status int, name string, data gonja.Context) {
+	ctx := pageContext(c)
+	maps.Copy(ctx, data)
+	out, err := templates.Render(name, ctx)
+	if err != nil {
+		dbase.LogServerErrorContext(c.Request.Context(), "WebUI:Render", err, "Template: "+name)
+		if name != "errors/500.j2" {
+			renderError(c, http.StatusInternalServerError, "", nil)
+			return
+		}
+		// The error of a broken template is shown in debug mode, where it
+		// is most likely being edited
+		message := http.StatusText(http.StatusInternalServerError)
+		if templates.Reloading() {
+			message += "\n\n" + err.Error()
+		}
+		c.String(http.StatusInternalServerError, message)
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", []byte(out))
+}
+
+// renderError renders the error page of a status, errors/<status>.j2 or
+// errors/error.j2, with the section of the navbar it happened in. The error
+// message is shown unless the status is 500 or more, those are logged
+// instead.
+func renderError(c *gin.Context, status int, section string, err error) {
+	data := gonja.Context{
+		"status":      status,
+		"status_text": http.StatusText(status),
+		"section":     section,
+	}
+	if err != nil {
+		if status >= http.StatusInternalServerError {
+			dbase.LogServerErrorContext(c.Request.Context(), "WebUI:"+c.FullPath(), err, "Path: "+c.Request.URL.Path)
+		} else {
+			data["error"] = err.Error()
+		}
+	}
+	name := fmt.Sprintf("errors/%d.j2", status)
+	if !templates.Has(name) {
+		name = "errors/error.j2"
+	}
+	render(c, status, name, data)
+	c.Abort()
+}
+
+// NotFound answers requests without route, with the 404 page for browser
+// pages and JSON otherwise
+func NotFound(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/web/") || c.Request.URL.Path == "/web" {
+		renderError(c, http.StatusNotFound, "", nil)
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+}
+
+// recoverPanics renders the 500 page for panics of browser pages, which are
+// logged with the request ID shown on the page
+func recoverPanics(c *gin.Context) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err, ok := recovered.(error)
+			if !ok {
+				err = fmt.Errorf("%v", recovered)
+			}
+			if errors.Is(err, http.ErrAbortHandler) {
+				panic(recovered)
+			}
+			renderError(c, http.StatusInternalServerError, "", fmt.Errorf("panic: %w", err))
+		}
+	}()
+	c.Next()
+}
+
+// refuseCSRF renders the 403 page for forms without valid CSRF token, such
+// as forms left open across a login
+func refuseCSRF(c *gin.Context) {
+	renderError(c, http.StatusForbidden, "", errors.New("the form has expired, reload the page and try again"))
+}
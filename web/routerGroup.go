@@ -4,15 +4,30 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/javitab/go-web/config"
+	dbase "github.com/javitab/go-web/database"
+	"github.com/javitab/go-web/middlewares"
+	"github.com/javitab/go-web/templates"
 )
 
-func WebRouterGroup(router *gin.Engine) *gin.RouterGroup {
-	web := router.Group("/web")
+func WebRouterGroup(router *gin.Engine, repo *dbase.Repository) *gin.RouterGroup {
+	web := router.Group("/web", middlewares.RateLimit(config.RateLimitGroupWeb), recoverPanics, middlewares.CSRFWith(refuseCSRF))
 	{
+		web.GET("/login", loginPageHandler)
+		web.POST("/login", middlewares.RateLimit(config.RateLimitGroupLogin), loginHandler(repo))
+		web.POST("/logout", logoutHandler)
 		web.GET("/hello", helloHandler)
 		web.GET("/test", func(c *gin.Context) {
 			c.Data(http.StatusOK, "text/plain", []byte("Web Test Successful"))
 		})
 	}
+	AdminRouterGroup(web, repo)
+	EventsRouterGroup(web, repo)
+
+	// Pages of debug mode poll for edits of templates and static files, out
+	// of the rate limit
+	if templates.Reloading() {
+		router.GET(DevVersionPath, devVersionHandler)
+	}
 	return web
 }